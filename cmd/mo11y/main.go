@@ -8,10 +8,13 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"mo11y/internal/auth"
+	"mo11y/internal/forward"
 	"mo11y/internal/server"
 	"mo11y/internal/storage"
 )
@@ -30,8 +33,68 @@ func main() {
 		CleanupIntervalMins: getEnvInt("MO11Y_CLEANUP_INTERVAL_MINS", 60),
 	}
 
+	spanMetricsCfg := storage.SpanMetricsConfig{
+		Enabled:           getEnv("MO11Y_SPANMETRICS_ENABLED", "false") == "true",
+		FlushIntervalSecs: getEnvInt("MO11Y_SPANMETRICS_FLUSH_INTERVAL_SECS", 15),
+		Dimensions:        getEnvList("MO11Y_SPANMETRICS_DIMENSIONS"),
+		BucketsMs:         getEnvFloatList("MO11Y_SPANMETRICS_BUCKETS_MS"),
+		MaxIdleFlushes:    getEnvInt("MO11Y_SPANMETRICS_MAX_IDLE_FLUSHES", storage.DefaultSpanMetricsIdleFlushes),
+	}
+
+	serviceGraphCfg := storage.ServiceGraphConfig{
+		Enabled:           getEnv("MO11Y_SERVICE_GRAPH_ENABLED", "false") == "true",
+		FlushIntervalSecs: getEnvInt("MO11Y_SERVICE_GRAPH_FLUSH_INTERVAL_SECS", 15),
+		WaitSecs:          getEnvInt("MO11Y_SERVICE_GRAPH_WAIT_SECS", 30),
+		MaxPending:        getEnvInt("MO11Y_SERVICE_GRAPH_MAX_PENDING", 100000),
+	}
+
+	logMetricsCfg := storage.LogMetricsConfig{
+		FlushIntervalSecs: getEnvInt("MO11Y_LOG_METRICS_FLUSH_INTERVAL_SECS", 15),
+		MaxIdleFlushes:    getEnvInt("MO11Y_LOG_METRICS_MAX_IDLE_FLUSHES", storage.DefaultLogMetricsIdleFlushes),
+	}
+
+	validationMode, err := storage.ParseValidationMode(getEnv("MO11Y_VALIDATION_MODE", "repair"))
+	if err != nil {
+		log.Fatalf("Invalid MO11Y_VALIDATION_MODE: %v", err)
+	}
+
+	var forwardTargets []forward.Target
+	if v := os.Getenv("MO11Y_FORWARD_TARGETS"); v != "" {
+		forwardTargets, err = forward.ParseTargets(v)
+		if err != nil {
+			log.Fatalf("Invalid MO11Y_FORWARD_TARGETS: %v", err)
+		}
+	}
+
 	maxConcurrentIngest := getEnvInt("MO11Y_MAX_CONCURRENT_INGEST", 10)
 	maxConcurrentQuery := getEnvInt("MO11Y_MAX_CONCURRENT_QUERY", 5)
+	maxTailSubscribers := getEnvInt("MO11Y_MAX_TAIL_SUBSCRIBERS", 20)
+
+	jobsCfg := storage.JobsConfig{
+		Dir:           getEnv("MO11Y_JOB_DIR", "mo11y-jobs"),
+		MaxConcurrent: getEnvInt("MO11Y_MAX_CONCURRENT_JOBS", 2),
+		Timeout:       time.Duration(getEnvInt("MO11Y_JOB_TIMEOUT_MINS", 60)) * time.Minute,
+		TTL:           time.Duration(getEnvInt("MO11Y_JOB_TTL_HOURS", 24)) * time.Hour,
+		MaxPending:    getEnvInt("MO11Y_MAX_PENDING_JOBS", 20),
+		CursorTTL:     time.Duration(getEnvInt("MO11Y_QUERY_CURSOR_TTL_MINS", 10)) * time.Minute,
+		CursorMaxRows: getEnvInt("MO11Y_QUERY_CURSOR_MAX_ROWS", 100000),
+	}
+
+	// DuckDB applies these to the whole database, not just /query
+	queryCfg := storage.QueryConfig{
+		MaxConns:       getEnvInt("MO11Y_QUERY_CONNECTIONS", maxConcurrentQuery+jobsCfg.MaxConcurrent),
+		MemoryLimit:    os.Getenv("MO11Y_DUCKDB_MEMORY_LIMIT"),
+		Threads:        getEnvInt("MO11Y_DUCKDB_THREADS", 0),
+		TempDirectory:  os.Getenv("MO11Y_DUCKDB_TEMP_DIRECTORY"),
+		MaxTempSize:    os.Getenv("MO11Y_DUCKDB_MAX_TEMP_SIZE"),
+		ExternalAccess: getEnv("MO11Y_DUCKDB_EXTERNAL_ACCESS", "false") == "true",
+	}
+
+	// Disabled unless given a size
+	resultCacheCfg := storage.ResultCacheConfig{
+		MaxBytes: int64(getEnvInt("MO11Y_QUERY_CACHE_MB", 0)) << 20,
+		TTL:      time.Duration(getEnvInt("MO11Y_QUERY_CACHE_TTL_SECS", 60)) * time.Second,
+	}
 
 	// Initialize storage
 	store, err := storage.New(dbPath)
@@ -39,6 +102,14 @@ func main() {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 	log.Printf("Connected to DuckDB: %s", dbPath)
+	store.SetValidation(storage.ValidationConfig{Mode: validationMode})
+	if err := store.ConfigureQueries(context.Background(), queryCfg); err != nil {
+		log.Fatalf("Failed to configure queries: %v", err)
+	}
+	if err := store.ConfigureJobs(context.Background(), jobsCfg); err != nil {
+		log.Fatalf("Failed to configure query jobs: %v", err)
+	}
+	store.ConfigureResultCache(resultCacheCfg)
 
 	// Initialize auth
 	var authProvider *auth.Auth
@@ -61,15 +132,48 @@ func main() {
 		if err := authProvider.Bootstrap(ctx, bootstrapKey); err != nil {
 			log.Fatalf("Failed to bootstrap auth: %v", err)
 		}
+
+		// Tenants may override the global retention
+		retentionCfg.Tenants = authProvider
 	} else {
 		log.Println("Auth disabled (MO11Y_AUTH_DISABLED=true)")
 	}
 
-	// Create cancellable context for cleanup worker
+	// Create cancellable context for background workers
 	ctx, cancel := context.WithCancel(context.Background())
 
+	var workers sync.WaitGroup
+	startWorker := func(run func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run()
+		}()
+	}
+
 	// Start cleanup worker
-	go store.StartCleanupWorker(ctx, retentionCfg)
+	startWorker(func() { store.StartCleanupWorker(ctx, retentionCfg) })
+
+	// Start span metrics generator
+	startWorker(func() { store.StartSpanMetrics(ctx, spanMetricsCfg) })
+
+	// Start service graph generator
+	startWorker(func() { store.StartServiceGraph(ctx, serviceGraphCfg) })
+
+	// Start log metric rules worker
+	startWorker(func() { store.StartLogMetrics(ctx, logMetricsCfg) })
+
+	// Start query job cleanup; cancels running jobs on shutdown
+	startWorker(func() { store.RunJobs(ctx) })
+
+	// Start forwarder
+	var forwarder *forward.Forwarder
+	if len(forwardTargets) > 0 {
+		forwarder = forward.New(forwardTargets)
+		startWorker(func() { forwarder.Run(ctx) })
+	} else {
+		log.Println("Forwarding disabled, no targets configured")
+	}
 
 	// Create server
 	srv := server.New(server.Config{
@@ -77,6 +181,8 @@ func main() {
 		RetentionCfg:       retentionCfg,
 		MaxConcurrentIngest: maxConcurrentIngest,
 		MaxConcurrentQuery:  maxConcurrentQuery,
+		MaxTailSubscribers:  maxTailSubscribers,
+		Forwarder:           forwarder,
 	}, store, authProvider)
 	log.Printf("Starting server on :%d", port)
 
@@ -94,9 +200,6 @@ func main() {
 
 	log.Println("Shutting down gracefully...")
 
-	// Stop cleanup worker
-	cancel()
-
 	// Give outstanding requests 5 seconds to complete
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer shutdownCancel()
@@ -105,6 +208,10 @@ func main() {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
+	// Stop background workers after in-flight requests are done, so final flushes see all data
+	cancel()
+	workers.Wait()
+
 	if authProvider != nil {
 		if err := authProvider.Close(); err != nil {
 			log.Printf("Error closing auth: %v", err)
@@ -134,6 +241,28 @@ func getEnvInt(key string, defaultVal int) int {
 	return defaultVal
 }
 
+// getEnvList parses a comma-separated list, skipping empty entries.
+func getEnvList(key string) []string {
+	var result []string
+	for _, part := range strings.Split(os.Getenv(key), ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+// getEnvFloatList parses a comma-separated list of floats, skipping invalid entries.
+func getEnvFloatList(key string) []float64 {
+	var result []float64
+	for _, part := range getEnvList(key) {
+		if f, err := strconv.ParseFloat(part, 64); err == nil {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
 func init() {
 	// Print startup banner
 	fmt.Println(`
@@ -63,7 +63,51 @@ func (a *Auth) initSchema(ctx context.Context) error {
 			created_by TEXT
 		);
 		CREATE INDEX IF NOT EXISTS idx_api_keys_hash ON api_keys(key_hash);
+
+		CREATE TABLE IF NOT EXISTS tenants (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			retention_hours INTEGER,
+			created_at TEXT NOT NULL
+		);
 	`)
+	if err != nil {
+		return err
+	}
+
+	// Keys created before tenants existed belong to the default tenant
+	var hasTenantID bool
+	err = a.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) > 0 FROM pragma_table_info('api_keys') WHERE name = 'tenant_id'").Scan(&hasTenantID)
+	if err != nil {
+		return err
+	}
+	if !hasTenantID {
+		_, err = a.db.ExecContext(ctx,
+			"ALTER TABLE api_keys ADD COLUMN tenant_id TEXT NOT NULL DEFAULT '"+DefaultTenant+"'")
+		if err != nil {
+			return err
+		}
+	}
+
+	// Per-key query limits; NULL uses the server defaults
+	for _, column := range []string{"query_timeout_ms", "query_max_rows", "query_max_concurrent"} {
+		var exists bool
+		err = a.db.QueryRowContext(ctx,
+			"SELECT COUNT(*) > 0 FROM pragma_table_info('api_keys') WHERE name = ?", column).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if _, err = a.db.ExecContext(ctx, "ALTER TABLE api_keys ADD COLUMN "+column+" INTEGER"); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = a.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO tenants (id, name, created_at) VALUES (?, ?, ?)
+	`, DefaultTenant, DefaultTenant, time.Now().Format(time.RFC3339))
 	return err
 }
 
@@ -89,7 +133,7 @@ func (a *Auth) Bootstrap(ctx context.Context, bootstrapKey string) error {
 		return nil
 	}
 
-	_, _, err = a.createKeyInternal(ctx, "bootstrap-admin", ScopeAdmin, nil, bootstrapKey, "system")
+	_, _, err = a.createKeyInternal(ctx, "bootstrap-admin", ScopeAdmin, DefaultTenant, QueryLimits{}, nil, bootstrapKey, "system")
 	if err != nil {
 		return err
 	}
@@ -104,11 +148,12 @@ func (a *Auth) ValidateKey(ctx context.Context, key string) (*KeyInfo, error) {
 
 	var info KeyInfo
 	var expiresAt, revokedAt sql.NullString
+	var timeoutMs, maxRows, maxConcurrent sql.NullInt64
 
 	err := a.db.QueryRowContext(ctx, `
-		SELECT id, name, scopes, expires_at, revoked_at
+		SELECT id, name, scopes, tenant_id, expires_at, revoked_at, query_timeout_ms, query_max_rows, query_max_concurrent
 		FROM api_keys WHERE key_hash = ?
-	`, hash).Scan(&info.ID, &info.Name, &info.Scopes, &expiresAt, &revokedAt)
+	`, hash).Scan(&info.ID, &info.Name, &info.Scopes, &info.TenantID, &expiresAt, &revokedAt, &timeoutMs, &maxRows, &maxConcurrent)
 
 	if err == sql.ErrNoRows {
 		return nil, ErrInvalidKey
@@ -120,6 +165,7 @@ func (a *Auth) ValidateKey(ctx context.Context, key string) (*KeyInfo, error) {
 	if revokedAt.Valid {
 		return nil, ErrKeyRevoked
 	}
+	info.Limits = queryLimitsFromColumns(timeoutMs, maxRows, maxConcurrent)
 
 	if expiresAt.Valid {
 		t, _ := time.Parse(time.RFC3339, expiresAt.String)
@@ -137,13 +183,16 @@ func (a *Auth) ValidateKey(ctx context.Context, key string) (*KeyInfo, error) {
 	return &info, nil
 }
 
-// CreateKey creates a new API key.
-func (a *Auth) CreateKey(ctx context.Context, name string, scopes Scope, expiresAt *time.Time, createdBy string) (string, *KeyInfo, error) {
+// CreateKey creates a new API key belonging to tenantID.
+func (a *Auth) CreateKey(ctx context.Context, name string, scopes Scope, tenantID string, limits QueryLimits, expiresAt *time.Time, createdBy string) (string, *KeyInfo, error) {
+	if _, err := a.GetTenant(ctx, tenantID); err != nil {
+		return "", nil, err
+	}
 	key := generateKey()
-	return a.createKeyInternal(ctx, name, scopes, expiresAt, key, createdBy)
+	return a.createKeyInternal(ctx, name, scopes, tenantID, limits, expiresAt, key, createdBy)
 }
 
-func (a *Auth) createKeyInternal(ctx context.Context, name string, scopes Scope, expiresAt *time.Time, key, createdBy string) (string, *KeyInfo, error) {
+func (a *Auth) createKeyInternal(ctx context.Context, name string, scopes Scope, tenantID string, limits QueryLimits, expiresAt *time.Time, key, createdBy string) (string, *KeyInfo, error) {
 	id := generateID()
 	hash := a.hashKey(key)
 	prefix := key[:12] // "mo11y_" + 6 chars
@@ -154,16 +203,34 @@ func (a *Auth) createKeyInternal(ctx context.Context, name string, scopes Scope,
 		expiresAtStr = &s
 	}
 
+	timeoutMs, maxRows, maxConcurrent := limits.columns()
 	_, err := a.db.ExecContext(ctx, `
-		INSERT INTO api_keys (id, name, key_hash, key_prefix, scopes, created_at, expires_at, created_by)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, id, name, hash, prefix, scopes, time.Now().Format(time.RFC3339), expiresAtStr, createdBy)
+		INSERT INTO api_keys (id, name, key_hash, key_prefix, scopes, tenant_id, created_at, expires_at, created_by, query_timeout_ms, query_max_rows, query_max_concurrent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, name, hash, prefix, scopes, tenantID, time.Now().Format(time.RFC3339), expiresAtStr, createdBy, timeoutMs, maxRows, maxConcurrent)
 
 	if err != nil {
 		return "", nil, err
 	}
 
-	return key, &KeyInfo{ID: id, Name: name, Scopes: scopes, Prefix: prefix}, nil
+	return key, &KeyInfo{ID: id, Name: name, Scopes: scopes, TenantID: tenantID, Prefix: prefix, Limits: limits}, nil
+}
+
+// SetKeyLimits replaces the query limits of an API key.
+func (a *Auth) SetKeyLimits(ctx context.Context, keyID string, limits QueryLimits) error {
+	timeoutMs, maxRows, maxConcurrent := limits.columns()
+	res, err := a.db.ExecContext(ctx, `
+		UPDATE api_keys SET query_timeout_ms = ?, query_max_rows = ?, query_max_concurrent = ? WHERE id = ?
+	`, timeoutMs, maxRows, maxConcurrent, keyID)
+	if err != nil {
+		return err
+	}
+
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
 }
 
 // RevokeKey revokes an API key.
@@ -185,7 +252,7 @@ func (a *Auth) RevokeKey(ctx context.Context, keyID string) error {
 // ListKeys returns all API keys (without sensitive data).
 func (a *Auth) ListKeys(ctx context.Context) ([]KeyInfo, error) {
 	rows, err := a.db.QueryContext(ctx, `
-		SELECT id, name, key_prefix, scopes, created_at, expires_at, revoked_at, last_used_at
+		SELECT id, name, key_prefix, scopes, tenant_id, created_at, expires_at, revoked_at, last_used_at, query_timeout_ms, query_max_rows, query_max_concurrent
 		FROM api_keys ORDER BY created_at DESC
 	`)
 	if err != nil {
@@ -198,8 +265,9 @@ func (a *Auth) ListKeys(ctx context.Context) ([]KeyInfo, error) {
 		var k KeyInfo
 		var createdAt string
 		var expiresAt, revokedAt, lastUsedAt sql.NullString
+		var timeoutMs, maxRows, maxConcurrent sql.NullInt64
 
-		err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Scopes, &createdAt, &expiresAt, &revokedAt, &lastUsedAt)
+		err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Scopes, &k.TenantID, &createdAt, &expiresAt, &revokedAt, &lastUsedAt, &timeoutMs, &maxRows, &maxConcurrent)
 		if err != nil {
 			return nil, err
 		}
@@ -210,6 +278,7 @@ func (a *Auth) ListKeys(ctx context.Context) ([]KeyInfo, error) {
 			k.ExpiresAt = &t
 		}
 		k.Revoked = revokedAt.Valid
+		k.Limits = queryLimitsFromColumns(timeoutMs, maxRows, maxConcurrent)
 		if lastUsedAt.Valid {
 			t, _ := time.Parse(time.RFC3339, lastUsedAt.String)
 			k.LastUsedAt = &t
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
 	"time"
 
@@ -14,10 +15,48 @@ type KeyInfo struct {
 	Name       string
 	Prefix     string
 	Scopes     Scope
+	TenantID   string
 	CreatedAt  time.Time
 	ExpiresAt  *time.Time
 	LastUsedAt *time.Time
 	Revoked    bool
+	Limits     QueryLimits
+}
+
+// QueryLimits override the server's /query limits for a key.
+// Zero fields use the server defaults. Memory, threads and spilling have no
+// per-key limits: DuckDB applies them to the whole database. MaxConcurrent
+// bounds the key's share of the query pool instead.
+type QueryLimits struct {
+	Timeout       time.Duration
+	MaxRows       int // Caps results even when the query has its own LIMIT
+	MaxConcurrent int // Queries and jobs running at once
+}
+
+// columns returns the values stored in the query_timeout_ms, query_max_rows
+// and query_max_concurrent columns, NULL for zero fields.
+func (l QueryLimits) columns() (timeoutMs, maxRows, maxConcurrent *int64) {
+	if l.Timeout > 0 {
+		ms := l.Timeout.Milliseconds()
+		timeoutMs = &ms
+	}
+	if l.MaxRows > 0 {
+		n := int64(l.MaxRows)
+		maxRows = &n
+	}
+	if l.MaxConcurrent > 0 {
+		n := int64(l.MaxConcurrent)
+		maxConcurrent = &n
+	}
+	return timeoutMs, maxRows, maxConcurrent
+}
+
+func queryLimitsFromColumns(timeoutMs, maxRows, maxConcurrent sql.NullInt64) QueryLimits {
+	return QueryLimits{
+		Timeout:       time.Duration(timeoutMs.Int64) * time.Millisecond,
+		MaxRows:       int(maxRows.Int64),
+		MaxConcurrent: int(maxConcurrent.Int64),
+	}
 }
 
 // generateKey creates a new API key: mo11y_<32 random hex chars>
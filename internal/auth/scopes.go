@@ -81,4 +81,9 @@ var (
 	ErrKeyRevoked  = errors.New("key revoked")
 	ErrKeyExpired  = errors.New("key expired")
 	ErrKeyNotFound = errors.New("key not found")
+
+	ErrTenantNotFound = errors.New("tenant not found")
+	ErrTenantExists   = errors.New("tenant already exists")
+	ErrTenantInUse    = errors.New("tenant has active keys")
+	ErrInvalidTenant  = errors.New("tenant id must be 1-64 characters of a-z, 0-9, '-' or '_'")
 )
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// DefaultTenant owns keys created before tenants existed and data ingested without auth.
+const DefaultTenant = "default"
+
+// Tenant is an isolated group of API keys and their data.
+type Tenant struct {
+	ID             string
+	Name           string
+	RetentionHours *int // nil uses the global retention
+	CreatedAt      time.Time
+}
+
+// validTenantID reports whether id is usable as a tenant ID.
+func validTenantID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateTenant creates a new tenant.
+func (a *Auth) CreateTenant(ctx context.Context, id, name string, retentionHours *int) (*Tenant, error) {
+	if !validTenantID(id) {
+		return nil, ErrInvalidTenant
+	}
+	if name == "" {
+		name = id
+	}
+
+	t := &Tenant{ID: id, Name: name, RetentionHours: retentionHours, CreatedAt: time.Now()}
+	_, err := a.db.ExecContext(ctx, `
+		INSERT INTO tenants (id, name, retention_hours, created_at) VALUES (?, ?, ?, ?)
+	`, t.ID, t.Name, retentionHours, t.CreatedAt.Format(time.RFC3339))
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return nil, ErrTenantExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// GetTenant returns a tenant by ID.
+func (a *Auth) GetTenant(ctx context.Context, id string) (*Tenant, error) {
+	var t Tenant
+	var retentionHours sql.NullInt64
+	var createdAt string
+	err := a.db.QueryRowContext(ctx, `
+		SELECT id, name, retention_hours, created_at FROM tenants WHERE id = ?
+	`, id).Scan(&t.ID, &t.Name, &retentionHours, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTenantNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	if retentionHours.Valid {
+		hours := int(retentionHours.Int64)
+		t.RetentionHours = &hours
+	}
+	return &t, nil
+}
+
+// ListTenants returns all tenants.
+func (a *Auth) ListTenants(ctx context.Context) ([]Tenant, error) {
+	rows, err := a.db.QueryContext(ctx, `
+		SELECT id, name, retention_hours, created_at FROM tenants ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []Tenant
+	for rows.Next() {
+		var t Tenant
+		var retentionHours sql.NullInt64
+		var createdAt string
+		if err := rows.Scan(&t.ID, &t.Name, &retentionHours, &createdAt); err != nil {
+			return nil, err
+		}
+		t.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		if retentionHours.Valid {
+			hours := int(retentionHours.Int64)
+			t.RetentionHours = &hours
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+// SetTenantRetention overrides the retention of a tenant; nil restores the global retention.
+func (a *Auth) SetTenantRetention(ctx context.Context, id string, retentionHours *int) error {
+	res, err := a.db.ExecContext(ctx, `
+		UPDATE tenants SET retention_hours = ? WHERE id = ?
+	`, retentionHours, id)
+	if err != nil {
+		return err
+	}
+
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return ErrTenantNotFound
+	}
+	return nil
+}
+
+// DeleteTenant deletes a tenant without active keys.
+// Its data is left in place and expires with the global retention.
+func (a *Auth) DeleteTenant(ctx context.Context, id string) error {
+	if id == DefaultTenant {
+		return ErrTenantInUse
+	}
+
+	var active int
+	err := a.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM api_keys WHERE tenant_id = ? AND revoked_at IS NULL
+	`, id).Scan(&active)
+	if err != nil {
+		return err
+	}
+	if active > 0 {
+		return ErrTenantInUse
+	}
+
+	res, err := a.db.ExecContext(ctx, "DELETE FROM tenants WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return ErrTenantNotFound
+	}
+	return nil
+}
+
+// TenantRetention returns the retention overrides in hours, keyed by tenant ID.
+// Tenants using the global retention are omitted.
+func (a *Auth) TenantRetention(ctx context.Context) (map[string]int, error) {
+	tenants, err := a.ListTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[string]int)
+	for _, t := range tenants {
+		if t.RetentionHours != nil {
+			overrides[t.ID] = *t.RetentionHours
+		}
+	}
+	return overrides, nil
+}
@@ -0,0 +1,366 @@
+// Package forward relays ingested OTLP/HTTP requests to upstream endpoints.
+//
+// Each target has its own bounded queue and delivery goroutine, so a slow or
+// unavailable upstream never delays ingestion or other targets.
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signals, matching the OTLP/HTTP path segments.
+const (
+	SignalTraces  = "traces"
+	SignalMetrics = "metrics"
+	SignalLogs    = "logs"
+)
+
+// Defaults applied to unset target fields.
+const (
+	DefaultQueueSize   = 1000
+	DefaultMaxRetries  = 5
+	DefaultTimeoutSecs = 10
+
+	maxBackoff = 30 * time.Second
+)
+
+// initialBackoff is the wait before the first retry; a variable so that tests
+// can shorten it.
+var initialBackoff = time.Second
+
+// Target is an upstream OTLP/HTTP endpoint.
+type Target struct {
+	Name        string            `json:"name"`
+	Endpoint    string            `json:"endpoint"`          // Base URL, /v1/<signal> is appended
+	Headers     map[string]string `json:"headers,omitempty"` // Added to every request, e.g. vendor API keys
+	Signals     []string          `json:"signals,omitempty"` // traces, metrics, logs; empty forwards all
+	QueueSize   int               `json:"queue_size,omitempty"`
+	MaxRetries  int               `json:"max_retries,omitempty"`
+	TimeoutSecs int               `json:"timeout_secs,omitempty"`
+}
+
+// ParseTargets parses a JSON array of targets and applies defaults.
+func ParseTargets(s string) ([]Target, error) {
+	var targets []Target
+	if err := json.Unmarshal([]byte(s), &targets); err != nil {
+		return nil, fmt.Errorf("invalid targets JSON: %w", err)
+	}
+
+	names := make(map[string]bool)
+	for i := range targets {
+		t := &targets[i]
+		u, err := url.Parse(t.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("target %d: endpoint must be an http or https URL", i)
+		}
+		t.Endpoint = strings.TrimSuffix(t.Endpoint, "/")
+		if t.Name == "" {
+			t.Name = u.Host
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("target %d: duplicate name %q", i, t.Name)
+		}
+		names[t.Name] = true
+
+		for _, signal := range t.Signals {
+			if signal != SignalTraces && signal != SignalMetrics && signal != SignalLogs {
+				return nil, fmt.Errorf("target %q: unknown signal %q", t.Name, signal)
+			}
+		}
+		if t.QueueSize <= 0 {
+			t.QueueSize = DefaultQueueSize
+		}
+		if t.MaxRetries < 0 {
+			t.MaxRetries = 0
+		} else if t.MaxRetries == 0 {
+			t.MaxRetries = DefaultMaxRetries
+		}
+		if t.TimeoutSecs <= 0 {
+			t.TimeoutSecs = DefaultTimeoutSecs
+		}
+	}
+	return targets, nil
+}
+
+// TargetStats reports delivery counters for a target.
+type TargetStats struct {
+	Name        string
+	Endpoint    string
+	Queued      int
+	LagSeconds  float64 // Age of the oldest undelivered request
+	Sent        int64
+	Failed      int64 // Requests given up after retries or rejected by the upstream
+	Dropped     int64 // Requests discarded because the queue was full
+	Retries     int64
+	Errors      int64 // Failed delivery attempts, including retried ones
+	LastError   string
+	LastErrorAt time.Time
+}
+
+// request is a queued OTLP request body.
+type request struct {
+	signal     string
+	body       []byte
+	enqueuedAt time.Time
+}
+
+// target holds the queue and counters of one upstream.
+type target struct {
+	cfg    Target
+	client *http.Client
+
+	mu          sync.Mutex
+	queue       []request
+	sent        int64
+	failed      int64
+	dropped     int64
+	retries     int64
+	errors      int64
+	lastError   string
+	lastErrorAt time.Time
+
+	notify chan struct{}
+}
+
+// Forwarder relays requests to all configured targets.
+type Forwarder struct {
+	targets []*target
+}
+
+// New creates a forwarder for the given targets. Call Run to start delivery.
+func New(targets []Target) *Forwarder {
+	f := &Forwarder{}
+	for _, cfg := range targets {
+		f.targets = append(f.targets, &target{
+			cfg:    cfg,
+			client: &http.Client{Timeout: time.Duration(cfg.TimeoutSecs) * time.Second},
+			notify: make(chan struct{}, 1),
+		})
+	}
+	return f
+}
+
+// Run delivers queued requests until ctx is cancelled.
+// Requests still queued at shutdown are discarded.
+func (f *Forwarder) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range f.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.run(ctx)
+		}()
+		log.Printf("Forwarding to %s: %s (signals=%v)", t.cfg.Name, t.cfg.Endpoint, t.cfg.Signals)
+	}
+	wg.Wait()
+	log.Println("Forwarder stopped")
+}
+
+// Forward queues an OTLP/HTTP protobuf body for every target accepting the signal.
+// Never blocks: when a target queue is full the request is dropped for that target.
+func (f *Forwarder) Forward(signal string, body []byte) {
+	if f == nil {
+		return
+	}
+	now := time.Now()
+	for _, t := range f.targets {
+		if t.accepts(signal) {
+			t.enqueue(request{signal: signal, body: body, enqueuedAt: now})
+		}
+	}
+}
+
+// Stats returns delivery counters for every target.
+func (f *Forwarder) Stats() []TargetStats {
+	if f == nil {
+		return nil
+	}
+	now := time.Now()
+	stats := make([]TargetStats, len(f.targets))
+	for i, t := range f.targets {
+		t.mu.Lock()
+		stats[i] = TargetStats{
+			Name:        t.cfg.Name,
+			Endpoint:    t.cfg.Endpoint,
+			Queued:      len(t.queue),
+			Sent:        t.sent,
+			Failed:      t.failed,
+			Dropped:     t.dropped,
+			Retries:     t.retries,
+			Errors:      t.errors,
+			LastError:   t.lastError,
+			LastErrorAt: t.lastErrorAt,
+		}
+		if len(t.queue) > 0 {
+			stats[i].LagSeconds = now.Sub(t.queue[0].enqueuedAt).Seconds()
+		}
+		t.mu.Unlock()
+	}
+	return stats
+}
+
+func (t *target) accepts(signal string) bool {
+	if len(t.cfg.Signals) == 0 {
+		return true
+	}
+	for _, s := range t.cfg.Signals {
+		if s == signal {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *target) enqueue(req request) {
+	t.mu.Lock()
+	if len(t.queue) >= t.cfg.QueueSize {
+		t.dropped++
+		t.mu.Unlock()
+		return
+	}
+	t.queue = append(t.queue, req)
+	t.mu.Unlock()
+
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queue head until it succeeds or is given up, then moves on.
+// The head stays queued during delivery so that lag covers in-flight requests.
+func (t *target) run(ctx context.Context) {
+	for {
+		t.mu.Lock()
+		var req request
+		ok := len(t.queue) > 0
+		if ok {
+			req = t.queue[0]
+		}
+		t.mu.Unlock()
+
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.notify:
+				continue
+			}
+		}
+
+		err := t.deliver(ctx, req)
+		if ctx.Err() != nil {
+			t.mu.Lock()
+			if n := len(t.queue); n > 0 {
+				log.Printf("Forwarding to %s: discarding %d queued requests at shutdown", t.cfg.Name, n)
+			}
+			t.mu.Unlock()
+			return
+		}
+
+		t.mu.Lock()
+		t.queue[0] = request{} // Release the body
+		t.queue = t.queue[1:]
+		if err != nil {
+			t.failed++
+		} else {
+			t.sent++
+		}
+		t.mu.Unlock()
+	}
+}
+
+// deliver sends req, retrying retryable failures with exponential backoff.
+func (t *target) deliver(ctx context.Context, req request) error {
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := t.send(ctx, req)
+		if err == nil {
+			return nil
+		}
+		t.recordError(err)
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= t.cfg.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		t.mu.Lock()
+		t.retries++
+		t.mu.Unlock()
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// permanentError is an upstream response that must not be retried.
+type permanentError struct {
+	status int
+}
+
+func (e *permanentError) Error() string {
+	return fmt.Sprintf("upstream rejected request: %s", http.StatusText(e.status))
+}
+
+// send performs one delivery attempt. Returns the Retry-After delay, if any.
+func (t *target) send(ctx context.Context, req request) (time.Duration, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.Endpoint+"/v1/"+req.signal, bytes.NewReader(req.body))
+	if err != nil {
+		return 0, &permanentError{status: http.StatusBadRequest}
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range t.cfg.Headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+
+	// Retryable responses as defined by the OTLP/HTTP specification
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		var retryAfter time.Duration
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			retryAfter = min(time.Duration(secs)*time.Second, maxBackoff)
+		}
+		return retryAfter, fmt.Errorf("upstream unavailable: %s", resp.Status)
+	}
+	return 0, &permanentError{status: resp.StatusCode}
+}
+
+func (t *target) recordError(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.errors++
+	t.lastError = err.Error()
+	t.lastErrorAt = time.Now()
+}
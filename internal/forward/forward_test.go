@@ -0,0 +1,283 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstream records the requests an httptest server receives and answers
+// them with respond, in order; 200 once it runs out.
+type upstream struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []received
+	respond  []func(w http.ResponseWriter)
+}
+
+type received struct {
+	path   string
+	header http.Header
+	body   string
+	at     time.Time
+}
+
+func newUpstream(t *testing.T, respond ...func(w http.ResponseWriter)) *upstream {
+	u := &upstream{respond: respond}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		u.mu.Lock()
+		u.requests = append(u.requests, received{path: r.URL.Path, header: r.Header.Clone(), body: string(body), at: time.Now()})
+		var fn func(w http.ResponseWriter)
+		if len(u.respond) > 0 {
+			fn, u.respond = u.respond[0], u.respond[1:]
+		}
+		u.mu.Unlock()
+		if fn != nil {
+			fn(w)
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *upstream) received() []received {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]received(nil), u.requests...)
+}
+
+func status(code int, header ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		w.WriteHeader(code)
+	}
+}
+
+// start runs a forwarder for targets until the test ends.
+func start(t *testing.T, targets ...Target) *Forwarder {
+	t.Helper()
+	for i := range targets {
+		if targets[i].QueueSize == 0 {
+			targets[i].QueueSize = DefaultQueueSize
+		}
+		if targets[i].TimeoutSecs == 0 {
+			targets[i].TimeoutSecs = DefaultTimeoutSecs
+		}
+	}
+	f := New(targets)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		f.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return f
+}
+
+// waitFor polls cond until it holds or a deadline passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func shortBackoff(t *testing.T, d time.Duration) {
+	old := initialBackoff
+	initialBackoff = d
+	t.Cleanup(func() { initialBackoff = old })
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	shortBackoff(t, 50*time.Millisecond)
+	up := newUpstream(t, status(http.StatusServiceUnavailable), status(http.StatusBadGateway))
+	f := start(t, Target{Name: "up", Endpoint: up.URL, MaxRetries: 3})
+
+	f.Forward(SignalTraces, []byte("spans"))
+	waitFor(t, "delivery", func() bool { return f.Stats()[0].Sent == 1 })
+
+	reqs := up.received()
+	if len(reqs) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(reqs))
+	}
+	if gap := reqs[1].at.Sub(reqs[0].at); gap < 50*time.Millisecond {
+		t.Errorf("first retry after %s, want at least 50ms", gap)
+	}
+	if gap := reqs[2].at.Sub(reqs[1].at); gap < 100*time.Millisecond {
+		t.Errorf("second retry after %s, want the backoff doubled to 100ms", gap)
+	}
+
+	stats := f.Stats()[0]
+	if stats.Retries != 2 || stats.Errors != 2 || stats.Failed != 0 {
+		t.Errorf("retries=%d errors=%d failed=%d, want 2, 2, 0", stats.Retries, stats.Errors, stats.Failed)
+	}
+	if !strings.Contains(stats.LastError, "502") {
+		t.Errorf("last error %q, want the 502 response", stats.LastError)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	shortBackoff(t, 10*time.Millisecond)
+	up := newUpstream(t, status(http.StatusTooManyRequests, "Retry-After", "1"))
+	f := start(t, Target{Name: "up", Endpoint: up.URL, MaxRetries: 1})
+
+	f.Forward(SignalLogs, []byte("logs"))
+	waitFor(t, "delivery", func() bool { return f.Stats()[0].Sent == 1 })
+
+	reqs := up.received()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d attempts, want 2", len(reqs))
+	}
+	if gap := reqs[1].at.Sub(reqs[0].at); gap < time.Second {
+		t.Errorf("retried after %s, want Retry-After's 1s", gap)
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	shortBackoff(t, time.Millisecond)
+	up := newUpstream(t,
+		status(http.StatusServiceUnavailable), status(http.StatusServiceUnavailable), status(http.StatusServiceUnavailable),
+		status(http.StatusBadRequest))
+	f := start(t, Target{Name: "up", Endpoint: up.URL, MaxRetries: 2})
+
+	// Retries run out for the first request; the second is not retried
+	f.Forward(SignalMetrics, []byte("first"))
+	f.Forward(SignalMetrics, []byte("second"))
+	waitFor(t, "both requests to fail", func() bool { return f.Stats()[0].Failed == 2 })
+
+	stats := f.Stats()[0]
+	if got := len(up.received()); got != 4 {
+		t.Errorf("got %d attempts, want 4", got)
+	}
+	if stats.Sent != 0 || stats.Retries != 2 || stats.Errors != 4 {
+		t.Errorf("sent=%d retries=%d errors=%d, want 0, 2, 4", stats.Sent, stats.Retries, stats.Errors)
+	}
+	if stats.LastError == "" || stats.LastErrorAt.IsZero() {
+		t.Errorf("last error not recorded: %+v", stats)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	up := newUpstream(t)
+	f := start(t, Target{
+		Name:     "vendor",
+		Endpoint: up.URL,
+		Headers:  map[string]string{"Authorization": "Bearer secret", "X-Tenant": "acme"},
+	})
+
+	f.Forward(SignalLogs, []byte("body"))
+	waitFor(t, "delivery", func() bool { return f.Stats()[0].Sent == 1 })
+
+	req := up.received()[0]
+	if req.path != "/v1/logs" || req.body != "body" {
+		t.Errorf("got %s %q, want /v1/logs \"body\"", req.path, req.body)
+	}
+	for k, want := range map[string]string{
+		"Authorization": "Bearer secret",
+		"X-Tenant":      "acme",
+		"Content-Type":  "application/x-protobuf",
+	} {
+		if got := req.header.Get(k); got != want {
+			t.Errorf("header %s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestSignalFilter(t *testing.T) {
+	traces := newUpstream(t)
+	all := newUpstream(t)
+	f := start(t,
+		Target{Name: "traces", Endpoint: traces.URL, Signals: []string{SignalTraces}},
+		Target{Name: "all", Endpoint: all.URL},
+	)
+
+	f.Forward(SignalMetrics, []byte("m"))
+	f.Forward(SignalLogs, []byte("l"))
+	f.Forward(SignalTraces, []byte("t"))
+	waitFor(t, "delivery", func() bool {
+		stats := f.Stats()
+		return stats[0].Sent == 1 && stats[1].Sent == 3
+	})
+
+	if reqs := traces.received(); len(reqs) != 1 || reqs[0].path != "/v1/traces" {
+		t.Errorf("traces-only target got %v", reqs)
+	}
+	var paths []string
+	for _, req := range all.received() {
+		paths = append(paths, req.path)
+	}
+	if got := strings.Join(paths, " "); got != "/v1/metrics /v1/logs /v1/traces" {
+		t.Errorf("unfiltered target got %s", got)
+	}
+}
+
+func TestLagAndDrops(t *testing.T) {
+	unblock := make(chan struct{})
+	var once sync.Once
+	release := func() { once.Do(func() { close(unblock) }) }
+	up := newUpstream(t, func(w http.ResponseWriter) { <-unblock })
+	t.Cleanup(release) // Before the server closes, which waits for handlers
+	slow := start(t, Target{Name: "slow", Endpoint: up.URL, QueueSize: 2})
+
+	for range 3 {
+		slow.Forward(SignalTraces, []byte("t"))
+	}
+	waitFor(t, "the first request to arrive", func() bool { return len(up.received()) == 1 })
+	time.Sleep(20 * time.Millisecond)
+
+	// The request in flight stays queued and counts toward lag
+	stats := slow.Stats()[0]
+	if stats.Queued != 2 || stats.Dropped != 1 {
+		t.Errorf("queued=%d dropped=%d, want 2, 1", stats.Queued, stats.Dropped)
+	}
+	if stats.LagSeconds < 0.02 {
+		t.Errorf("lag %.3fs, want at least the 20ms the request waited", stats.LagSeconds)
+	}
+
+	release()
+	waitFor(t, "the queue to drain", func() bool { return slow.Stats()[0].Sent == 2 })
+	if stats := slow.Stats()[0]; stats.Queued != 0 || stats.LagSeconds != 0 {
+		t.Errorf("queued=%d lag=%.3fs after draining, want 0", stats.Queued, stats.LagSeconds)
+	}
+}
+
+func TestParseTargets(t *testing.T) {
+	targets, err := ParseTargets(`[{"endpoint": "https://otlp.example.com/", "max_retries": -1}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := targets[0]
+	if got.Name != "otlp.example.com" || got.Endpoint != "https://otlp.example.com" {
+		t.Errorf("name=%q endpoint=%q", got.Name, got.Endpoint)
+	}
+	if got.QueueSize != DefaultQueueSize || got.MaxRetries != 0 || got.TimeoutSecs != DefaultTimeoutSecs {
+		t.Errorf("defaults not applied: %+v", got)
+	}
+
+	for _, bad := range []string{
+		`[{"endpoint": "ftp://example.com"}]`,
+		`[{"endpoint": "http://a"}, {"endpoint": "http://a"}]`,
+		`[{"endpoint": "http://a", "signals": ["profiles"]}]`,
+	} {
+		if _, err := ParseTargets(bad); err == nil {
+			t.Errorf("ParseTargets(%s) succeeded, want an error", bad)
+		}
+	}
+}
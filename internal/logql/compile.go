@@ -0,0 +1,273 @@
+package logql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LogsRelation is the relation compiled queries read log lines from. The
+// caller defines it as a CTE with one row per log record and the columns
+// timestamp, line, stream (the resource attributes) and metadata (the log
+// attributes), the latter two as label lists built by LabelsExpr.
+const LogsRelation = "logql_logs"
+
+// StepsRelation is the relation metric queries read evaluation timestamps
+// from. The caller defines it as a CTE with one TIMESTAMP column t.
+const StepsRelation = "logql_steps"
+
+// A label list is a sorted LIST(STRUCT(name VARCHAR, value VARCHAR)).
+const emptyLabels = "[]::STRUCT(name VARCHAR, value VARCHAR)[]"
+
+// labelNameExpr converts an attribute key to a label name.
+func labelNameExpr(key string) string {
+	return "regexp_replace(" + key + ", '[^a-zA-Z0-9_]', '_', 'g')"
+}
+
+// LabelsExpr returns SQL converting a MAP(VARCHAR, VARCHAR) column to a label
+// list. Invalid characters in keys become underscores, so service.name is
+// matched as service_name, and empty values are dropped.
+func LabelsExpr(column string) string {
+	return "coalesce(list_sort(list_filter(list_transform(map_entries(" + column + "), " +
+		"e -> {'name': " + labelNameExpr("e.key") + ", 'value': e.value}), e -> e.value <> '')), " + emptyLabels + ")"
+}
+
+// SQL is a compiled query: CTE definitions to follow LogsRelation (and
+// StepsRelation for metric queries) in a WITH clause, the CTE holding the
+// result and the positional arguments of the CTEs in order.
+//
+// The result of a log query has the columns timestamp, line and labels; that
+// of a metric query has one row per series and step with the columns t,
+// labels and value.
+type SQL struct {
+	CTEs   []string // "name AS (...)"
+	Result string
+	Metric bool
+	// Lookback is how far before the first step LogsRelation must reach
+	Lookback time.Duration
+	Args     []any
+}
+
+// Compile translates a parsed query to SQL.
+func Compile(e Expr) (*SQL, error) {
+	c := &compiler{}
+	result, err := c.expr(e)
+	if err != nil {
+		return nil, err
+	}
+	_, isLog := e.(*LogQuery)
+	return &SQL{CTEs: c.ctes, Result: result, Metric: !isLog, Lookback: c.lookback, Args: c.args}, nil
+}
+
+// CompileSelector translates a stream selector to a condition on the stream
+// column of LogsRelation.
+func CompileSelector(matchers []*Matcher) (string, []any) {
+	conds := make([]string, 0, len(matchers))
+	var args []any
+	for _, m := range matchers {
+		cond, condArgs := matchCond(m, "coalesce("+labelValue("stream")+", '')")
+		conds = append(conds, cond)
+		args = append(args, m.Name)
+		args = append(args, condArgs...)
+	}
+	if len(conds) == 0 {
+		return "true", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+type compiler struct {
+	ctes     []string
+	args     []any
+	lookback time.Duration
+}
+
+// add registers a CTE and returns its name.
+func (c *compiler) add(query string, args ...any) string {
+	name := fmt.Sprintf("logql_%d", len(c.ctes))
+	c.ctes = append(c.ctes, name+" AS ("+query+")")
+	c.args = append(c.args, args...)
+	return name
+}
+
+func (c *compiler) expr(e Expr) (string, error) {
+	switch e := e.(type) {
+	case *LogQuery:
+		return c.logQuery(e)
+
+	case *RangeAggregation:
+		lines, err := c.logQuery(e.Query)
+		if err != nil {
+			return "", err
+		}
+		c.lookback = max(c.lookback, e.Range)
+		divisor := 1.0
+		if e.Op == "rate" {
+			divisor = e.Range.Seconds()
+		}
+		return c.add(`SELECT s.t, l.labels, count(*) / ?::DOUBLE AS value
+			FROM `+StepsRelation+` s
+			JOIN `+lines+` l ON l.timestamp > s.t - to_microseconds(?::BIGINT) AND l.timestamp <= s.t
+			GROUP BY s.t, l.labels`, divisor, e.Range.Microseconds()), nil
+
+	case *VectorAggregation:
+		input, err := c.expr(e.Expr)
+		if err != nil {
+			return "", err
+		}
+		value := e.Op + "(value)"
+		if e.Op == "count" {
+			value = "count(*)::DOUBLE"
+		}
+
+		grouping := "labels"
+		var args []any
+		switch {
+		case e.Without && len(e.Grouping) > 0:
+			grouping = "list_filter(labels, e -> e.name NOT IN (" + placeholders(len(e.Grouping)) + "))"
+		case !e.Without && len(e.Grouping) > 0:
+			grouping = "list_filter(labels, e -> e.name IN (" + placeholders(len(e.Grouping)) + "))"
+		case !e.Without:
+			grouping = emptyLabels
+		}
+		for _, name := range e.Grouping {
+			args = append(args, name)
+		}
+		return c.add("SELECT t, "+grouping+" AS labels, "+value+" AS value FROM "+input+" GROUP BY 1, 2", args...), nil
+	}
+	return "", fmt.Errorf("unsupported expression %T", e)
+}
+
+// logQuery compiles the selector and pipeline; the result has the columns
+// timestamp, line and labels.
+func (c *compiler) logQuery(q *LogQuery) (string, error) {
+	where, args := CompileSelector(q.Selector)
+	input := c.add("SELECT timestamp, line, stream, metadata, "+emptyLabels+" AS parsed FROM "+LogsRelation+" WHERE "+where, args...)
+
+	for _, stage := range q.Pipeline {
+		switch stage := stage.(type) {
+		case *LineFilter:
+			var cond string
+			switch stage.Op {
+			case "|=":
+				cond = "contains(line, ?)"
+			case "!=":
+				cond = "NOT contains(line, ?)"
+			case "|~":
+				cond = "regexp_matches(line, ?)"
+			case "!~":
+				cond = "NOT regexp_matches(line, ?)"
+			default:
+				return "", fmt.Errorf("unknown line filter %q", stage.Op)
+			}
+			input = c.add("SELECT * FROM "+input+" WHERE "+cond, stage.Value)
+
+		case *LabelParser:
+			var extracted string
+			switch stage.Kind {
+			case "json":
+				extracted = jsonLabels
+			case "logfmt":
+				extracted = logfmtLabels
+			default:
+				return "", fmt.Errorf("unknown parser %q", stage.Kind)
+			}
+			input = c.add("SELECT * REPLACE (list_concat(parsed, " + extracted + ") AS parsed) FROM " + input)
+
+		case *LabelFilter:
+			cond, args, err := labelCond(stage.Cond)
+			if err != nil {
+				return "", err
+			}
+			input = c.add("SELECT * FROM "+input+" WHERE "+cond, args...)
+		}
+	}
+
+	return c.add("SELECT timestamp, line, list_sort(list_filter(list_concat(stream, parsed), e -> e.value <> '')) AS labels FROM " + input), nil
+}
+
+// extractedName converts a parsed field name to a label name; names taken by
+// stream labels get an _extracted suffix.
+func extractedName(key string) string {
+	name := labelNameExpr(key)
+	return "CASE WHEN list_contains(list_transform(stream, s -> s.name), " + name + ") " +
+		"THEN " + name + " || '_extracted' ELSE " + name + " END"
+}
+
+// jsonLabels extracts the top-level fields of a JSON object line; nested
+// values are kept as JSON text. Other lines get an __error__ label.
+var jsonLabels = `CASE WHEN json_valid(line) AND json_type(line) = 'OBJECT'
+	THEN list_transform(json_keys(line), k -> {'name': ` + extractedName("k") + `, 'value': coalesce(line ->> k, '')})
+	ELSE [{'name': '__error__', 'value': 'JSONParserErr'}] END`
+
+// logfmtLabels extracts key=value and key="quoted value" pairs.
+var logfmtLabels = `list_transform(
+	regexp_extract_all(line, '(?:^|\s)[a-zA-Z_][a-zA-Z0-9_.\-]*=(?:"(?:[^"\\]|\\.)*"|\S*)'),
+	kv -> {
+		'name': ` + extractedName(`regexp_extract(kv, '^\s*([^=]+)=', 1)`) + `,
+		'value': CASE WHEN regexp_matches(kv, '^\s*[^=]+="')
+			THEN replace(replace(regexp_extract(kv, '^\s*[^=]+="(.*)"$', 1), '\"', '"'), '\\', '\')
+			ELSE regexp_extract(kv, '^\s*[^=]+=(.*)$', 1) END
+	})`
+
+// labelValue returns SQL looking up the label named by the next argument in
+// a label list; it is NULL if the label is missing.
+func labelValue(list string) string {
+	return "list_filter(" + list + ", e -> e.name = ?)[1].value"
+}
+
+// labelCond compiles a label filter condition. Labels are looked up among
+// parsed labels, then stream labels, then log attributes.
+func labelCond(cond LabelCond) (string, []any, error) {
+	switch cond := cond.(type) {
+	case *BinaryLabelCond:
+		lhs, lhsArgs, err := labelCond(cond.LHS)
+		if err != nil {
+			return "", nil, err
+		}
+		rhs, rhsArgs, err := labelCond(cond.RHS)
+		if err != nil {
+			return "", nil, err
+		}
+		return "(" + lhs + " " + strings.ToUpper(cond.Op) + " " + rhs + ")", append(lhsArgs, rhsArgs...), nil
+
+	case *LabelMatch:
+		value, args := lookup(cond.Name)
+		sql, condArgs := matchCond(&cond.Matcher, value)
+		return sql, append(args, condArgs...), nil
+
+	case *NumericLabelFilter:
+		op := cond.Op
+		switch op {
+		case "==":
+			op = "="
+		case "!=":
+			op = "<>"
+		}
+		value, args := lookup(cond.Name)
+		return "TRY_CAST(" + value + " AS DOUBLE) " + op + " ?", append(args, cond.Value), nil
+	}
+	return "", nil, fmt.Errorf("unsupported label filter %T", cond)
+}
+
+func lookup(name string) (string, []any) {
+	return "coalesce(" + labelValue("parsed") + ", " + labelValue("stream") + ", " + labelValue("metadata") + ", '')",
+		[]any{name, name, name}
+}
+
+// matchCond compiles a matcher applied to the string expression value.
+func matchCond(m *Matcher, value string) (string, []any) {
+	switch m.Type {
+	case MatchNotEqual:
+		return value + " <> ?", []any{m.Value}
+	case MatchRegexp:
+		return "regexp_full_match(" + value + ", ?)", []any{m.Value}
+	case MatchNotRegexp:
+		return "NOT regexp_full_match(" + value + ", ?)", []any{m.Value}
+	}
+	return value + " = ?", []any{m.Value}
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
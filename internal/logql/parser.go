@@ -0,0 +1,504 @@
+// Package logql parses a subset of the Loki LogQL query language and compiles
+// it to DuckDB SQL over the logs table.
+//
+// Supported are stream selectors over resource attributes, the line filters
+// |=, !=, |~ and !~, the json and logfmt parsers, label filters with string
+// and numeric comparisons combined with and, or and commas, the range
+// aggregations count_over_time and rate, and the vector aggregations sum,
+// avg, min, max and count with by or without grouping.
+package logql
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Expr is a parsed query: a *LogQuery selecting log lines or a metric
+// expression producing sample series.
+type Expr interface {
+	expr()
+}
+
+// LogQuery selects the lines of the streams matching Selector that pass
+// every stage of Pipeline.
+type LogQuery struct {
+	Selector []*Matcher
+	Pipeline []Stage
+}
+
+// RangeAggregation counts the lines of Query within Range before each step.
+// Op is "count_over_time" or "rate" (lines per second).
+type RangeAggregation struct {
+	Op    string
+	Query *LogQuery
+	Range time.Duration
+}
+
+// VectorAggregation aggregates the series of Expr per step. Op is sum, avg,
+// min, max or count; series are grouped by the Grouping labels, or by all
+// other labels when Without is set.
+type VectorAggregation struct {
+	Op       string
+	Expr     Expr
+	Grouping []string
+	Without  bool
+}
+
+func (*LogQuery) expr()          {}
+func (*RangeAggregation) expr()  {}
+func (*VectorAggregation) expr() {}
+
+// MatchType is the operator of a stream matcher.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher compares a stream label with a value. Regular expressions are
+// anchored at both ends; a missing label has the empty value.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// matchesEmpty reports whether the matcher selects streams without the label.
+func (m *Matcher) matchesEmpty() bool {
+	switch m.Type {
+	case MatchEqual:
+		return m.Value == ""
+	case MatchNotEqual:
+		return m.Value != ""
+	case MatchRegexp:
+		return m.re.MatchString("")
+	default:
+		return !m.re.MatchString("")
+	}
+}
+
+// Stage is a step of a log pipeline.
+type Stage interface {
+	stage()
+}
+
+// LineFilter keeps the lines containing (|=), not containing (!=), matching
+// (|~) or not matching (!~) Value. Regular expressions are unanchored.
+type LineFilter struct {
+	Op    string
+	Value string
+}
+
+// LabelParser extracts labels from the line. Kind is "json" (top-level
+// fields) or "logfmt".
+type LabelParser struct {
+	Kind string
+}
+
+// LabelFilter keeps the lines whose labels satisfy Cond.
+type LabelFilter struct {
+	Cond LabelCond
+}
+
+func (*LineFilter) stage()  {}
+func (*LabelParser) stage() {}
+func (*LabelFilter) stage() {}
+
+// LabelCond is a condition of a label filter.
+type LabelCond interface {
+	labelCond()
+}
+
+// BinaryLabelCond is Op ("and" or "or") applied to two conditions.
+type BinaryLabelCond struct {
+	Op       string
+	LHS, RHS LabelCond
+}
+
+// LabelMatch compares a label with a string like a stream matcher does.
+type LabelMatch struct {
+	Matcher
+}
+
+// NumericLabelFilter compares a label's numeric value with Value. Op is ==,
+// !=, >, >=, < or <=; lines whose label is not a number never match.
+type NumericLabelFilter struct {
+	Name  string
+	Op    string
+	Value float64
+}
+
+func (*BinaryLabelCond) labelCond()    {}
+func (*LabelMatch) labelCond()         {}
+func (*NumericLabelFilter) labelCond() {}
+
+var rangeAggregations = map[string]bool{"count_over_time": true, "rate": true}
+
+var comparisonOps = map[string]bool{"=": true, "!=": true, "=~": true, "!~": true, "==": true, ">": true, ">=": true, "<": true, "<=": true}
+
+var vectorAggregations = map[string]bool{"sum": true, "avg": true, "min": true, "max": true, "count": true}
+
+// Parse parses a LogQL query.
+func Parse(query string) (Expr, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t)
+	}
+	return e, nil
+}
+
+// ParseSelector parses a stream selector such as {service_name="api"}.
+func ParseSelector(selector string) ([]*Matcher, error) {
+	tokens, err := lex(selector)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	matchers, err := p.parseSelector()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t)
+	}
+	return matchers, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the given punctuation.
+func (p *parser) accept(punct string) bool {
+	if t := p.peek(); t.kind == tokPunct && t.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(punct string) error {
+	if !p.accept(punct) {
+		return fmt.Errorf("expected %q, got %s", punct, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) unexpected(t token) error {
+	return fmt.Errorf("unexpected %s at %d", t, t.pos)
+}
+
+func (p *parser) parseExpr() (Expr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokPunct && t.text == "{":
+		return p.parseLogQuery()
+	case t.kind == tokPunct && t.text == "(":
+		p.next()
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case t.kind == tokIdent && rangeAggregations[t.text]:
+		return p.parseRangeAggregation()
+	case t.kind == tokIdent && vectorAggregations[t.text]:
+		return p.parseVectorAggregation()
+	case t.kind == tokIdent:
+		return nil, fmt.Errorf("unsupported function %q", t.text)
+	}
+	return nil, p.unexpected(t)
+}
+
+func (p *parser) parseRangeAggregation() (Expr, error) {
+	op := p.next().text
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	q, err := p.parseLogQuery()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	t := p.next()
+	if t.kind != tokDuration || t.dur <= 0 {
+		return nil, fmt.Errorf("expected range duration, got %s", t)
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return &RangeAggregation{Op: op, Query: q, Range: t.dur}, nil
+}
+
+func (p *parser) parseVectorAggregation() (Expr, error) {
+	agg := &VectorAggregation{Op: p.next().text}
+	grouped, err := p.parseGrouping(agg)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if agg.Expr, err = p.parseExpr(); err != nil {
+		return nil, err
+	}
+	if _, ok := agg.Expr.(*LogQuery); ok {
+		return nil, fmt.Errorf("%s expects a metric expression, not a log query", agg.Op)
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if !grouped {
+		if _, err := p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+// parseGrouping reads an optional by or without clause.
+func (p *parser) parseGrouping(agg *VectorAggregation) (bool, error) {
+	t := p.peek()
+	if t.kind != tokIdent || t.text != "by" && t.text != "without" {
+		return false, nil
+	}
+	p.next()
+	agg.Without = t.text == "without"
+	if err := p.expect("("); err != nil {
+		return false, err
+	}
+	agg.Grouping = []string{}
+	for !p.accept(")") {
+		if len(agg.Grouping) > 0 {
+			if err := p.expect(","); err != nil {
+				return false, err
+			}
+		}
+		name := p.next()
+		if name.kind != tokIdent {
+			return false, fmt.Errorf("expected label name, got %s", name)
+		}
+		agg.Grouping = append(agg.Grouping, name.text)
+	}
+	return true, nil
+}
+
+func (p *parser) parseLogQuery() (*LogQuery, error) {
+	selector, err := p.parseSelector()
+	if err != nil {
+		return nil, err
+	}
+	q := &LogQuery{Selector: selector}
+	for {
+		t := p.peek()
+		if t.kind != tokPunct {
+			return q, nil
+		}
+		switch t.text {
+		case "|=", "!=", "|~", "!~":
+			p.next()
+			value := p.next()
+			if value.kind != tokString {
+				return nil, fmt.Errorf("expected string after %s, got %s", t.text, value)
+			}
+			if t.text == "|~" || t.text == "!~" {
+				if _, err := regexp.Compile(value.text); err != nil {
+					return nil, fmt.Errorf("invalid regular expression %q: %w", value.text, err)
+				}
+			}
+			q.Pipeline = append(q.Pipeline, &LineFilter{Op: t.text, Value: value.text})
+
+		case "|":
+			p.next()
+			stage, err := p.parseStage()
+			if err != nil {
+				return nil, err
+			}
+			q.Pipeline = append(q.Pipeline, stage)
+
+		default:
+			return q, nil
+		}
+	}
+}
+
+func (p *parser) parseStage() (Stage, error) {
+	t := p.peek()
+	if t.kind != tokIdent {
+		return nil, p.unexpected(t)
+	}
+	if t.text == "json" || t.text == "logfmt" {
+		p.next()
+		// Parameters such as | json field="path" would follow here
+		if p.peek().kind == tokIdent {
+			return nil, fmt.Errorf("%s parameters are not supported", t.text)
+		}
+		return &LabelParser{Kind: t.text}, nil
+	}
+	if op := p.tokens[p.pos+1]; op.kind != tokPunct || !comparisonOps[op.text] {
+		return nil, fmt.Errorf("unsupported pipeline stage %q", t.text)
+	}
+	cond, err := p.parseLabelOr()
+	if err != nil {
+		return nil, err
+	}
+	return &LabelFilter{Cond: cond}, nil
+}
+
+func (p *parser) parseLabelOr() (LabelCond, error) {
+	lhs, err := p.parseLabelAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokIdent && p.peek().text == "or" {
+		p.next()
+		rhs, err := p.parseLabelAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryLabelCond{Op: "or", LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseLabelAnd() (LabelCond, error) {
+	lhs, err := p.parseLabelPrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if t := p.peek(); !(t.kind == tokIdent && t.text == "and") && !(t.kind == tokPunct && t.text == ",") {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parseLabelPrimary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryLabelCond{Op: "and", LHS: lhs, RHS: rhs}
+	}
+}
+
+func (p *parser) parseLabelPrimary() (LabelCond, error) {
+	if p.accept("(") {
+		cond, err := p.parseLabelOr()
+		if err != nil {
+			return nil, err
+		}
+		return cond, p.expect(")")
+	}
+
+	name := p.next()
+	if name.kind != tokIdent {
+		return nil, fmt.Errorf("expected label name, got %s", name)
+	}
+	op := p.next()
+	if op.kind != tokPunct {
+		return nil, fmt.Errorf("expected comparison operator, got %s", op)
+	}
+	value := p.next()
+	switch value.kind {
+	case tokString:
+		m, err := newMatcher(MatchType(op.text), name.text, value.text)
+		if err != nil {
+			return nil, err
+		}
+		return &LabelMatch{Matcher: *m}, nil
+	case tokNumber:
+		switch op.text {
+		case "=", "==":
+			return &NumericLabelFilter{Name: name.text, Op: "==", Value: value.num}, nil
+		case "!=", ">", ">=", "<", "<=":
+			return &NumericLabelFilter{Name: name.text, Op: op.text, Value: value.num}, nil
+		}
+		return nil, fmt.Errorf("operator %s cannot compare numbers", op.text)
+	case tokDuration:
+		return nil, fmt.Errorf("duration label filters are not supported")
+	}
+	return nil, fmt.Errorf("expected string or number, got %s", value)
+}
+
+// parseSelector reads {name="value", ...}.
+func (p *parser) parseSelector() ([]*Matcher, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var matchers []*Matcher
+	for !p.accept("}") {
+		if len(matchers) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if p.accept("}") {
+				break
+			}
+		}
+		name := p.next()
+		if name.kind != tokIdent {
+			return nil, fmt.Errorf("expected label name, got %s", name)
+		}
+		op := p.next()
+		value := p.next()
+		if value.kind != tokString {
+			return nil, fmt.Errorf("expected string value for label %s, got %s", name.text, value)
+		}
+		m, err := newMatcher(MatchType(op.text), name.text, value.text)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	for _, m := range matchers {
+		if !m.matchesEmpty() {
+			return matchers, nil
+		}
+	}
+	return nil, fmt.Errorf("stream selector must contain at least one matcher that does not match the empty string")
+}
+
+func newMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: t, Name: name, Value: value}
+	switch t {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", value, err)
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("invalid matcher operator %q for label %s", t, name)
+	}
+	return m, nil
+}
@@ -0,0 +1,149 @@
+package logsearch
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PostingsRelation is the relation compiled queries read postings from. The
+// caller defines it as a CTE over log_terms with at least the columns term,
+// log_id and field, restricted to the records being searched.
+const PostingsRelation = "search_postings"
+
+// DocsRelation is the relation phrases are verified against. The caller
+// defines it as a CTE with the columns log_id, body and body_fields, only if
+// SQL.Docs is set: DuckDB does not bind parameters of unreferenced CTEs.
+const DocsRelation = "search_docs"
+
+// SQL is a compiled query: CTE definitions to follow PostingsRelation and
+// DocsRelation in a WITH clause, the CTE holding the matching log_id values
+// and the positional arguments of the CTEs in order.
+type SQL struct {
+	CTEs   []string // "name AS (...)"
+	Result string
+	Docs   bool // Whether the CTEs read DocsRelation
+	Args   []any
+}
+
+// Compile translates a parsed query to SQL.
+func Compile(e Expr) (*SQL, error) {
+	c := &compiler{}
+	result, err := c.expr(e)
+	if err != nil {
+		return nil, err
+	}
+	return &SQL{CTEs: c.ctes, Result: result, Docs: c.docs, Args: c.args}, nil
+}
+
+type compiler struct {
+	ctes []string
+	args []any
+	docs bool
+}
+
+// add registers a CTE and returns its name.
+func (c *compiler) add(query string, args ...any) string {
+	name := fmt.Sprintf("search_%d", len(c.ctes))
+	c.ctes = append(c.ctes, name+" AS ("+query+")")
+	c.args = append(c.args, args...)
+	return name
+}
+
+func (c *compiler) expr(e Expr) (string, error) {
+	switch e := e.(type) {
+	case *Term:
+		return c.term(e), nil
+
+	case *And:
+		lhs, err := c.expr(e.LHS)
+		if err != nil {
+			return "", err
+		}
+		// a AND NOT b needs no universe to negate against
+		if not, ok := e.RHS.(*Not); ok {
+			rhs, err := c.expr(not.Expr)
+			if err != nil {
+				return "", err
+			}
+			return c.add(fmt.Sprintf("SELECT log_id FROM %s EXCEPT SELECT log_id FROM %s", lhs, rhs)), nil
+		}
+		rhs, err := c.expr(e.RHS)
+		if err != nil {
+			return "", err
+		}
+		return c.add(fmt.Sprintf("SELECT log_id FROM %s INTERSECT SELECT log_id FROM %s", lhs, rhs)), nil
+
+	case *Or:
+		lhs, err := c.expr(e.LHS)
+		if err != nil {
+			return "", err
+		}
+		rhs, err := c.expr(e.RHS)
+		if err != nil {
+			return "", err
+		}
+		return c.add(fmt.Sprintf("SELECT log_id FROM %s UNION SELECT log_id FROM %s", lhs, rhs)), nil
+
+	case *Not:
+		inner, err := c.expr(e.Expr)
+		if err != nil {
+			return "", err
+		}
+		return c.add(fmt.Sprintf("SELECT DISTINCT log_id FROM %s EXCEPT SELECT log_id FROM %s", PostingsRelation, inner)), nil
+	}
+	return "", fmt.Errorf("unsupported expression %T", e)
+}
+
+func (c *compiler) term(t *Term) string {
+	fieldCond := ""
+	var fieldArgs []any
+	if t.Scoped {
+		fieldCond = " AND field = ?"
+		fieldArgs = []any{t.Field}
+	}
+	if !t.Phrase() {
+		return c.add("SELECT DISTINCT log_id FROM "+PostingsRelation+" WHERE term = ?"+fieldCond,
+			append([]any{t.Tokens[0]}, fieldArgs...)...)
+	}
+
+	// Records with every token, then the sequence checked against the text
+	distinct := make(map[string]bool)
+	var args []any
+	for _, token := range t.Tokens {
+		if !distinct[token] {
+			distinct[token] = true
+			args = append(args, token)
+		}
+	}
+	candidates := c.add(fmt.Sprintf("SELECT log_id FROM %s WHERE term IN (%s)%s GROUP BY log_id HAVING count(DISTINCT term) = ?",
+		PostingsRelation, placeholders(len(args)), fieldCond), append(append(args, fieldArgs...), len(args))...)
+
+	c.docs = true
+	pattern := phrasePattern(t.Tokens)
+	switch {
+	case t.Scoped && t.Field == "":
+		return c.add("SELECT log_id FROM "+candidates+" JOIN "+DocsRelation+" USING (log_id) WHERE regexp_matches(body, ?)", pattern)
+	case t.Scoped:
+		return c.add("SELECT log_id FROM "+candidates+" JOIN "+DocsRelation+" USING (log_id) WHERE regexp_matches(element_at(body_fields, ?)[1], ?)",
+			t.Field, pattern)
+	}
+	return c.add("SELECT log_id FROM "+candidates+" JOIN "+DocsRelation+" USING (log_id) "+
+		"WHERE regexp_matches(coalesce(body, ''), ?) OR len(list_filter(map_values(body_fields), v -> regexp_matches(v, ?))) > 0",
+		pattern, pattern)
+}
+
+// phrasePattern matches the tokens in sequence, separated by anything that
+// is not part of a token.
+func phrasePattern(tokens []string) string {
+	quoted := make([]string, len(tokens))
+	for i, t := range tokens {
+		quoted[i] = regexp.QuoteMeta(t)
+	}
+	const sep = `[^\p{L}\p{N}_]`
+	return `(?i)(?:^|` + sep + `)` + strings.Join(quoted, sep+`+`) + `(?:` + sep + `|$)`
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
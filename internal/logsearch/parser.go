@@ -0,0 +1,291 @@
+// Package logsearch implements full-text search over log bodies: the
+// tokenizer shared by indexing and querying, a query language and its
+// compilation to DuckDB SQL over the log_terms inverted index.
+//
+// Queries consist of terms (timeout), phrases ("connection refused") and
+// field-scoped terms (level:error, body:"disk full"), combined with AND
+// (implicit between adjacent terms), OR, NOT or a leading -, and parentheses.
+// The body: scope restricts a term to the body text; any other scope names a
+// structured body field.
+package logsearch
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Expr is a search expression; it evaluates to a set of log records.
+type Expr interface {
+	expr()
+}
+
+// Term matches records containing Tokens in sequence. A term has one token,
+// a phrase several. Unscoped terms match the body and every body field.
+type Term struct {
+	Scoped bool
+	Field  string // Body field name, "" for the body text; only if Scoped
+	Tokens []string
+}
+
+// And matches records matching both sides.
+type And struct {
+	LHS, RHS Expr
+}
+
+// Or matches records matching either side.
+type Or struct {
+	LHS, RHS Expr
+}
+
+// Not matches records not matching Expr.
+type Not struct {
+	Expr Expr
+}
+
+func (*Term) expr() {}
+func (*And) expr()  {}
+func (*Or) expr()   {}
+func (*Not) expr()  {}
+
+// Phrase reports whether the term consists of several tokens.
+func (t *Term) Phrase() bool {
+	return len(t.Tokens) > 1
+}
+
+// Positive returns the terms of e that are not negated; they are the terms
+// that contribute to relevance and are highlighted.
+func Positive(e Expr) []*Term {
+	var terms []*Term
+	var walk func(Expr, bool)
+	walk = func(e Expr, negated bool) {
+		switch e := e.(type) {
+		case *Term:
+			if !negated {
+				terms = append(terms, e)
+			}
+		case *And:
+			walk(e.LHS, negated)
+			walk(e.RHS, negated)
+		case *Or:
+			walk(e.LHS, negated)
+			walk(e.RHS, negated)
+		case *Not:
+			walk(e.Expr, !negated)
+		}
+	}
+	walk(e, false)
+	return terms
+}
+
+// Parse parses a search query.
+func Parse(query string) (Expr, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+	if len(Positive(e)) == 0 {
+		return nil, fmt.Errorf("query must contain a term that is not negated")
+	}
+	return e, nil
+}
+
+type tokenKind int
+
+const (
+	tokWord   tokenKind = iota // Bare word or keyword
+	tokPhrase                  // Quoted text
+	tokLParen
+	tokRParen
+	tokMinus // Negation prefix
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	field  string // Scope before a colon, for words and phrases
+	scoped bool
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokLParen:
+		return `"("`
+	case tokRParen:
+		return `")"`
+	case tokMinus:
+		return `"-"`
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lex splits a query into words, phrases, parentheses and negations.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen})
+			i++
+		case c == '-' && (i == 0 || strings.IndexByte(" \t\n\r(", input[i-1]) >= 0):
+			tokens = append(tokens, token{kind: tokMinus})
+			i++
+		default:
+			var t token
+			// Optional field scope: name:word or name:"phrase"
+			if n := fieldPrefix(input[i:]); n > 0 {
+				t.field, t.scoped = input[i:i+n-1], true
+				i += n
+			}
+			if i < len(input) && input[i] == '"' {
+				end := strings.IndexByte(input[i+1:], '"')
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated phrase")
+				}
+				t.kind, t.text = tokPhrase, input[i+1:i+1+end]
+				i += end + 2
+			} else {
+				start := i
+				for i < len(input) && strings.IndexByte(" \t\n\r()\"", input[i]) < 0 {
+					i++
+				}
+				t.kind, t.text = tokWord, input[start:i]
+			}
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+// fieldPrefix returns the length of a leading "name:" scope, or 0.
+func fieldPrefix(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ':':
+			if i == 0 || i+1 == len(s) || strings.IndexByte(" \t\n\r()", s[i+1]) >= 0 {
+				return 0
+			}
+			return i + 1
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.', c == '-':
+		default:
+			return 0
+		}
+	}
+	return 0
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) keyword(word string) bool {
+	if p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		if t.kind == tokWord && !t.scoped && t.text == word {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	lhs, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Or{LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		if t.kind == tokRParen || t.kind == tokWord && !t.scoped && t.text == "OR" {
+			break
+		}
+		p.keyword("AND")
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &And{LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	negated := p.keyword("NOT")
+	if !negated && p.tokens[p.pos].kind == tokMinus {
+		p.pos++
+		negated = true
+	}
+	if negated {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Expr: e}, nil
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokLParen:
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokRParen {
+			return nil, fmt.Errorf("missing \")\"")
+		}
+		p.pos++
+		return e, nil
+	case tokWord, tokPhrase:
+		if t.kind == tokWord && !t.scoped && (t.text == "AND" || t.text == "OR") {
+			return nil, fmt.Errorf("unexpected %s", t)
+		}
+		tokens := Tokenize(t.text)
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("%s contains no searchable characters", t)
+		}
+		term := &Term{Scoped: t.scoped, Tokens: tokens}
+		if t.scoped && t.field != "body" {
+			term.Field = t.field
+		}
+		return term, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", t)
+}
@@ -0,0 +1,49 @@
+package logsearch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseIncomplete(t *testing.T) {
+	for _, query := range []string{
+		"NOT",
+		"foo NOT",
+		"foo -",
+		"foo AND",
+		"foo OR",
+		"foo AND NOT",
+		"(foo",
+	} {
+		_, err := Parse(query)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", query)
+			continue
+		}
+		if query != "(foo" && !strings.Contains(err.Error(), "unexpected end of query") {
+			t.Errorf("Parse(%q) = %v, want unexpected end of query", query, err)
+		}
+	}
+}
+
+func TestParseNegation(t *testing.T) {
+	for _, query := range []string{"foo NOT bar", "foo -bar", "foo NOT -bar"} {
+		e, err := Parse(query)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", query, err)
+		}
+		and, ok := e.(*And)
+		if !ok {
+			t.Fatalf("Parse(%q) = %T, want *And", query, e)
+		}
+		not, ok := and.RHS.(*Not)
+		if !ok {
+			t.Fatalf("Parse(%q) right side = %T, want *Not", query, and.RHS)
+		}
+		if query == "foo NOT -bar" {
+			if _, ok := not.Expr.(*Not); !ok {
+				t.Errorf("Parse(%q) negated once, want twice", query)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package logsearch
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxTokenLength is the length in bytes above which tokens are not indexed,
+// so that hashes and encoded blobs do not bloat the index.
+const MaxTokenLength = 64
+
+// tokenSpan is a token and its byte offsets in the source text.
+type tokenSpan struct {
+	token      string
+	start, end int
+}
+
+// isTokenRune reports whether r is part of a token. Everything else separates
+// tokens; the phrase patterns built by phrasePattern use the same classes.
+func isTokenRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+func tokenSpans(text string) []tokenSpan {
+	var spans []tokenSpan
+	start := -1
+	for i, r := range text {
+		if isTokenRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			spans = append(spans, tokenSpan{token: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, tokenSpan{token: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+	return spans
+}
+
+// Tokenize splits text into lowercase tokens of letters, digits and
+// underscores. Tokens longer than MaxTokenLength are dropped.
+func Tokenize(text string) []string {
+	spans := tokenSpans(text)
+	tokens := make([]string, 0, len(spans))
+	for _, s := range spans {
+		if len(s.token) <= MaxTokenLength {
+			tokens = append(tokens, s.token)
+		}
+	}
+	return tokens
+}
+
+// TermCounts returns how often each token occurs in text, and the number of tokens.
+func TermCounts(text string) (map[string]int, int) {
+	tokens := Tokenize(text)
+	counts := make(map[string]int, len(tokens))
+	for _, t := range tokens {
+		counts[t]++
+	}
+	return counts, len(tokens)
+}
+
+// Highlight returns an HTML snippet of about width bytes around the first
+// occurrence of any of terms, with every occurrence wrapped in <em>. It
+// returns "" if text contains none of the terms.
+func Highlight(text string, terms []string, width int) string {
+	wanted := make(map[string]bool, len(terms))
+	for _, t := range terms {
+		wanted[t] = true
+	}
+	var matches []tokenSpan
+	for _, s := range tokenSpans(text) {
+		if wanted[s.token] {
+			matches = append(matches, s)
+		}
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+
+	// Center the window on the first match, snapped to rune boundaries
+	start := max(0, matches[0].start-width/2)
+	end := min(len(text), start+width)
+	start = max(0, min(start, end-width))
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m.start < pos || m.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:m.start]))
+		b.WriteString("<em>")
+		b.WriteString(html.EscapeString(text[m.start:m.end]))
+		b.WriteString("</em>")
+		pos = m.end
+	}
+	b.WriteString(html.EscapeString(text[pos:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
@@ -0,0 +1,758 @@
+package promql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Defaults from Prometheus.
+const (
+	DefaultLookbackDelta = 5 * time.Minute
+	MaxPointsPerSeries   = 11000 // Range query resolution limit
+)
+
+// ValueType is the type of an expression result.
+type ValueType string
+
+const (
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+	ValueTypeString ValueType = "string"
+)
+
+// Value is an evaluation result: Scalar, Vector, Matrix or String.
+type Value interface {
+	Type() ValueType
+}
+
+// Labels is a label set; __name__ holds the metric name.
+type Labels map[string]string
+
+// Point is a sample value at a timestamp in milliseconds.
+type Point struct {
+	T int64
+	V float64
+}
+
+// Series is a labeled list of points in time order.
+type Series struct {
+	Metric Labels
+	Points []Point
+}
+
+// Sample is a labeled value at a timestamp in milliseconds.
+type Sample struct {
+	Metric Labels
+	T      int64
+	V      float64
+}
+
+type (
+	Vector []Sample
+	Matrix []Series
+)
+
+// Scalar is a single number.
+type Scalar struct {
+	T int64
+	V float64
+}
+
+// String is a string literal result.
+type String struct {
+	T int64
+	V string
+}
+
+func (Vector) Type() ValueType { return ValueTypeVector }
+func (Matrix) Type() ValueType { return ValueTypeMatrix }
+func (Scalar) Type() ValueType { return ValueTypeScalar }
+func (String) Type() ValueType { return ValueTypeString }
+
+// Querier loads the series matching all matchers with their points in [start, end].
+type Querier interface {
+	Select(ctx context.Context, matchers []*Matcher, start, end time.Time) ([]Series, error)
+}
+
+// QuerierFunc adapts a function to the Querier interface.
+type QuerierFunc func(ctx context.Context, matchers []*Matcher, start, end time.Time) ([]Series, error)
+
+func (f QuerierFunc) Select(ctx context.Context, matchers []*Matcher, start, end time.Time) ([]Series, error) {
+	return f(ctx, matchers, start, end)
+}
+
+// ExecError is an evaluation error caused by the query rather than by the
+// storage, such as many-to-many vector matching.
+type ExecError struct {
+	msg string
+}
+
+func (e *ExecError) Error() string { return e.msg }
+
+func execErrorf(format string, args ...any) error {
+	return &ExecError{msg: fmt.Sprintf(format, args...)}
+}
+
+// IsExecError reports whether err is an ExecError.
+func IsExecError(err error) bool {
+	var e *ExecError
+	return errors.As(err, &e)
+}
+
+// InstantQuery evaluates an expression at ts.
+func InstantQuery(ctx context.Context, q Querier, e Expr, ts time.Time) (Value, error) {
+	ev, err := newEvaluator(ctx, q, e, ts, ts)
+	if err != nil {
+		return nil, err
+	}
+	v, err := ev.eval(e, ts.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case Vector:
+		if err := checkUniqueLabels(v); err != nil {
+			return nil, err
+		}
+		if !isSortCall(e) {
+			sort.Slice(v, func(i, j int) bool { return v[i].Metric.Key() < v[j].Metric.Key() })
+		}
+	case Matrix:
+		sort.Slice(v, func(i, j int) bool { return v[i].Metric.Key() < v[j].Metric.Key() })
+	}
+	return v, nil
+}
+
+// CheckRangeQuery validates the expression type and resolution of a range query.
+func CheckRangeQuery(e Expr, start, end time.Time, step time.Duration) error {
+	if t := typeOf(e); t != ValueTypeScalar && t != ValueTypeVector {
+		return fmt.Errorf("invalid expression type %q for range query, must be scalar or instant vector", t)
+	}
+	if step <= 0 {
+		return fmt.Errorf("zero or negative query resolution step widths are not accepted")
+	}
+	if end.Sub(start)/step > MaxPointsPerSeries {
+		return fmt.Errorf("exceeded maximum resolution of %d points per timeseries, try decreasing the query resolution", MaxPointsPerSeries)
+	}
+	return nil
+}
+
+// RangeQuery evaluates an expression at every step from start to end.
+func RangeQuery(ctx context.Context, q Querier, e Expr, start, end time.Time, step time.Duration) (Matrix, error) {
+	if err := CheckRangeQuery(e, start, end, step); err != nil {
+		return nil, err
+	}
+
+	ev, err := newEvaluator(ctx, q, e, start, end)
+	if err != nil {
+		return nil, err
+	}
+	series := make(map[string]*Series)
+	for t := start.UnixMilli(); t <= end.UnixMilli(); t += step.Milliseconds() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		v, err := ev.eval(e, t)
+		if err != nil {
+			return nil, err
+		}
+		var samples Vector
+		switch v := v.(type) {
+		case Scalar:
+			samples = Vector{{Metric: Labels{}, T: t, V: v.V}}
+		case Vector:
+			if err := checkUniqueLabels(v); err != nil {
+				return nil, err
+			}
+			samples = v
+		}
+		for _, s := range samples {
+			key := s.Metric.Key()
+			ss, ok := series[key]
+			if !ok {
+				ss = &Series{Metric: s.Metric}
+				series[key] = ss
+			}
+			ss.Points = append(ss.Points, Point{T: t, V: s.V})
+		}
+	}
+
+	result := make(Matrix, 0, len(series))
+	for _, s := range series {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Metric.Key() < result[j].Metric.Key() })
+	return result, nil
+}
+
+func isSortCall(e Expr) bool {
+	c, ok := unwrapParens(e).(*Call)
+	return ok && (c.Func == "sort" || c.Func == "sort_desc")
+}
+
+func checkUniqueLabels(v Vector) error {
+	seen := make(map[string]bool, len(v))
+	for _, s := range v {
+		key := s.Metric.Key()
+		if seen[key] {
+			return execErrorf("vector cannot contain metrics with the same labelset")
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// evaluator holds the series loaded for each selector of an expression.
+type evaluator struct {
+	series map[*VectorSelector][]Series
+}
+
+// newEvaluator loads the data all selectors need to evaluate e from start to end.
+func newEvaluator(ctx context.Context, q Querier, e Expr, start, end time.Time) (*evaluator, error) {
+	ev := &evaluator{series: make(map[*VectorSelector][]Series)}
+	var err error
+	load := func(vs *VectorSelector, window time.Duration) {
+		if err != nil {
+			return
+		}
+		from := start.Add(-vs.Offset - window)
+		to := end.Add(-vs.Offset)
+		ev.series[vs], err = q.Select(ctx, vs.Matchers, from, to)
+	}
+	walk(e, func(e Expr) bool {
+		switch e := e.(type) {
+		case *MatrixSelector:
+			load(e.Vector, e.Range)
+			return false
+		case *VectorSelector:
+			load(e, DefaultLookbackDelta)
+		}
+		return true
+	})
+	return ev, err
+}
+
+// walk calls fn for e and, while fn returns true, its subexpressions.
+func walk(e Expr, fn func(Expr) bool) {
+	if !fn(e) {
+		return
+	}
+	switch e := e.(type) {
+	case *ParenExpr:
+		walk(e.Expr, fn)
+	case *UnaryExpr:
+		walk(e.Expr, fn)
+	case *MatrixSelector:
+		walk(e.Vector, fn)
+	case *Call:
+		for _, arg := range e.Args {
+			walk(arg, fn)
+		}
+	case *AggregateExpr:
+		if e.Param != nil {
+			walk(e.Param, fn)
+		}
+		walk(e.Expr, fn)
+	case *BinaryExpr:
+		walk(e.LHS, fn)
+		walk(e.RHS, fn)
+	}
+}
+
+// eval evaluates e at timestamp t in milliseconds.
+func (ev *evaluator) eval(e Expr, t int64) (Value, error) {
+	switch e := e.(type) {
+	case *NumberLiteral:
+		return Scalar{T: t, V: e.Val}, nil
+
+	case *StringLiteral:
+		return String{T: t, V: e.Val}, nil
+
+	case *ParenExpr:
+		return ev.eval(e.Expr, t)
+
+	case *UnaryExpr:
+		v, err := ev.eval(e.Expr, t)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case Scalar:
+			return Scalar{T: t, V: -v.V}, nil
+		case Vector:
+			out := make(Vector, len(v))
+			for i, s := range v {
+				out[i] = Sample{Metric: s.Metric.withoutName(), T: t, V: -s.V}
+			}
+			return out, nil
+		}
+		return nil, fmt.Errorf("unary minus on %s", v.Type())
+
+	case *VectorSelector:
+		return ev.vectorSelector(e, t), nil
+
+	case *MatrixSelector:
+		return ev.matrixSelector(e, t), nil
+
+	case *Call:
+		return ev.call(e, t)
+
+	case *AggregateExpr:
+		return ev.aggregate(e, t)
+
+	case *BinaryExpr:
+		return ev.binary(e, t)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", e)
+}
+
+// vectorSelector returns the latest sample of each series within the lookback window.
+func (ev *evaluator) vectorSelector(vs *VectorSelector, t int64) Vector {
+	ref := t - vs.Offset.Milliseconds()
+	minT := ref - DefaultLookbackDelta.Milliseconds()
+	var out Vector
+	for _, s := range ev.series[vs] {
+		// First point after ref
+		i := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > ref })
+		if i == 0 || s.Points[i-1].T <= minT {
+			continue
+		}
+		out = append(out, Sample{Metric: s.Metric, T: t, V: s.Points[i-1].V})
+	}
+	return out
+}
+
+// matrixSelector returns the points of each series in (t-range, t], shifted by offset.
+func (ev *evaluator) matrixSelector(ms *MatrixSelector, t int64) Matrix {
+	ref := t - ms.Vector.Offset.Milliseconds()
+	minT := ref - ms.Range.Milliseconds()
+	var out Matrix
+	for _, s := range ev.series[ms.Vector] {
+		lo := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > minT })
+		hi := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > ref })
+		if lo < hi {
+			out = append(out, Series{Metric: s.Metric, Points: s.Points[lo:hi]})
+		}
+	}
+	return out
+}
+
+// Key returns a canonical encoding of the label set.
+func (l Labels) Key() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(0xff)
+		b.WriteString(l[name])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+func (l Labels) withoutName() Labels {
+	if _, ok := l[MetricNameLabel]; !ok {
+		return l
+	}
+	out := make(Labels, len(l))
+	for k, v := range l {
+		if k != MetricNameLabel {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// subset returns the labels in names (include) or not in names (exclude).
+func (l Labels) subset(names []string, include bool) Labels {
+	in := make(map[string]bool, len(names))
+	for _, n := range names {
+		in[n] = true
+	}
+	out := make(Labels)
+	for k, v := range l {
+		if in[k] == include {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// aggregate evaluates an aggregation expression.
+func (ev *evaluator) aggregate(e *AggregateExpr, t int64) (Value, error) {
+	v, err := ev.eval(e.Expr, t)
+	if err != nil {
+		return nil, err
+	}
+	vec := v.(Vector)
+
+	var param float64
+	if e.Param != nil {
+		p, err := ev.eval(e.Param, t)
+		if err != nil {
+			return nil, err
+		}
+		param = p.(Scalar).V
+	}
+
+	type group struct {
+		labels  Labels
+		samples Vector
+	}
+	groups := make(map[string]*group)
+	var order []string
+	for _, s := range vec {
+		var labels Labels
+		if e.Without {
+			labels = s.Metric.subset(append([]string{MetricNameLabel}, e.Grouping...), false)
+		} else {
+			labels = s.Metric.subset(e.Grouping, true)
+		}
+		key := labels.Key()
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.samples = append(g.samples, s)
+	}
+
+	var out Vector
+	for _, key := range order {
+		g := groups[key]
+		switch e.Op {
+		case "topk", "bottomk":
+			k := int(param)
+			samples := append(Vector(nil), g.samples...)
+			sort.SliceStable(samples, func(i, j int) bool {
+				if e.Op == "topk" {
+					return samples[i].V > samples[j].V || math.IsNaN(samples[j].V) && !math.IsNaN(samples[i].V)
+				}
+				return samples[i].V < samples[j].V || math.IsNaN(samples[j].V) && !math.IsNaN(samples[i].V)
+			})
+			if k < len(samples) {
+				samples = samples[:max(k, 0)]
+			}
+			for _, s := range samples {
+				out = append(out, Sample{Metric: s.Metric, T: t, V: s.V})
+			}
+			continue
+		}
+
+		values := make([]float64, len(g.samples))
+		for i, s := range g.samples {
+			values[i] = s.V
+		}
+		var value float64
+		switch e.Op {
+		case "sum":
+			value = sum(values)
+		case "avg":
+			value = sum(values) / float64(len(values))
+		case "min":
+			value = math.NaN()
+			for _, v := range values {
+				if math.IsNaN(value) || v < value {
+					value = v
+				}
+			}
+		case "max":
+			value = math.NaN()
+			for _, v := range values {
+				if math.IsNaN(value) || v > value {
+					value = v
+				}
+			}
+		case "count":
+			value = float64(len(values))
+		case "group":
+			value = 1
+		case "stddev":
+			value = math.Sqrt(variance(values))
+		case "stdvar":
+			value = variance(values)
+		case "quantile":
+			value = quantile(param, values)
+		default:
+			return nil, fmt.Errorf("unsupported aggregation %q", e.Op)
+		}
+		out = append(out, Sample{Metric: g.labels, T: t, V: value})
+	}
+	return out, nil
+}
+
+func sum(values []float64) float64 {
+	var s float64
+	for _, v := range values {
+		s += v
+	}
+	return s
+}
+
+func variance(values []float64) float64 {
+	mean := sum(values) / float64(len(values))
+	var sq float64
+	for _, v := range values {
+		sq += (v - mean) * (v - mean)
+	}
+	return sq / float64(len(values))
+}
+
+// quantile interpolates the q-quantile of values like Prometheus' quantile().
+func quantile(q float64, values []float64) float64 {
+	if len(values) == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(1)
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := q * float64(len(sorted)-1)
+	lower := math.Max(0, math.Floor(rank))
+	upper := math.Min(float64(len(sorted)-1), lower+1)
+	weight := rank - math.Floor(rank)
+	return sorted[int(lower)]*(1-weight) + sorted[int(upper)]*weight
+}
+
+// binary evaluates a binary operation.
+func (ev *evaluator) binary(e *BinaryExpr, t int64) (Value, error) {
+	lhs, err := ev.eval(e.LHS, t)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(e.RHS, t)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			v, keep := applyOp(e.Op, l.V, r.V)
+			if isComparison(e.Op) {
+				v = boolValue(keep)
+			}
+			return Scalar{T: t, V: v}, nil
+		case Vector:
+			return vectorScalar(e, r, l.V, true, t), nil
+		}
+	case Vector:
+		switch r := rhs.(type) {
+		case Scalar:
+			return vectorScalar(e, l, r.V, false, t), nil
+		case Vector:
+			return vectorVector(e, l, r, t)
+		}
+	}
+	return nil, fmt.Errorf("invalid operands for %s: %s and %s", e.Op, lhs.Type(), rhs.Type())
+}
+
+// applyOp returns the result of an arithmetic operator, or the left value and
+// whether a comparison holds.
+func applyOp(op string, l, r float64) (float64, bool) {
+	switch op {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		return l / r, true
+	case "%":
+		return math.Mod(l, r), true
+	case "^":
+		return math.Pow(l, r), true
+	case "atan2":
+		return math.Atan2(l, r), true
+	case "==":
+		return l, l == r
+	case "!=":
+		return l, l != r
+	case ">":
+		return l, l > r
+	case "<":
+		return l, l < r
+	case ">=":
+		return l, l >= r
+	case "<=":
+		return l, l <= r
+	}
+	return math.NaN(), false
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// vectorScalar applies an operator between each sample and a scalar.
+// scalarLeft is set when the scalar is the left operand.
+func vectorScalar(e *BinaryExpr, vec Vector, scalar float64, scalarLeft bool, t int64) Vector {
+	var out Vector
+	for _, s := range vec {
+		l, r := s.V, scalar
+		if scalarLeft {
+			l, r = r, l
+		}
+		v, keep := applyOp(e.Op, l, r)
+		metric := s.Metric
+		if isComparison(e.Op) {
+			if e.ReturnBool {
+				v, keep = boolValue(keep), true
+				metric = metric.withoutName()
+			} else {
+				// Filters keep the sample value
+				v = s.V
+			}
+		} else {
+			metric = metric.withoutName()
+		}
+		if keep {
+			out = append(out, Sample{Metric: metric, T: t, V: v})
+		}
+	}
+	return out
+}
+
+// signature returns the matching key of a sample's labels.
+func signature(m *VectorMatching, l Labels) string {
+	if m.On {
+		return l.subset(m.Labels, true).Key()
+	}
+	return l.subset(append([]string{MetricNameLabel}, m.Labels...), false).Key()
+}
+
+// vectorVector applies an operator between matching samples of two vectors.
+func vectorVector(e *BinaryExpr, lhs, rhs Vector, t int64) (Vector, error) {
+	m := e.Matching
+	if m == nil {
+		m = &VectorMatching{Card: CardOneToOne}
+	}
+
+	switch e.Op {
+	case "and", "unless":
+		rsigs := make(map[string]bool, len(rhs))
+		for _, s := range rhs {
+			rsigs[signature(m, s.Metric)] = true
+		}
+		var out Vector
+		for _, s := range lhs {
+			if rsigs[signature(m, s.Metric)] == (e.Op == "and") {
+				out = append(out, Sample{Metric: s.Metric, T: t, V: s.V})
+			}
+		}
+		return out, nil
+	case "or":
+		lsigs := make(map[string]bool, len(lhs))
+		out := make(Vector, 0, len(lhs)+len(rhs))
+		for _, s := range lhs {
+			lsigs[signature(m, s.Metric)] = true
+			out = append(out, Sample{Metric: s.Metric, T: t, V: s.V})
+		}
+		for _, s := range rhs {
+			if !lsigs[signature(m, s.Metric)] {
+				out = append(out, Sample{Metric: s.Metric, T: t, V: s.V})
+			}
+		}
+		return out, nil
+	}
+
+	// The "one" side must have unique signatures; for one-to-one both sides
+	many, one := lhs, rhs
+	if m.Card == CardOneToMany {
+		many, one = rhs, lhs
+	}
+	oneBySig := make(map[string]Sample, len(one))
+	for _, s := range one {
+		sig := signature(m, s.Metric)
+		if _, dup := oneBySig[sig]; dup {
+			side := "right"
+			if m.Card == CardOneToMany {
+				side = "left"
+			}
+			return nil, execErrorf("found duplicate series for the match group on the %s hand-side of the operation; many-to-many matching not allowed: matching labels must be unique on one side", side)
+		}
+		oneBySig[sig] = s
+	}
+
+	var out Vector
+	matchedMany := make(map[string]bool)
+	for _, ms := range many {
+		sig := signature(m, ms.Metric)
+		os, ok := oneBySig[sig]
+		if !ok {
+			continue
+		}
+		if m.Card == CardOneToOne {
+			if matchedMany[sig] {
+				return nil, execErrorf("multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
+			}
+			matchedMany[sig] = true
+		}
+
+		l, r := ms, os
+		if m.Card == CardOneToMany {
+			l, r = os, ms
+		}
+		v, keep := applyOp(e.Op, l.V, r.V)
+		if isComparison(e.Op) {
+			if e.ReturnBool {
+				v, keep = boolValue(keep), true
+			} else {
+				v = l.V
+			}
+		}
+		if !keep {
+			continue
+		}
+		out = append(out, Sample{Metric: resultMetric(e, m, ms.Metric, os.Metric), T: t, V: v})
+	}
+	return out, nil
+}
+
+// resultMetric returns the labels of a vector operation result; manyLabels
+// belong to the left side for one-to-one matching.
+func resultMetric(e *BinaryExpr, m *VectorMatching, manyLabels, oneLabels Labels) Labels {
+	out := make(Labels, len(manyLabels))
+	for k, v := range manyLabels {
+		out[k] = v
+	}
+	if !isComparison(e.Op) || e.ReturnBool {
+		delete(out, MetricNameLabel)
+	}
+	if m.Card == CardOneToOne {
+		if m.On {
+			out = out.subset(m.Labels, true)
+		} else {
+			out = out.subset(m.Labels, false)
+		}
+		return out
+	}
+	for _, name := range m.Include {
+		if v := oneLabels[name]; v != "" {
+			out[name] = v
+		} else {
+			delete(out, name)
+		}
+	}
+	return out
+}
@@ -0,0 +1,605 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// function describes a PromQL function's signature and implementation.
+type function struct {
+	args       []ValueType
+	optional   int // Trailing arguments that may be omitted
+	returns    ValueType
+	keepName   bool // The result keeps __name__
+	rangeFunc  func(points []Point, rangeStart, rangeEnd int64) (float64, bool)
+	vectorFunc func(v float64, args []float64) float64
+	call       func(ev *evaluator, e *Call, t int64) (Value, error)
+}
+
+var functions map[string]*function
+
+func init() {
+	math1 := func(f func(float64) float64) *function {
+		return &function{
+			args:       []ValueType{ValueTypeVector},
+			returns:    ValueTypeVector,
+			vectorFunc: func(v float64, _ []float64) float64 { return f(v) },
+		}
+	}
+	overTime := func(f func(points []Point) float64) *function {
+		return &function{
+			args:      []ValueType{ValueTypeMatrix},
+			returns:   ValueTypeVector,
+			rangeFunc: func(points []Point, _, _ int64) (float64, bool) { return f(points), true },
+		}
+	}
+	values := func(points []Point) []float64 {
+		out := make([]float64, len(points))
+		for i, p := range points {
+			out[i] = p.V
+		}
+		return out
+	}
+	rate := func(isCounter, isRate bool) *function {
+		return &function{
+			args:    []ValueType{ValueTypeMatrix},
+			returns: ValueTypeVector,
+			rangeFunc: func(points []Point, rangeStart, rangeEnd int64) (float64, bool) {
+				return extrapolatedRate(points, rangeStart, rangeEnd, isCounter, isRate)
+			},
+		}
+	}
+	instant := func(isRate bool) *function {
+		return &function{
+			args:    []ValueType{ValueTypeMatrix},
+			returns: ValueTypeVector,
+			rangeFunc: func(points []Point, _, _ int64) (float64, bool) {
+				return instantValue(points, isRate)
+			},
+		}
+	}
+
+	functions = map[string]*function{
+		"rate":     rate(true, true),
+		"increase": rate(true, false),
+		"delta":    rate(false, false),
+		"irate":    instant(true),
+		"idelta":   instant(false),
+
+		"avg_over_time":   overTime(func(p []Point) float64 { return sum(values(p)) / float64(len(p)) }),
+		"sum_over_time":   overTime(func(p []Point) float64 { return sum(values(p)) }),
+		"count_over_time": overTime(func(p []Point) float64 { return float64(len(p)) }),
+		"min_over_time": overTime(func(p []Point) float64 {
+			m := p[0].V
+			for _, x := range p[1:] {
+				if x.V < m || math.IsNaN(m) {
+					m = x.V
+				}
+			}
+			return m
+		}),
+		"max_over_time": overTime(func(p []Point) float64 {
+			m := p[0].V
+			for _, x := range p[1:] {
+				if x.V > m || math.IsNaN(m) {
+					m = x.V
+				}
+			}
+			return m
+		}),
+		"last_over_time":    overTime(func(p []Point) float64 { return p[len(p)-1].V }),
+		"present_over_time": overTime(func([]Point) float64 { return 1 }),
+		"stddev_over_time":  overTime(func(p []Point) float64 { return math.Sqrt(variance(values(p))) }),
+		"changes": overTime(func(p []Point) float64 {
+			n := 0
+			for i := 1; i < len(p); i++ {
+				if p[i].V != p[i-1].V {
+					n++
+				}
+			}
+			return float64(n)
+		}),
+		"resets": overTime(func(p []Point) float64 {
+			n := 0
+			for i := 1; i < len(p); i++ {
+				if p[i].V < p[i-1].V {
+					n++
+				}
+			}
+			return float64(n)
+		}),
+
+		"abs":   math1(math.Abs),
+		"ceil":  math1(math.Ceil),
+		"floor": math1(math.Floor),
+		"exp":   math1(math.Exp),
+		"ln":    math1(math.Log),
+		"log2":  math1(math.Log2),
+		"log10": math1(math.Log10),
+		"sqrt":  math1(math.Sqrt),
+		"round": {
+			args:     []ValueType{ValueTypeVector, ValueTypeScalar},
+			optional: 1,
+			returns:  ValueTypeVector,
+			vectorFunc: func(v float64, args []float64) float64 {
+				toNearest := 1.0
+				if len(args) > 0 {
+					toNearest = args[0]
+				}
+				return math.Floor(v/toNearest+0.5) * toNearest
+			},
+		},
+		"clamp": {
+			args:    []ValueType{ValueTypeVector, ValueTypeScalar, ValueTypeScalar},
+			returns: ValueTypeVector,
+			vectorFunc: func(v float64, args []float64) float64 {
+				return math.Max(args[0], math.Min(args[1], v))
+			},
+		},
+		"clamp_min": {
+			args:       []ValueType{ValueTypeVector, ValueTypeScalar},
+			returns:    ValueTypeVector,
+			vectorFunc: func(v float64, args []float64) float64 { return math.Max(args[0], v) },
+		},
+		"clamp_max": {
+			args:       []ValueType{ValueTypeVector, ValueTypeScalar},
+			returns:    ValueTypeVector,
+			vectorFunc: func(v float64, args []float64) float64 { return math.Min(args[0], v) },
+		},
+
+		"histogram_quantile": {
+			args:    []ValueType{ValueTypeScalar, ValueTypeVector},
+			returns: ValueTypeVector,
+			call:    callHistogramQuantile,
+		},
+		"time": {
+			returns: ValueTypeScalar,
+			call: func(_ *evaluator, _ *Call, t int64) (Value, error) {
+				return Scalar{T: t, V: float64(t) / 1000}, nil
+			},
+		},
+		"vector": {
+			args:    []ValueType{ValueTypeScalar},
+			returns: ValueTypeVector,
+			call: func(ev *evaluator, e *Call, t int64) (Value, error) {
+				v, err := ev.eval(e.Args[0], t)
+				if err != nil {
+					return nil, err
+				}
+				return Vector{{Metric: Labels{}, T: t, V: v.(Scalar).V}}, nil
+			},
+		},
+		"scalar": {
+			args:    []ValueType{ValueTypeVector},
+			returns: ValueTypeScalar,
+			call: func(ev *evaluator, e *Call, t int64) (Value, error) {
+				v, err := ev.eval(e.Args[0], t)
+				if err != nil {
+					return nil, err
+				}
+				if vec := v.(Vector); len(vec) == 1 {
+					return Scalar{T: t, V: vec[0].V}, nil
+				}
+				return Scalar{T: t, V: math.NaN()}, nil
+			},
+		},
+		"absent": {
+			args:    []ValueType{ValueTypeVector},
+			returns: ValueTypeVector,
+			call:    callAbsent,
+		},
+		"sort": {
+			args:     []ValueType{ValueTypeVector},
+			returns:  ValueTypeVector,
+			keepName: true,
+			call:     callSort(false),
+		},
+		"sort_desc": {
+			args:     []ValueType{ValueTypeVector},
+			returns:  ValueTypeVector,
+			keepName: true,
+			call:     callSort(true),
+		},
+		"label_replace": {
+			args:     []ValueType{ValueTypeVector, ValueTypeString, ValueTypeString, ValueTypeString, ValueTypeString},
+			returns:  ValueTypeVector,
+			keepName: true,
+			call:     callLabelReplace,
+		},
+	}
+	functions["last_over_time"].keepName = true
+}
+
+// call evaluates a function call.
+func (ev *evaluator) call(e *Call, t int64) (Value, error) {
+	f := functions[e.Func]
+	switch {
+	case f.call != nil:
+		return f.call(ev, e, t)
+
+	case f.rangeFunc != nil:
+		ms := unwrapParens(e.Args[0]).(*MatrixSelector)
+		rangeEnd := t - ms.Vector.Offset.Milliseconds()
+		rangeStart := rangeEnd - ms.Range.Milliseconds()
+		var out Vector
+		for _, s := range ev.matrixSelector(ms, t) {
+			v, ok := f.rangeFunc(s.Points, rangeStart, rangeEnd)
+			if !ok {
+				continue
+			}
+			metric := s.Metric
+			if !f.keepName {
+				metric = metric.withoutName()
+			}
+			out = append(out, Sample{Metric: metric, T: t, V: v})
+		}
+		return out, nil
+	}
+
+	v, err := ev.eval(e.Args[0], t)
+	if err != nil {
+		return nil, err
+	}
+	var args []float64
+	for _, arg := range e.Args[1:] {
+		a, err := ev.eval(arg, t)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a.(Scalar).V)
+	}
+	vec := v.(Vector)
+	out := make(Vector, len(vec))
+	for i, s := range vec {
+		out[i] = Sample{Metric: s.Metric.withoutName(), T: t, V: f.vectorFunc(s.V, args)}
+	}
+	return out, nil
+}
+
+// extrapolatedRate implements rate, increase and delta like Prometheus:
+// the change over the samples is extrapolated towards the range boundaries.
+func extrapolatedRate(points []Point, rangeStart, rangeEnd int64, isCounter, isRate bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	first, last := points[0], points[len(points)-1]
+	result := last.V - first.V
+	if isCounter {
+		// Counter resets restart from zero
+		prev := first.V
+		for _, p := range points[1:] {
+			if p.V < prev {
+				result += prev
+			}
+			prev = p.V
+		}
+	}
+
+	durationToStart := float64(first.T-rangeStart) / 1000
+	durationToEnd := float64(rangeEnd-last.T) / 1000
+	sampledInterval := float64(last.T-first.T) / 1000
+	averageInterval := sampledInterval / float64(len(points)-1)
+	threshold := averageInterval * 1.1
+
+	if durationToStart >= threshold {
+		durationToStart = averageInterval / 2
+	}
+	if isCounter && result > 0 && first.V >= 0 {
+		// Counters cannot be extrapolated below zero
+		if durationToZero := sampledInterval * (first.V / result); durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+	if durationToEnd >= threshold {
+		durationToEnd = averageInterval / 2
+	}
+
+	result *= (sampledInterval + durationToStart + durationToEnd) / sampledInterval
+	if isRate {
+		result /= float64(rangeEnd-rangeStart) / 1000
+	}
+	return result, true
+}
+
+// instantValue implements irate and idelta from the last two samples.
+func instantValue(points []Point, isRate bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	prev, last := points[len(points)-2], points[len(points)-1]
+	result := last.V - prev.V
+	if !isRate {
+		return result, true
+	}
+	if last.V < prev.V {
+		// Counter reset
+		result = last.V
+	}
+	interval := float64(last.T-prev.T) / 1000
+	if interval == 0 {
+		return 0, false
+	}
+	return result / interval, true
+}
+
+// callHistogramQuantile computes quantiles from cumulative "le" bucket series.
+func callHistogramQuantile(ev *evaluator, e *Call, t int64) (Value, error) {
+	qv, err := ev.eval(e.Args[0], t)
+	if err != nil {
+		return nil, err
+	}
+	v, err := ev.eval(e.Args[1], t)
+	if err != nil {
+		return nil, err
+	}
+	q := qv.(Scalar).V
+
+	type histogram struct {
+		labels  Labels
+		buckets []bucket
+	}
+	histograms := make(map[string]*histogram)
+	var order []string
+	for _, s := range v.(Vector) {
+		le, err := strconv.ParseFloat(s.Metric["le"], 64)
+		if err != nil {
+			// Series without a valid le label are ignored
+			continue
+		}
+		labels := s.Metric.subset([]string{MetricNameLabel, "le"}, false)
+		key := labels.Key()
+		h, ok := histograms[key]
+		if !ok {
+			h = &histogram{labels: labels}
+			histograms[key] = h
+			order = append(order, key)
+		}
+		h.buckets = append(h.buckets, bucket{upperBound: le, count: s.V})
+	}
+
+	out := make(Vector, 0, len(order))
+	for _, key := range order {
+		h := histograms[key]
+		out = append(out, Sample{Metric: h.labels, T: t, V: bucketQuantile(q, h.buckets)})
+	}
+	return out, nil
+}
+
+type bucket struct {
+	upperBound float64
+	count      float64 // Cumulative
+}
+
+// bucketQuantile interpolates linearly within the bucket holding the quantile,
+// following Prometheus' histogram_quantile.
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	if math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(1)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		return math.NaN()
+	}
+
+	// Merge duplicate bounds and repair non-monotonic counts
+	merged := buckets[:1]
+	for _, b := range buckets[1:] {
+		if b.upperBound == merged[len(merged)-1].upperBound {
+			merged[len(merged)-1].count += b.count
+			continue
+		}
+		merged = append(merged, b)
+	}
+	buckets = merged
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+
+	total := buckets[len(buckets)-1].count
+	if total == 0 {
+		return math.NaN()
+	}
+	rank := q * total
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+
+	var start, count float64
+	end := buckets[b].upperBound
+	if b > 0 {
+		start = buckets[b-1].upperBound
+		count = buckets[b].count - buckets[b-1].count
+		rank -= buckets[b-1].count
+	} else {
+		count = buckets[0].count
+	}
+	return start + (end-start)*(rank/count)
+}
+
+// callAbsent returns a 1-valued sample if the vector is empty, labeled from
+// the equality matchers of a selector argument.
+func callAbsent(ev *evaluator, e *Call, t int64) (Value, error) {
+	v, err := ev.eval(e.Args[0], t)
+	if err != nil {
+		return nil, err
+	}
+	if len(v.(Vector)) > 0 {
+		return Vector{}, nil
+	}
+	labels := Labels{}
+	if vs, ok := unwrapParens(e.Args[0]).(*VectorSelector); ok {
+		for _, m := range vs.Matchers {
+			if m.Type == MatchEqual && m.Name != MetricNameLabel {
+				labels[m.Name] = m.Value
+			}
+		}
+	}
+	return Vector{{Metric: labels, T: t, V: 1}}, nil
+}
+
+func callSort(desc bool) func(*evaluator, *Call, int64) (Value, error) {
+	return func(ev *evaluator, e *Call, t int64) (Value, error) {
+		v, err := ev.eval(e.Args[0], t)
+		if err != nil {
+			return nil, err
+		}
+		vec := append(Vector(nil), v.(Vector)...)
+		sort.SliceStable(vec, func(i, j int) bool {
+			if desc {
+				return vec[i].V > vec[j].V
+			}
+			return vec[i].V < vec[j].V
+		})
+		return vec, nil
+	}
+}
+
+// callLabelReplace implements label_replace(v, dst, replacement, src, regex).
+func callLabelReplace(ev *evaluator, e *Call, t int64) (Value, error) {
+	v, err := ev.eval(e.Args[0], t)
+	if err != nil {
+		return nil, err
+	}
+	var strs [4]string
+	for i := range strs {
+		s, err := ev.eval(e.Args[i+1], t)
+		if err != nil {
+			return nil, err
+		}
+		strs[i] = s.(String).V
+	}
+	dst, repl, src, pattern := strs[0], strs[1], strs[2], strs[3]
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, execErrorf("invalid regular expression in label_replace(): %s", pattern)
+	}
+
+	vec := v.(Vector)
+	out := make(Vector, len(vec))
+	for i, s := range vec {
+		metric := s.Metric
+		if idx := re.FindStringSubmatchIndex(s.Metric[src]); idx != nil {
+			value := string(re.ExpandString(nil, repl, s.Metric[src], idx))
+			metric = make(Labels, len(s.Metric)+1)
+			for k, v := range s.Metric {
+				metric[k] = v
+			}
+			if value == "" {
+				delete(metric, dst)
+			} else {
+				metric[dst] = value
+			}
+		}
+		out[i] = Sample{Metric: metric, T: t, V: s.V}
+	}
+	return out, nil
+}
+
+func unwrapParens(e Expr) Expr {
+	for {
+		p, ok := e.(*ParenExpr)
+		if !ok {
+			return e
+		}
+		e = p.Expr
+	}
+}
+
+// typeOf returns the result type of an expression that passed check.
+func typeOf(e Expr) ValueType {
+	switch e := e.(type) {
+	case *NumberLiteral:
+		return ValueTypeScalar
+	case *StringLiteral:
+		return ValueTypeString
+	case *ParenExpr:
+		return typeOf(e.Expr)
+	case *UnaryExpr:
+		return typeOf(e.Expr)
+	case *VectorSelector, *AggregateExpr:
+		return ValueTypeVector
+	case *MatrixSelector:
+		return ValueTypeMatrix
+	case *Call:
+		return functions[e.Func].returns
+	case *BinaryExpr:
+		if typeOf(e.LHS) == ValueTypeScalar && typeOf(e.RHS) == ValueTypeScalar {
+			return ValueTypeScalar
+		}
+		return ValueTypeVector
+	}
+	return ""
+}
+
+// check validates operand and argument types.
+func check(e Expr) error {
+	var err error
+	walk(e, func(e Expr) bool {
+		if err == nil {
+			err = checkNode(e)
+		}
+		return err == nil
+	})
+	return err
+}
+
+func checkNode(e Expr) error {
+	switch e := e.(type) {
+	case *UnaryExpr:
+		if t := typeOf(e.Expr); t != ValueTypeScalar && t != ValueTypeVector {
+			return fmt.Errorf("unary expression only allowed on expressions of type scalar or instant vector, got %q", t)
+		}
+
+	case *Call:
+		f := functions[e.Func]
+		if len(e.Args) < len(f.args)-f.optional || len(e.Args) > len(f.args) {
+			return fmt.Errorf("expected %d argument(s) in call to %q, got %d", len(f.args), e.Func, len(e.Args))
+		}
+		for i, arg := range e.Args {
+			if t := typeOf(arg); t != f.args[i] {
+				return fmt.Errorf("expected type %s in call to function %q, got %s", f.args[i], e.Func, t)
+			}
+		}
+
+	case *AggregateExpr:
+		if t := typeOf(e.Expr); t != ValueTypeVector {
+			return fmt.Errorf("expected type instant vector in aggregation expression, got %s", t)
+		}
+		if e.Param != nil && typeOf(e.Param) != ValueTypeScalar {
+			return fmt.Errorf("expected type scalar in aggregation parameter, got %s", typeOf(e.Param))
+		}
+
+	case *BinaryExpr:
+		lt, rt := typeOf(e.LHS), typeOf(e.RHS)
+		for _, t := range []ValueType{lt, rt} {
+			if t != ValueTypeScalar && t != ValueTypeVector {
+				return fmt.Errorf("binary expression must contain only scalar and instant vector types")
+			}
+		}
+		if isSetOperator(e.Op) && (lt != ValueTypeVector || rt != ValueTypeVector) {
+			return fmt.Errorf("set operator %q not allowed in binary scalar expression", e.Op)
+		}
+		if isComparison(e.Op) && !e.ReturnBool && lt == ValueTypeScalar && rt == ValueTypeScalar {
+			return fmt.Errorf("comparisons between scalars must use BOOL modifier")
+		}
+		if e.Matching != nil && e.Matching.explicit && (lt != ValueTypeVector || rt != ValueTypeVector) {
+			return fmt.Errorf("vector matching only allowed between instant vectors")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokDuration
+	tokPunct // Brackets, operators and the comma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+
+	num float64       // tokNumber
+	dur time.Duration // tokDuration
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of input"
+	}
+	return strconv.Quote(t.text)
+}
+
+// Operators, longest first.
+var punctuation = []string{
+	"==", "!=", "=~", "!~", "<=", ">=",
+	"(", ")", "{", "}", "[", "]", ",", "=", "<", ">", "+", "-", "*", "/", "%", "^", ":", "@",
+}
+
+var durationUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+	'y': 365 * 24 * time.Hour,
+}
+
+// lex splits an expression into tokens.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '#':
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+
+		case c == '"' || c == '\'' || c == '`':
+			s, n, err := lexString(input[i:])
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %w", i, err)
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, pos: i})
+			i += n
+
+		case isDigit(c) || c == '.' && i+1 < len(input) && isDigit(input[i+1]):
+			tok, n, err := lexNumber(input[i:])
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %w", i, err)
+			}
+			tok.pos = i
+			tokens = append(tokens, tok)
+			i += n
+
+		case isIdentStart(c):
+			n := 1
+			for n < len(input[i:]) && (isIdentStart(input[i+n]) || isDigit(input[i+n]) || input[i+n] == ':') {
+				n++
+			}
+			text := input[i : i+n]
+			switch strings.ToLower(text) {
+			case "inf":
+				tokens = append(tokens, token{kind: tokNumber, text: text, pos: i, num: math.Inf(1)})
+			case "nan":
+				tokens = append(tokens, token{kind: tokNumber, text: text, pos: i, num: math.NaN()})
+			default:
+				tokens = append(tokens, token{kind: tokIdent, text: text, pos: i})
+			}
+			i += n
+
+		default:
+			matched := false
+			for _, p := range punctuation {
+				if strings.HasPrefix(input[i:], p) {
+					tokens = append(tokens, token{kind: tokPunct, text: p, pos: i})
+					i += len(p)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("at %d: unexpected character %q", i, c)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+// lexString reads a quoted string. Double and single quotes support Go
+// escapes, backticks are raw.
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	if quote == '`' {
+		end := strings.IndexByte(s[1:], '`')
+		if end < 0 {
+			return "", 0, fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], end + 2, nil
+	}
+
+	escaped := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == quote:
+			body := s[1:i]
+			if quote == '\'' {
+				// Unquote expects double quotes
+				body = strings.ReplaceAll(strings.ReplaceAll(body, `\'`, `'`), `"`, `\"`)
+			}
+			v, err := strconv.Unquote(`"` + body + `"`)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string %s", s[:i+1])
+			}
+			return v, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// lexNumber reads a number or a duration such as 5m or 1h30m.
+func lexNumber(s string) (token, int, error) {
+	n := 0
+	for n < len(s) && (isDigit(s[n]) || s[n] == '.') {
+		n++
+	}
+	// Durations are integers with units, possibly several
+	if n < len(s) && durationUnits[s[n]] != 0 && !strings.Contains(s[:n], ".") {
+		return lexDuration(s)
+	}
+	if n < len(s) && (s[n] == 'e' || s[n] == 'E') {
+		n++
+		if n < len(s) && (s[n] == '+' || s[n] == '-') {
+			n++
+		}
+		for n < len(s) && isDigit(s[n]) {
+			n++
+		}
+	}
+	if n == 1 && s[0] == '0' && len(s) > 1 && (s[1] == 'x' || s[1] == 'X') {
+		n = 2
+		for n < len(s) && strings.IndexByte("0123456789abcdefABCDEF", s[n]) >= 0 {
+			n++
+		}
+		v, err := strconv.ParseInt(s[2:n], 16, 64)
+		if err != nil {
+			return token{}, 0, fmt.Errorf("invalid number %q", s[:n])
+		}
+		return token{kind: tokNumber, text: s[:n], num: float64(v)}, n, nil
+	}
+	v, err := strconv.ParseFloat(s[:n], 64)
+	if err != nil {
+		return token{}, 0, fmt.Errorf("invalid number %q", s[:n])
+	}
+	return token{kind: tokNumber, text: s[:n], num: v}, n, nil
+}
+
+func lexDuration(s string) (token, int, error) {
+	var total time.Duration
+	n := 0
+	for n < len(s) && isDigit(s[n]) {
+		start := n
+		for n < len(s) && isDigit(s[n]) {
+			n++
+		}
+		v, err := strconv.ParseInt(s[start:n], 10, 64)
+		if err != nil || n == len(s) {
+			return token{}, 0, fmt.Errorf("invalid duration %q", s[:n])
+		}
+		unit := durationUnits[s[n]]
+		if strings.HasPrefix(s[n:], "ms") {
+			unit = time.Millisecond
+			n++
+		}
+		if unit == 0 {
+			return token{}, 0, fmt.Errorf("invalid duration %q", s[:n+1])
+		}
+		n++
+		total += time.Duration(v) * unit
+	}
+	if n < len(s) && (isIdentStart(s[n]) || s[n] == '.') {
+		return token{}, 0, fmt.Errorf("invalid duration %q", s[:n+1])
+	}
+	return token{kind: tokDuration, text: s[:n], dur: total}, n, nil
+}
+
+// ParseDuration parses a PromQL duration such as 30s or 1h30m, or a number of seconds.
+func ParseDuration(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	if s == "" || !isDigit(s[0]) {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	tok, n, err := lexDuration(s)
+	if err != nil || n != len(s) {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return tok.dur, nil
+}
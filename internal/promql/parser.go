@@ -0,0 +1,613 @@
+// Package promql parses and evaluates PromQL expressions.
+//
+// The supported language covers vector and range selectors with offset,
+// arithmetic, comparison and set operators with vector matching
+// (on/ignoring, group_left/group_right), aggregations with by/without and the
+// commonly used functions listed in functions.go. Subqueries and the @
+// modifier are not supported.
+package promql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Expr is a parsed PromQL expression.
+type Expr interface {
+	expr()
+}
+
+// NumberLiteral is a float constant.
+type NumberLiteral struct {
+	Val float64
+}
+
+// StringLiteral is a string constant, used as a function argument.
+type StringLiteral struct {
+	Val string
+}
+
+// ParenExpr is an expression in parentheses.
+type ParenExpr struct {
+	Expr Expr
+}
+
+// UnaryExpr is a negated expression.
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+}
+
+// VectorSelector selects the latest sample of each matching series.
+type VectorSelector struct {
+	Matchers []*Matcher // Includes the __name__ matcher
+	Offset   time.Duration
+}
+
+// MatrixSelector selects the samples of each matching series within Range.
+type MatrixSelector struct {
+	Vector *VectorSelector
+	Range  time.Duration
+}
+
+// Call is a function call.
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+// AggregateExpr aggregates a vector, grouping by or without labels.
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr // topk, bottomk and quantile
+	Grouping []string
+	Without  bool
+}
+
+// BinaryExpr applies an operator to two expressions.
+type BinaryExpr struct {
+	Op         string
+	LHS, RHS   Expr
+	ReturnBool bool
+	Matching   *VectorMatching // Nil unless both sides are vectors
+}
+
+// VectorMatching describes how samples of two vectors are paired.
+type VectorMatching struct {
+	On       bool     // Match on Labels only, otherwise ignore Labels
+	Labels   []string // on(...) or ignoring(...)
+	Card     string   // "one-to-one", "many-to-one" (group_left) or "one-to-many" (group_right)
+	Include  []string // Extra labels copied from the "one" side
+	explicit bool
+}
+
+func (*NumberLiteral) expr()  {}
+func (*StringLiteral) expr()  {}
+func (*ParenExpr) expr()      {}
+func (*UnaryExpr) expr()      {}
+func (*VectorSelector) expr() {}
+func (*MatrixSelector) expr() {}
+func (*Call) expr()           {}
+func (*AggregateExpr) expr()  {}
+func (*BinaryExpr) expr()     {}
+
+// Vector matching cardinalities.
+const (
+	CardOneToOne  = "one-to-one"
+	CardManyToOne = "many-to-one"
+	CardOneToMany = "one-to-many"
+)
+
+// MatchType is a label matcher operator.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// MetricNameLabel is the label holding the metric name.
+const MetricNameLabel = "__name__"
+
+// Matcher matches a label value. A missing label matches as the empty string.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewMatcher creates a matcher; regular expressions are fully anchored.
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: t, Name: name, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", value, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches reports whether the label value matches.
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	}
+	return !m.re.MatchString(v)
+}
+
+var aggregateOps = map[string]bool{
+	"sum": true, "avg": true, "min": true, "max": true, "count": true, "group": true,
+	"stddev": true, "stdvar": true, "topk": true, "bottomk": true, "quantile": true,
+}
+
+// Binary operator precedence, higher binds tighter.
+var binaryPrecedence = map[string]int{
+	"or":     1,
+	"and":    2,
+	"unless": 2,
+	"==":     3, "!=": 3, "<=": 3, "<": 3, ">=": 3, ">": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5, "atan2": 5,
+	"^": 6,
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<=", "<", ">=", ">":
+		return true
+	}
+	return false
+}
+
+func isSetOperator(op string) bool {
+	return op == "and" || op == "or" || op == "unless"
+}
+
+// ParseExpr parses a PromQL expression.
+func ParseExpr(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t)
+	}
+	if err := check(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ParseMetricSelector parses a series selector such as up{job="api"}, as used
+// by the match[] parameter.
+func ParseMetricSelector(input string) ([]*Matcher, error) {
+	e, err := ParseExpr(input)
+	if err != nil {
+		return nil, err
+	}
+	vs, ok := e.(*VectorSelector)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a series selector", input)
+	}
+	return vs.Matchers, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(punct string) bool {
+	if t := p.peek(); t.kind == tokPunct && t.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// acceptKeyword consumes an identifier case-insensitively.
+func (p *parser) acceptKeyword(kw string) bool {
+	if t := p.peek(); t.kind == tokIdent && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(punct string) error {
+	if !p.accept(punct) {
+		return fmt.Errorf("at %d: expected %q, got %s", p.peek().pos, punct, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) unexpected(t token) error {
+	return fmt.Errorf("at %d: unexpected %s", t.pos, t)
+}
+
+// binaryOp returns the binary operator at the current position, if any.
+func (p *parser) binaryOp() string {
+	t := p.peek()
+	switch t.kind {
+	case tokPunct:
+		if _, ok := binaryPrecedence[t.text]; ok {
+			return t.text
+		}
+	case tokIdent:
+		op := strings.ToLower(t.text)
+		if op == "and" || op == "or" || op == "unless" || op == "atan2" {
+			return op
+		}
+	}
+	return ""
+}
+
+// parseExpr parses binary operations binding tighter than minPrec.
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.binaryOp()
+		prec := binaryPrecedence[op]
+		if op == "" || prec <= minPrec {
+			return lhs, nil
+		}
+		p.next()
+
+		b := &BinaryExpr{Op: op}
+		if p.acceptKeyword("bool") {
+			if !isComparison(op) {
+				return nil, fmt.Errorf("bool modifier can only be used on comparison operators")
+			}
+			b.ReturnBool = true
+		}
+		if b.Matching, err = p.parseVectorMatching(op); err != nil {
+			return nil, err
+		}
+
+		// ^ is right-associative
+		nextPrec := prec
+		if op == "^" {
+			nextPrec = prec - 1
+		}
+		rhs, err := p.parseExpr(nextPrec)
+		if err != nil {
+			return nil, err
+		}
+		b.LHS, b.RHS = lhs, rhs
+		lhs = b
+	}
+}
+
+// parseVectorMatching parses on/ignoring and group_left/group_right.
+func (p *parser) parseVectorMatching(op string) (*VectorMatching, error) {
+	m := &VectorMatching{Card: CardOneToOne}
+	switch {
+	case p.acceptKeyword("on"):
+		m.On, m.explicit = true, true
+	case p.acceptKeyword("ignoring"):
+		m.explicit = true
+	default:
+		return m, nil
+	}
+	var err error
+	if m.Labels, err = p.parseLabelList(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.acceptKeyword("group_left"):
+		m.Card = CardManyToOne
+	case p.acceptKeyword("group_right"):
+		m.Card = CardOneToMany
+	default:
+		return m, nil
+	}
+	if isSetOperator(op) {
+		return nil, fmt.Errorf("no grouping allowed for %q operation", op)
+	}
+	if t := p.peek(); t.kind == tokPunct && t.text == "(" {
+		if m.Include, err = p.parseLabelList(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// parseLabelList parses "(" label ("," label)* ")".
+func (p *parser) parseLabelList() ([]string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for !p.accept(")") {
+		t := p.next()
+		if t.kind != tokIdent {
+			return nil, fmt.Errorf("at %d: expected label name, got %s", t.pos, t)
+		}
+		labels = append(labels, t.text)
+		if !p.accept(",") {
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return labels, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if t := p.peek(); t.kind == tokPunct && (t.text == "-" || t.text == "+") {
+		p.next()
+		// Unary operators bind looser than ^: -2^2 is -4
+		e, err := p.parseExpr(binaryPrecedence["*"])
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := e.(*NumberLiteral); ok {
+			if t.text == "-" {
+				n.Val = -n.Val
+			}
+			return n, nil
+		}
+		if t.text == "+" {
+			return e, nil
+		}
+		return &UnaryExpr{Op: "-", Expr: e}, nil
+	}
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return p.parsePostfix(e)
+}
+
+// parsePostfix parses range selectors and offset modifiers.
+func (p *parser) parsePostfix(e Expr) (Expr, error) {
+	for {
+		switch {
+		case p.accept("["):
+			vs, ok := e.(*VectorSelector)
+			if !ok {
+				return nil, fmt.Errorf("ranges are only allowed for vector selectors")
+			}
+			d, err := p.parseDuration()
+			if err != nil {
+				return nil, err
+			}
+			if p.accept(":") {
+				return nil, fmt.Errorf("subqueries are not supported")
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if d <= 0 {
+				return nil, fmt.Errorf("range must be positive")
+			}
+			e = &MatrixSelector{Vector: vs, Range: d}
+
+		case p.acceptKeyword("offset"):
+			neg := p.accept("-")
+			d, err := p.parseDuration()
+			if err != nil {
+				return nil, err
+			}
+			if neg {
+				d = -d
+			}
+			switch s := e.(type) {
+			case *VectorSelector:
+				s.Offset = d
+			case *MatrixSelector:
+				s.Vector.Offset = d
+			default:
+				return nil, fmt.Errorf("offset modifier must be preceded by a selector")
+			}
+
+		case p.accept("@"):
+			return nil, fmt.Errorf("the @ modifier is not supported")
+
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *parser) parseDuration() (time.Duration, error) {
+	t := p.next()
+	switch t.kind {
+	case tokDuration:
+		return t.dur, nil
+	case tokNumber:
+		return time.Duration(t.num * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf("at %d: expected duration, got %s", t.pos, t)
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &NumberLiteral{Val: t.num}, nil
+	case tokString:
+		return &StringLiteral{Val: t.text}, nil
+	case tokPunct:
+		switch t.text {
+		case "(":
+			e, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			return &ParenExpr{Expr: e}, p.expect(")")
+		case "{":
+			return p.parseSelector("")
+		}
+	case tokIdent:
+		name := t.text
+		next := p.peek()
+		isCall := next.kind == tokPunct && next.text == "("
+		if op := strings.ToLower(name); aggregateOps[op] &&
+			(isCall || next.kind == tokIdent && (strings.EqualFold(next.text, "by") || strings.EqualFold(next.text, "without"))) {
+			return p.parseAggregate(op)
+		}
+		if isCall {
+			return p.parseCall(name, t.pos)
+		}
+		if p.accept("{") {
+			return p.parseSelector(name)
+		}
+		m, _ := NewMatcher(MatchEqual, MetricNameLabel, name)
+		return &VectorSelector{Matchers: []*Matcher{m}}, nil
+	}
+	return nil, p.unexpected(t)
+}
+
+// parseSelector parses the label matchers after "{".
+func (p *parser) parseSelector(name string) (Expr, error) {
+	vs := &VectorSelector{}
+	if name != "" {
+		m, _ := NewMatcher(MatchEqual, MetricNameLabel, name)
+		vs.Matchers = append(vs.Matchers, m)
+	}
+	for !p.accept("}") {
+		label := p.next()
+		if label.kind != tokIdent {
+			return nil, fmt.Errorf("at %d: expected label name, got %s", label.pos, label)
+		}
+		op := p.next()
+		if op.kind != tokPunct || (op.text != "=" && op.text != "!=" && op.text != "=~" && op.text != "!~") {
+			return nil, fmt.Errorf("at %d: expected label matcher operator, got %s", op.pos, op)
+		}
+		value := p.next()
+		if value.kind != tokString {
+			return nil, fmt.Errorf("at %d: expected label value string, got %s", value.pos, value)
+		}
+		m, err := NewMatcher(MatchType(op.text), label.text, value.text)
+		if err != nil {
+			return nil, err
+		}
+		vs.Matchers = append(vs.Matchers, m)
+		if !p.accept(",") {
+			if err := p.expect("}"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	// Selectors must not match every series
+	for _, m := range vs.Matchers {
+		if !m.Matches("") {
+			return vs, nil
+		}
+	}
+	return nil, fmt.Errorf("vector selector must contain at least one non-empty matcher")
+}
+
+func (p *parser) parseCall(name string, pos int) (Expr, error) {
+	if _, ok := functions[name]; !ok {
+		return nil, fmt.Errorf("at %d: unknown function %q", pos, name)
+	}
+	args, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	}
+	return &Call{Func: name, Args: args}, nil
+}
+
+func (p *parser) parseArgs() ([]Expr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []Expr
+	for !p.accept(")") {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.accept(",") {
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return args, nil
+}
+
+// parseAggregate parses "op [by|without (...)] (args) [by|without (...)]".
+func (p *parser) parseAggregate(op string) (Expr, error) {
+	agg := &AggregateExpr{Op: op}
+	grouped := false
+	parseGrouping := func() error {
+		switch {
+		case p.acceptKeyword("by"):
+		case p.acceptKeyword("without"):
+			agg.Without = true
+		default:
+			return nil
+		}
+		if grouped {
+			return fmt.Errorf("duplicate grouping clause in %s", op)
+		}
+		grouped = true
+		var err error
+		agg.Grouping, err = p.parseLabelList()
+		return err
+	}
+
+	if err := parseGrouping(); err != nil {
+		return nil, err
+	}
+	args, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	}
+	if err := parseGrouping(); err != nil {
+		return nil, err
+	}
+
+	want := 1
+	if op == "topk" || op == "bottomk" || op == "quantile" {
+		want = 2
+	}
+	if len(args) != want {
+		return nil, fmt.Errorf("wrong number of arguments for aggregate %s: expected %d, got %d", op, want, len(args))
+	}
+	if want == 2 {
+		agg.Param = args[0]
+	}
+	agg.Expr = args[want-1]
+	return agg, nil
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
@@ -9,6 +10,36 @@ import (
 	"mo11y/internal/auth"
 )
 
+// QueryLimits is the JSON representation of an API key's /query limits.
+// Omitted or zero fields use the server defaults.
+type QueryLimits struct {
+	TimeoutMs     int `json:"timeout_ms,omitempty"`
+	MaxRows       int `json:"max_rows,omitempty"`
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+func toQueryLimits(l auth.QueryLimits) *QueryLimits {
+	if l == (auth.QueryLimits{}) {
+		return nil
+	}
+	return &QueryLimits{TimeoutMs: int(l.Timeout.Milliseconds()), MaxRows: l.MaxRows, MaxConcurrent: l.MaxConcurrent}
+}
+
+// parseQueryLimits validates limits from a request; nil clears them.
+func parseQueryLimits(l *QueryLimits) (auth.QueryLimits, error) {
+	if l == nil {
+		return auth.QueryLimits{}, nil
+	}
+	if l.TimeoutMs < 0 || l.MaxRows < 0 || l.MaxConcurrent < 0 {
+		return auth.QueryLimits{}, errors.New("query_limits must not be negative")
+	}
+	return auth.QueryLimits{
+		Timeout:       time.Duration(l.TimeoutMs) * time.Millisecond,
+		MaxRows:       l.MaxRows,
+		MaxConcurrent: l.MaxConcurrent,
+	}, nil
+}
+
 func handleListKeys(a *auth.Auth) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -26,25 +57,29 @@ func handleListKeys(a *auth.Auth) http.HandlerFunc {
 		}
 
 		type keyResponse struct {
-			ID         string  `json:"id"`
-			Name       string  `json:"name"`
-			Prefix     string  `json:"prefix"`
-			Scopes     string  `json:"scopes"`
-			CreatedAt  string  `json:"created_at"`
-			ExpiresAt  *string `json:"expires_at,omitempty"`
-			LastUsedAt *string `json:"last_used_at,omitempty"`
-			Revoked    bool    `json:"revoked"`
+			ID          string       `json:"id"`
+			Name        string       `json:"name"`
+			Prefix      string       `json:"prefix"`
+			Scopes      string       `json:"scopes"`
+			TenantID    string       `json:"tenant_id"`
+			CreatedAt   string       `json:"created_at"`
+			ExpiresAt   *string      `json:"expires_at,omitempty"`
+			LastUsedAt  *string      `json:"last_used_at,omitempty"`
+			Revoked     bool         `json:"revoked"`
+			QueryLimits *QueryLimits `json:"query_limits,omitempty"`
 		}
 
 		resp := make([]keyResponse, len(keys))
 		for i, k := range keys {
 			resp[i] = keyResponse{
-				ID:        k.ID,
-				Name:      k.Name,
-				Prefix:    k.Prefix,
-				Scopes:    k.Scopes.String(),
-				CreatedAt: k.CreatedAt.Format(time.RFC3339),
-				Revoked:   k.Revoked,
+				ID:          k.ID,
+				Name:        k.Name,
+				Prefix:      k.Prefix,
+				Scopes:      k.Scopes.String(),
+				TenantID:    k.TenantID,
+				CreatedAt:   k.CreatedAt.Format(time.RFC3339),
+				Revoked:     k.Revoked,
+				QueryLimits: toQueryLimits(k.Limits),
 			}
 			if k.ExpiresAt != nil {
 				s := k.ExpiresAt.Format(time.RFC3339)
@@ -70,8 +105,10 @@ func handleCreateKey(a *auth.Auth) http.HandlerFunc {
 		}
 
 		var req struct {
-			Name   string `json:"name"`
-			Scopes string `json:"scopes"` // comma-separated: "ingest,read"
+			Name        string       `json:"name"`
+			Scopes      string       `json:"scopes"`              // comma-separated: "ingest,read"
+			TenantID    string       `json:"tenant_id,omitempty"` // defaults to the caller's tenant
+			QueryLimits *QueryLimits `json:"query_limits,omitempty"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -93,12 +130,29 @@ func handleCreateKey(a *auth.Auth) http.HandlerFunc {
 			return
 		}
 
+		limits, err := parseQueryLimits(req.QueryLimits)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
 		createdBy := ""
+		tenantID := auth.DefaultTenant
 		if info := auth.KeyFromContext(r.Context()); info != nil {
 			createdBy = info.ID
+			tenantID = info.TenantID
+		}
+		if req.TenantID != "" {
+			tenantID = req.TenantID
 		}
 
-		key, info, err := a.CreateKey(r.Context(), req.Name, scopes, nil, createdBy)
+		key, info, err := a.CreateKey(r.Context(), req.Name, scopes, tenantID, limits, nil, createdBy)
+		if err == auth.ErrTenantNotFound {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "tenant not found"})
+			return
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
@@ -107,10 +161,12 @@ func handleCreateKey(a *auth.Auth) http.HandlerFunc {
 
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(map[string]any{
-			"id":     info.ID,
-			"name":   info.Name,
-			"key":    key, // Only time the full key is returned
-			"scopes": info.Scopes.String(),
+			"id":           info.ID,
+			"name":         info.Name,
+			"key":          key, // Only time the full key is returned
+			"scopes":       info.Scopes.String(),
+			"tenant_id":    info.TenantID,
+			"query_limits": toQueryLimits(info.Limits),
 		})
 	}
 }
@@ -147,3 +203,40 @@ func handleRevokeKey(a *auth.Auth) http.HandlerFunc {
 		json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
 	}
 }
+
+// handleUpdateKey handles PUT /admin/keys/{id}, which replaces the key's
+// query_limits; null restores the server defaults.
+func handleUpdateKey(a *auth.Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/admin/keys/")
+		if id == "" || id == r.URL.Path {
+			writeError(w, http.StatusBadRequest, "key id required")
+			return
+		}
+
+		var req struct {
+			QueryLimits *QueryLimits `json:"query_limits"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		limits, err := parseQueryLimits(req.QueryLimits)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		err = a.SetKeyLimits(r.Context(), id, limits)
+		if errors.Is(err, auth.ErrKeyNotFound) {
+			writeError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{"id": id, "query_limits": toQueryLimits(limits)})
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"mo11y/internal/storage"
+)
+
+// Counter functions served under /api/metrics/.
+const (
+	counterRate     = "rate"
+	counterIncrease = "increase"
+	counterDelta    = "delta"
+)
+
+// CounterResponse is the JSON response for /api/metrics/{rate,increase,delta}.
+type CounterResponse struct {
+	Metric      string          `json:"metric"`
+	Function    string          `json:"function"`
+	StepSeconds float64         `json:"step_seconds"`
+	Timestamps  []string        `json:"timestamps"`
+	Series      []CounterSeries `json:"series"`
+}
+
+// CounterSeries is the time series of one series identity. Values are aligned
+// with the response timestamps and null for steps without a change.
+type CounterSeries struct {
+	Attrs         map[string]string `json:"attrs"`
+	ResourceAttrs map[string]string `json:"resource_attrs"`
+	Monotonic     bool              `json:"monotonic"`
+	Temporality   string            `json:"temporality,omitempty"`
+	Resets        int               `json:"resets"`
+	Values        []*float64        `json:"values"`
+}
+
+// handleCounters handles GET /api/metrics/rate, /api/metrics/increase and
+// /api/metrics/delta, computing function for every series of a gauge or sum.
+// Query parameters: metric (required), attr (repeatable), start, end, step.
+func handleCounters(store *storage.Storage, function string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reqID := RequestID(r.Context())
+
+		mr, err := parseMetricRange(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		steps, err := store.CounterSteps(withOrigin(r), mr.counterQuery())
+		if errors.Is(err, storage.ErrTooManySeries) {
+			writeError(w, http.StatusBadRequest, err.Error()+", narrow the attribute filters")
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] counter error: %v", reqID, err)
+			writeError(w, http.StatusInternalServerError, "failed to load counters")
+			return
+		}
+
+		resp := CounterResponse{
+			Metric:      mr.Metric,
+			Function:    function,
+			StepSeconds: mr.Step.Seconds(),
+			Timestamps:  formatStepTimes(steps.Times),
+			Series:      make([]CounterSeries, len(steps.Series)),
+		}
+		for i, s := range steps.Series {
+			values := s.Increase
+			switch function {
+			case counterDelta:
+				values = s.Delta
+			case counterRate:
+				for j, v := range values {
+					if v != nil {
+						rate := *v / mr.Step.Seconds()
+						values[j] = &rate
+					}
+				}
+			}
+			resp.Series[i] = CounterSeries{
+				Attrs:         s.Attrs,
+				ResourceAttrs: s.ResourceAttrs,
+				Monotonic:     s.Monotonic,
+				Temporality:   s.Temporality,
+				Resets:        s.Resets,
+				Values:        values,
+			}
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
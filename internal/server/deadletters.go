@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mo11y/internal/storage"
+)
+
+const (
+	deadLetterLimit    = 100
+	maxDeadLetterLimit = 1000
+)
+
+// DeadLetterResponse is a rejected record with its OTLP JSON payload.
+type DeadLetterResponse struct {
+	ID        string          `json:"id"`
+	Signal    string          `json:"signal"`
+	Reason    string          `json:"reason"`
+	Error     string          `json:"error"`
+	RequestID string          `json:"request_id"`
+	APIKeyID  string          `json:"api_key_id,omitempty"`
+	CreatedAt string          `json:"created_at"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// ReingestRequest selects the dead letters to re-ingest.
+// Empty fields match everything; at most 1000 dead letters are processed per call.
+type ReingestRequest struct {
+	IDs    []string `json:"ids,omitempty"`
+	Signal string   `json:"signal,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+	Start  string   `json:"start,omitempty"`
+	End    string   `json:"end,omitempty"`
+	Limit  int      `json:"limit,omitempty"`
+}
+
+// handleDeadLetters handles GET /api/dead-letters.
+// Query parameters: signal, reason, start, end, limit.
+func handleDeadLetters(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reqID := RequestID(r.Context())
+
+		filter := storage.DeadLetterFilter{
+			Signal: r.FormValue("signal"),
+			Reason: r.FormValue("reason"),
+			Limit:  deadLetterLimit,
+		}
+		var err error
+		if filter.Start, filter.End, err = parseOptionalTimes(r.FormValue("start"), r.FormValue("end")); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if v := r.FormValue("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxDeadLetterLimit {
+				writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+				return
+			}
+			filter.Limit = n
+		}
+
+		letters, err := store.DeadLetters(withOrigin(r), filter)
+		if err != nil {
+			log.Printf("[%s] dead letters error: %v", reqID, err)
+			writeError(w, http.StatusInternalServerError, "failed to load dead letters")
+			return
+		}
+
+		resp := make([]DeadLetterResponse, len(letters))
+		for i, dl := range letters {
+			resp[i] = DeadLetterResponse{
+				ID:        dl.ID,
+				Signal:    dl.Signal,
+				Reason:    dl.Reason,
+				Error:     dl.Error,
+				RequestID: dl.RequestID,
+				APIKeyID:  dl.APIKeyID,
+				CreatedAt: dl.CreatedAt.Format(time.RFC3339Nano),
+				Payload:   json.RawMessage(dl.Payload),
+			}
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"dead_letters": resp,
+			"count":        len(resp),
+		})
+	}
+}
+
+// handleReingestDeadLetters handles POST /admin/dead-letters/reingest.
+func handleReingestDeadLetters(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reqID := RequestID(r.Context())
+
+		var req ReingestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		filter := storage.DeadLetterFilter{
+			IDs:    req.IDs,
+			Signal: req.Signal,
+			Reason: req.Reason,
+			Limit:  maxDeadLetterLimit,
+		}
+		var err error
+		if filter.Start, filter.End, err = parseOptionalTimes(req.Start, req.End); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Limit != 0 {
+			if req.Limit < 1 || req.Limit > maxDeadLetterLimit {
+				writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+				return
+			}
+			filter.Limit = req.Limit
+		}
+
+		result, err := store.ReingestDeadLetters(withOrigin(r), filter)
+		if err != nil {
+			var storageErr *storage.StorageError
+			if errors.As(err, &storageErr) {
+				log.Printf("[%s] reingest: storage unavailable: %v", reqID, err)
+				writeError(w, http.StatusServiceUnavailable, "storage unavailable")
+				return
+			}
+			log.Printf("[%s] reingest error: %v", reqID, err)
+			writeError(w, http.StatusInternalServerError, "failed to reingest dead letters")
+			return
+		}
+
+		log.Printf("[%s] reingest: reingested %d, failed %d dead letters", reqID, result.Reingested, result.Failed)
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"reingested": result.Reingested,
+			"failed":     result.Failed,
+			"errors":     result.Errors,
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mo11y/internal/storage"
+)
+
+const exemplarLimit = 100
+
+// ExemplarResponse is a stored exemplar linked to an existing trace.
+type ExemplarResponse struct {
+	MetricID      string            `json:"metric_id"`
+	Metric        string            `json:"metric"`
+	Timestamp     string            `json:"timestamp"`
+	Value         float64           `json:"value"`
+	TraceID       string            `json:"trace_id"`
+	SpanID        string            `json:"span_id"`
+	FilteredAttrs map[string]string `json:"filtered_attrs"`
+	MetricAttrs   map[string]string `json:"metric_attrs"`
+	SpanName      string            `json:"span_name,omitempty"`
+	ServiceName   string            `json:"service_name,omitempty"`
+	DurationMs    float64           `json:"duration_ms,omitempty"`
+}
+
+// handleExemplars handles GET /api/exemplars.
+// Query parameters: metric (required), start, end, limit.
+func handleExemplars(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reqID := RequestID(r.Context())
+
+		metric := r.FormValue("metric")
+		if metric == "" {
+			writeError(w, http.StatusBadRequest, "missing metric parameter")
+			return
+		}
+
+		start, end, err := parseTimeRange(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		limit := exemplarLimit
+		if v := r.FormValue("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > exemplarLimit {
+				writeError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+				return
+			}
+			limit = n
+		}
+
+		exemplars, err := store.ExemplarTraces(withOrigin(r), metric, start, end, limit)
+		if err != nil {
+			log.Printf("[%s] exemplars error: %v", reqID, err)
+			writeError(w, http.StatusInternalServerError, "failed to load exemplars")
+			return
+		}
+
+		resp := make([]ExemplarResponse, len(exemplars))
+		for i, ex := range exemplars {
+			resp[i] = ExemplarResponse{
+				MetricID:      ex.MetricID,
+				Metric:        ex.MetricName,
+				Timestamp:     ex.Timestamp.Format(time.RFC3339Nano),
+				Value:         ex.Value,
+				TraceID:       ex.TraceID,
+				SpanID:        ex.SpanID,
+				FilteredAttrs: ex.FilteredAttrs,
+				MetricAttrs:   ex.MetricAttrs,
+				SpanName:      ex.SpanName,
+				ServiceName:   ex.ServiceName,
+				DurationMs:    float64(ex.DurationNs) / 1e6,
+			}
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"exemplars": resp,
+			"count":     len(resp),
+		})
+	}
+}
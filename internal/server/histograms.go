@@ -0,0 +1,237 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mo11y/internal/promql"
+	"mo11y/internal/storage"
+)
+
+const defaultMetricStep = time.Minute
+
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// HistogramQuantilesResponse is the JSON response for /api/metrics/quantiles.
+// Values are aligned with Timestamps and null for steps without observations.
+type HistogramQuantilesResponse struct {
+	Metric      string                `json:"metric"`
+	Unit        string                `json:"unit,omitempty"`
+	StepSeconds float64               `json:"step_seconds"`
+	SeriesCount int                   `json:"series_count"`
+	Timestamps  []string              `json:"timestamps"`
+	Quantiles   []HistogramQuantileTS `json:"quantiles"`
+	Mean        []*float64            `json:"mean"`
+	Count       []int64               `json:"count"`
+}
+
+// HistogramQuantileTS is the time series of one quantile.
+type HistogramQuantileTS struct {
+	Quantile float64    `json:"quantile"`
+	Values   []*float64 `json:"values"`
+}
+
+// HistogramHeatmapResponse is the JSON response for /api/metrics/heatmap.
+// Counts has a row per timestamp and a column per bucket; the last column
+// counts observations above the highest bound.
+type HistogramHeatmapResponse struct {
+	Metric      string    `json:"metric"`
+	Unit        string    `json:"unit,omitempty"`
+	StepSeconds float64   `json:"step_seconds"`
+	SeriesCount int       `json:"series_count"`
+	Timestamps  []string  `json:"timestamps"`
+	Bounds      []float64 `json:"bounds"`
+	Counts      [][]int64 `json:"counts"`
+}
+
+// handleHistogramQuantiles handles GET /api/metrics/quantiles.
+// Query parameters: metric (required), attr (repeatable), start, end, step,
+// quantile (repeatable or comma separated).
+func handleHistogramQuantiles(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		mr, err := parseMetricRange(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		q := mr.histogramQuery()
+		quantiles, err := parseQuantiles(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		steps, ok := histogramSteps(w, r, store, q)
+		if !ok {
+			return
+		}
+
+		resp := HistogramQuantilesResponse{
+			Metric:      q.Metric,
+			Unit:        steps.Unit,
+			StepSeconds: q.Step.Seconds(),
+			SeriesCount: steps.Series,
+			Timestamps:  formatStepTimes(steps.Times),
+			Quantiles:   make([]HistogramQuantileTS, len(quantiles)),
+			Mean:        make([]*float64, len(steps.Times)),
+			Count:       make([]int64, len(steps.Times)),
+		}
+		for i := range steps.Times {
+			resp.Count[i] = steps.Total(i)
+			if resp.Count[i] > 0 {
+				mean := steps.Sums[i] / float64(resp.Count[i])
+				resp.Mean[i] = &mean
+			}
+		}
+		for j, quantile := range quantiles {
+			ts := HistogramQuantileTS{Quantile: quantile, Values: make([]*float64, len(steps.Times))}
+			for i := range steps.Times {
+				if v := storage.HistogramQuantile(quantile, steps.Bounds, steps.Counts[i]); !math.IsNaN(v) {
+					ts.Values[i] = &v
+				}
+			}
+			resp.Quantiles[j] = ts
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// handleHistogramHeatmap handles GET /api/metrics/heatmap.
+// Query parameters: metric (required), attr (repeatable), start, end, step.
+func handleHistogramHeatmap(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		mr, err := parseMetricRange(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		q := mr.histogramQuery()
+
+		steps, ok := histogramSteps(w, r, store, q)
+		if !ok {
+			return
+		}
+
+		bounds := steps.Bounds
+		if bounds == nil {
+			bounds = []float64{}
+		}
+		writeJSON(w, http.StatusOK, HistogramHeatmapResponse{
+			Metric:      q.Metric,
+			Unit:        steps.Unit,
+			StepSeconds: q.Step.Seconds(),
+			SeriesCount: steps.Series,
+			Timestamps:  formatStepTimes(steps.Times),
+			Bounds:      bounds,
+			Counts:      steps.Counts,
+		})
+	}
+}
+
+// metricRange holds the parameters shared by the histogram and counter endpoints.
+type metricRange struct {
+	Metric string
+	Attrs  []storage.AttrFilter
+	Start  time.Time
+	End    time.Time
+	Step   time.Duration
+}
+
+func (q metricRange) histogramQuery() storage.HistogramQuery {
+	return storage.HistogramQuery{Metric: q.Metric, Attrs: q.Attrs, Start: q.Start, End: q.End, Step: q.Step}
+}
+
+func (q metricRange) counterQuery() storage.CounterQuery {
+	return storage.CounterQuery{Metric: q.Metric, Attrs: q.Attrs, Start: q.Start, End: q.End, Step: q.Step}
+}
+
+// parseMetricRange reads the metric, attr, start, end and step parameters.
+func parseMetricRange(r *http.Request) (metricRange, error) {
+	var q metricRange
+	q.Metric = r.FormValue("metric")
+	if q.Metric == "" {
+		return q, fmt.Errorf("missing metric parameter")
+	}
+
+	var err error
+	if q.Start, q.End, err = parseTimeRange(r); err != nil {
+		return q, err
+	}
+
+	q.Step = defaultMetricStep
+	if v := r.FormValue("step"); v != "" {
+		if q.Step, err = promql.ParseDuration(v); err != nil {
+			return q, fmt.Errorf("invalid step: %v", err)
+		}
+		if q.Step <= 0 {
+			return q, fmt.Errorf("step must be positive")
+		}
+	}
+	if q.End.Sub(q.Start)/q.Step > promql.MaxPointsPerSeries {
+		return q, fmt.Errorf("exceeded maximum of %d steps, increase the step", promql.MaxPointsPerSeries)
+	}
+
+	if q.Attrs, err = parseAttrFilters(r); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// parseQuantiles reads the quantile parameter, defaulting to defaultQuantiles.
+func parseQuantiles(r *http.Request) ([]float64, error) {
+	var quantiles []float64
+	for _, v := range r.Form["quantile"] {
+		for _, s := range strings.Split(v, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil || f < 0 || f > 1 {
+				return nil, fmt.Errorf("invalid quantile %q, must be between 0 and 1", s)
+			}
+			quantiles = append(quantiles, f)
+		}
+	}
+	if len(quantiles) == 0 {
+		return defaultQuantiles, nil
+	}
+	return quantiles, nil
+}
+
+// histogramSteps loads the merged histogram steps, writing the error response
+// and returning false on failure.
+func histogramSteps(w http.ResponseWriter, r *http.Request, store *storage.Storage, q storage.HistogramQuery) (*storage.HistogramSteps, bool) {
+	steps, err := store.HistogramSteps(withOrigin(r), q)
+	if errors.Is(err, storage.ErrHistogramBounds) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("[%s] histogram error: %v", RequestID(r.Context()), err)
+		writeError(w, http.StatusInternalServerError, "failed to load histograms")
+		return nil, false
+	}
+	return steps, true
+}
+
+func formatStepTimes(times []time.Time) []string {
+	out := make([]string, len(times))
+	for i, t := range times {
+		out[i] = t.Format(time.RFC3339Nano)
+	}
+	return out
+}
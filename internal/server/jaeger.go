@@ -0,0 +1,461 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"mo11y/internal/storage"
+)
+
+// Jaeger query API, served under /jaeger so Grafana's Jaeger data source can
+// point at http://<host>:4318/jaeger. Responses follow the Jaeger UI JSON format.
+
+const (
+	jaegerSearchLimit    = 20
+	maxJaegerSearchLimit = 1500
+	jaegerLookback       = time.Hour
+)
+
+type jaegerResponse struct {
+	Data   any           `json:"data"`
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+	Errors []jaegerError `json:"errors"`
+}
+
+type jaegerError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	TraceID string `json:"traceID,omitempty"`
+}
+
+type jaegerTrace struct {
+	TraceID   string                   `json:"traceID"`
+	Spans     []jaegerSpan             `json:"spans"`
+	Processes map[string]jaegerProcess `json:"processes"`
+	Warnings  []string                 `json:"warnings"`
+}
+
+type jaegerSpan struct {
+	TraceID       string            `json:"traceID"`
+	SpanID        string            `json:"spanID"`
+	OperationName string            `json:"operationName"`
+	References    []jaegerReference `json:"references"`
+	StartTime     int64             `json:"startTime"` // Microseconds
+	Duration      int64             `json:"duration"`  // Microseconds
+	Tags          []jaegerKeyValue  `json:"tags"`
+	Logs          []jaegerLog       `json:"logs"`
+	ProcessID     string            `json:"processID"`
+	Warnings      []string          `json:"warnings"`
+}
+
+type jaegerReference struct {
+	RefType string `json:"refType"` // CHILD_OF or FOLLOWS_FROM
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type jaegerKeyValue struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Value any    `json:"value"`
+}
+
+type jaegerLog struct {
+	Timestamp int64            `json:"timestamp"`
+	Fields    []jaegerKeyValue `json:"fields"`
+}
+
+type jaegerProcess struct {
+	ServiceName string           `json:"serviceName"`
+	Tags        []jaegerKeyValue `json:"tags"`
+}
+
+type jaegerOperation struct {
+	Name     string `json:"name"`
+	SpanKind string `json:"spanKind"`
+}
+
+type jaegerDependency struct {
+	Parent    string `json:"parent"`
+	Child     string `json:"child"`
+	CallCount int64  `json:"callCount"`
+}
+
+// jaegerSpanKinds maps OTLP span kinds to Jaeger span.kind tag values.
+var jaegerSpanKinds = map[tracev1.Span_SpanKind]string{
+	tracev1.Span_SPAN_KIND_INTERNAL: "internal",
+	tracev1.Span_SPAN_KIND_SERVER:   "server",
+	tracev1.Span_SPAN_KIND_CLIENT:   "client",
+	tracev1.Span_SPAN_KIND_PRODUCER: "producer",
+	tracev1.Span_SPAN_KIND_CONSUMER: "consumer",
+}
+
+// handleJaeger handles the Jaeger query API under /jaeger/api/.
+func handleJaeger(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/jaeger")
+		switch {
+		case path == "/api/services":
+			jaegerServices(store, w, r)
+		case strings.HasPrefix(path, "/api/services/") && strings.HasSuffix(path, "/operations"):
+			service := strings.TrimSuffix(strings.TrimPrefix(path, "/api/services/"), "/operations")
+			jaegerOperations(store, w, r, service, false)
+		case path == "/api/operations":
+			jaegerOperations(store, w, r, r.FormValue("service"), true)
+		case path == "/api/traces":
+			jaegerSearch(store, w, r)
+		case strings.HasPrefix(path, "/api/traces/"):
+			jaegerGetTrace(store, w, r, strings.TrimPrefix(path, "/api/traces/"))
+		case path == "/api/dependencies":
+			jaegerDependencies(store, w, r)
+		default:
+			writeJaegerError(w, http.StatusNotFound, "not found")
+		}
+	}
+}
+
+func writeJaeger(w http.ResponseWriter, data any, total int) {
+	writeJSON(w, http.StatusOK, jaegerResponse{Data: data, Total: total})
+}
+
+func writeJaegerError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, jaegerResponse{Errors: []jaegerError{{Code: status, Msg: msg}}})
+}
+
+func jaegerServices(store *storage.Storage, w http.ResponseWriter, r *http.Request) {
+	services, err := store.Services(withOrigin(r))
+	if err != nil {
+		log.Printf("[%s] jaeger services error: %v", RequestID(r.Context()), err)
+		writeJaegerError(w, http.StatusInternalServerError, "failed to load services")
+		return
+	}
+	writeJaeger(w, services, len(services))
+}
+
+// jaegerOperations serves both the legacy operation name list and the
+// /api/operations form with span kinds.
+func jaegerOperations(store *storage.Storage, w http.ResponseWriter, r *http.Request, service string, withKind bool) {
+	if service == "" {
+		writeJaegerError(w, http.StatusBadRequest, "service is required")
+		return
+	}
+
+	ops, err := store.Operations(withOrigin(r), service)
+	if err != nil {
+		log.Printf("[%s] jaeger operations error: %v", RequestID(r.Context()), err)
+		writeJaegerError(w, http.StatusInternalServerError, "failed to load operations")
+		return
+	}
+
+	if withKind {
+		spanKind := r.FormValue("spanKind")
+		result := []jaegerOperation{}
+		for _, op := range ops {
+			kind := jaegerSpanKinds[tracev1.Span_SpanKind(op.Kind)]
+			if spanKind == "" || spanKind == kind {
+				result = append(result, jaegerOperation{Name: op.Name, SpanKind: kind})
+			}
+		}
+		writeJaeger(w, result, len(result))
+		return
+	}
+
+	names := []string{}
+	for _, op := range ops {
+		if len(names) == 0 || names[len(names)-1] != op.Name {
+			names = append(names, op.Name)
+		}
+	}
+	writeJaeger(w, names, len(names))
+}
+
+// jaegerSearch handles /api/traces.
+// Query parameters: service, operation, tags (JSON object), start, end
+// (microseconds), lookback, minDuration, maxDuration, limit.
+func jaegerSearch(store *storage.Storage, w http.ResponseWriter, r *http.Request) {
+	reqID := RequestID(r.Context())
+
+	q, err := parseJaegerSearch(r)
+	if err != nil {
+		writeJaegerError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := withOrigin(r)
+	summaries, _, err := store.SearchTraces(ctx, q)
+	if err != nil {
+		log.Printf("[%s] jaeger search error: %v", reqID, err)
+		writeJaegerError(w, http.StatusInternalServerError, "failed to search traces")
+		return
+	}
+
+	traces := make([]jaegerTrace, 0, len(summaries))
+	for _, s := range summaries {
+		t, err := store.Trace(ctx, s.TraceID)
+		if errors.Is(err, storage.ErrTraceNotFound) {
+			continue // Removed by retention since the search
+		}
+		if err != nil {
+			log.Printf("[%s] jaeger search error: %v", reqID, err)
+			writeJaegerError(w, http.StatusInternalServerError, "failed to load traces")
+			return
+		}
+		traces = append(traces, toJaegerTrace(t))
+	}
+	writeJaeger(w, traces, len(traces))
+}
+
+func parseJaegerSearch(r *http.Request) (storage.TraceSearch, error) {
+	q := storage.TraceSearch{
+		Service:  r.FormValue("service"),
+		SpanName: r.FormValue("operation"),
+		Limit:    jaegerSearchLimit,
+	}
+	if q.Service == "" {
+		return q, fmt.Errorf("service is required")
+	}
+
+	q.End = time.Now()
+	if v := r.FormValue("end"); v != "" {
+		us, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid end %q, expected microseconds", v)
+		}
+		q.End = time.UnixMicro(us)
+	}
+	q.Start = q.End.Add(-jaegerLookback)
+	if v := r.FormValue("start"); v != "" {
+		us, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid start %q, expected microseconds", v)
+		}
+		q.Start = time.UnixMicro(us)
+	} else if v := r.FormValue("lookback"); v != "" && v != "custom" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid lookback %q", v)
+		}
+		q.Start = q.End.Add(-d)
+	}
+	if !q.Start.Before(q.End) {
+		return q, fmt.Errorf("start must be before end")
+	}
+
+	var err error
+	if v := r.FormValue("minDuration"); v != "" {
+		if q.MinDuration, err = time.ParseDuration(v); err != nil {
+			return q, fmt.Errorf("invalid minDuration %q", v)
+		}
+	}
+	if v := r.FormValue("maxDuration"); v != "" {
+		if q.MaxDuration, err = time.ParseDuration(v); err != nil {
+			return q, fmt.Errorf("invalid maxDuration %q", v)
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid limit %q", v)
+		}
+		q.Limit = min(n, maxJaegerSearchLimit)
+	}
+
+	// Grafana sends tags as a JSON object; error=true selects failed spans
+	if v := r.FormValue("tags"); v != "" {
+		var tags map[string]string
+		if err := json.Unmarshal([]byte(v), &tags); err != nil {
+			return q, fmt.Errorf("invalid tags, expected a JSON object of strings")
+		}
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if k == "error" && tags[k] == "true" {
+				code := int8(tracev1.Status_STATUS_CODE_ERROR)
+				q.StatusCode = &code
+				continue
+			}
+			q.Attrs = append(q.Attrs, storage.AttrFilter{Key: k, Value: tags[k]})
+		}
+	}
+	return q, nil
+}
+
+// jaegerGetTrace handles /api/traces/{id}. 64-bit Jaeger IDs are zero-padded.
+func jaegerGetTrace(store *storage.Storage, w http.ResponseWriter, r *http.Request, traceID string) {
+	traceID = strings.ToLower(traceID)
+	if len(traceID) < 32 {
+		traceID = strings.Repeat("0", 32-len(traceID)) + traceID
+	}
+
+	t, err := store.Trace(withOrigin(r), traceID)
+	if errors.Is(err, storage.ErrTraceNotFound) {
+		writeJaegerError(w, http.StatusNotFound, "trace not found")
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] jaeger trace error: %v", RequestID(r.Context()), err)
+		writeJaegerError(w, http.StatusInternalServerError, "failed to load trace")
+		return
+	}
+	writeJaeger(w, []jaegerTrace{toJaegerTrace(t)}, 1)
+}
+
+// jaegerDependencies handles /api/dependencies from the service graph.
+// Query parameters: endTs and lookback in milliseconds.
+func jaegerDependencies(store *storage.Storage, w http.ResponseWriter, r *http.Request) {
+	end := time.Now()
+	if v := r.FormValue("endTs"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeJaegerError(w, http.StatusBadRequest, "invalid endTs, expected milliseconds")
+			return
+		}
+		end = time.UnixMilli(ms)
+	}
+	lookback := 24 * time.Hour
+	if v := r.FormValue("lookback"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || ms <= 0 {
+			writeJaegerError(w, http.StatusBadRequest, "invalid lookback, expected milliseconds")
+			return
+		}
+		lookback = time.Duration(ms) * time.Millisecond
+	}
+
+	edges, err := store.ServiceGraph(withOrigin(r), end.Add(-lookback), end)
+	if err != nil {
+		log.Printf("[%s] jaeger dependencies error: %v", RequestID(r.Context()), err)
+		writeJaegerError(w, http.StatusInternalServerError, "failed to load dependencies")
+		return
+	}
+
+	// Jaeger has no connection types; sum them per service pair
+	deps := []jaegerDependency{}
+	index := make(map[[2]string]int)
+	for _, e := range edges {
+		key := [2]string{e.Client, e.Server}
+		if i, ok := index[key]; ok {
+			deps[i].CallCount += e.CallCount
+			continue
+		}
+		index[key] = len(deps)
+		deps = append(deps, jaegerDependency{Parent: e.Client, Child: e.Server, CallCount: e.CallCount})
+	}
+	writeJaeger(w, deps, len(deps))
+}
+
+// toJaegerTrace converts a stored trace, mapping each distinct resource to a process.
+func toJaegerTrace(t *storage.Trace) jaegerTrace {
+	jt := jaegerTrace{
+		TraceID:   t.TraceID,
+		Spans:     make([]jaegerSpan, len(t.Spans)),
+		Processes: make(map[string]jaegerProcess),
+	}
+
+	processIDs := make(map[string]string)
+	for i, sp := range t.Spans {
+		resourceKey, _ := json.Marshal(sp.ResourceAttrs)
+		processID, ok := processIDs[string(resourceKey)]
+		if !ok {
+			processID = fmt.Sprintf("p%d", len(processIDs)+1)
+			processIDs[string(resourceKey)] = processID
+
+			process := jaegerProcess{ServiceName: sp.ResourceAttrs["service.name"], Tags: []jaegerKeyValue{}}
+			for _, k := range sortedKeys(sp.ResourceAttrs) {
+				if k != "service.name" {
+					process.Tags = append(process.Tags, jaegerString(k, sp.ResourceAttrs[k]))
+				}
+			}
+			jt.Processes[processID] = process
+		}
+		jt.Spans[i] = toJaegerSpan(t.TraceID, sp, processID)
+	}
+	return jt
+}
+
+func toJaegerSpan(traceID string, sp *storage.TraceSpan, processID string) jaegerSpan {
+	js := jaegerSpan{
+		TraceID:       traceID,
+		SpanID:        sp.SpanID,
+		OperationName: sp.Name,
+		References:    []jaegerReference{},
+		StartTime:     sp.StartTime.UnixMicro(),
+		Duration:      sp.DurationNs / 1000,
+		Tags:          []jaegerKeyValue{},
+		Logs:          []jaegerLog{},
+		ProcessID:     processID,
+	}
+	if sp.ParentSpanID != "" {
+		js.References = append(js.References, jaegerReference{RefType: "CHILD_OF", TraceID: traceID, SpanID: sp.ParentSpanID})
+	}
+	for _, link := range sp.Links {
+		js.References = append(js.References, jaegerReference{RefType: "FOLLOWS_FROM", TraceID: link.TraceID, SpanID: link.SpanID})
+	}
+	if sp.Orphan {
+		js.Warnings = append(js.Warnings, "parent span "+sp.ParentSpanID+" is missing")
+	}
+
+	for _, k := range sortedKeys(sp.Attrs) {
+		js.Tags = append(js.Tags, jaegerString(k, sp.Attrs[k]))
+	}
+	if kind, ok := jaegerSpanKinds[tracev1.Span_SpanKind(sp.Kind)]; ok {
+		js.Tags = append(js.Tags, jaegerString("span.kind", kind))
+	}
+	if sp.ScopeName != "" {
+		js.Tags = append(js.Tags, jaegerString("otel.scope.name", sp.ScopeName))
+	}
+	if sp.ScopeVersion != "" {
+		js.Tags = append(js.Tags, jaegerString("otel.scope.version", sp.ScopeVersion))
+	}
+	switch tracev1.Status_StatusCode(sp.StatusCode) {
+	case tracev1.Status_STATUS_CODE_ERROR:
+		js.Tags = append(js.Tags, jaegerKeyValue{Key: "error", Type: "bool", Value: true})
+		js.Tags = append(js.Tags, jaegerString("otel.status_code", "ERROR"))
+	case tracev1.Status_STATUS_CODE_OK:
+		js.Tags = append(js.Tags, jaegerString("otel.status_code", "OK"))
+	}
+	if sp.StatusMessage != "" {
+		js.Tags = append(js.Tags, jaegerString("otel.status_description", sp.StatusMessage))
+	}
+
+	for _, ev := range sp.Events {
+		l := jaegerLog{Timestamp: ev.Time.UnixMicro(), Fields: []jaegerKeyValue{jaegerString("event", ev.Name)}}
+		for _, k := range sortedKeys(ev.Attrs) {
+			l.Fields = append(l.Fields, jaegerString(k, ev.Attrs[k]))
+		}
+		js.Logs = append(js.Logs, l)
+	}
+	return js
+}
+
+func jaegerString(key, value string) jaegerKeyValue {
+	return jaegerKeyValue{Key: key, Type: "string", Value: value}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
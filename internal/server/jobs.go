@@ -0,0 +1,229 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"mo11y/internal/auth"
+	"mo11y/internal/storage"
+)
+
+// Job is the JSON representation of an asynchronous query.
+type Job struct {
+	ID         string      `json:"id"`
+	SQL        string      `json:"sql"`
+	Status     string      `json:"status"` // queued, running, succeeded, failed or canceled
+	Error      string      `json:"error,omitempty"`
+	Rows       int64       `json:"rows"`  // Written so far while running
+	Bytes      int64       `json:"bytes"` // Size of the stored result
+	MaxRows    int         `json:"max_rows,omitempty"`
+	ElapsedMs  int64       `json:"elapsed_ms"` // Since the job started running
+	Usage      *QueryUsage `json:"usage,omitempty"`
+	CreatedAt  string      `json:"created_at"`
+	StartedAt  *string     `json:"started_at,omitempty"`
+	FinishedAt *string     `json:"finished_at,omitempty"`
+	ExpiresAt  *string     `json:"expires_at,omitempty"`
+}
+
+func toJob(j storage.Job) Job {
+	format := func(t *time.Time) *string {
+		if t == nil {
+			return nil
+		}
+		s := t.Format(time.RFC3339)
+		return &s
+	}
+	job := Job{
+		ID:         j.ID,
+		SQL:        j.SQL,
+		Status:     j.Status,
+		Error:      j.Error,
+		Rows:       j.Rows,
+		Bytes:      j.Bytes,
+		MaxRows:    j.MaxRows,
+		CreatedAt:  j.CreatedAt.Format(time.RFC3339),
+		StartedAt:  format(j.StartedAt),
+		FinishedAt: format(j.FinishedAt),
+		ExpiresAt:  format(j.ExpiresAt),
+	}
+	if j.Usage != nil {
+		job.Usage = toQueryUsage(j.Usage)
+	}
+	if j.StartedAt != nil {
+		end := time.Now()
+		if j.FinishedAt != nil {
+			end = *j.FinishedAt
+		}
+		job.ElapsedMs = end.Sub(*j.StartedAt).Milliseconds()
+	}
+	return job
+}
+
+// handleJobs handles GET and POST /query/jobs. POST takes the sql parameter
+// of /query and queues it; the interactive timeout and row cap do not apply,
+// but an API key's row cap does.
+func handleJobs(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			jobs, err := store.ListJobs(withOrigin(r))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			resp := make([]Job, len(jobs))
+			for i, j := range jobs {
+				resp[i] = toJob(j)
+			}
+			writeJSON(w, http.StatusOK, resp)
+
+		case http.MethodPost:
+			query := trimQuery(r.FormValue("sql"))
+			if query == "" {
+				writeError(w, http.StatusBadRequest, "missing sql parameter")
+				return
+			}
+
+			var maxRows, maxConcurrent int
+			if info := auth.KeyFromContext(r.Context()); info != nil {
+				maxRows, maxConcurrent = info.Limits.MaxRows, info.Limits.MaxConcurrent
+			}
+
+			job, err := store.SubmitJob(withOrigin(r), query, maxRows, maxConcurrent)
+			switch {
+			case errors.Is(err, storage.ErrJobsDisabled):
+				writeError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			case errors.Is(err, storage.ErrTooManyJobs), errors.Is(err, storage.ErrTooManyQueries):
+				writeError(w, http.StatusTooManyRequests, err.Error())
+				return
+			case storage.IsQueryError(err):
+				writeError(w, http.StatusBadRequest, errors.Unwrap(err).Error())
+				return
+			case err != nil:
+				log.Printf("[%s] job: submit error: %v", RequestID(r.Context()), err)
+				writeError(w, http.StatusInternalServerError, "failed to create job")
+				return
+			}
+
+			w.Header().Set("Location", "/query/jobs/"+job.ID)
+			writeJSON(w, http.StatusAccepted, toJob(*job))
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleJob handles /query/jobs/{id}: GET returns the job and its progress,
+// DELETE removes it and its result, canceling it if needed. POST
+// /query/jobs/{id}/cancel cancels it and GET /query/jobs/{id}/result
+// downloads the result in any /query output format.
+func handleJob(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/query/jobs/"), "/")
+		if id == "" {
+			writeError(w, http.StatusBadRequest, "job id required")
+			return
+		}
+		ctx := withOrigin(r)
+
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			job, err := store.GetJob(ctx, id)
+			if err != nil {
+				writeJobError(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, toJob(*job))
+
+		case action == "" && r.Method == http.MethodDelete:
+			if err := store.DeleteJob(ctx, id); err != nil {
+				writeJobError(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+
+		case action == "cancel" && r.Method == http.MethodPost:
+			if err := store.CancelJob(ctx, id); err != nil {
+				writeJobError(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "canceling"})
+
+		case action == "result" && r.Method == http.MethodGet:
+			writeJobResult(w, r, store, id)
+
+		case action == "" || action == "cancel" || action == "result":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	}
+}
+
+// writeJobResult writes the stored result of a job. Arrow is the stored
+// format and is sent as is; other formats are converted by DuckDB.
+func writeJobResult(w http.ResponseWriter, r *http.Request, store *storage.Storage, id string) {
+	reqID := RequestID(r.Context())
+	ctx := withOrigin(r)
+
+	format, err := queryFormat(r)
+	if err == nil && format == formatParquet && !store.ParquetEnabled() {
+		err = storage.ErrParquetDisabled
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if format == formatArrow {
+		f, err := store.OpenJobResult(ctx, id)
+		if err != nil {
+			writeJobError(w, r, err)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", formatContentTypes[format])
+		if _, err := io.Copy(w, f); err != nil {
+			log.Printf("[%s] job: result output error: %v", reqID, err)
+		}
+		return
+	}
+
+	conn, err := store.QueryConn(ctx)
+	if err != nil {
+		log.Printf("[%s] job: connection error: %v", reqID, err)
+		writeError(w, http.StatusServiceUnavailable, "storage unavailable")
+		return
+	}
+	defer conn.Close()
+
+	query, release, err := store.ViewJobResult(ctx, conn, id)
+	if err != nil {
+		writeJobError(w, r, err)
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "application/json")
+	writeQueryResult(ctx, w, reqID, conn, query, nil, format, nil)
+}
+
+// writeJobError maps job errors to responses.
+func writeJobError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, storage.ErrJobNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, storage.ErrJobFinished), errors.Is(err, storage.ErrJobNoResult):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		log.Printf("[%s] job error: %v", RequestID(r.Context()), err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"mo11y/internal/storage"
+)
+
+// LogMetricRule is the JSON representation of a log-to-metric rule.
+type LogMetricRule struct {
+	ID           string            `json:"id,omitempty"`
+	Name         string            `json:"name"`
+	Metric       string            `json:"metric"`
+	Description  string            `json:"description,omitempty"`
+	Type         string            `json:"type"` // count, sum or gauge
+	MinSeverity  int32             `json:"min_severity,omitempty"`
+	Match        map[string]string `json:"match,omitempty"`
+	BodyContains string            `json:"body_contains,omitempty"`
+	ValueField   string            `json:"value_field,omitempty"`
+	GroupBy      []string          `json:"group_by,omitempty"`
+	CreatedAt    string            `json:"created_at,omitempty"`
+}
+
+func toLogMetricRule(r storage.LogMetricRule) LogMetricRule {
+	return LogMetricRule{
+		ID:           r.ID,
+		Name:         r.Name,
+		Metric:       r.Metric,
+		Description:  r.Description,
+		Type:         r.Type,
+		MinSeverity:  r.MinSeverity,
+		Match:        r.Match,
+		BodyContains: r.BodyContains,
+		ValueField:   r.ValueField,
+		GroupBy:      r.GroupBy,
+		CreatedAt:    r.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// handleLogMetricRules handles GET and POST /admin/log-metric-rules for the
+// rules of the caller's tenant.
+func handleLogMetricRules(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			rules := store.ListLogMetricRules(withOrigin(r))
+			resp := make([]LogMetricRule, len(rules))
+			for i, rule := range rules {
+				resp[i] = toLogMetricRule(rule)
+			}
+			writeJSON(w, http.StatusOK, resp)
+
+		case http.MethodPost:
+			var req LogMetricRule
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+
+			rule, err := store.CreateLogMetricRule(withOrigin(r), storage.LogMetricRule{
+				Name:         req.Name,
+				Metric:       req.Metric,
+				Description:  req.Description,
+				Type:         req.Type,
+				MinSeverity:  req.MinSeverity,
+				Match:        req.Match,
+				BodyContains: req.BodyContains,
+				ValueField:   req.ValueField,
+				GroupBy:      req.GroupBy,
+			})
+			if errors.Is(err, storage.ErrRuleExists) {
+				writeError(w, http.StatusConflict, err.Error())
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			writeJSON(w, http.StatusCreated, toLogMetricRule(*rule))
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleDeleteLogMetricRule handles DELETE /admin/log-metric-rules/{id}.
+func handleDeleteLogMetricRule(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/admin/log-metric-rules/")
+		if id == "" || id == r.URL.Path {
+			writeError(w, http.StatusBadRequest, "rule id required")
+			return
+		}
+
+		err := store.DeleteLogMetricRule(withOrigin(r), id)
+		if errors.Is(err, storage.ErrRuleNotFound) {
+			writeError(w, http.StatusNotFound, "rule not found")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mo11y/internal/logsearch"
+	"mo11y/internal/storage"
+)
+
+const (
+	logSearchLimit    = 50
+	maxLogSearchLimit = 1000
+	highlightWidth    = 160
+)
+
+// severityNumbers maps severity names to the lowest OTLP severity number of
+// their range.
+var severityNumbers = map[string]int8{
+	"trace": 1,
+	"debug": 5,
+	"info":  9,
+	"warn":  13,
+	"error": 17,
+	"fatal": 21,
+}
+
+// LogSearchResponse is the JSON response for a full-text log search.
+type LogSearchResponse struct {
+	Logs  []LogSearchHit `json:"logs"`
+	Count int            `json:"count"`
+}
+
+type LogSearchHit struct {
+	LogID          string            `json:"log_id"`
+	Timestamp      string            `json:"timestamp"`
+	SeverityNumber int8              `json:"severity_number"`
+	SeverityText   string            `json:"severity_text,omitempty"`
+	Service        string            `json:"service,omitempty"`
+	TraceID        string            `json:"trace_id,omitempty"`
+	SpanID         string            `json:"span_id,omitempty"`
+	Body           string            `json:"body"`
+	BodyFields     map[string]string `json:"body_fields,omitempty"`
+	Score          float64           `json:"score"`
+	// Highlights holds HTML snippets with matches in <em>, keyed by "body"
+	// or "body_fields.<name>"
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// handleLogSearch handles GET /api/logs/search.
+// Query parameters: q (required), start, end, severity (minimum, as a number
+// or trace, debug, info, warn, error or fatal), sort (relevance or time), limit.
+func handleLogSearch(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reqID := RequestID(r.Context())
+
+		q, err := parseLogSearch(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		hits, err := store.SearchLogs(withOrigin(r), q)
+		if err != nil {
+			log.Printf("[%s] log search error: %v", reqID, err)
+			writeError(w, http.StatusInternalServerError, "failed to search logs")
+			return
+		}
+
+		terms := logsearch.Positive(q.Query)
+		resp := LogSearchResponse{
+			Logs:  make([]LogSearchHit, len(hits)),
+			Count: len(hits),
+		}
+		for i, h := range hits {
+			resp.Logs[i] = toLogSearchHit(h, terms)
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func parseLogSearch(r *http.Request) (storage.LogSearch, error) {
+	text := r.FormValue("q")
+	if text == "" {
+		return storage.LogSearch{}, fmt.Errorf("missing q parameter")
+	}
+	expr, err := logsearch.Parse(text)
+	if err != nil {
+		return storage.LogSearch{}, fmt.Errorf("invalid query: %v", err)
+	}
+
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		return storage.LogSearch{}, err
+	}
+
+	q := storage.LogSearch{
+		Query: expr,
+		Start: start,
+		End:   end,
+		Sort:  r.FormValue("sort"),
+	}
+	if q.Sort != "" && q.Sort != storage.LogSortRelevance && q.Sort != storage.LogSortTime {
+		return q, fmt.Errorf("sort must be relevance or time")
+	}
+	if q.MinSeverity, err = parseSeverity(r.FormValue("severity")); err != nil {
+		return q, err
+	}
+	if q.Limit, err = intParam(r, "limit", logSearchLimit, maxLogSearchLimit); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// parseSeverity parses a minimum severity given as an OTLP severity number or
+// a name; "" yields 0 (no bound).
+func parseSeverity(v string) (int8, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if n, ok := severityNumbers[strings.ToLower(v)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > 24 {
+		return 0, fmt.Errorf("severity must be a number from 1 to 24 or trace, debug, info, warn, error or fatal")
+	}
+	return int8(n), nil
+}
+
+func toLogSearchHit(h storage.LogSearchHit, terms []*logsearch.Term) LogSearchHit {
+	hit := LogSearchHit{
+		LogID:          h.LogID,
+		Timestamp:      h.Timestamp.UTC().Format(time.RFC3339Nano),
+		SeverityNumber: h.SeverityNumber,
+		SeverityText:   h.SeverityText,
+		Service:        h.Service,
+		TraceID:        h.TraceID,
+		SpanID:         h.SpanID,
+		Body:           h.Body,
+		BodyFields:     h.BodyFields,
+		Score:          h.Score,
+	}
+
+	// Highlight each field with the terms that can match it
+	highlight := func(key, field, text string) {
+		var tokens []string
+		for _, t := range terms {
+			if !t.Scoped || t.Field == field {
+				tokens = append(tokens, t.Tokens...)
+			}
+		}
+		if s := logsearch.Highlight(text, tokens, highlightWidth); s != "" {
+			if hit.Highlights == nil {
+				hit.Highlights = make(map[string]string)
+			}
+			hit.Highlights[key] = s
+		}
+	}
+	highlight("body", "", h.Body)
+	for name, value := range h.BodyFields {
+		if name != "" {
+			highlight("body_fields."+name, name, value)
+		}
+	}
+	return hit
+}
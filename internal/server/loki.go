@@ -0,0 +1,233 @@
+package server
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mo11y/internal/logql"
+	"mo11y/internal/promql"
+	"mo11y/internal/storage"
+)
+
+// Loki HTTP API, served under /loki/api/v1 so Grafana's Loki data source can
+// point at http://<host>:4318. LogQL is compiled to SQL over the logs table;
+// stream labels are resource attributes with invalid characters replaced by
+// underscores, so service.name is selected as service_name.
+
+const (
+	lokiLimit         = 100
+	maxLokiLimit      = 5000
+	lokiDefaultPoints = 250
+)
+
+type lokiQueryData struct {
+	ResultType string   `json:"resultType"` // streams or matrix
+	Result     any      `json:"result"`
+	Stats      struct{} `json:"stats"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"` // Unix nanoseconds and line
+}
+
+// handleLoki handles the Loki query API under /loki/api/v1/.
+func handleLoki(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/loki/api/v1")
+		switch {
+		case path == "/query_range":
+			lokiRangeQuery(store, w, r)
+		case path == "/series":
+			lokiSeries(store, w, r)
+		case path == "/labels":
+			lokiLabelNames(store, w, r)
+		case strings.HasPrefix(path, "/label/") && strings.HasSuffix(path, "/values"):
+			lokiLabelValues(store, w, r, strings.TrimSuffix(strings.TrimPrefix(path, "/label/"), "/values"))
+		default:
+			writePromError(w, http.StatusNotFound, "not_found", "unknown endpoint")
+		}
+	}
+}
+
+// lokiRangeQuery handles /loki/api/v1/query_range.
+// Query parameters: query, start, end, limit (log queries), direction
+// (backward or forward, log queries) and step (metric queries, duration or
+// seconds).
+func lokiRangeQuery(store *storage.Storage, w http.ResponseWriter, r *http.Request) {
+	expr, err := logql.Parse(r.FormValue("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"query\": "+err.Error())
+		return
+	}
+	compiled, err := logql.Compile(expr)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"query\": "+err.Error())
+		return
+	}
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+
+	if compiled.Metric {
+		step := time.Duration(math.Ceil(end.Sub(start).Seconds()/lokiDefaultPoints)) * time.Second
+		if v := r.FormValue("step"); v != "" {
+			if step, err = logql.ParseDuration(v); err != nil {
+				writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"step\": "+err.Error())
+				return
+			}
+		}
+		if step < time.Millisecond {
+			writePromError(w, http.StatusBadRequest, "bad_data", "zero or negative query resolution step widths are not accepted")
+			return
+		}
+		if end.Sub(start)/step > promql.MaxPointsPerSeries {
+			writePromError(w, http.StatusBadRequest, "bad_data", "exceeded maximum resolution of 11,000 points per timeseries")
+			return
+		}
+
+		series, err := store.LogQLSeries(withOrigin(r), compiled, start, end, step)
+		if err != nil {
+			writeLokiError(w, r, err)
+			return
+		}
+		writeProm(w, lokiQueryData{ResultType: "matrix", Result: promResult(promql.Matrix(series))})
+		return
+	}
+
+	limit, err := intParam(r, "limit", lokiLimit, maxLokiLimit)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	direction := r.FormValue("direction")
+	if direction != "" && direction != "backward" && direction != "forward" {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"direction\": must be backward or forward")
+		return
+	}
+
+	streams, err := store.LogQLStreams(withOrigin(r), compiled, start, end, limit, direction == "forward")
+	if err != nil {
+		writeLokiError(w, r, err)
+		return
+	}
+	result := make([]lokiStream, len(streams))
+	for i, s := range streams {
+		values := make([][2]string, len(s.Entries))
+		for j, e := range s.Entries {
+			values[j] = [2]string{strconv.FormatInt(e.Timestamp.UnixNano(), 10), e.Line}
+		}
+		result[i] = lokiStream{Stream: s.Labels, Values: values}
+	}
+	writeProm(w, lokiQueryData{ResultType: "streams", Result: result})
+}
+
+func writeLokiError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		writePromError(w, http.StatusServiceUnavailable, "timeout", "query timed out")
+		return
+	}
+	log.Printf("[%s] LogQL error: %v", RequestID(r.Context()), err)
+	writePromError(w, http.StatusInternalServerError, "internal", "failed to run query")
+}
+
+// lokiStreamLabels loads the stream label sets selected by the given
+// parameter (match[] or query) within start and end.
+func lokiStreamLabels(store *storage.Storage, w http.ResponseWriter, r *http.Request, param string, requireMatch bool) ([]map[string]string, bool) {
+	r.ParseForm()
+	var selectors [][]*logql.Matcher
+	for _, s := range r.Form[param] {
+		if s == "" {
+			continue
+		}
+		matchers, err := logql.ParseSelector(s)
+		if err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \""+param+"\": "+err.Error())
+			return nil, false
+		}
+		selectors = append(selectors, matchers)
+	}
+	if requireMatch && len(selectors) == 0 {
+		writePromError(w, http.StatusBadRequest, "bad_data", "no "+param+" parameter provided")
+		return nil, false
+	}
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return nil, false
+	}
+
+	sets, err := store.LogStreamLabels(withOrigin(r), selectors, start, end)
+	if err != nil {
+		log.Printf("[%s] Loki series error: %v", RequestID(r.Context()), err)
+		writePromError(w, http.StatusInternalServerError, "internal", "failed to load streams")
+		return nil, false
+	}
+	return sets, true
+}
+
+// lokiSeries handles /loki/api/v1/series.
+// Query parameters: match[] (required, repeatable), start, end.
+func lokiSeries(store *storage.Storage, w http.ResponseWriter, r *http.Request) {
+	sets, ok := lokiStreamLabels(store, w, r, "match[]", true)
+	if !ok {
+		return
+	}
+	sort.Slice(sets, func(i, j int) bool { return promql.Labels(sets[i]).Key() < promql.Labels(sets[j]).Key() })
+	if sets == nil {
+		sets = []map[string]string{}
+	}
+	writeProm(w, sets)
+}
+
+// lokiLabelNames handles /loki/api/v1/labels.
+// Query parameters: query (optional stream selector), start, end.
+func lokiLabelNames(store *storage.Storage, w http.ResponseWriter, r *http.Request) {
+	sets, ok := lokiStreamLabels(store, w, r, "query", false)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, set := range sets {
+		for name := range set {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	writeProm(w, names)
+}
+
+// lokiLabelValues handles /loki/api/v1/label/{name}/values.
+// Query parameters: query (optional stream selector), start, end.
+func lokiLabelValues(store *storage.Storage, w http.ResponseWriter, r *http.Request, name string) {
+	sets, ok := lokiStreamLabels(store, w, r, "query", false)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	values := []string{}
+	for _, set := range sets {
+		if v, ok := set[name]; ok && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	writeProm(w, values)
+}
@@ -10,6 +10,9 @@ import (
 	"strings"
 
 	"github.com/google/uuid"
+
+	"mo11y/internal/auth"
+	"mo11y/internal/storage"
 )
 
 const maxRequestSize = 10 * 1024 * 1024 // 10MB
@@ -25,6 +28,26 @@ func RequestID(ctx context.Context) string {
 	return ""
 }
 
+// withOrigin returns the request context annotated with the request ID, API key and tenant.
+// Storage stamps ingested rows with the tenant and restricts reads to it.
+// Without auth there is no tenant and reads are unrestricted.
+func withOrigin(r *http.Request) context.Context {
+	origin := storage.Origin{RequestID: RequestID(r.Context())}
+	if info := auth.KeyFromContext(r.Context()); info != nil {
+		origin.APIKeyID = info.ID
+		origin.TenantID = info.TenantID
+	}
+	return storage.WithOrigin(r.Context(), origin)
+}
+
+// tenantOf returns the tenant of the request's API key, or "" without auth.
+func tenantOf(r *http.Request) string {
+	if info := auth.KeyFromContext(r.Context()); info != nil {
+		return info.TenantID
+	}
+	return ""
+}
+
 // chain applies middleware in the order they execute (first to last).
 // Given: chain(handler, A, B, C)
 // Execution order: A -> B -> C -> handler -> C -> B -> A
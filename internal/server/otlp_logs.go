@@ -10,11 +10,12 @@ import (
 	collectorlogsv1 "go.opentelemetry.io/proto/otlp/collector/logs/v1"
 	"google.golang.org/protobuf/proto"
 
+	"mo11y/internal/forward"
 	"mo11y/internal/storage"
 )
 
 // handleLogs handles POST /v1/logs.
-func handleLogs(store *storage.Storage) http.HandlerFunc {
+func handleLogs(store *storage.Storage, fwd *forward.Forwarder) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		reqID := RequestID(r.Context())
 
@@ -48,7 +49,7 @@ func handleLogs(store *storage.Storage) http.HandlerFunc {
 		}
 
 		// 5. Store data
-		result, err := store.StoreLogs(r.Context(), req)
+		result, err := store.StoreLogs(withOrigin(r), req)
 		if err != nil {
 			var storageErr *storage.StorageError
 			if errors.As(err, &storageErr) {
@@ -63,6 +64,9 @@ func handleLogs(store *storage.Storage) http.HandlerFunc {
 
 		log.Printf("[%s] logs: accepted %d, rejected %d log records", reqID, result.Accepted, result.Rejected)
 
+		// Relay the original request; forwarding never affects the ingest response
+		fwd.Forward(forward.SignalLogs, body)
+
 		// 6. Build response with partial success if needed
 		resp := &collectorlogsv1.ExportLogsServiceResponse{}
 		if result.HasRejections() {
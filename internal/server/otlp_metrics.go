@@ -10,11 +10,12 @@ import (
 	collectormetricsv1 "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
 	"google.golang.org/protobuf/proto"
 
+	"mo11y/internal/forward"
 	"mo11y/internal/storage"
 )
 
 // handleMetrics handles POST /v1/metrics.
-func handleMetrics(store *storage.Storage) http.HandlerFunc {
+func handleMetrics(store *storage.Storage, fwd *forward.Forwarder) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		reqID := RequestID(r.Context())
 
@@ -48,7 +49,7 @@ func handleMetrics(store *storage.Storage) http.HandlerFunc {
 		}
 
 		// 5. Store data
-		result, err := store.StoreMetrics(r.Context(), req)
+		result, err := store.StoreMetrics(withOrigin(r), req)
 		if err != nil {
 			var storageErr *storage.StorageError
 			if errors.As(err, &storageErr) {
@@ -63,6 +64,9 @@ func handleMetrics(store *storage.Storage) http.HandlerFunc {
 
 		log.Printf("[%s] metrics: accepted %d, rejected %d data points", reqID, result.Accepted, result.Rejected)
 
+		// Relay the original request; forwarding never affects the ingest response
+		fwd.Forward(forward.SignalMetrics, body)
+
 		// 6. Build response with partial success if needed
 		resp := &collectormetricsv1.ExportMetricsServiceResponse{}
 		if result.HasRejections() {
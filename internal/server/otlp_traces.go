@@ -10,11 +10,12 @@ import (
 	collectortracev1 "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 	"google.golang.org/protobuf/proto"
 
+	"mo11y/internal/forward"
 	"mo11y/internal/storage"
 )
 
 // handleTraces handles POST /v1/traces.
-func handleTraces(store *storage.Storage) http.HandlerFunc {
+func handleTraces(store *storage.Storage, fwd *forward.Forwarder) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		reqID := RequestID(r.Context())
 
@@ -48,7 +49,7 @@ func handleTraces(store *storage.Storage) http.HandlerFunc {
 		}
 
 		// 5. Store data
-		result, err := store.StoreTraces(r.Context(), req)
+		result, err := store.StoreTraces(withOrigin(r), req)
 		if err != nil {
 			var storageErr *storage.StorageError
 			if errors.As(err, &storageErr) {
@@ -64,9 +65,13 @@ func handleTraces(store *storage.Storage) http.HandlerFunc {
 
 		log.Printf("[%s] traces: accepted %d, rejected %d spans", reqID, result.Accepted, result.Rejected)
 
-		// 6. Build response with partial success if needed
+		// Relay the original request; forwarding never affects the ingest response
+		fwd.Forward(forward.SignalTraces, body)
+
+		// 6. Build response with partial success if needed; span event and
+		// link failures are reported as warnings with no rejected spans
 		resp := &collectortracev1.ExportTraceServiceResponse{}
-		if result.HasRejections() {
+		if result.HasErrors() {
 			resp.PartialSuccess = &collectortracev1.ExportTracePartialSuccess{
 				RejectedSpans: int64(result.Rejected),
 				ErrorMessage:  result.ErrorMessage(),
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTimeRange = time.Hour
+
+// parseTimeRange reads the start and end query parameters.
+// Both default relative to now: end to now, start to one hour before end.
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	end := time.Now()
+	if v := r.FormValue("end"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid end: %w", err)
+		}
+		end = t
+	}
+
+	start := end.Add(-defaultTimeRange)
+	if v := r.FormValue("start"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid start: %w", err)
+		}
+		start = t
+	}
+
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("start must be before end")
+	}
+	return start, end, nil
+}
+
+// parseOptionalTimes parses optional start and end timestamps; empty values stay zero.
+func parseOptionalTimes(startValue, endValue string) (time.Time, time.Time, error) {
+	var start, end time.Time
+	var err error
+	if startValue != "" {
+		if start, err = parseTime(startValue); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid start: %w", err)
+		}
+	}
+	if endValue != "" {
+		if end, err = parseTime(endValue); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid end: %w", err)
+		}
+	}
+	return start, end, nil
+}
+
+// parseTime accepts RFC3339 timestamps or Unix timestamps.
+// Unix values are interpreted as seconds, milliseconds, microseconds or
+// nanoseconds depending on their magnitude; fractional seconds are allowed.
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+
+	if strings.Contains(v, ".") {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("expected RFC3339 or Unix timestamp, got %q", v)
+		}
+		return time.Unix(0, int64(f*1e9)), nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC3339 or Unix timestamp, got %q", v)
+	}
+	switch {
+	case n < 1e11:
+		return time.Unix(n, 0), nil
+	case n < 1e14:
+		return time.UnixMilli(n), nil
+	case n < 1e17:
+		return time.UnixMicro(n), nil
+	default:
+		return time.Unix(0, n), nil
+	}
+}
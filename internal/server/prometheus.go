@@ -0,0 +1,311 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mo11y/internal/promql"
+	"mo11y/internal/storage"
+)
+
+// Prometheus HTTP API, served under /api/v1 so Grafana's Prometheus data
+// source can point at http://<host>:4318. PromQL is evaluated over the
+// metrics table; see storage.PromSeries for how metrics map to series.
+
+type promResponse struct {
+	Status    string `json:"status"` // success or error
+	Data      any    `json:"data,omitempty"`
+	ErrorType string `json:"errorType,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type promQueryData struct {
+	ResultType promql.ValueType `json:"resultType"`
+	Result     any              `json:"result"`
+}
+
+type promSample struct {
+	Metric promql.Labels `json:"metric"`
+	Value  [2]any        `json:"value"`
+}
+
+type promSeries struct {
+	Metric promql.Labels `json:"metric"`
+	Values [][2]any      `json:"values"`
+}
+
+// handlePrometheus handles the Prometheus query API under /api/v1/.
+func handlePrometheus(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+		switch {
+		case path == "/query":
+			promInstantQuery(store, w, r)
+		case path == "/query_range":
+			promRangeQuery(store, w, r)
+		case path == "/series":
+			promSeriesList(store, w, r)
+		case path == "/labels":
+			promLabelNames(store, w, r)
+		case strings.HasPrefix(path, "/label/") && strings.HasSuffix(path, "/values"):
+			promLabelValues(store, w, r, strings.TrimSuffix(strings.TrimPrefix(path, "/label/"), "/values"))
+		default:
+			writePromError(w, http.StatusNotFound, "not_found", "unknown endpoint")
+		}
+	}
+}
+
+func writeProm(w http.ResponseWriter, data any) {
+	writeJSON(w, http.StatusOK, promResponse{Status: "success", Data: data})
+}
+
+func writePromError(w http.ResponseWriter, status int, errorType, msg string) {
+	writeJSON(w, status, promResponse{Status: "error", ErrorType: errorType, Error: msg})
+}
+
+// writePromEvalError maps an evaluation error to the Prometheus error types.
+func writePromEvalError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case promql.IsExecError(err), errors.Is(err, storage.ErrTooManySamples):
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		writePromError(w, http.StatusServiceUnavailable, "timeout", "query timed out")
+	default:
+		log.Printf("[%s] PromQL error: %v", RequestID(r.Context()), err)
+		writePromError(w, http.StatusInternalServerError, "internal", "failed to evaluate query")
+	}
+}
+
+// promQuerier returns the PromQL data source for a request's tenant.
+func promQuerier(store *storage.Storage, r *http.Request) promql.Querier {
+	ctx := withOrigin(r)
+	return promql.QuerierFunc(func(_ context.Context, matchers []*promql.Matcher, start, end time.Time) ([]promql.Series, error) {
+		return store.PromSeries(ctx, matchers, start, end)
+	})
+}
+
+// promInstantQuery handles /api/v1/query.
+// Query parameters: query, time (default now).
+func promInstantQuery(store *storage.Storage, w http.ResponseWriter, r *http.Request) {
+	expr, err := promql.ParseExpr(r.FormValue("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"query\": "+err.Error())
+		return
+	}
+	ts := time.Now()
+	if v := r.FormValue("time"); v != "" {
+		if ts, err = parseTime(v); err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"time\": "+err.Error())
+			return
+		}
+	}
+
+	value, err := promql.InstantQuery(r.Context(), promQuerier(store, r), expr, ts)
+	if err != nil {
+		writePromEvalError(w, r, err)
+		return
+	}
+	writeProm(w, promQueryData{ResultType: value.Type(), Result: promResult(value)})
+}
+
+// promRangeQuery handles /api/v1/query_range.
+// Query parameters: query, start, end, step (duration or seconds).
+func promRangeQuery(store *storage.Storage, w http.ResponseWriter, r *http.Request) {
+	expr, err := promql.ParseExpr(r.FormValue("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"query\": "+err.Error())
+		return
+	}
+	var start, end time.Time
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"start", &start}, {"end", &end}} {
+		if *p.dst, err = parseTime(r.FormValue(p.name)); err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \""+p.name+"\": "+err.Error())
+			return
+		}
+	}
+	if end.Before(start) {
+		writePromError(w, http.StatusBadRequest, "bad_data", "end timestamp must not be before start time")
+		return
+	}
+	step, err := promql.ParseDuration(r.FormValue("step"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"step\": "+err.Error())
+		return
+	}
+	if err := promql.CheckRangeQuery(expr, start, end, step); err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+
+	matrix, err := promql.RangeQuery(r.Context(), promQuerier(store, r), expr, start, end, step)
+	if err != nil {
+		writePromEvalError(w, r, err)
+		return
+	}
+	writeProm(w, promQueryData{ResultType: promql.ValueTypeMatrix, Result: promResult(matrix)})
+}
+
+// promResult converts an evaluation result to the Prometheus JSON layout.
+func promResult(v promql.Value) any {
+	switch v := v.(type) {
+	case promql.Scalar:
+		return [2]any{promTime(v.T), promFloat(v.V)}
+	case promql.String:
+		return [2]any{promTime(v.T), v.V}
+	case promql.Vector:
+		out := make([]promSample, len(v))
+		for i, s := range v {
+			out[i] = promSample{Metric: nonNilLabels(s.Metric), Value: [2]any{promTime(s.T), promFloat(s.V)}}
+		}
+		return out
+	case promql.Matrix:
+		out := make([]promSeries, len(v))
+		for i, s := range v {
+			values := make([][2]any, len(s.Points))
+			for j, p := range s.Points {
+				values[j] = [2]any{promTime(p.T), promFloat(p.V)}
+			}
+			out[i] = promSeries{Metric: nonNilLabels(s.Metric), Values: values}
+		}
+		return out
+	}
+	return nil
+}
+
+func nonNilLabels(l promql.Labels) promql.Labels {
+	if l == nil {
+		return promql.Labels{}
+	}
+	return l
+}
+
+// promTime converts milliseconds to Unix seconds.
+func promTime(ms int64) float64 {
+	return float64(ms) / 1000
+}
+
+// promFloat formats a sample value as Prometheus does.
+func promFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// promSelectors parses the repeatable match[] parameter.
+func promSelectors(r *http.Request) ([][]*promql.Matcher, error) {
+	r.ParseForm()
+	var selectors [][]*promql.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, matchers)
+	}
+	return selectors, nil
+}
+
+// promLabelSets loads the label sets selected by match[] within start and end.
+func promLabelSets(store *storage.Storage, w http.ResponseWriter, r *http.Request, requireMatch bool) ([]promql.Labels, bool) {
+	selectors, err := promSelectors(r)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"match[]\": "+err.Error())
+		return nil, false
+	}
+	if requireMatch && len(selectors) == 0 {
+		writePromError(w, http.StatusBadRequest, "bad_data", "no match[] parameter provided")
+		return nil, false
+	}
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return nil, false
+	}
+
+	sets, err := store.PromLabelSets(withOrigin(r), selectors, start, end)
+	if errors.Is(err, storage.ErrTooManySamples) {
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("[%s] Prometheus series error: %v", RequestID(r.Context()), err)
+		writePromError(w, http.StatusInternalServerError, "internal", "failed to load series")
+		return nil, false
+	}
+	return sets, true
+}
+
+// promSeriesList handles /api/v1/series.
+// Query parameters: match[] (required, repeatable), start, end.
+func promSeriesList(store *storage.Storage, w http.ResponseWriter, r *http.Request) {
+	sets, ok := promLabelSets(store, w, r, true)
+	if !ok {
+		return
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Key() < sets[j].Key() })
+	if sets == nil {
+		sets = []promql.Labels{}
+	}
+	writeProm(w, sets)
+}
+
+// promLabelNames handles /api/v1/labels.
+// Query parameters: match[] (optional, repeatable), start, end.
+func promLabelNames(store *storage.Storage, w http.ResponseWriter, r *http.Request) {
+	sets, ok := promLabelSets(store, w, r, false)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, set := range sets {
+		for name := range set {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	writeProm(w, names)
+}
+
+// promLabelValues handles /api/v1/label/{name}/values.
+// Query parameters: match[] (optional, repeatable), start, end.
+func promLabelValues(store *storage.Storage, w http.ResponseWriter, r *http.Request, name string) {
+	sets, ok := promLabelSets(store, w, r, false)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	values := []string{}
+	for _, set := range sets {
+		if v, ok := set[name]; ok && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	writeProm(w, values)
+}
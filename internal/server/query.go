@@ -2,13 +2,17 @@ package server
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/apache/arrow-go/v18/arrow/array"
+
+	"mo11y/internal/auth"
 	"mo11y/internal/storage"
 )
 
@@ -17,7 +21,65 @@ const (
 	queryRowLimit = 1000
 )
 
-var blockedKeywords = []string{"EXPLAIN", "DESCRIBE", "SHOW", "PRAGMA", "ATTACH", "DETACH"}
+// queryUsageTrailer carries the QueryUsage of streamed responses.
+const queryUsageTrailer = "X-Query-Usage"
+
+// streamTrailers lists the trailers of streamed responses.
+var streamTrailers = strings.Join([]string{queryErrorTrailer, queryUsageTrailer, queryHasMoreTrailer, queryCursorTrailer}, ", ")
+
+// QueryUsage is the JSON representation of the resources a query consumed.
+type QueryUsage struct {
+	CPUMs        float64 `json:"cpu_ms"` // Summed over DuckDB's threads
+	LatencyMs    float64 `json:"latency_ms"`
+	RowsScanned  int64   `json:"rows_scanned"`
+	RowsReturned int64   `json:"rows_returned"`
+	ResultBytes  int64   `json:"result_bytes"`
+}
+
+// queryUsage returns the usage of the last query on conn, or nil if DuckDB
+// has none.
+func queryUsage(reqID string, conn *sql.Conn) *QueryUsage {
+	u, err := storage.LastQueryUsage(conn)
+	if err != nil {
+		log.Printf("[%s] query: usage unavailable: %v", reqID, err)
+		return nil
+	}
+	return toQueryUsage(u)
+}
+
+func toQueryUsage(u *storage.QueryUsage) *QueryUsage {
+	return &QueryUsage{
+		CPUMs:        float64(u.CPUTime) / 1e6,
+		LatencyMs:    float64(u.Latency) / 1e6,
+		RowsScanned:  u.RowsScanned,
+		RowsReturned: u.RowsReturned,
+		ResultBytes:  u.ResultBytes,
+	}
+}
+
+// setUsageTrailer reports the usage of a streamed response in its trailer.
+func setUsageTrailer(w http.ResponseWriter, usage *QueryUsage) {
+	if usage != nil {
+		b, _ := json.Marshal(usage)
+		w.Header().Set(queryUsageTrailer, string(b))
+	}
+}
+
+// queryLimits returns the timeout and row cap of a request, with the API key's
+// limits applied. capAlways is set when the key caps rows, which then also
+// applies to queries with their own LIMIT.
+func queryLimits(r *http.Request) (timeout time.Duration, maxRows int, capAlways bool) {
+	timeout, maxRows = queryTimeout, queryRowLimit
+	if info := auth.KeyFromContext(r.Context()); info != nil {
+		if info.Limits.Timeout > 0 {
+			timeout = info.Limits.Timeout
+		}
+		if info.Limits.MaxRows > 0 {
+			maxRows, capAlways = info.Limits.MaxRows, true
+		}
+	}
+	return timeout, maxRows, capAlways
+}
 
 func handleQuery(store *storage.Storage) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -28,93 +90,316 @@ func handleQuery(store *storage.Storage) http.HandlerFunc {
 			return
 		}
 
-		reqID := RequestID(r.Context())
-		sql := strings.TrimSpace(r.FormValue("sql"))
+		query := trimQuery(r.FormValue("sql"))
 
 		// Validate: non-empty
-		if sql == "" {
+		if query == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(map[string]string{"error": "missing sql parameter"})
 			return
 		}
 
-		upperSQL := strings.ToUpper(sql)
+		runQuery(w, r, store, query, nil)
+	}
+}
 
-		// Validate: SELECT or WITH only
-		if !strings.HasPrefix(upperSQL, "SELECT") && !strings.HasPrefix(upperSQL, "WITH") {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "only SELECT queries allowed"})
+// trimQuery removes surrounding whitespace and trailing semicolons, which
+// would end the statement inside the LIMIT wrapper.
+func trimQuery(query string) string {
+	return strings.TrimRight(strings.TrimSpace(query), "; \t\r\n")
+}
+
+// runQuery checks query, runs it with args under the caller's limits and
+// writes the result in the requested format.
+func runQuery(w http.ResponseWriter, r *http.Request, store *storage.Storage, query string, args []any) {
+	reqID := RequestID(r.Context())
+
+	format, err := queryFormat(r)
+	if err == nil && format == formatParquet && !store.ParquetEnabled() {
+		err = storage.ErrParquetDisabled
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Context with timeout
+	timeout, maxRows, capAlways := queryLimits(r)
+	ctx, cancel := context.WithTimeout(withOrigin(r), timeout)
+	defer cancel()
+
+	// A key's concurrency limit bounds its share of the query pool
+	var maxConcurrent int
+	if info := auth.KeyFromContext(r.Context()); info != nil {
+		maxConcurrent = info.Limits.MaxConcurrent
+	}
+	releaseSlot, err := store.AcquireQuerySlot(ctx, maxConcurrent)
+	if err != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	defer releaseSlot()
+
+	// Queries run on the query pool, apart from ingest. Tenant keys get a
+	// connection where each table only shows the tenant's rows
+	var conn *sql.Conn
+	tenantID := tenantOf(r)
+	if tenantID != "" {
+		scoped, release, err := store.ScopedConn(ctx, tenantID)
+		if err != nil {
+			log.Printf("[%s] query: scoped connection error: %v", reqID, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": "storage unavailable"})
 			return
 		}
+		defer release()
+		conn = scoped
+	} else {
+		if conn, err = store.QueryConn(ctx); err != nil {
+			log.Printf("[%s] query: connection error: %v", reqID, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": "storage unavailable"})
+			return
+		}
+		defer conn.Close()
+	}
+
+	// Only single SELECT statements over mo11y tables pass
+	shape, err := storage.CheckQuery(ctx, conn, query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 
-		// Validate: no multi-statement
-		if strings.Contains(sql, ";") {
+	// The row cap applies unless the statement has its own LIMIT; the rows
+	// past it are reached through cursors
+	var page *queryPage
+	if !shape.Limited || capAlways {
+		if page, err = parsePage(r, shape.Fingerprint, args, maxRows); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "multi-statement queries not allowed"})
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 			return
 		}
+	} else if r.FormValue("cursor") != "" || r.FormValue("page_size") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "queries with their own LIMIT are not paged"})
+		return
+	}
 
-		// Validate: no blocked keywords
-		for _, kw := range blockedKeywords {
-			if strings.Contains(upperSQL, kw) {
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("%s not allowed", kw)})
-				return
-			}
-		}
+	limit := store.ResultCacheLimit()
+	if limit == 0 {
+		writeQueryPage(ctx, w, reqID, store, conn, query, args, format, page)
+		return
+	}
 
-		// Add LIMIT if not present
-		if !strings.Contains(upperSQL, "LIMIT") {
-			sql = fmt.Sprintf("%s LIMIT %d", sql, queryRowLimit)
+	// Results are cached until their TTL passes or rows they were computed
+	// from are written
+	lookup, keep := cachePolicy(r)
+	key := resultCacheKey(tenantID, shape, args, format, page)
+	if lookup {
+		if v, age, ok := store.CachedResult(key); ok {
+			writeCachedResponse(w, v.(*cachedResponse), age)
+			return
 		}
+	}
+	if !keep {
+		w.Header().Set(queryCacheHeader, "bypass")
+		writeQueryPage(ctx, w, reqID, store, conn, query, args, format, page)
+		return
+	}
 
-		// Context with timeout
-		ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
-		defer cancel()
+	w.Header().Set(queryCacheHeader, "miss")
+	version := store.ResultCacheVersion()
+	rec := &responseRecorder{ResponseWriter: w, limit: limit}
+	writeQueryPage(ctx, rec, reqID, store, conn, query, args, format, page)
+	if resp := rec.response(); resp != nil {
+		scope := storage.ResultScope{Tenant: tenantID, Reads: shape.Reads(args)}
+		store.CacheResult(key, version, scope, resp, resp.size())
+	}
+}
 
-		rows, err := store.DB().QueryContext(ctx, sql)
+// writeQueryPage writes the page of query's result, or the whole result
+// without a page.
+func writeQueryPage(ctx context.Context, w http.ResponseWriter, reqID string, store *storage.Storage, conn *sql.Conn, query string, args []any, format string, page *queryPage) {
+	if page == nil {
+		writeQueryResult(ctx, w, reqID, conn, query, args, format, nil)
+		return
+	}
+
+	pageQuery, release, err := page.open(ctx, store, conn, query, args)
+	switch {
+	case errors.Is(err, storage.ErrCursorExpired):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, storage.ErrJobsDisabled):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case storage.IsQueryError(err):
+		log.Printf("[%s] query error: %v", reqID, err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("[%s] query: snapshot error: %v", reqID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to store results"})
+		return
+	}
+	defer release()
+	writeQueryResult(ctx, w, reqID, conn, pageQuery, nil, format, page)
+}
+
+// writeQueryResult runs query with args on conn and writes the result in
+// format, followed by the usage DuckDB reports. With a page, at most
+// page.size rows are written, and whether query returned more is reported
+// with a cursor for the next page.
+func writeQueryResult(ctx context.Context, w http.ResponseWriter, reqID string, conn *sql.Conn, query string, args []any, format string, page *queryPage) {
+	if format == formatArrow || format == formatParquet {
+		writeColumnar(ctx, w, reqID, conn, query, args, format, page)
+		return
+	}
+
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Printf("[%s] query error: %v", reqID, err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	cols, _ := rows.Columns()
+	if format != formatJSON {
+		// Rows are written as they are scanned; later errors can only be
+		// reported in a trailer
+		w.Header().Set("Content-Type", formatContentTypes[format])
+		w.Header().Set("Trailer", streamTrailers)
+		write := writeRowsNDJSON
+		if format == formatCSV {
+			write = writeRowsCSV
+		}
+		more, err := write(w, rows, cols, page.limit())
 		if err != nil {
-			log.Printf("[%s] query error: %v", reqID, err)
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			log.Printf("[%s] query: %s output error: %v", reqID, format, err)
+			w.Header().Set(queryErrorTrailer, err.Error())
 			return
 		}
-		defer rows.Close()
-
-		cols, _ := rows.Columns()
-		var results []map[string]any
+		rows.Close()
+		setUsageTrailer(w, page.queryUsage(reqID, conn))
+		setPageTrailers(w, page, more)
+		return
+	}
 
-		for rows.Next() {
-			vals := make([]any, len(cols))
-			ptrs := make([]any, len(cols))
-			for i := range vals {
-				ptrs[i] = &vals[i]
-			}
-			if err := rows.Scan(ptrs...); err != nil {
-				log.Printf("[%s] scan error: %v", reqID, err)
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{"error": "failed to scan row"})
-				return
-			}
+	var results []map[string]any
+	more := false
 
-			row := make(map[string]any)
-			for i, col := range cols {
-				row[col] = vals[i]
-			}
-			results = append(results, row)
+	for rows.Next() {
+		if page != nil && len(results) == page.size {
+			more = true
+			break
 		}
 
-		if err := rows.Err(); err != nil {
-			log.Printf("[%s] rows error: %v", reqID, err)
+		vals := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			log.Printf("[%s] scan error: %v", reqID, err)
 			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "error reading results"})
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to scan row"})
 			return
 		}
 
-		json.NewEncoder(w).Encode(map[string]any{
-			"columns": cols,
-			"rows":    results,
-			"count":   len(results),
+		row := make(map[string]any)
+		for i, col := range cols {
+			row[col] = vals[i]
+		}
+		results = append(results, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("[%s] rows error: %v", reqID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error reading results"})
+		return
+	}
+	rows.Close()
+
+	resp := map[string]any{
+		"columns":  cols,
+		"rows":     results,
+		"count":    len(results),
+		"has_more": more,
+		"usage":    page.queryUsage(reqID, conn),
+	}
+	if more {
+		resp["next_cursor"] = page.next()
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeColumnar runs query with args and writes the result as Arrow IPC or
+// Parquet, paged like writeQueryResult.
+func writeColumnar(ctx context.Context, w http.ResponseWriter, reqID string, conn *sql.Conn, query string, args []any, format string, page *queryPage) {
+	started := false
+	start := func() {
+		w.Header().Set("Content-Type", formatContentTypes[format])
+		w.Header().Set("Trailer", streamTrailers)
+		started = true
+	}
+
+	var usage *QueryUsage
+	var more bool
+	var err error
+	if format == formatArrow {
+		err = storage.QueryArrow(ctx, conn, query, args, func(reader array.RecordReader) error {
+			start()
+			var werr error
+			more, werr = writeRecordsArrow(w, reader, page.limit())
+			return werr
 		})
+	} else {
+		// The whole file is written once DuckDB has produced it
+		var u *storage.QueryUsage
+		u, more, err = storage.CopyParquet(ctx, conn, query, args, page.limit(), writerFunc(func(p []byte) (int, error) {
+			if !started {
+				start()
+			}
+			return w.Write(p)
+		}))
+		if u != nil {
+			usage = toQueryUsage(u)
+		}
+	}
+
+	switch {
+	case err == nil:
+		if usage == nil || page != nil && page.usage != nil {
+			usage = page.queryUsage(reqID, conn)
+		}
+		setUsageTrailer(w, usage)
+		setPageTrailers(w, page, more)
+	case started:
+		log.Printf("[%s] query: %s output error: %v", reqID, format, err)
+		w.Header().Set(queryErrorTrailer, err.Error())
+	case storage.IsQueryError(err):
+		log.Printf("[%s] query error: %v", reqID, err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	default:
+		log.Printf("[%s] query: %s output error: %v", reqID, format, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to write results"})
 	}
 }
+
+// writerFunc adapts a function to io.Writer.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mo11y/internal/storage"
+)
+
+// queryCacheHeader reports whether a /query response came from the result
+// cache: hit, miss or bypass.
+const queryCacheHeader = "X-Query-Cache"
+
+// cachedResponse is a /query response kept in the result cache.
+type cachedResponse struct {
+	contentType string
+	trailers    map[string]string // nil for responses without trailers
+	body        []byte
+}
+
+func (c *cachedResponse) size() int64 {
+	n := len(c.contentType) + len(c.body)
+	for k, v := range c.trailers {
+		n += len(k) + len(v)
+	}
+	return int64(n)
+}
+
+// cachePolicy returns whether a request may be answered from the result
+// cache and whether its result may be cached. Cache-Control: no-cache runs
+// the query and refreshes the cached result, no-store bypasses the cache
+// altogether.
+func cachePolicy(r *http.Request) (lookup, keep bool) {
+	cc := strings.ToLower(r.Header.Get("Cache-Control"))
+	if strings.Contains(cc, "no-store") {
+		return false, false
+	}
+	return !strings.Contains(cc, "no-cache"), true
+}
+
+// resultCacheKey identifies the result of a checked statement for a tenant.
+// Statements differing only in formatting share results.
+func resultCacheKey(tenantID string, shape storage.QueryShape, args []any, format string, page *queryPage) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", tenantID, shape.Fingerprint, format)
+	if page != nil {
+		fmt.Fprintf(h, "\x00%s\x00%d\x00%d", page.snapshot, page.offset, page.size)
+	}
+	for _, arg := range args {
+		fmt.Fprintf(h, "\x00%#v", arg)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeCachedResponse writes a response from the result cache.
+func writeCachedResponse(w http.ResponseWriter, c *cachedResponse, age time.Duration) {
+	w.Header().Set("Content-Type", c.contentType)
+	w.Header().Set(queryCacheHeader, "hit")
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	if c.trailers != nil {
+		w.Header().Set("Trailer", streamTrailers)
+	}
+	w.Write(c.body)
+	for k, v := range c.trailers {
+		w.Header().Set(k, v)
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it for
+// the result cache, up to limit bytes.
+type responseRecorder struct {
+	http.ResponseWriter
+	limit    int64
+	status   int
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	if !rr.tooLarge {
+		if int64(rr.body.Len()+len(p)) > rr.limit {
+			rr.tooLarge = true
+			rr.body = bytes.Buffer{}
+		} else {
+			rr.body.Write(p)
+		}
+	}
+	return rr.ResponseWriter.Write(p)
+}
+
+// response returns the recorded response, or nil if it cannot be cached:
+// it failed, was cut short or is too large.
+func (rr *responseRecorder) response() *cachedResponse {
+	h := rr.Header()
+	if rr.status != http.StatusOK || rr.tooLarge || h.Get(queryErrorTrailer) != "" {
+		return nil
+	}
+	c := &cachedResponse{contentType: h.Get("Content-Type"), body: rr.body.Bytes()}
+	if h.Get("Trailer") != "" {
+		c.trailers = make(map[string]string)
+		for _, k := range []string{queryUsageTrailer, queryHasMoreTrailer, queryCursorTrailer} {
+			if v := h.Get(k); v != "" {
+				c.trailers[k] = v
+			}
+		}
+	}
+	return c
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/marcboeker/go-duckdb"
+)
+
+// Output formats of /query.
+const (
+	formatJSON    = "json"
+	formatNDJSON  = "ndjson"
+	formatCSV     = "csv"
+	formatArrow   = "arrow"
+	formatParquet = "parquet"
+)
+
+var formatContentTypes = map[string]string{
+	formatJSON:    "application/json",
+	formatNDJSON:  "application/x-ndjson",
+	formatCSV:     "text/csv; charset=utf-8",
+	formatArrow:   "application/vnd.apache.arrow.stream",
+	formatParquet: "application/vnd.apache.parquet",
+}
+
+// acceptFormats maps media types in Accept headers to formats.
+var acceptFormats = map[string]string{
+	"application/json":                    formatJSON,
+	"application/x-ndjson":                formatNDJSON,
+	"application/jsonl":                   formatNDJSON,
+	"text/csv":                            formatCSV,
+	"application/vnd.apache.arrow.stream": formatArrow,
+	"application/vnd.apache.parquet":      formatParquet,
+	"application/x-parquet":               formatParquet,
+}
+
+// queryErrorTrailer carries errors that occur after a streamed response has started.
+const queryErrorTrailer = "X-Query-Error"
+
+// queryFormat returns the format requested by the format parameter or, if
+// absent, the first supported media type in the Accept header. It defaults
+// to JSON.
+func queryFormat(r *http.Request) (string, error) {
+	if f := r.FormValue("format"); f != "" {
+		if _, ok := formatContentTypes[f]; !ok {
+			return "", fmt.Errorf("format must be json, ndjson, csv, arrow or parquet")
+		}
+		return f, nil
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if f, ok := acceptFormats[mediaType]; ok {
+			return f, nil
+		}
+	}
+	return formatJSON, nil
+}
+
+// writeRowsNDJSON streams rows as one JSON object per line, keys in column
+// order. It stops after max rows if max is above 0; more reports whether
+// rows continued.
+func writeRowsNDJSON(w io.Writer, rows *sql.Rows, cols []string, max int) (more bool, err error) {
+	keys := make([][]byte, len(cols))
+	for i, col := range cols {
+		keys[i], _ = json.Marshal(col)
+	}
+	return scanRows(rows, len(cols), max, func(vals []any) error {
+		line := []byte{'{'}
+		for i, v := range vals {
+			if i > 0 {
+				line = append(line, ',')
+			}
+			b, err := json.Marshal(jsonValue(v))
+			if err != nil {
+				return fmt.Errorf("column %s: %w", cols[i], err)
+			}
+			line = append(line, keys[i]...)
+			line = append(line, ':')
+			line = append(line, b...)
+		}
+		line = append(line, '}', '\n')
+		_, err := w.Write(line)
+		return err
+	})
+}
+
+// writeRowsCSV streams rows as CSV with a header line, stopping like
+// writeRowsNDJSON. NULL is an empty field and nested values are JSON.
+func writeRowsCSV(w io.Writer, rows *sql.Rows, cols []string, max int) (more bool, err error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(cols); err != nil {
+		return false, err
+	}
+	record := make([]string, len(cols))
+	more, err = scanRows(rows, len(cols), max, func(vals []any) error {
+		for i, v := range vals {
+			s, err := csvValue(v)
+			if err != nil {
+				return fmt.Errorf("column %s: %w", cols[i], err)
+			}
+			record[i] = s
+		}
+		return cw.Write(record)
+	})
+	cw.Flush()
+	if err != nil {
+		return false, err
+	}
+	return more, cw.Error()
+}
+
+// writeRecordsArrow streams record batches in the Arrow IPC stream format,
+// stopping like writeRowsNDJSON.
+func writeRecordsArrow(w io.Writer, reader array.RecordReader, max int) (more bool, err error) {
+	iw := ipc.NewWriter(w, ipc.WithSchema(reader.Schema()))
+	var written int64
+	for reader.Next() {
+		rec := reader.Record()
+		if max > 0 && written+rec.NumRows() > int64(max) {
+			if keep := int64(max) - written; keep > 0 {
+				slice := rec.NewSlice(0, keep)
+				err := iw.Write(slice)
+				slice.Release()
+				if err != nil {
+					iw.Close()
+					return false, err
+				}
+			}
+			return true, iw.Close()
+		}
+		if err := iw.Write(rec); err != nil {
+			iw.Close()
+			return false, err
+		}
+		written += rec.NumRows()
+	}
+	if err := reader.Err(); err != nil {
+		iw.Close()
+		return false, err
+	}
+	return false, iw.Close()
+}
+
+// scanRows calls fn with the values of each row, at most max rows if max is
+// above 0; the slice is reused. more reports whether rows continued.
+func scanRows(rows *sql.Rows, n, max int, fn func([]any) error) (more bool, err error) {
+	vals := make([]any, n)
+	ptrs := make([]any, n)
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	count := 0
+	for rows.Next() {
+		if max > 0 && count == max {
+			return true, nil
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return false, err
+		}
+		if err := fn(vals); err != nil {
+			return false, err
+		}
+		count++
+	}
+	return false, rows.Err()
+}
+
+// jsonValue converts scanned values that encoding/json cannot handle:
+// MAP values have non-string keys.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case duckdb.Map:
+		m := make(map[string]any, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonValue(val)
+		}
+		return m
+	case []any:
+		list := make([]any, len(v))
+		for i, val := range v {
+			list[i] = jsonValue(val)
+		}
+		return list
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, val := range v {
+			m[k] = jsonValue(val)
+		}
+		return m
+	}
+	return v
+}
+
+func csvValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return hex.EncodeToString(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case duckdb.Map, []any, map[string]any:
+		b, err := json.Marshal(jsonValue(v))
+		return string(b), err
+	}
+	return fmt.Sprint(v), nil
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"mo11y/internal/storage"
+)
+
+// Trailers and headers reporting whether a /query result continues.
+const (
+	queryHasMoreTrailer = "X-Query-Has-More"
+	queryCursorTrailer  = "X-Query-Next-Cursor"
+)
+
+// queryPage selects a page of a query's result. Queries with their own
+// LIMIT are not paged. Pages are read from a snapshot of the result stored
+// by the first request, so they neither skip nor repeat rows when rows are
+// ingested in between, and the query runs once.
+type queryPage struct {
+	size     int
+	offset   int
+	query    string // Identifies the query a cursor belongs to
+	snapshot string // Stored result, empty for the first page
+
+	usage *storage.QueryUsage // Of the query, when this request ran it
+}
+
+// pageCursor is the content of the opaque cursor.
+type pageCursor struct {
+	Offset   int    `json:"o"`
+	Query    string `json:"q"`
+	Snapshot string `json:"s"`
+}
+
+// parsePage returns the page selected by the cursor and page_size
+// parameters for the statement with the given fingerprint. Pages hold
+// maxRows rows unless page_size asks for fewer.
+func parsePage(r *http.Request, fingerprint string, args []any, maxRows int) (*queryPage, error) {
+	size, err := intParam(r, "page_size", maxRows, maxRows)
+	if err != nil {
+		return nil, err
+	}
+	page := &queryPage{size: size, query: queryKey(fingerprint, args)}
+
+	if v := r.FormValue("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		var c pageCursor
+		if err == nil {
+			err = json.Unmarshal(b, &c)
+		}
+		if err != nil || c.Offset < 0 || c.Snapshot == "" {
+			return nil, errors.New("invalid cursor")
+		}
+		if c.Query != page.query {
+			return nil, errors.New("cursor belongs to a different query")
+		}
+		page.offset, page.snapshot = c.Offset, c.Snapshot
+	}
+	return page, nil
+}
+
+// queryKey returns a short digest of a statement fingerprint and its
+// arguments.
+func queryKey(fingerprint string, args []any) string {
+	h := sha256.New()
+	h.Write([]byte(fingerprint))
+	for _, arg := range args {
+		fmt.Fprintf(h, "\x00%#v", arg)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// next returns the cursor of the page after p.
+func (p *queryPage) next() string {
+	b, _ := json.Marshal(pageCursor{Offset: p.offset + p.size, Query: p.query, Snapshot: p.snapshot})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// open returns a query selecting the page, and one row more to tell whether
+// the result continues, from the snapshot of query. The first page stores
+// the snapshot; a result that fits in it is deleted on release.
+func (p *queryPage) open(ctx context.Context, store *storage.Storage, conn *sql.Conn, query string, args []any) (string, func(), error) {
+	last := false
+	if p.snapshot == "" {
+		id, rows, usage, err := store.StoreSnapshot(ctx, conn, query, args)
+		if err != nil {
+			return "", nil, err
+		}
+		p.snapshot, p.usage, last = id, usage, rows <= int64(p.size)
+	}
+
+	pageQuery, release, err := store.ViewSnapshot(ctx, conn, p.snapshot, p.offset, p.size+1)
+	if err != nil || !last {
+		return pageQuery, release, err
+	}
+	return pageQuery, func() {
+		release()
+		store.DeleteSnapshot(p.snapshot)
+	}, nil
+}
+
+// queryUsage returns the usage of the query when this request stored its
+// result, else that of the last query on conn, reading the page.
+func (p *queryPage) queryUsage(reqID string, conn *sql.Conn) *QueryUsage {
+	if p != nil && p.usage != nil {
+		return toQueryUsage(p.usage)
+	}
+	return queryUsage(reqID, conn)
+}
+
+// limit returns the number of rows to write, 0 for all.
+func (p *queryPage) limit() int {
+	if p == nil {
+		return 0
+	}
+	return p.size
+}
+
+// setPageTrailers reports in the trailers of a streamed response whether the
+// result continues after this page.
+func setPageTrailers(w http.ResponseWriter, page *queryPage, more bool) {
+	w.Header().Set(queryHasMoreTrailer, strconv.FormatBool(more))
+	if more {
+		w.Header().Set(queryCursorTrailer, page.next())
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"mo11y/internal/auth"
+	"mo11y/internal/storage"
+)
+
+// SavedQuery is the JSON representation of a saved query.
+type SavedQuery struct {
+	Name        string               `json:"name"`
+	Description string               `json:"description,omitempty"`
+	SQL         string               `json:"sql"`
+	Params      []storage.QueryParam `json:"params"`
+	Owner       string               `json:"owner,omitempty"`
+	Visibility  string               `json:"visibility"` // private or tenant
+	CreatedAt   string               `json:"created_at,omitempty"`
+	UpdatedAt   string               `json:"updated_at,omitempty"`
+}
+
+// SavedQueryRun is the request body of POST /query/saved/{name}.
+type SavedQueryRun struct {
+	Params map[string]any `json:"params"`
+}
+
+func toSavedQuery(q storage.SavedQuery) SavedQuery {
+	return SavedQuery{
+		Name:        q.Name,
+		Description: q.Description,
+		SQL:         q.SQL,
+		Params:      q.Params,
+		Owner:       q.Owner,
+		Visibility:  q.Visibility,
+		CreatedAt:   q.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:   q.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+func fromSavedQuery(req SavedQuery) storage.SavedQuery {
+	return storage.SavedQuery{
+		Name:        req.Name,
+		Description: req.Description,
+		SQL:         trimQuery(req.SQL),
+		Params:      req.Params,
+		Visibility:  req.Visibility,
+	}
+}
+
+// handleSavedQueries handles GET and POST /query/saved.
+func handleSavedQueries(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			queries, err := store.ListSavedQueries(withOrigin(r))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			resp := make([]SavedQuery, len(queries))
+			for i, q := range queries {
+				resp[i] = toSavedQuery(q)
+			}
+			writeJSON(w, http.StatusOK, resp)
+
+		case http.MethodPost:
+			var req SavedQuery
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+
+			q, err := store.CreateSavedQuery(withOrigin(r), fromSavedQuery(req))
+			if errors.Is(err, storage.ErrSavedQueryExists) {
+				writeError(w, http.StatusConflict, err.Error())
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			writeJSON(w, http.StatusCreated, toSavedQuery(*q))
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleSavedQuery handles /query/saved/{name}: GET returns the query, PUT
+// replaces it, DELETE removes it and POST runs it with the parameters in
+// the body. Only the owner or an admin key may change a query.
+func handleSavedQuery(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/query/saved/")
+		if name == "" || name == r.URL.Path {
+			writeError(w, http.StatusBadRequest, "query name required")
+			return
+		}
+
+		ctx := withOrigin(r)
+		q, err := store.GetSavedQuery(ctx, name)
+		if errors.Is(err, storage.ErrSavedQueryNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, toSavedQuery(*q))
+
+		case http.MethodPut:
+			if !canChangeSavedQuery(r, q) {
+				writeError(w, http.StatusForbidden, "only the owner or an admin key may change this query")
+				return
+			}
+			var req SavedQuery
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			req.Name = name
+
+			updated, err := store.UpdateSavedQuery(ctx, fromSavedQuery(req))
+			if errors.Is(err, storage.ErrSavedQueryNotFound) {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, toSavedQuery(*updated))
+
+		case http.MethodDelete:
+			if !canChangeSavedQuery(r, q) {
+				writeError(w, http.StatusForbidden, "only the owner or an admin key may change this query")
+				return
+			}
+			err := store.DeleteSavedQuery(ctx, name)
+			if errors.Is(err, storage.ErrSavedQueryNotFound) {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+
+		case http.MethodPost:
+			var req SavedQueryRun
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					writeError(w, http.StatusBadRequest, "invalid request body")
+					return
+				}
+			}
+
+			// Values are bound to the parameters, never spliced into the SQL
+			args, err := storage.BindParams(q.Params, req.Params)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			query, err := store.ParamSQL(ctx, q.SQL, q.Params)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			runQuery(w, r, store, query, args)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// canChangeSavedQuery reports whether the request's API key owns q or is an
+// admin key. Anyone may change queries when auth is disabled.
+func canChangeSavedQuery(r *http.Request, q *storage.SavedQuery) bool {
+	info := auth.KeyFromContext(r.Context())
+	return info == nil || info.ID == q.Owner || info.Scopes.Has(auth.ScopeAdmin)
+}
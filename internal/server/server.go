@@ -3,10 +3,10 @@ package server
 import (
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"mo11y/internal/auth"
+	"mo11y/internal/forward"
 	"mo11y/internal/storage"
 )
 
@@ -16,6 +16,8 @@ type Config struct {
 	RetentionCfg       storage.CleanupConfig
 	MaxConcurrentIngest int
 	MaxConcurrentQuery  int
+	MaxTailSubscribers  int
+	Forwarder           *forward.Forwarder // nil when forwarding is disabled
 }
 
 // New creates a new HTTP server with OTLP endpoints.
@@ -25,53 +27,84 @@ func New(cfg Config, store *storage.Storage, authProvider *auth.Auth) *http.Serv
 	// Semaphores for backpressure
 	ingestSem := NewSemaphore(cfg.MaxConcurrentIngest)
 	querySem := NewSemaphore(cfg.MaxConcurrentQuery)
+	// Live tails are long-lived, so they get their own limit instead of query slots
+	tailSem := NewSemaphore(cfg.MaxTailSubscribers)
+
+	// Closed when the server begins shutting down, ending live tails
+	shutdown := make(chan struct{})
+
+	// protect wraps h with API key authentication and a scope check.
+	// When auth is disabled, handlers are mounted directly.
+	protect := func(scope auth.Scope, h http.Handler) http.Handler {
+		if authProvider == nil {
+			return h
+		}
+		return authProvider.Middleware(auth.RequireScope(scope)(h))
+	}
 
 	// Health endpoint (always public)
 	mux.HandleFunc("/health", handleHealth(store))
 
-	if authProvider == nil {
-		// Auth disabled - mount handlers directly
-		mux.HandleFunc("/stats", handleStats(store, cfg.RetentionCfg))
-		mux.Handle("/query", querySem.Middleware(http.HandlerFunc(handleQuery(store))))
-		mux.Handle("/v1/traces", ingestSem.Middleware(http.HandlerFunc(handleTraces(store))))
-		mux.Handle("/v1/metrics", ingestSem.Middleware(http.HandlerFunc(handleMetrics(store))))
-		mux.Handle("/v1/logs", ingestSem.Middleware(http.HandlerFunc(handleLogs(store))))
-	} else {
-		// Auth enabled - wrap with auth middleware
-		// Read endpoints
-		mux.Handle("/stats", authProvider.Middleware(
-			auth.RequireScope(auth.ScopeRead)(http.HandlerFunc(handleStats(store, cfg.RetentionCfg)))))
-		mux.Handle("/query", authProvider.Middleware(
-			auth.RequireScope(auth.ScopeRead)(querySem.Middleware(http.HandlerFunc(handleQuery(store))))))
+	// Read endpoints
+	mux.Handle("/stats", protect(auth.ScopeRead, http.HandlerFunc(handleStats(store, cfg.RetentionCfg, cfg.Forwarder))))
+	mux.Handle("/query", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleQuery(store)))))
+	mux.Handle("/query/saved", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleSavedQueries(store)))))
+	mux.Handle("/query/saved/", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleSavedQuery(store)))))
+	mux.Handle("/query/jobs", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleJobs(store)))))
+	mux.Handle("/query/jobs/", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleJob(store)))))
+	mux.Handle("/api/exemplars", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleExemplars(store)))))
+	mux.Handle("/api/metrics/quantiles", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleHistogramQuantiles(store)))))
+	mux.Handle("/api/metrics/heatmap", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleHistogramHeatmap(store)))))
+	mux.Handle("/api/metrics/rate", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleCounters(store, counterRate)))))
+	mux.Handle("/api/metrics/increase", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleCounters(store, counterIncrease)))))
+	mux.Handle("/api/metrics/delta", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleCounters(store, counterDelta)))))
+	mux.Handle("/api/service-graph", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleServiceGraph(store)))))
+	mux.Handle("/api/traces", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleSearchTraces(store)))))
+	mux.Handle("/api/traces/", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleTrace(store)))))
+	mux.Handle("/api/traceql", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleTraceQL(store)))))
+	mux.Handle("/api/dead-letters", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleDeadLetters(store)))))
+	mux.Handle("/jaeger/", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleJaeger(store)))))
+	mux.Handle("/api/v1/", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handlePrometheus(store)))))
+	mux.Handle("/loki/api/v1/", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleLoki(store)))))
+	mux.Handle("/api/logs/search", protect(auth.ScopeRead, querySem.Middleware(http.HandlerFunc(handleLogSearch(store)))))
+	mux.Handle("/api/tail", protect(auth.ScopeRead, tailSem.Middleware(http.HandlerFunc(handleTail(store, shutdown)))))
+
+	// Ingest endpoints
+	mux.Handle("/v1/traces", protect(auth.ScopeIngest, ingestSem.Middleware(http.HandlerFunc(handleTraces(store, cfg.Forwarder)))))
+	mux.Handle("/v1/metrics", protect(auth.ScopeIngest, ingestSem.Middleware(http.HandlerFunc(handleMetrics(store, cfg.Forwarder)))))
+	mux.Handle("/v1/logs", protect(auth.ScopeIngest, ingestSem.Middleware(http.HandlerFunc(handleLogs(store, cfg.Forwarder)))))
+
+	// Admin endpoints
+	mux.Handle("/admin/log-metric-rules", protect(auth.ScopeAdmin, http.HandlerFunc(handleLogMetricRules(store))))
+	mux.Handle("/admin/log-metric-rules/", protect(auth.ScopeAdmin, http.HandlerFunc(handleDeleteLogMetricRule(store))))
+	mux.Handle("/admin/dead-letters/reingest", protect(auth.ScopeAdmin, ingestSem.Middleware(http.HandlerFunc(handleReingestDeadLetters(store)))))
 
-		// Ingest endpoints
-		mux.Handle("/v1/traces", authProvider.Middleware(
-			auth.RequireScope(auth.ScopeIngest)(ingestSem.Middleware(http.HandlerFunc(handleTraces(store))))))
-		mux.Handle("/v1/metrics", authProvider.Middleware(
-			auth.RequireScope(auth.ScopeIngest)(ingestSem.Middleware(http.HandlerFunc(handleMetrics(store))))))
-		mux.Handle("/v1/logs", authProvider.Middleware(
-			auth.RequireScope(auth.ScopeIngest)(ingestSem.Middleware(http.HandlerFunc(handleLogs(store))))))
+	if authProvider != nil {
+		// Key management
+		mux.Handle("/admin/keys", protect(auth.ScopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+				handleListKeys(authProvider)(w, r)
+			case http.MethodPost:
+				handleCreateKey(authProvider)(w, r)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		})))
+		mux.Handle("/admin/keys/", protect(auth.ScopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodDelete:
+				handleRevokeKey(authProvider)(w, r)
+			case http.MethodPut:
+				handleUpdateKey(authProvider)(w, r)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		})))
 
-		// Admin endpoints
-		mux.Handle("/admin/keys", authProvider.Middleware(
-			auth.RequireScope(auth.ScopeAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				switch r.Method {
-				case http.MethodGet:
-					handleListKeys(authProvider)(w, r)
-				case http.MethodPost:
-					handleCreateKey(authProvider)(w, r)
-				default:
-					w.WriteHeader(http.StatusMethodNotAllowed)
-				}
-			}))))
-		mux.Handle("/admin/keys/", authProvider.Middleware(
-			auth.RequireScope(auth.ScopeAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/admin/keys/") {
-					handleRevokeKey(authProvider)(w, r)
-				} else {
-					w.WriteHeader(http.StatusMethodNotAllowed)
-				}
-			}))))
+		// Tenant management
+		mux.Handle("/admin/tenants", protect(auth.ScopeAdmin, http.HandlerFunc(handleTenants(authProvider))))
+		mux.Handle("/admin/tenants/", protect(auth.ScopeAdmin, http.HandlerFunc(handleTenant(authProvider))))
 	}
 
 	// Middleware execution order (request path):
@@ -83,11 +116,15 @@ func New(cfg Config, store *storage.Storage, authProvider *auth.Auth) *http.Serv
 		gzipMiddleware,
 	)
 
-	return &http.Server{
+	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.Port),
 		Handler:      handler,
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
+	// Shutdown waits for handlers to return, which streaming handlers only
+	// do when told to
+	srv.RegisterOnShutdown(func() { close(shutdown) })
+	return srv
 }
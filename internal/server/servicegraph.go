@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"mo11y/internal/storage"
+)
+
+// ServiceGraphResponse is the JSON response for the service dependency graph.
+type ServiceGraphResponse struct {
+	Start string             `json:"start"`
+	End   string             `json:"end"`
+	Nodes []string           `json:"nodes"`
+	Edges []ServiceGraphEdge `json:"edges"`
+}
+
+// ServiceGraphEdge is a client to server dependency aggregated over the range.
+type ServiceGraphEdge struct {
+	Client             string  `json:"client"`
+	Server             string  `json:"server"`
+	ConnectionType     string  `json:"connection_type"`
+	CallCount          int64   `json:"call_count"`
+	ErrorCount         int64   `json:"error_count"`
+	ClientLatencyAvgMs float64 `json:"client_latency_avg_ms"`
+	ServerLatencyAvgMs float64 `json:"server_latency_avg_ms"`
+	ClientLatencyMaxMs float64 `json:"client_latency_max_ms"`
+}
+
+// handleServiceGraph handles GET /api/service-graph.
+// Query parameters: start, end, format (json or dot).
+func handleServiceGraph(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reqID := RequestID(r.Context())
+
+		start, end, err := parseTimeRange(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		format := r.FormValue("format")
+		if format != "" && format != "json" && format != "dot" {
+			writeError(w, http.StatusBadRequest, "format must be json or dot")
+			return
+		}
+
+		edges, err := store.ServiceGraph(withOrigin(r), start, end)
+		if err != nil {
+			log.Printf("[%s] service graph error: %v", reqID, err)
+			writeError(w, http.StatusInternalServerError, "failed to load service graph")
+			return
+		}
+
+		if format == "dot" {
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			w.Write([]byte(serviceGraphDOT(edges)))
+			return
+		}
+
+		resp := ServiceGraphResponse{
+			Start: start.Format(time.RFC3339),
+			End:   end.Format(time.RFC3339),
+			Nodes: serviceGraphNodes(edges),
+			Edges: make([]ServiceGraphEdge, len(edges)),
+		}
+		for i, e := range edges {
+			resp.Edges[i] = ServiceGraphEdge{
+				Client:             e.Client,
+				Server:             e.Server,
+				ConnectionType:     e.ConnectionType,
+				CallCount:          e.CallCount,
+				ErrorCount:         e.ErrorCount,
+				ClientLatencyAvgMs: float64(e.ClientDurationAvgNs) / 1e6,
+				ServerLatencyAvgMs: float64(e.ServerDurationAvgNs) / 1e6,
+				ClientLatencyMaxMs: float64(e.ClientDurationMaxNs) / 1e6,
+			}
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// serviceGraphNodes returns the distinct services of the edges in first-seen order.
+func serviceGraphNodes(edges []storage.ServiceGraphEdge) []string {
+	nodes := []string{}
+	seen := make(map[string]bool)
+	for _, e := range edges {
+		for _, svc := range []string{e.Client, e.Server} {
+			if !seen[svc] {
+				seen[svc] = true
+				nodes = append(nodes, svc)
+			}
+		}
+	}
+	return nodes
+}
+
+// serviceGraphDOT renders edges as a Graphviz digraph.
+// Edges with errors are drawn red.
+func serviceGraphDOT(edges []storage.ServiceGraphEdge) string {
+	var b strings.Builder
+	b.WriteString("digraph services {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box];\n")
+	for _, svc := range serviceGraphNodes(edges) {
+		fmt.Fprintf(&b, "  %s;\n", dotQuote(svc))
+	}
+	for _, e := range edges {
+		// The label holds only numbers, and keeps its \n line breaks
+		attrs := fmt.Sprintf(`label="%d calls\n%d errors\navg %.1fms"`, e.CallCount, e.ErrorCount, float64(e.ClientDurationAvgNs)/1e6)
+		if e.ErrorCount > 0 {
+			attrs += ", color=red"
+		}
+		if e.ConnectionType == storage.ConnectionTypeMessaging {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(&b, "  %s -> %s [%s];\n", dotQuote(e.Client), dotQuote(e.Server), attrs)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// dotQuote quotes a DOT identifier, escaping backslashes before quotes so
+// that a name ending in a backslash cannot escape the closing quote.
+func dotQuote(s string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+}
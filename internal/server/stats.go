@@ -4,15 +4,26 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"mo11y/internal/forward"
 	"mo11y/internal/storage"
 )
 
 // StatsResponse is the JSON response for storage stats.
+// With a tenant, table counts and log metric rules are scoped to it and the
+// instance-wide sections (database, cleanup, service graph, query cache,
+// validation, forwarding) are left out.
 type StatsResponse struct {
-	Database  DatabaseStats  `json:"database"`
+	Tenant    string         `json:"tenant,omitempty"` // Set when the stats are scoped to the caller's tenant
+	Database  *DatabaseStats `json:"database,omitempty"`
 	Tables    TableStats     `json:"tables"`
 	Retention RetentionStats `json:"retention"`
 	Cleanup   *CleanupStats  `json:"cleanup,omitempty"`
+
+	ServiceGraph   *ServiceGraphStats   `json:"service_graph,omitempty"`
+	QueryCache     *QueryCacheStats     `json:"query_cache,omitempty"`
+	LogMetricRules []LogMetricRuleStats `json:"log_metric_rules"`
+	Validation     *ValidationStats     `json:"validation,omitempty"`
+	Forwarding     []ForwardTargetStats `json:"forwarding,omitempty"`
 }
 
 type DatabaseStats struct {
@@ -27,6 +38,9 @@ type TableStats struct {
 	SpanLinks  int64 `json:"span_links"`
 	Logs       int64 `json:"logs"`
 	Metrics    int64 `json:"metrics"`
+
+	MetricExemplars int64 `json:"metric_exemplars"`
+	DeadLetters     int64 `json:"dead_letters"`
 }
 
 type RetentionStats struct {
@@ -42,21 +56,70 @@ type CleanupStats struct {
 }
 
 type CleanupCounts struct {
-	SpansDeleted      int64 `json:"spans_deleted"`
-	SpanEventsDeleted int64 `json:"span_events_deleted"`
-	SpanLinksDeleted  int64 `json:"span_links_deleted"`
-	LogsDeleted       int64 `json:"logs_deleted"`
-	MetricsDeleted    int64 `json:"metrics_deleted"`
+	SpansDeleted       int64 `json:"spans_deleted"`
+	SpanEventsDeleted  int64 `json:"span_events_deleted"`
+	SpanLinksDeleted   int64 `json:"span_links_deleted"`
+	LogsDeleted        int64 `json:"logs_deleted"`
+	LogTermsDeleted    int64 `json:"log_terms_deleted"`
+	MetricsDeleted     int64 `json:"metrics_deleted"`
+	ExemplarsDeleted   int64 `json:"metric_exemplars_deleted"`
+	EdgesDeleted       int64 `json:"service_graph_edges_deleted"`
+	DeadLettersDeleted int64 `json:"dead_letters_deleted"`
+}
+
+type LogMetricRuleStats struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Metric  string `json:"metric"`
+	Matches int64  `json:"matches"`
+	Series  int    `json:"series"`
+	Evicted int64  `json:"evicted_series"` // Dropped after going idle
+}
+
+type ServiceGraphStats struct {
+	PendingSpans int   `json:"pending_spans"`
+	DroppedSpans int64 `json:"dropped_spans"`
+}
+
+type QueryCacheStats struct {
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+	MaxBytes      int64 `json:"max_bytes"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Invalidations int64 `json:"invalidations"` // Dropped because their data changed
+	Evictions     int64 `json:"evictions"`     // Dropped for space
+}
+
+type ValidationStats struct {
+	Mode     string                      `json:"mode"`
+	Rejected map[string]map[string]int64 `json:"rejected"` // signal -> reason -> count
+	Repaired map[string]map[string]int64 `json:"repaired"` // signal -> reason -> count
+	Dropped  map[string]map[string]int64 `json:"dropped"`  // Parts of stored records: signal -> reason -> count
+}
+
+type ForwardTargetStats struct {
+	Name        string  `json:"name"`
+	Endpoint    string  `json:"endpoint"`
+	Queued      int     `json:"queued"`
+	LagSeconds  float64 `json:"lag_seconds"`
+	Sent        int64   `json:"sent"`
+	Failed      int64   `json:"failed"`
+	Dropped     int64   `json:"dropped"`
+	Retries     int64   `json:"retries"`
+	Errors      int64   `json:"errors"`
+	LastError   string  `json:"last_error,omitempty"`
+	LastErrorAt string  `json:"last_error_at,omitempty"`
 }
 
-func handleStats(store *storage.Storage, retentionCfg storage.CleanupConfig) http.HandlerFunc {
+func handleStats(store *storage.Storage, retentionCfg storage.CleanupConfig, fwd *forward.Forwarder) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
 
-		stats, err := store.Stats(r.Context())
+		stats, err := store.Stats(withOrigin(r))
 		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusInternalServerError)
@@ -65,17 +128,16 @@ func handleStats(store *storage.Storage, retentionCfg storage.CleanupConfig) htt
 		}
 
 		resp := StatsResponse{
-			Database: DatabaseStats{
-				Path:         stats.DBPath,
-				SizeBytes:    stats.DBSizeBytes,
-				WALSizeBytes: stats.WALSizeBytes,
-			},
+			Tenant: tenantOf(r),
 			Tables: TableStats{
 				Spans:      stats.Tables.Spans,
 				SpanEvents: stats.Tables.SpanEvents,
 				SpanLinks:  stats.Tables.SpanLinks,
 				Logs:       stats.Tables.Logs,
 				Metrics:    stats.Tables.Metrics,
+
+				MetricExemplars: stats.Tables.MetricExemplars,
+				DeadLetters:     stats.Tables.DeadLetters,
 			},
 			Retention: RetentionStats{
 				Enabled:             retentionCfg.RetentionHours > 0,
@@ -84,21 +146,95 @@ func handleStats(store *storage.Storage, retentionCfg storage.CleanupConfig) htt
 			},
 		}
 
-		if stats.LastCleanup != nil {
-			resp.Cleanup = &CleanupStats{
-				LastRun:        stats.LastCleanup.Timestamp.Format("2006-01-02T15:04:05Z07:00"),
-				LastDurationMs: stats.LastCleanup.Duration.Milliseconds(),
-				LastResult: CleanupCounts{
-					SpansDeleted:      stats.LastCleanup.SpansDeleted,
-					SpanEventsDeleted: stats.LastCleanup.SpanEventsDeleted,
-					SpanLinksDeleted:  stats.LastCleanup.SpanLinksDeleted,
-					LogsDeleted:       stats.LastCleanup.LogsDeleted,
-					MetricsDeleted:    stats.LastCleanup.MetricsDeleted,
-				},
+		resp.LogMetricRules = make([]LogMetricRuleStats, len(stats.LogMetricRules))
+		for i, rs := range stats.LogMetricRules {
+			resp.LogMetricRules[i] = LogMetricRuleStats{
+				ID:      rs.ID,
+				Name:    rs.Name,
+				Metric:  rs.Metric,
+				Matches: rs.Matches,
+				Series:  rs.Series,
+				Evicted: rs.Evicted,
 			}
 		}
 
+		if resp.Tenant == "" {
+			addInstanceStats(&resp, stats, fwd)
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	}
 }
+
+// addInstanceStats adds the stats that cover all tenants to resp.
+func addInstanceStats(resp *StatsResponse, stats *storage.StorageStats, fwd *forward.Forwarder) {
+	resp.Database = &DatabaseStats{
+		Path:         stats.DBPath,
+		SizeBytes:    stats.DBSizeBytes,
+		WALSizeBytes: stats.WALSizeBytes,
+	}
+
+	if stats.LastCleanup != nil {
+		resp.Cleanup = &CleanupStats{
+			LastRun:        stats.LastCleanup.Timestamp.Format("2006-01-02T15:04:05Z07:00"),
+			LastDurationMs: stats.LastCleanup.Duration.Milliseconds(),
+			LastResult: CleanupCounts{
+				SpansDeleted:       stats.LastCleanup.SpansDeleted,
+				SpanEventsDeleted:  stats.LastCleanup.SpanEventsDeleted,
+				SpanLinksDeleted:   stats.LastCleanup.SpanLinksDeleted,
+				LogsDeleted:        stats.LastCleanup.LogsDeleted,
+				LogTermsDeleted:    stats.LastCleanup.LogTermsDeleted,
+				MetricsDeleted:     stats.LastCleanup.MetricsDeleted,
+				ExemplarsDeleted:   stats.LastCleanup.ExemplarsDeleted,
+				EdgesDeleted:       stats.LastCleanup.EdgesDeleted,
+				DeadLettersDeleted: stats.LastCleanup.DeadLettersDeleted,
+			},
+		}
+	}
+
+	if stats.ServiceGraph != nil {
+		resp.ServiceGraph = &ServiceGraphStats{
+			PendingSpans: stats.ServiceGraph.PendingSpans,
+			DroppedSpans: stats.ServiceGraph.DroppedSpans,
+		}
+	}
+
+	if c := stats.ResultCache; c != nil {
+		resp.QueryCache = &QueryCacheStats{
+			Entries:       c.Entries,
+			Bytes:         c.Bytes,
+			MaxBytes:      c.MaxBytes,
+			Hits:          c.Hits,
+			Misses:        c.Misses,
+			Invalidations: c.Invalidations,
+			Evictions:     c.Evictions,
+		}
+	}
+
+	for _, ts := range fwd.Stats() {
+		fs := ForwardTargetStats{
+			Name:       ts.Name,
+			Endpoint:   ts.Endpoint,
+			Queued:     ts.Queued,
+			LagSeconds: ts.LagSeconds,
+			Sent:       ts.Sent,
+			Failed:     ts.Failed,
+			Dropped:    ts.Dropped,
+			Retries:    ts.Retries,
+			Errors:     ts.Errors,
+			LastError:  ts.LastError,
+		}
+		if !ts.LastErrorAt.IsZero() {
+			fs.LastErrorAt = ts.LastErrorAt.Format("2006-01-02T15:04:05Z07:00")
+		}
+		resp.Forwarding = append(resp.Forwarding, fs)
+	}
+
+	resp.Validation = &ValidationStats{
+		Mode:     stats.Validation.Mode,
+		Rejected: stats.Validation.Rejected,
+		Repaired: stats.Validation.Repaired,
+		Dropped:  stats.Validation.Dropped,
+	}
+}
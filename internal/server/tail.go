@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"golang.org/x/net/websocket"
+
+	"mo11y/internal/storage"
+)
+
+const (
+	tailBuffer        = 256
+	maxTailBuffer     = 10000
+	tailHeartbeat     = 15 * time.Second
+	tailWriteDeadline = 10 * time.Second // A client this slow to accept a write is dropped
+)
+
+// TailEvent is a log record or span streamed by the live tail.
+type TailEvent struct {
+	Signal        string            `json:"signal"` // logs or spans
+	Timestamp     string            `json:"timestamp"`
+	Service       string            `json:"service,omitempty"`
+	TraceID       string            `json:"trace_id,omitempty"`
+	SpanID        string            `json:"span_id,omitempty"`
+	Attrs         map[string]string `json:"attrs"`
+	ResourceAttrs map[string]string `json:"resource_attrs"`
+
+	// Logs
+	LogID          string            `json:"log_id,omitempty"`
+	SeverityNumber int8              `json:"severity_number,omitempty"`
+	SeverityText   string            `json:"severity_text,omitempty"`
+	Body           string            `json:"body,omitempty"`
+	BodyFields     map[string]string `json:"body_fields,omitempty"`
+
+	// Spans
+	ParentSpanID string  `json:"parent_span_id,omitempty"`
+	Name         string  `json:"name,omitempty"`
+	Kind         string  `json:"kind,omitempty"`
+	StatusCode   string  `json:"status_code,omitempty"`
+	DurationMs   float64 `json:"duration_ms,omitempty"`
+}
+
+// TailDropped reports records dropped because the subscriber fell behind.
+type TailDropped struct {
+	Dropped uint64 `json:"dropped"` // Total since the stream started
+}
+
+// handleTail handles GET /api/tail, streaming logs and spans as they are
+// ingested. It serves Server-Sent Events, or a WebSocket when the request
+// asks for an upgrade. The stream ends when the server shuts down.
+// Query parameters: signal (repeatable, logs or spans), service, severity
+// (minimum log severity; excludes spans), attr (repeatable key=value or
+// key=~regex), buffer.
+func handleTail(store *storage.Storage, shutdown <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reqID := RequestID(r.Context())
+
+		f, buffer, err := parseTailFilter(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sub, err := store.SubscribeTail(withOrigin(r), f, buffer)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer sub.Close()
+
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			websocket.Server{
+				// Any origin may connect; access is governed by the API key
+				Handshake: func(*websocket.Config, *http.Request) error { return nil },
+				Handler:   func(ws *websocket.Conn) { tailWebSocket(ws, sub, shutdown) },
+			}.ServeHTTP(w, r)
+		} else {
+			tailSSE(w, r, sub, shutdown)
+		}
+		log.Printf("[%s] tail ended, %d records dropped", reqID, sub.Dropped())
+	}
+}
+
+func parseTailFilter(r *http.Request) (storage.TailFilter, int, error) {
+	f := storage.TailFilter{Service: r.FormValue("service")}
+	for _, v := range r.Form["signal"] {
+		if v != storage.SignalLogs && v != storage.SignalSpans {
+			return f, 0, fmt.Errorf("signal must be logs or spans")
+		}
+		f.Signals = append(f.Signals, v)
+	}
+
+	var err error
+	if f.MinSeverity, err = parseSeverity(r.FormValue("severity")); err != nil {
+		return f, 0, err
+	}
+	if f.Attrs, err = parseAttrFilters(r); err != nil {
+		return f, 0, err
+	}
+	buffer, err := intParam(r, "buffer", tailBuffer, maxTailBuffer)
+	if err != nil {
+		return f, 0, err
+	}
+	return f, buffer, nil
+}
+
+// tailSSE streams records as events named after their signal. Drops are
+// reported in dropped events, and comments keep idle connections open.
+func tailSSE(w http.ResponseWriter, r *http.Request, sub *storage.TailSubscription, shutdown <-chan struct{}) {
+	rc := http.NewResponseController(w)
+	send := func(event string, data any) error {
+		// Replaces the server's WriteTimeout, which would end the stream
+		if err := rc.SetWriteDeadline(time.Now().Add(tailWriteDeadline)); err != nil {
+			return err
+		}
+		if event != "" {
+			b, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+				return err
+			}
+		} else if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	streamTail(r.Context().Done(), sub, shutdown, func(rec *storage.TailRecord, dropped uint64) error {
+		switch {
+		case rec != nil:
+			return send(rec.Signal, toTailEvent(rec))
+		case dropped > 0:
+			return send("dropped", TailDropped{Dropped: dropped})
+		}
+		return send("", nil)
+	})
+}
+
+// tailWebSocket streams records as JSON text messages. Drops are reported as
+// {"dropped": n} messages.
+func tailWebSocket(ws *websocket.Conn, sub *storage.TailSubscription, shutdown <-chan struct{}) {
+	defer ws.Close()
+
+	// The connection keeps the read deadline of the upgrade request; clear it
+	// and read until the client goes away
+	ws.SetReadDeadline(time.Time{})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var msg []byte
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+
+	streamTail(closed, sub, shutdown, func(rec *storage.TailRecord, dropped uint64) error {
+		ws.SetWriteDeadline(time.Now().Add(tailWriteDeadline))
+		switch {
+		case rec != nil:
+			return websocket.JSON.Send(ws, toTailEvent(rec))
+		case dropped > 0:
+			return websocket.JSON.Send(ws, TailDropped{Dropped: dropped})
+		}
+		return wsPing.Send(ws, nil)
+	})
+}
+
+// wsPing sends ping frames, which clients answer without passing them on.
+var wsPing = websocket.Codec{Marshal: func(any) ([]byte, byte, error) {
+	return nil, websocket.PingFrame, nil
+}}
+
+// streamTail hands records to send until done is closed, a write fails or
+// the server shuts down. send receives either a record, a new drop total or
+// neither for a heartbeat.
+func streamTail(done <-chan struct{}, sub *storage.TailSubscription, shutdown <-chan struct{}, send func(*storage.TailRecord, uint64) error) {
+	heartbeat := time.NewTicker(tailHeartbeat)
+	defer heartbeat.Stop()
+
+	var reported uint64
+	reportDrops := func() error {
+		if dropped := sub.Dropped(); dropped != reported {
+			reported = dropped
+			return send(nil, dropped)
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-shutdown:
+			return
+		case rec := <-sub.Records():
+			if err := reportDrops(); err != nil {
+				return
+			}
+			if err := send(&rec, 0); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := reportDrops(); err != nil {
+				return
+			}
+			if err := send(nil, 0); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func toTailEvent(rec *storage.TailRecord) TailEvent {
+	ev := TailEvent{
+		Signal:        rec.Signal,
+		Timestamp:     rec.Timestamp.UTC().Format(time.RFC3339Nano),
+		Service:       rec.Service,
+		TraceID:       rec.TraceID,
+		SpanID:        rec.SpanID,
+		Attrs:         rec.Attrs,
+		ResourceAttrs: rec.ResourceAttrs,
+	}
+	if rec.Signal == storage.SignalLogs {
+		ev.LogID = rec.LogID
+		ev.SeverityNumber = rec.SeverityNumber
+		ev.SeverityText = rec.SeverityText
+		ev.Body = rec.Body
+		ev.BodyFields = rec.BodyFields
+	} else {
+		ev.ParentSpanID = rec.ParentSpanID
+		ev.Name = rec.Name
+		ev.Kind = tracev1.Span_SpanKind(rec.Kind).String()
+		ev.StatusCode = tracev1.Status_StatusCode(rec.StatusCode).String()
+		ev.DurationMs = float64(rec.Duration) / 1e6
+	}
+	return ev
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"mo11y/internal/auth"
+)
+
+// Tenant is the JSON representation of a tenant.
+type Tenant struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	RetentionHours *int   `json:"retention_hours"` // null uses the global retention, 0 keeps data forever
+	CreatedAt      string `json:"created_at,omitempty"`
+}
+
+func toTenant(t auth.Tenant) Tenant {
+	return Tenant{
+		ID:             t.ID,
+		Name:           t.Name,
+		RetentionHours: t.RetentionHours,
+		CreatedAt:      t.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// handleTenants handles GET and POST /admin/tenants.
+func handleTenants(a *auth.Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			tenants, err := a.ListTenants(r.Context())
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			resp := make([]Tenant, len(tenants))
+			for i, t := range tenants {
+				resp[i] = toTenant(t)
+			}
+			writeJSON(w, http.StatusOK, resp)
+
+		case http.MethodPost:
+			var req Tenant
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if req.RetentionHours != nil && *req.RetentionHours < 0 {
+				writeError(w, http.StatusBadRequest, "retention_hours must not be negative")
+				return
+			}
+
+			t, err := a.CreateTenant(r.Context(), req.ID, req.Name, req.RetentionHours)
+			if errors.Is(err, auth.ErrTenantExists) {
+				writeError(w, http.StatusConflict, err.Error())
+				return
+			}
+			if errors.Is(err, auth.ErrInvalidTenant) {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			writeJSON(w, http.StatusCreated, toTenant(*t))
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleTenant handles PUT and DELETE /admin/tenants/{id}.
+// PUT only updates retention_hours.
+func handleTenant(a *auth.Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/admin/tenants/")
+		if id == "" || id == r.URL.Path {
+			writeError(w, http.StatusBadRequest, "tenant id required")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			var req struct {
+				RetentionHours *int `json:"retention_hours"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if req.RetentionHours != nil && *req.RetentionHours < 0 {
+				writeError(w, http.StatusBadRequest, "retention_hours must not be negative")
+				return
+			}
+
+			err := a.SetTenantRetention(r.Context(), id, req.RetentionHours)
+			if errors.Is(err, auth.ErrTenantNotFound) {
+				writeError(w, http.StatusNotFound, "tenant not found")
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			t, err := a.GetTenant(r.Context(), id)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, toTenant(*t))
+
+		case http.MethodDelete:
+			err := a.DeleteTenant(r.Context(), id)
+			if errors.Is(err, auth.ErrTenantNotFound) {
+				writeError(w, http.StatusNotFound, "tenant not found")
+				return
+			}
+			if errors.Is(err, auth.ErrTenantInUse) {
+				writeError(w, http.StatusConflict, err.Error())
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mo11y/internal/storage"
+	"mo11y/internal/traceql"
+)
+
+const (
+	traceQLSpansPerTrace    = 3
+	maxTraceQLSpansPerTrace = 100
+)
+
+// TraceQLResponse is the JSON response for a TraceQL query.
+type TraceQLResponse struct {
+	Traces []TraceQLTrace `json:"traces"`
+	Count  int            `json:"count"`
+}
+
+// TraceQLTrace is a trace summary with the spans that matched the query.
+type TraceQLTrace struct {
+	TraceSummary
+	MatchedCount int64         `json:"matched_count"`
+	MatchedSpans []MatchedSpan `json:"matched_spans"` // At most spss, earliest first
+}
+
+type MatchedSpan struct {
+	SpanID     string  `json:"span_id"`
+	Name       string  `json:"name"`
+	Service    string  `json:"service,omitempty"`
+	StartTime  string  `json:"start_time"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// handleTraceQL handles GET /api/traceql.
+// Query parameters: q (TraceQL query), start, end, limit, spss (matched spans
+// returned per trace).
+func handleTraceQL(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reqID := RequestID(r.Context())
+
+		query := r.FormValue("q")
+		if query == "" {
+			writeError(w, http.StatusBadRequest, "missing q parameter")
+			return
+		}
+		expr, err := traceql.Parse(query)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid TraceQL: "+err.Error())
+			return
+		}
+		compiled, err := traceql.Compile(expr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid TraceQL: "+err.Error())
+			return
+		}
+
+		start, end, err := parseTimeRange(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit, err := intParam(r, "limit", traceSearchLimit, maxTraceSearchLimit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		spss, err := intParam(r, "spss", traceQLSpansPerTrace, maxTraceQLSpansPerTrace)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		results, err := store.TraceQL(withOrigin(r), compiled, start, end, limit, spss)
+		if err != nil {
+			log.Printf("[%s] TraceQL error: %v", reqID, err)
+			writeError(w, http.StatusInternalServerError, "failed to run TraceQL query")
+			return
+		}
+
+		resp := TraceQLResponse{Traces: make([]TraceQLTrace, len(results)), Count: len(results)}
+		for i, res := range results {
+			t := TraceQLTrace{
+				TraceSummary: toTraceSummary(res.TraceSummary),
+				MatchedCount: res.MatchedCount,
+				MatchedSpans: make([]MatchedSpan, len(res.Matched)),
+			}
+			for j, sp := range res.Matched {
+				t.MatchedSpans[j] = MatchedSpan{
+					SpanID:     sp.SpanID,
+					Name:       sp.Name,
+					Service:    sp.Service,
+					StartTime:  sp.StartTime.Format(time.RFC3339Nano),
+					DurationMs: float64(sp.DurationNs) / 1e6,
+				}
+			}
+			resp.Traces[i] = t
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// intParam parses an optional integer parameter between 1 and max.
+func intParam(r *http.Request, name string, def, max int) (int, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > max {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, max)
+	}
+	return n, nil
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"mo11y/internal/storage"
+)
+
+const (
+	traceSearchLimit    = 20
+	maxTraceSearchLimit = 1000
+)
+
+// TraceSearchResponse is the JSON response for a trace search.
+type TraceSearchResponse struct {
+	Traces     []TraceSummary `json:"traces"`
+	Count      int            `json:"count"`
+	NextCursor string         `json:"next_cursor,omitempty"` // Pass as cursor for the next page
+}
+
+type TraceSummary struct {
+	TraceID     string   `json:"trace_id"`
+	RootService string   `json:"root_service"`
+	RootName    string   `json:"root_name"`
+	StartTime   string   `json:"start_time"`
+	DurationMs  float64  `json:"duration_ms"`
+	SpanCount   int64    `json:"span_count"`
+	ErrorCount  int64    `json:"error_count"`
+	Services    []string `json:"services"`
+}
+
+// spanStatusCodes maps the status parameter to OTLP status codes.
+var spanStatusCodes = map[string]int8{
+	"unset": int8(tracev1.Status_STATUS_CODE_UNSET),
+	"ok":    int8(tracev1.Status_STATUS_CODE_OK),
+	"error": int8(tracev1.Status_STATUS_CODE_ERROR),
+}
+
+// handleSearchTraces handles GET /api/traces.
+// Query parameters: start, end, service, name, min_duration, max_duration,
+// status (unset, ok or error), attr (repeatable key=value or key=~regex),
+// sort (start_time or duration), limit, cursor.
+func handleSearchTraces(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reqID := RequestID(r.Context())
+
+		q, err := parseTraceSearch(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		traces, cursor, err := store.SearchTraces(withOrigin(r), q)
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] trace search error: %v", reqID, err)
+			writeError(w, http.StatusInternalServerError, "failed to search traces")
+			return
+		}
+
+		resp := TraceSearchResponse{
+			Traces:     make([]TraceSummary, len(traces)),
+			Count:      len(traces),
+			NextCursor: cursor,
+		}
+		for i, t := range traces {
+			resp.Traces[i] = toTraceSummary(t)
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func toTraceSummary(t storage.TraceSummary) TraceSummary {
+	return TraceSummary{
+		TraceID:     t.TraceID,
+		RootService: t.RootService,
+		RootName:    t.RootName,
+		StartTime:   t.StartTime.Format(time.RFC3339Nano),
+		DurationMs:  float64(t.DurationNs) / 1e6,
+		SpanCount:   t.SpanCount,
+		ErrorCount:  t.ErrorCount,
+		Services:    t.Services,
+	}
+}
+
+func parseTraceSearch(r *http.Request) (storage.TraceSearch, error) {
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		return storage.TraceSearch{}, err
+	}
+
+	q := storage.TraceSearch{
+		Start:    start,
+		End:      end,
+		Service:  r.FormValue("service"),
+		SpanName: r.FormValue("name"),
+		Sort:     r.FormValue("sort"),
+		Limit:    traceSearchLimit,
+		Cursor:   r.FormValue("cursor"),
+	}
+	if q.Sort != "" && q.Sort != storage.TraceSortStartTime && q.Sort != storage.TraceSortDuration {
+		return q, fmt.Errorf("sort must be start_time or duration")
+	}
+	if v := r.FormValue("min_duration"); v != "" {
+		if q.MinDuration, err = time.ParseDuration(v); err != nil || q.MinDuration < 0 {
+			return q, fmt.Errorf("invalid min_duration %q, expected e.g. 250ms", v)
+		}
+	}
+	if v := r.FormValue("max_duration"); v != "" {
+		if q.MaxDuration, err = time.ParseDuration(v); err != nil || q.MaxDuration < 0 {
+			return q, fmt.Errorf("invalid max_duration %q, expected e.g. 2s", v)
+		}
+	}
+	if v := r.FormValue("status"); v != "" {
+		code, ok := spanStatusCodes[v]
+		if !ok {
+			return q, fmt.Errorf("status must be unset, ok or error")
+		}
+		q.StatusCode = &code
+	}
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTraceSearchLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxTraceSearchLimit)
+		}
+		q.Limit = n
+	}
+
+	if q.Attrs, err = parseAttrFilters(r); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// parseAttrFilters parses the repeatable attr parameter, key=value or key=~regex.
+func parseAttrFilters(r *http.Request) ([]storage.AttrFilter, error) {
+	var filters []storage.AttrFilter
+	for _, v := range r.Form["attr"] {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid attr %q, expected key=value or key=~regex", v)
+		}
+		f := storage.AttrFilter{Key: key, Value: value}
+		if strings.HasPrefix(value, "~") {
+			f.Value, f.Regex = value[1:], true
+			if _, err := regexp.Compile(f.Value); err != nil {
+				return nil, fmt.Errorf("invalid attr regex %q: %v", f.Value, err)
+			}
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// TraceResponse is the JSON response for a trace assembled into a span tree.
+type TraceResponse struct {
+	TraceID     string      `json:"trace_id"`
+	StartTime   string      `json:"start_time"`
+	EndTime     string      `json:"end_time"`
+	DurationMs  float64     `json:"duration_ms"`
+	SpanCount   int         `json:"span_count"`
+	OrphanCount int         `json:"orphan_count"`
+	Services    []string    `json:"services"`
+	Roots       []*SpanNode `json:"roots"` // Root spans followed by orphans
+}
+
+// SpanNode is a span with its children in a trace tree.
+type SpanNode struct {
+	SpanID        string            `json:"span_id"`
+	ParentSpanID  string            `json:"parent_span_id,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind"`
+	Service       string            `json:"service,omitempty"`
+	StartTime     string            `json:"start_time"`
+	EndTime       string            `json:"end_time"`
+	DurationMs    float64           `json:"duration_ms"`
+	SelfTimeMs    float64           `json:"self_time_ms"`
+	StatusCode    string            `json:"status_code"`
+	StatusMessage string            `json:"status_message,omitempty"`
+	Orphan        bool              `json:"orphan,omitempty"`
+	Attrs         map[string]string `json:"attrs"`
+	Resource      SpanResource      `json:"resource"`
+	Scope         SpanScope         `json:"scope"`
+	Events        []SpanEvent       `json:"events"`
+	Links         []SpanLink        `json:"links"`
+	Children      []*SpanNode       `json:"children"`
+}
+
+type SpanResource struct {
+	Attrs     map[string]string `json:"attrs"`
+	SchemaURL string            `json:"schema_url,omitempty"`
+}
+
+type SpanScope struct {
+	Name      string            `json:"name,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+	SchemaURL string            `json:"schema_url,omitempty"`
+}
+
+type SpanEvent struct {
+	Time  string            `json:"time"`
+	Name  string            `json:"name"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+type SpanLink struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	TraceState string            `json:"trace_state,omitempty"`
+	Attrs      map[string]string `json:"attrs,omitempty"`
+}
+
+// handleTrace handles GET /api/traces/{trace_id}.
+// Query parameters: format (tree, otlp-json or otlp-proto). An Accept header of
+// application/x-protobuf selects otlp-proto when no format is given.
+func handleTrace(store *storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		reqID := RequestID(r.Context())
+
+		traceID := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/api/traces/"))
+		if b, err := hex.DecodeString(traceID); err != nil || len(b) != 16 {
+			writeError(w, http.StatusBadRequest, "trace id must be 32 hex characters")
+			return
+		}
+
+		format := r.FormValue("format")
+		if format == "" {
+			format = "tree"
+			if strings.HasPrefix(r.Header.Get("Accept"), "application/x-protobuf") {
+				format = "otlp-proto"
+			}
+		}
+		if format != "tree" && format != "otlp-json" && format != "otlp-proto" {
+			writeError(w, http.StatusBadRequest, "format must be tree, otlp-json or otlp-proto")
+			return
+		}
+
+		trace, err := store.Trace(withOrigin(r), traceID)
+		if errors.Is(err, storage.ErrTraceNotFound) {
+			writeError(w, http.StatusNotFound, "trace not found")
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] trace error: %v", reqID, err)
+			writeError(w, http.StatusInternalServerError, "failed to load trace")
+			return
+		}
+
+		switch format {
+		case "otlp-proto":
+			body, err := proto.Marshal(trace.OTLP())
+			if err != nil {
+				log.Printf("[%s] BUG: trace: failed to marshal protobuf: %v", reqID, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.Write(body)
+
+		case "otlp-json":
+			body, err := storage.MarshalOTLPJSON(trace.OTLP())
+			if err != nil {
+				log.Printf("[%s] BUG: trace: failed to marshal OTLP JSON: %v", reqID, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+
+		default:
+			writeJSON(w, http.StatusOK, toTraceResponse(trace))
+		}
+	}
+}
+
+func toTraceResponse(t *storage.Trace) TraceResponse {
+	resp := TraceResponse{
+		TraceID:   t.TraceID,
+		SpanCount: len(t.Spans),
+		Services:  []string{},
+		Roots:     make([]*SpanNode, len(t.Roots)),
+	}
+
+	var start, end time.Time
+	seen := make(map[string]bool)
+	for i, sp := range t.Spans {
+		spanEnd := sp.StartTime.Add(time.Duration(sp.DurationNs))
+		if i == 0 || sp.StartTime.Before(start) {
+			start = sp.StartTime
+		}
+		if spanEnd.After(end) {
+			end = spanEnd
+		}
+		if sp.Orphan {
+			resp.OrphanCount++
+		}
+		if svc := sp.ResourceAttrs["service.name"]; svc != "" && !seen[svc] {
+			seen[svc] = true
+			resp.Services = append(resp.Services, svc)
+		}
+	}
+	resp.StartTime = start.Format(time.RFC3339Nano)
+	resp.EndTime = end.Format(time.RFC3339Nano)
+	resp.DurationMs = float64(end.Sub(start)) / 1e6
+
+	for i, sp := range t.Roots {
+		resp.Roots[i] = toSpanNode(sp)
+	}
+	return resp
+}
+
+func toSpanNode(sp *storage.TraceSpan) *SpanNode {
+	node := &SpanNode{
+		SpanID:        sp.SpanID,
+		ParentSpanID:  sp.ParentSpanID,
+		Name:          sp.Name,
+		Kind:          tracev1.Span_SpanKind(sp.Kind).String(),
+		Service:       sp.ResourceAttrs["service.name"],
+		StartTime:     sp.StartTime.Format(time.RFC3339Nano),
+		EndTime:       sp.StartTime.Add(time.Duration(sp.DurationNs)).Format(time.RFC3339Nano),
+		DurationMs:    float64(sp.DurationNs) / 1e6,
+		SelfTimeMs:    float64(sp.SelfTimeNs) / 1e6,
+		StatusCode:    tracev1.Status_StatusCode(sp.StatusCode).String(),
+		StatusMessage: sp.StatusMessage,
+		Orphan:        sp.Orphan,
+		Attrs:         sp.Attrs,
+		Resource:      SpanResource{Attrs: sp.ResourceAttrs, SchemaURL: sp.ResourceSchemaURL},
+		Scope: SpanScope{
+			Name:      sp.ScopeName,
+			Version:   sp.ScopeVersion,
+			Attrs:     sp.ScopeAttrs,
+			SchemaURL: sp.ScopeSchemaURL,
+		},
+		Events:   make([]SpanEvent, len(sp.Events)),
+		Links:    make([]SpanLink, len(sp.Links)),
+		Children: make([]*SpanNode, len(sp.Children)),
+	}
+	for i, ev := range sp.Events {
+		node.Events[i] = SpanEvent{Time: ev.Time.Format(time.RFC3339Nano), Name: ev.Name, Attrs: ev.Attrs}
+	}
+	for i, link := range sp.Links {
+		node.Links[i] = SpanLink{TraceID: link.TraceID, SpanID: link.SpanID, TraceState: link.TraceState, Attrs: link.Attrs}
+	}
+	for i, child := range sp.Children {
+		node.Children[i] = toSpanNode(child)
+	}
+	return node
+}
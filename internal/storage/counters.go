@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// maxCounterSeries limits the series returned by CounterSteps.
+const maxCounterSeries = 1000
+
+// ErrTooManySeries reports a CounterQuery matching more than maxCounterSeries.
+var ErrTooManySeries = fmt.Errorf("more than %d series match", maxCounterSeries)
+
+// counterChangesSelect computes the change of each gauge and sum data point
+// since the previous point of its series, identified by name, attrs and
+// resource_attrs. The caller fills in the row conditions.
+//
+// increase is the growth of the counter: the value itself for delta
+// temporality and after a reset, the difference to the previous value
+// otherwise. A cumulative point resets when its start time moved on, or, for
+// monotonic sums, when its value went down. delta is the plain difference
+// without reset handling, or the value itself for delta temporality. Both
+// are NULL for the first point of a cumulative series. temporality holds the
+// OTLP value, 1 for delta; sums stored without one are cumulative.
+const counterChangesSelect = `SELECT name, attrs, resource_attrs, timestamp, type, value, is_monotonic, temporality,
+	CASE WHEN temporality = 1 OR reset THEN value ELSE value - prev_value END AS increase,
+	CASE WHEN temporality = 1 THEN value ELSE value - prev_value END AS delta,
+	coalesce(reset, false) AS reset
+FROM (
+	SELECT *, prev_value IS NOT NULL AND temporality IS DISTINCT FROM 1
+		AND (start_time > prev_start OR (is_monotonic AND value < prev_value)) AS reset
+	FROM (
+		SELECT name, attrs, resource_attrs, timestamp, type, value, is_monotonic, start_time, temporality,
+			lag(value) OVER series AS prev_value,
+			lag(start_time) OVER series AS prev_start
+		FROM metrics
+		WHERE type IN (1, 2) AND %s
+		WINDOW series AS (PARTITION BY name, attrs, resource_attrs ORDER BY timestamp)
+	)
+)`
+
+// counterMacros are the table macros over counterChangesSelect available in
+// user queries, mapped to the table they read.
+var counterMacros = map[string]string{
+	"metric_changes":  "metrics",
+	"metric_increase": "metrics",
+	"metric_rate":     "metrics",
+	"metric_delta":    "metrics",
+}
+
+// counterMacroStatements define the counterMacros. metric_changes returns
+// every data point of a metric with its increase, delta and reset flag; the
+// others sum those per series in steps of an INTERVAL.
+func counterMacroStatements() []string {
+	return []string{
+		"CREATE OR REPLACE MACRO metric_changes(metric_name) AS TABLE\n" +
+			fmt.Sprintf(counterChangesSelect, "name = metric_name"),
+		`CREATE OR REPLACE MACRO metric_increase(metric_name, step) AS TABLE
+			SELECT name, attrs, resource_attrs, time_bucket(step, timestamp) AS time, sum(increase) AS value
+			FROM metric_changes(metric_name)
+			WHERE increase IS NOT NULL
+			GROUP BY ALL`,
+		`CREATE OR REPLACE MACRO metric_rate(metric_name, step) AS TABLE
+			SELECT name, attrs, resource_attrs, time_bucket(step, timestamp) AS time, sum(increase) / epoch(step) AS value
+			FROM metric_changes(metric_name)
+			WHERE increase IS NOT NULL
+			GROUP BY ALL`,
+		`CREATE OR REPLACE MACRO metric_delta(metric_name, step) AS TABLE
+			SELECT name, attrs, resource_attrs, time_bucket(step, timestamp) AS time, sum(delta) AS value
+			FROM metric_changes(metric_name)
+			WHERE delta IS NOT NULL
+			GROUP BY ALL`,
+	}
+}
+
+// CounterQuery selects the gauge and sum series returned by CounterSteps.
+type CounterQuery struct {
+	Metric string
+	Attrs  []AttrFilter // Matched against data point, then resource attributes
+	Start  time.Time
+	End    time.Time
+	Step   time.Duration
+}
+
+// CounterSeries holds the changes of one series in each step.
+type CounterSeries struct {
+	Attrs         map[string]string
+	ResourceAttrs map[string]string
+	Monotonic     bool
+	Temporality   string     // TemporalityCumulative or TemporalityDelta, empty for gauges
+	Increase      []*float64 // Per step, nil for steps without a change
+	Delta         []*float64 // Per step, nil for steps without a change
+	Resets        int        // Resets detected within the range
+}
+
+// CounterSteps holds the series of a CounterQuery, aligned to the same steps.
+type CounterSteps struct {
+	Times  []time.Time // Start of each step
+	Series []CounterSeries
+}
+
+// CounterSteps sums the increase and delta of each series of a metric per
+// step, as computed by counterChangesSelect. The change of a point is counted
+// in the step holding the point; the previous point of a series is looked up
+// as far back as one step before the start.
+func (s *Storage) CounterSteps(ctx context.Context, q CounterQuery) (*CounterSteps, error) {
+	if q.Step <= 0 || !q.Start.Before(q.End) {
+		return nil, fmt.Errorf("invalid counter range")
+	}
+	n := int((q.End.Sub(q.Start) + q.Step - 1) / q.Step)
+
+	conds := []string{"name = ?", "timestamp >= ?", "timestamp < ?"}
+	args := []any{q.Metric, q.Start.Add(-q.Step), q.End}
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		conds = append(conds, "tenant_id = ?")
+		args = append(args, tenantID)
+	}
+	attrConds, attrArgs := attrFilterConditions(q.Attrs)
+	conds = append(conds, attrConds...)
+	args = append(args, attrArgs...)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT hash(attrs, resource_attrs) AS series, attrs, resource_attrs, timestamp,
+			type, is_monotonic, temporality, increase, delta, reset
+		FROM (`+fmt.Sprintf(counterChangesSelect, strings.Join(conds, " AND "))+`)
+		ORDER BY series, timestamp
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query counters: %w", err)
+	}
+	defer rows.Close()
+
+	result := &CounterSteps{Times: make([]time.Time, n)}
+	for i := range result.Times {
+		result.Times[i] = q.Start.Add(time.Duration(i) * q.Step)
+	}
+
+	var (
+		current  *CounterSeries
+		seriesID uint64
+	)
+	for rows.Next() {
+		var id uint64
+		var attrs, resourceAttrs duckdb.Map
+		var ts time.Time
+		var metricType int8
+		var monotonic *bool
+		var temporality *int8
+		var increase, delta *float64
+		var reset bool
+		if err := rows.Scan(&id, &attrs, &resourceAttrs, &ts, &metricType, &monotonic, &temporality, &increase, &delta, &reset); err != nil {
+			return nil, fmt.Errorf("failed to scan counter: %w", err)
+		}
+		if current == nil || id != seriesID {
+			if len(result.Series) == maxCounterSeries {
+				return nil, ErrTooManySeries
+			}
+			result.Series = append(result.Series, CounterSeries{
+				Attrs:         mapToStrings(attrs),
+				ResourceAttrs: mapToStrings(resourceAttrs),
+				Increase:      make([]*float64, n),
+				Delta:         make([]*float64, n),
+			})
+			current, seriesID = &result.Series[len(result.Series)-1], id
+		}
+		current.Monotonic = monotonic != nil && *monotonic
+		current.Temporality = ""
+		if metricType == MetricTypeSum {
+			current.Temporality = TemporalityCumulative
+			if temporality != nil && *temporality == int8(metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA) {
+				current.Temporality = TemporalityDelta
+			}
+		}
+
+		i := int(ts.Sub(q.Start) / q.Step)
+		if ts.Before(q.Start) || i >= n {
+			continue
+		}
+		if reset {
+			current.Resets++
+		}
+		addStep(current.Increase, i, increase)
+		addStep(current.Delta, i, delta)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read counters: %w", err)
+	}
+	return result, nil
+}
+
+// addStep adds v to steps[i], leaving it nil if v is.
+func addStep(steps []*float64, i int, v *float64) {
+	if v == nil {
+		return
+	}
+	if steps[i] == nil {
+		steps[i] = new(float64)
+	}
+	*steps[i] += *v
+}
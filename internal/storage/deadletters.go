@@ -0,0 +1,400 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/marcboeker/go-duckdb"
+	collectorlogsv1 "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	collectormetricsv1 "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortracev1 "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// reingestKey marks a context used to re-ingest dead letters.
+// Records rejected again are not dead-lettered a second time.
+type reingestKey struct{}
+
+// DeadLetter is a rejected record kept for inspection and re-ingestion.
+type DeadLetter struct {
+	ID        string
+	Signal    string
+	Reason    string
+	Error     string
+	RequestID string
+	APIKeyID  string
+	TenantID  string
+	Payload   string // OTLP JSON export request holding only the rejected record
+	CreatedAt time.Time
+}
+
+// DeadLetterFilter selects dead letters. Zero values match everything.
+type DeadLetterFilter struct {
+	IDs    []string
+	Signal string
+	Reason string
+	Start  time.Time
+	End    time.Time
+	Limit  int
+}
+
+// ReingestResult contains the outcome of re-ingesting dead letters.
+type ReingestResult struct {
+	Reingested int      // Dead letters stored and removed
+	Failed     int      // Dead letters rejected again and kept
+	Errors     []string // Error messages for failed dead letters
+}
+
+// deadLetter is a rejected record waiting to be written at the end of a store call.
+type deadLetter struct {
+	signal string
+	reason string
+	err    string
+	record proto.Message // Export request holding only the rejected record
+}
+
+// writeDeadLetters writes the rejected records of a store call to dead_letters.
+// Failures are logged, the store call itself has already succeeded.
+func (s *Storage) writeDeadLetters(ctx context.Context, result *StoreResult) {
+	if len(result.deadLetters) == 0 || ctx.Value(reingestKey{}) != nil {
+		return
+	}
+
+	origin := originFromContext(ctx)
+	tenantID := tenantFromContext(ctx)
+	now := time.Now()
+	err := s.withAppender(ctx, "dead_letters", func(appender *duckdb.Appender) error {
+		for _, dl := range result.deadLetters {
+			payload, err := MarshalOTLPJSON(dl.record)
+			if err != nil {
+				log.Printf("[%s] dead letter %s: failed to encode payload: %v", origin.RequestID, dl.signal, err)
+				continue
+			}
+			err = appender.AppendRow(
+				uuid.New().String(),
+				dl.signal,
+				dl.reason,
+				dl.err,
+				origin.RequestID,
+				origin.APIKeyID,
+				string(payload),
+				now,
+				tenantID,
+			)
+			if err != nil {
+				return fmt.Errorf("dead letter %s: %w", dl.signal, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[%s] failed to write %d dead letters: %v", origin.RequestID, len(result.deadLetters), err)
+	}
+	s.invalidateResults(tenantID, writeSet{"dead_letters": {}})
+}
+
+// DeadLetters returns dead letters matching the filter, newest first.
+func (s *Storage) DeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error) {
+	where, args := filter.where(scopedTenant(ctx))
+	query := `
+		SELECT id, signal, reason, error, request_id, api_key_id, tenant_id, payload, ingested_at
+		FROM dead_letters` + where + `
+		ORDER BY ingested_at DESC`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var result []DeadLetter
+	for rows.Next() {
+		var dl DeadLetter
+		err := rows.Scan(&dl.ID, &dl.Signal, &dl.Reason, &dl.Error, &dl.RequestID, &dl.APIKeyID, &dl.TenantID,
+			&dl.Payload, &dl.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dead letter: %w", err)
+		}
+		result = append(result, dl)
+	}
+	return result, rows.Err()
+}
+
+// ReingestDeadLetters stores the dead letters matching the filter again.
+// Dead letters that are accepted are removed; those rejected again are kept unchanged.
+// Spans that are already stored are skipped, so reingesting never duplicates them.
+func (s *Storage) ReingestDeadLetters(ctx context.Context, filter DeadLetterFilter) (*ReingestResult, error) {
+	letters, err := s.DeadLetters(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReingestResult{}
+	origin := originFromContext(ctx)
+	reingestCtx := context.WithValue(ctx, reingestKey{}, true)
+	for _, dl := range letters {
+		// Stamp the records with the tenant that originally sent them
+		origin.TenantID = dl.TenantID
+		stored, err := s.reingest(WithOrigin(reingestCtx, origin), dl)
+		var storageErr *StorageError
+		if errors.As(err, &storageErr) {
+			return result, err
+		}
+		if err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", dl.ID, err))
+			continue
+		}
+		if stored.HasRejections() {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", dl.ID, stored.ErrorMessage()))
+			continue
+		}
+
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM dead_letters WHERE id = ?", dl.ID); err != nil {
+			return result, NewInfrastructureError("failed to delete dead letter", err)
+		}
+		s.invalidateResults(dl.TenantID, writeSet{"dead_letters": {}})
+		result.Reingested++
+	}
+	return result, nil
+}
+
+// reingest decodes a dead letter payload and stores it.
+func (s *Storage) reingest(ctx context.Context, dl DeadLetter) (*StoreResult, error) {
+	switch dl.Signal {
+	case SignalSpans:
+		req := &collectortracev1.ExportTraceServiceRequest{}
+		if err := unmarshalOTLPJSON([]byte(dl.Payload), req); err != nil {
+			return nil, err
+		}
+		if err := s.dropStoredSpans(ctx, req); err != nil {
+			return nil, err
+		}
+		return s.StoreTraces(ctx, req)
+	case SignalLogs:
+		req := &collectorlogsv1.ExportLogsServiceRequest{}
+		if err := unmarshalOTLPJSON([]byte(dl.Payload), req); err != nil {
+			return nil, err
+		}
+		return s.StoreLogs(ctx, req)
+	case SignalMetrics:
+		req := &collectormetricsv1.ExportMetricsServiceRequest{}
+		if err := unmarshalOTLPJSON([]byte(dl.Payload), req); err != nil {
+			return nil, err
+		}
+		return s.StoreMetrics(ctx, req)
+	}
+	return nil, fmt.Errorf("unknown signal %q", dl.Signal)
+}
+
+// dropStoredSpans removes the spans from req that the tenant of ctx already
+// has stored under the same trace and span ID.
+func (s *Storage) dropStoredSpans(ctx context.Context, req *collectortracev1.ExportTraceServiceRequest) error {
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			spans := ss.Spans[:0]
+			for _, span := range ss.Spans {
+				var stored bool
+				err := s.db.QueryRowContext(ctx,
+					"SELECT count(*) > 0 FROM spans WHERE tenant_id = ? AND trace_id = ? AND span_id = ?",
+					tenantFromContext(ctx), hexEncode(span.TraceId), hexEncode(span.SpanId)).Scan(&stored)
+				if err != nil {
+					return NewInfrastructureError("failed to look up span", err)
+				}
+				if !stored {
+					spans = append(spans, span)
+				}
+			}
+			ss.Spans = spans
+		}
+	}
+	return nil
+}
+
+// where builds the WHERE clause of the filter, restricted to tenantID unless empty.
+func (f DeadLetterFilter) where(tenantID string) (string, []any) {
+	var conds []string
+	var args []any
+	if tenantID != "" {
+		conds = append(conds, "tenant_id = ?")
+		args = append(args, tenantID)
+	}
+	if len(f.IDs) > 0 {
+		placeholders := make([]string, len(f.IDs))
+		for i, id := range f.IDs {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		conds = append(conds, "id IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if f.Signal != "" {
+		conds = append(conds, "signal = ?")
+		args = append(args, f.Signal)
+	}
+	if f.Reason != "" {
+		conds = append(conds, "reason = ?")
+		args = append(args, f.Reason)
+	}
+	if !f.Start.IsZero() {
+		conds = append(conds, "ingested_at >= ?")
+		args = append(args, f.Start)
+	}
+	if !f.End.IsZero() {
+		conds = append(conds, "ingested_at < ?")
+		args = append(args, f.End)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// spanEnvelope builds an export request holding only span, with its resource and scope.
+func spanEnvelope(rs *tracev1.ResourceSpans, ss *tracev1.ScopeSpans, span *tracev1.Span) proto.Message {
+	return &collectortracev1.ExportTraceServiceRequest{ResourceSpans: []*tracev1.ResourceSpans{{
+		Resource:  rs.Resource,
+		SchemaUrl: rs.SchemaUrl,
+		ScopeSpans: []*tracev1.ScopeSpans{{
+			Scope:     ss.Scope,
+			SchemaUrl: ss.SchemaUrl,
+			Spans:     []*tracev1.Span{span},
+		}},
+	}}}
+}
+
+// logEnvelope builds an export request holding only lr, with its resource and scope.
+func logEnvelope(rl *logsv1.ResourceLogs, sl *logsv1.ScopeLogs, lr *logsv1.LogRecord) proto.Message {
+	return &collectorlogsv1.ExportLogsServiceRequest{ResourceLogs: []*logsv1.ResourceLogs{{
+		Resource:  rl.Resource,
+		SchemaUrl: rl.SchemaUrl,
+		ScopeLogs: []*logsv1.ScopeLogs{{
+			Scope:      sl.Scope,
+			SchemaUrl:  sl.SchemaUrl,
+			LogRecords: []*logsv1.LogRecord{lr},
+		}},
+	}}}
+}
+
+// metricEnvelope builds an export request holding only m, with its resource and scope.
+func metricEnvelope(rm *metricsv1.ResourceMetrics, sm *metricsv1.ScopeMetrics, m *metricsv1.Metric) proto.Message {
+	return &collectormetricsv1.ExportMetricsServiceRequest{ResourceMetrics: []*metricsv1.ResourceMetrics{{
+		Resource:  rm.Resource,
+		SchemaUrl: rm.SchemaUrl,
+		ScopeMetrics: []*metricsv1.ScopeMetrics{{
+			Scope:     sm.Scope,
+			SchemaUrl: sm.SchemaUrl,
+			Metrics:   []*metricsv1.Metric{m},
+		}},
+	}}}
+}
+
+// singlePointMetric returns a copy of m holding only the given data point.
+func singlePointMetric(m *metricsv1.Metric, dp proto.Message) *metricsv1.Metric {
+	single := &metricsv1.Metric{
+		Name:        m.Name,
+		Description: m.Description,
+		Unit:        m.Unit,
+		Metadata:    m.Metadata,
+	}
+	switch data := m.Data.(type) {
+	case *metricsv1.Metric_Gauge:
+		single.Data = &metricsv1.Metric_Gauge{Gauge: &metricsv1.Gauge{
+			DataPoints: []*metricsv1.NumberDataPoint{dp.(*metricsv1.NumberDataPoint)},
+		}}
+	case *metricsv1.Metric_Sum:
+		single.Data = &metricsv1.Metric_Sum{Sum: &metricsv1.Sum{
+			DataPoints:             []*metricsv1.NumberDataPoint{dp.(*metricsv1.NumberDataPoint)},
+			AggregationTemporality: data.Sum.AggregationTemporality,
+			IsMonotonic:            data.Sum.IsMonotonic,
+		}}
+	case *metricsv1.Metric_Histogram:
+		single.Data = &metricsv1.Metric_Histogram{Histogram: &metricsv1.Histogram{
+			DataPoints:             []*metricsv1.HistogramDataPoint{dp.(*metricsv1.HistogramDataPoint)},
+			AggregationTemporality: data.Histogram.AggregationTemporality,
+		}}
+	}
+	return single
+}
+
+// otlpIDFields are the bytes fields that OTLP JSON encodes as hex instead of base64.
+var otlpIDFields = map[string]bool{"traceId": true, "spanId": true, "parentSpanId": true}
+
+// MarshalOTLPJSON encodes msg following the OTLP/JSON rules:
+// lowerCamelCase field names, enums as integers and hex trace and span IDs.
+func MarshalOTLPJSON(msg proto.Message) ([]byte, error) {
+	data, err := protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return convertOTLPIDs(data, func(s string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(s)
+		return hex.EncodeToString(b), err
+	})
+}
+
+// unmarshalOTLPJSON decodes OTLP/JSON produced by MarshalOTLPJSON into msg.
+func unmarshalOTLPJSON(data []byte, msg proto.Message) error {
+	data, err := convertOTLPIDs(data, func(s string) (string, error) {
+		b, err := hex.DecodeString(s)
+		return base64.StdEncoding.EncodeToString(b), err
+	})
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(data, msg)
+}
+
+// convertOTLPIDs rewrites every trace and span ID string in a JSON document.
+func convertOTLPIDs(data []byte, convert func(string) (string, error)) ([]byte, error) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	var walk func(v any) error
+	walk = func(v any) error {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, child := range v {
+				if s, ok := child.(string); ok && otlpIDFields[k] {
+					converted, err := convert(s)
+					if err != nil {
+						return fmt.Errorf("invalid %s: %w", k, err)
+					}
+					v[k] = converted
+					continue
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case []any:
+			for _, child := range v {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
@@ -5,19 +5,43 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/marcboeker/go-duckdb"
+	"github.com/marcboeker/go-duckdb"
 )
 
 // Storage provides database operations.
 type Storage struct {
-	db     *sql.DB
-	dbPath string
+	db      *sql.DB
+	queryDB *sql.DB // Pool for user queries, on the same database
+	dbPath  string
+
+	querySlots querySlots // Per-key concurrency on queryDB
+
+	noExternalAccess bool // DuckDB may not touch other files, see QueryConfig
 
 	// Cleanup state
 	cleanupRunning chan struct{}
 	lastCleanup    *CleanupResult
+
+	// Ingest-time generators (nil when disabled)
+	spanMetrics  atomic.Pointer[spanMetricsGenerator]
+	serviceGraph atomic.Pointer[serviceGraphGenerator]
+	logMetrics   *logMetricsEngine
+
+	// Live tail subscribers
+	tail *tailHub
+
+	// Asynchronous queries (nil until configured)
+	jobs *jobRunner
+
+	// Cached query results (nil when disabled)
+	results *resultCache
+
+	// Validation of incoming telemetry
+	validation       ValidationConfig
+	validationCounts *validationCounters
 }
 
 // New creates a new Storage instance connected to DuckDB.
@@ -27,10 +51,11 @@ func New(dbPath string) (*Storage, error) {
 		dbPath = ":memory:"
 	}
 
-	db, err := sql.Open("duckdb", dbPath)
+	connector, err := duckdb.NewConnector(dbPath, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open duckdb: %w", err)
 	}
+	db := sql.OpenDB(connector)
 
 	// Verify connection works
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -42,9 +67,12 @@ func New(dbPath string) (*Storage, error) {
 	}
 
 	s := &Storage{
-		db:             db,
-		dbPath:         dbPath,
-		cleanupRunning: make(chan struct{}, 1),
+		db:               db,
+		queryDB:          sql.OpenDB(queryConnector{connector}),
+		dbPath:           dbPath,
+		cleanupRunning:   make(chan struct{}, 1),
+		validationCounts: newValidationCounters(),
+		tail:             newTailHub(),
 	}
 
 	// Initialize schema
@@ -53,6 +81,16 @@ func New(dbPath string) (*Storage, error) {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
+	if err := s.registerHistogramFunctions(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to register histogram functions: %w", err)
+	}
+
+	if err := s.loadLogMetricRules(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load log metric rules: %w", err)
+	}
+
 	return s, nil
 }
 
@@ -63,8 +101,19 @@ func (s *Storage) initSchema(ctx context.Context) error {
 		spanEventsSchema, spanEventsIndexes,
 		spanLinksSchema, spanLinksIndexes,
 		logsSchema, logsIndexes,
+		logTermsSchema, logTermsIndexes,
 		metricsSchema, metricsIndexes,
+		metricExemplarsSchema, metricExemplarsIndexes,
+		serviceGraphEdgesSchema, serviceGraphEdgesIndexes,
+		logMetricRulesSchema,
+		savedQueriesSchema,
+		deadLettersSchema, deadLettersIndexes,
+		queryJobsSchema,
 	}
+	statements = append(statements, tenantMigrations()...)
+	statements = append(statements, metricsMigrations...)
+	statements = append(statements, logMetricRulesIndexes...)
+	statements = append(statements, counterMacroStatements()...)
 	for _, stmt := range statements {
 		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
 			return err
@@ -73,13 +122,49 @@ func (s *Storage) initSchema(ctx context.Context) error {
 	return nil
 }
 
+// withAppender runs fn with an appender on table and flushes it afterwards.
+// Used by background writers that append to a single table.
+func (s *Storage) withAppender(ctx context.Context, table string, fn func(*duckdb.Appender) error) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return NewInfrastructureError("failed to get connection", err)
+	}
+	defer conn.Close()
+
+	var appender *duckdb.Appender
+	err = conn.Raw(func(driverConn any) error {
+		duckConn, ok := driverConn.(*duckdb.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected connection type: %T", driverConn)
+		}
+		var appErr error
+		appender, appErr = duckdb.NewAppenderFromConn(duckConn, "", table)
+		return appErr
+	})
+	if err != nil {
+		return NewInfrastructureError("failed to create appender", err)
+	}
+	defer appender.Close()
+
+	if err := fn(appender); err != nil {
+		return err
+	}
+
+	if err := appender.Flush(); err != nil {
+		return NewInfrastructureError("failed to flush "+table, err)
+	}
+	return nil
+}
+
 // Health checks if the database connection is healthy.
 func (s *Storage) Health(ctx context.Context) error {
 	return s.db.PingContext(ctx)
 }
 
-// Close closes the database connection.
+// Close closes the database connections.
 func (s *Storage) Close() error {
+	// The main pool owns the connector and closes the database
+	s.queryDB.Close()
 	return s.db.Close()
 }
 
@@ -96,8 +181,12 @@ func (s *Storage) DBPath() string {
 // Stats returns storage statistics.
 func (s *Storage) Stats(ctx context.Context) (*StorageStats, error) {
 	stats := &StorageStats{
-		DBPath:      s.dbPath,
-		LastCleanup: s.lastCleanup,
+		DBPath:         s.dbPath,
+		LastCleanup:    s.lastCleanup,
+		ServiceGraph:   s.serviceGraphStatus(),
+		LogMetricRules: s.logMetricRuleStatus(scopedTenant(ctx)),
+		Validation:     s.validationStatus(),
+		ResultCache:    s.resultCacheStatus(),
 	}
 
 	// File sizes
@@ -110,21 +199,33 @@ func (s *Storage) Stats(ctx context.Context) (*StorageStats, error) {
 		}
 	}
 
-	// Row counts
+	// Row counts, restricted to the caller's tenant if any
+	where := ""
+	var args []any
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		where = " WHERE tenant_id = ?"
+		for range 7 {
+			args = append(args, tenantID)
+		}
+	}
 	row := s.db.QueryRowContext(ctx, `
 		SELECT 
-			(SELECT COUNT(*) FROM spans) as spans,
-			(SELECT COUNT(*) FROM span_events) as span_events,
-			(SELECT COUNT(*) FROM span_links) as span_links,
-			(SELECT COUNT(*) FROM logs) as logs,
-			(SELECT COUNT(*) FROM metrics) as metrics
-	`)
+			(SELECT COUNT(*) FROM spans`+where+`) as spans,
+			(SELECT COUNT(*) FROM span_events`+where+`) as span_events,
+			(SELECT COUNT(*) FROM span_links`+where+`) as span_links,
+			(SELECT COUNT(*) FROM logs`+where+`) as logs,
+			(SELECT COUNT(*) FROM metrics`+where+`) as metrics,
+			(SELECT COUNT(*) FROM metric_exemplars`+where+`) as metric_exemplars,
+			(SELECT COUNT(*) FROM dead_letters`+where+`) as dead_letters
+	`, args...)
 	err := row.Scan(
 		&stats.Tables.Spans,
 		&stats.Tables.SpanEvents,
 		&stats.Tables.SpanLinks,
 		&stats.Tables.Logs,
 		&stats.Tables.Metrics,
+		&stats.Tables.MetricExemplars,
+		&stats.Tables.DeadLetters,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get row counts: %w", err)
@@ -135,11 +236,15 @@ func (s *Storage) Stats(ctx context.Context) (*StorageStats, error) {
 
 // StorageStats contains storage statistics.
 type StorageStats struct {
-	DBPath       string
-	DBSizeBytes  int64
-	WALSizeBytes int64
-	Tables       TableCounts
-	LastCleanup  *CleanupResult
+	DBPath         string
+	DBSizeBytes    int64
+	WALSizeBytes   int64
+	Tables         TableCounts
+	LastCleanup    *CleanupResult
+	ServiceGraph   *ServiceGraphStatus // nil when the generator is disabled
+	LogMetricRules []LogMetricRuleStatus
+	Validation     ValidationStatus
+	ResultCache    *ResultCacheStats // nil when the cache is disabled
 }
 
 // TableCounts contains row counts for each table.
@@ -149,4 +254,7 @@ type TableCounts struct {
 	SpanLinks  int64
 	Logs       int64
 	Metrics    int64
+
+	MetricExemplars int64
+	DeadLetters     int64
 }
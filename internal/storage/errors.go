@@ -1,6 +1,10 @@
 package storage
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // ErrorType distinguishes between retryable and non-retryable errors.
 type ErrorType int
@@ -10,6 +14,8 @@ const (
 	ErrorTypeInfrastructure ErrorType = iota
 	// ErrorTypeInvalidData indicates bad input data (handled via partial success).
 	ErrorTypeInvalidData
+	// ErrorTypeInvalidQuery indicates a query DuckDB rejected or failed to run (400).
+	ErrorTypeInvalidQuery
 )
 
 // StorageError wraps storage layer errors with type information.
@@ -39,12 +45,38 @@ func NewInfrastructureError(message string, cause error) *StorageError {
 	}
 }
 
+// NewQueryError creates an invalid query error (400).
+func NewQueryError(cause error) *StorageError {
+	return &StorageError{
+		Type:    ErrorTypeInvalidQuery,
+		Message: "invalid query",
+		Cause:   cause,
+	}
+}
+
+// IsQueryError reports whether err is an invalid query error.
+func IsQueryError(err error) bool {
+	var se *StorageError
+	return errors.As(err, &se) && se.Type == ErrorTypeInvalidQuery
+}
+
 // StoreResult contains the outcome of a storage operation.
 // Used for OTLP partial success responses.
 type StoreResult struct {
 	Accepted int      // Number of items successfully stored
 	Rejected int      // Number of items that failed validation
-	Errors   []string // Human-readable error messages for rejected items
+	Errors   []string // Human-readable error messages for rejected items and warnings
+
+	deadLetters []deadLetter // Rejected records, written to dead_letters after the store call
+	written     writeSet     // Tables appended to, for invalidating cached results
+}
+
+// wrote records a row appended to table, see writeSet.add.
+func (r *StoreResult) wrote(table string, t time.Time) {
+	if r.written == nil {
+		r.written = make(writeSet)
+	}
+	r.written.add(table, t)
 }
 
 // AddError records a rejected item with its error message.
@@ -53,11 +85,22 @@ func (r *StoreResult) AddError(msg string) {
 	r.Errors = append(r.Errors, msg)
 }
 
+// AddWarning records an error about part of an accepted item, such as a span
+// event that could not be stored, without rejecting the item.
+func (r *StoreResult) AddWarning(msg string) {
+	r.Errors = append(r.Errors, msg)
+}
+
 // HasRejections returns true if any items were rejected.
 func (r *StoreResult) HasRejections() bool {
 	return r.Rejected > 0
 }
 
+// HasErrors returns true if any items were rejected or warnings recorded.
+func (r *StoreResult) HasErrors() bool {
+	return len(r.Errors) > 0
+}
+
 // ErrorMessage returns a combined error message for partial success response.
 func (r *StoreResult) ErrorMessage() string {
 	if len(r.Errors) == 0 {
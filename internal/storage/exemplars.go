@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// ExemplarTrace is a stored exemplar whose trace exists in the spans table.
+type ExemplarTrace struct {
+	MetricID      string
+	MetricName    string
+	Timestamp     time.Time
+	Value         float64
+	TraceID       string
+	SpanID        string
+	FilteredAttrs map[string]string
+	MetricAttrs   map[string]string
+
+	// Span details, empty if only other spans of the trace were stored
+	SpanName    string
+	ServiceName string
+	DurationNs  int64
+}
+
+// ExemplarTraces returns exemplars of a metric in [start, end) whose trace_id
+// matches at least one stored span, newest first.
+func (s *Storage) ExemplarTraces(ctx context.Context, metricName string, start, end time.Time, limit int) ([]ExemplarTrace, error) {
+	tenantFilter := ""
+	args := []any{metricName, start, end}
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		tenantFilter = "AND e.tenant_id = ?"
+		args = append(args, tenantID)
+	}
+	args = append(args, limit)
+
+	// Exemplars only link to traces of their own tenant
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			e.metric_id,
+			e.metric_name,
+			e.timestamp,
+			e.value,
+			e.trace_id,
+			e.span_id,
+			e.filtered_attrs,
+			m.attrs,
+			sp.name,
+			sp.resource_attrs['service.name'][1],
+			sp.duration_ns
+		FROM metric_exemplars e
+		LEFT JOIN metrics m ON m.metric_id = e.metric_id
+		LEFT JOIN spans sp ON sp.trace_id = e.trace_id AND sp.span_id = e.span_id AND sp.tenant_id = e.tenant_id
+		WHERE e.metric_name = ?
+			AND e.timestamp >= ? AND e.timestamp < ?
+			AND e.trace_id <> ''
+			`+tenantFilter+`
+			AND EXISTS (SELECT 1 FROM spans t WHERE t.trace_id = e.trace_id AND t.tenant_id = e.tenant_id)
+		ORDER BY e.timestamp DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query exemplars: %w", err)
+	}
+	defer rows.Close()
+
+	var result []ExemplarTrace
+	for rows.Next() {
+		var ex ExemplarTrace
+		var filteredAttrs, metricAttrs duckdb.Map
+		var spanName, serviceName sql.NullString
+		var durationNs sql.NullInt64
+		err := rows.Scan(&ex.MetricID, &ex.MetricName, &ex.Timestamp, &ex.Value, &ex.TraceID, &ex.SpanID,
+			&filteredAttrs, &metricAttrs, &spanName, &serviceName, &durationNs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan exemplar: %w", err)
+		}
+		ex.FilteredAttrs = mapToStrings(filteredAttrs)
+		ex.MetricAttrs = mapToStrings(metricAttrs)
+		ex.SpanName = spanName.String
+		ex.ServiceName = serviceName.String
+		ex.DurationNs = durationNs.Int64
+		result = append(result, ex)
+	}
+	return result, rows.Err()
+}
+
+// mapToStrings converts a scanned MAP(VARCHAR, VARCHAR) to a string map.
+func mapToStrings(m duckdb.Map) map[string]string {
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		ks, _ := k.(string)
+		vs, _ := v.(string)
+		result[ks] = vs
+	}
+	return result
+}
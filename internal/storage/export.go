@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/marcboeker/go-duckdb"
+)
+
+// QueryArrow runs query with args on conn and hands its result to fn as
+// Arrow record batches, read from DuckDB as fn consumes them. Errors running
+// the query satisfy IsQueryError.
+func QueryArrow(ctx context.Context, conn *sql.Conn, query string, args []any, fn func(array.RecordReader) error) error {
+	return conn.Raw(func(driverConn any) error {
+		dc, ok := driverConn.(driver.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected connection type: %T", driverConn)
+		}
+		args, err := positionalArgs(ctx, dc, query, args)
+		if err != nil {
+			return NewQueryError(err)
+		}
+		ar, err := duckdb.NewArrowFromConn(dc)
+		if err != nil {
+			return err
+		}
+		reader, err := ar.QueryContext(ctx, query, args...)
+		if err != nil {
+			return NewQueryError(err)
+		}
+		defer reader.Release()
+		return fn(reader)
+	})
+}
+
+// positionalArgs orders named arguments by the parameters of query, as the
+// Arrow interface only binds by position.
+func positionalArgs(ctx context.Context, dc driver.Conn, query string, args []any) ([]any, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	named := make(map[string]any, len(args))
+	for _, arg := range args {
+		if n, ok := arg.(sql.NamedArg); ok {
+			named[n.Name] = n.Value
+		}
+	}
+	if len(named) == 0 {
+		return args, nil
+	}
+
+	prepared, err := dc.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer prepared.Close()
+	stmt, ok := prepared.(*duckdb.Stmt)
+	if !ok {
+		return nil, fmt.Errorf("unexpected statement type: %T", prepared)
+	}
+
+	ordered := make([]any, stmt.NumInput())
+	for i := range ordered {
+		name, err := stmt.ParamName(i + 1)
+		if err != nil {
+			return nil, err
+		}
+		ordered[i] = named[name]
+	}
+	return ordered, nil
+}
+
+// CopyParquet runs query with args on conn and writes the result to w as a
+// Parquet file. With maxRows above 0, the file holds at most maxRows rows
+// and more reports whether query returned more. The file is assembled in a
+// temporary file first, as Parquet metadata follows the data. usage is that
+// of query, or nil if DuckDB has none. Errors running the query satisfy
+// IsQueryError.
+func CopyParquet(ctx context.Context, conn *sql.Conn, query string, args []any, maxRows int, w io.Writer) (usage *QueryUsage, more bool, err error) {
+	// query is embedded in COPY, so it must be a complete statement on its own
+	if _, err := parseSelect(ctx, conn, query); err != nil {
+		return nil, false, NewQueryError(err)
+	}
+
+	path, err := tempParquet()
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.Remove(path)
+
+	// The newline ends a trailing line comment in query
+	res, err := conn.ExecContext(ctx, "COPY ("+query+"\n) TO "+quoteLiteral(path)+" (FORMAT parquet)", args...)
+	if err != nil {
+		return nil, false, NewQueryError(err)
+	}
+	// Read before trimming, which would replace it
+	usage, _ = LastQueryUsage(conn)
+
+	if n, _ := res.RowsAffected(); maxRows > 0 && n > int64(maxRows) {
+		// Rewrite the file without the surplus rows, keeping their order
+		more = true
+		trimmed, err := tempParquet()
+		if err != nil {
+			return nil, false, err
+		}
+		defer os.Remove(trimmed)
+		trim := fmt.Sprintf("COPY (SELECT * FROM read_parquet(%s) LIMIT %d) TO %s (FORMAT parquet)",
+			quoteLiteral(path), maxRows, quoteLiteral(trimmed))
+		if _, err := conn.ExecContext(ctx, trim); err != nil {
+			return nil, false, fmt.Errorf("failed to trim export file: %w", err)
+		}
+		path = trimmed
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open export file: %w", err)
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return usage, more, err
+}
+
+// tempParquet returns the path of a new, empty temporary file for COPY.
+func tempParquet() (string, error) {
+	f, err := os.CreateTemp("", "mo11y-export-*.parquet")
+	if err != nil {
+		return "", fmt.Errorf("failed to create export file: %w", err)
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
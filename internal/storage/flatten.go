@@ -19,6 +19,15 @@ func unixNanoToTime(nanos uint64) time.Time {
 	return time.Unix(0, int64(nanos))
 }
 
+// optionalTime converts OTLP nanoseconds like unixNanoToTime, but returns nil
+// (NULL) for unset timestamps.
+func optionalTime(nanos uint64) any {
+	if nanos == 0 {
+		return nil
+	}
+	return unixNanoToTime(nanos)
+}
+
 // hexEncode converts a byte slice to hex string.
 // Used for trace_id (16 bytes → 32 chars) and span_id (8 bytes → 16 chars).
 func hexEncode(b []byte) string {
@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// Aggregation temporalities recorded in histogram_json.
+// Histograms stored without one are cumulative.
+const (
+	TemporalityCumulative = "cumulative"
+	TemporalityDelta      = "delta"
+)
+
+// ErrHistogramBounds reports histogram series that cannot be merged because
+// their bucket bounds differ.
+var ErrHistogramBounds = errors.New("histogram series have different bucket bounds")
+
+// histogramMacros define the SQL helpers over histogram_json that need no Go
+// code. histogram_merge sums the histograms of a group, or returns NULL if
+// their bucket bounds differ. Empty values, stored for gauges and sums, are
+// ignored.
+var histogramMacros = []string{
+	`CREATE OR REPLACE MACRO histogram_merge(h) AS
+		CASE WHEN count(DISTINCT nullif(h, '')->'explicit_bounds') = 1 THEN json_object(
+			'count', sum((nullif(h, '')->>'count')::BIGINT)::BIGINT,
+			'sum', sum((nullif(h, '')->>'sum')::DOUBLE),
+			'bucket_counts', list_reduce(
+				list((nullif(h, '')->'bucket_counts')::BIGINT[]) FILTER (WHERE h <> ''),
+				(a, b) -> list_transform(list_zip(a, b), x -> x[1] + x[2])),
+			'explicit_bounds', any_value(nullif(h, '')->'explicit_bounds')
+		)::VARCHAR END`,
+}
+
+// registerHistogramFunctions defines histogram_quantile, histogram_mean and
+// histogram_merge. The Go functions are registered on one connection and are
+// visible to every connection of the database, including the query pool.
+func (s *Storage) registerHistogramFunctions(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := duckdb.RegisterScalarUDF(conn, "histogram_quantile", histogramQuantileFunc{}); err != nil {
+		return fmt.Errorf("histogram_quantile: %w", err)
+	}
+	if err := duckdb.RegisterScalarUDF(conn, "histogram_mean", histogramMeanFunc{}); err != nil {
+		return fmt.Errorf("histogram_mean: %w", err)
+	}
+	for _, stmt := range histogramMacros {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// histogramQuantileFunc implements histogram_quantile(histogram_json, q).
+type histogramQuantileFunc struct{}
+
+func (histogramQuantileFunc) Config() duckdb.ScalarFuncConfig {
+	return duckdb.ScalarFuncConfig{
+		InputTypeInfos: []duckdb.TypeInfo{typeInfo(duckdb.TYPE_VARCHAR), typeInfo(duckdb.TYPE_DOUBLE)},
+		ResultTypeInfo: typeInfo(duckdb.TYPE_DOUBLE),
+	}
+}
+
+func (histogramQuantileFunc) Executor() duckdb.ScalarFuncExecutor {
+	return duckdb.ScalarFuncExecutor{RowExecutor: func(values []driver.Value) (any, error) {
+		q := values[1].(float64)
+		if q < 0 || q > 1 || math.IsNaN(q) {
+			return nil, fmt.Errorf("histogram_quantile: quantile must be between 0 and 1, got %v", q)
+		}
+		h, ok := decodeHistogram(values[0].(string))
+		if !ok {
+			return nil, nil
+		}
+		return nullIfNaN(HistogramQuantile(q, h.ExplicitBounds, h.BucketCounts)), nil
+	}}
+}
+
+// histogramMeanFunc implements histogram_mean(histogram_json).
+type histogramMeanFunc struct{}
+
+func (histogramMeanFunc) Config() duckdb.ScalarFuncConfig {
+	return duckdb.ScalarFuncConfig{
+		InputTypeInfos: []duckdb.TypeInfo{typeInfo(duckdb.TYPE_VARCHAR)},
+		ResultTypeInfo: typeInfo(duckdb.TYPE_DOUBLE),
+	}
+}
+
+func (histogramMeanFunc) Executor() duckdb.ScalarFuncExecutor {
+	return duckdb.ScalarFuncExecutor{RowExecutor: func(values []driver.Value) (any, error) {
+		h, ok := decodeHistogram(values[0].(string))
+		if !ok || h.Count == 0 {
+			return nil, nil
+		}
+		return h.Sum / float64(h.Count), nil
+	}}
+}
+
+// typeInfo returns the TypeInfo of a primitive DuckDB type.
+func typeInfo(t duckdb.Type) duckdb.TypeInfo {
+	info, err := duckdb.NewTypeInfo(t)
+	if err != nil {
+		panic(err) // Only fails for non-primitive types
+	}
+	return info
+}
+
+func nullIfNaN(v float64) any {
+	if math.IsNaN(v) {
+		return nil
+	}
+	return v
+}
+
+// decodeHistogram parses a histogram_json value. It reports false for empty
+// or malformed values and for bucket counts not matching the bounds.
+func decodeHistogram(s string) (Histogram, bool) {
+	var h Histogram
+	if s == "" || json.Unmarshal([]byte(s), &h) != nil {
+		return h, false
+	}
+	return h, len(h.BucketCounts) == len(h.ExplicitBounds)+1
+}
+
+// HistogramQuantile estimates the q-quantile of a histogram by linear
+// interpolation within the bucket holding it, like Prometheus'
+// histogram_quantile. The first bucket is assumed to start at zero unless its
+// upper bound is negative; a quantile in the overflow bucket is reported as
+// the highest bound. Returns NaN for an empty histogram.
+func HistogramQuantile(q float64, bounds []float64, counts []int64) float64 {
+	var total int64
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 || len(counts) != len(bounds)+1 {
+		return math.NaN()
+	}
+
+	rank := q * float64(total)
+	var cum int64
+	for i, c := range counts {
+		if c == 0 || float64(cum+c) < rank {
+			cum += c
+			continue
+		}
+		if i == len(bounds) {
+			if len(bounds) == 0 {
+				return math.NaN()
+			}
+			return bounds[len(bounds)-1]
+		}
+		lower, upper := 0.0, bounds[i]
+		if i > 0 {
+			lower = bounds[i-1]
+		} else if upper <= 0 {
+			return upper
+		}
+		return lower + (upper-lower)*(rank-float64(cum))/float64(c)
+	}
+	return math.NaN()
+}
+
+// HistogramQuery selects the histogram series merged by HistogramSteps.
+type HistogramQuery struct {
+	Metric string
+	Attrs  []AttrFilter // Matched against data point, then resource attributes
+	Start  time.Time
+	End    time.Time
+	Step   time.Duration
+}
+
+// HistogramSteps holds the observations of a histogram metric in each step of
+// a HistogramQuery, summed over its series.
+type HistogramSteps struct {
+	Unit   string
+	Bounds []float64
+	Times  []time.Time // Start of each step
+	Counts [][]int64   // Bucket counts per step, len(Bounds)+1 each
+	Sums   []float64   // Sum of the observed values per step
+	Series int         // Number of series merged
+}
+
+// Total returns the number of observations in step i.
+func (hs *HistogramSteps) Total(i int) int64 {
+	var n int64
+	for _, c := range hs.Counts[i] {
+		n += c
+	}
+	return n
+}
+
+// HistogramSteps merges the histogram series of a metric into steps.
+// Cumulative series contribute their increase within each step, measured from
+// their last point before it; the first point of a series, looked up as far
+// back as one step before the start, only serves as a baseline. Delta series
+// contribute every point. All series must share the same bucket bounds.
+func (s *Storage) HistogramSteps(ctx context.Context, q HistogramQuery) (*HistogramSteps, error) {
+	if q.Step <= 0 || !q.Start.Before(q.End) {
+		return nil, fmt.Errorf("invalid histogram range")
+	}
+	n := int((q.End.Sub(q.Start) + q.Step - 1) / q.Step)
+
+	conds := []string{"name = ?", "type = ?", "timestamp >= ?", "timestamp < ?"}
+	args := []any{q.Metric, MetricTypeHistogram, q.Start.Add(-q.Step), q.End}
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		conds = append(conds, "tenant_id = ?")
+		args = append(args, tenantID)
+	}
+	attrConds, attrArgs := attrFilterConditions(q.Attrs)
+	conds = append(conds, attrConds...)
+	args = append(args, attrArgs...)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT hash(tenant_id, resource_attrs, scope_name, attrs) AS series, timestamp, unit, histogram_json
+		FROM metrics
+		WHERE `+strings.Join(conds, " AND ")+`
+		ORDER BY series, timestamp
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query histograms: %w", err)
+	}
+	defer rows.Close()
+
+	result := &HistogramSteps{
+		Times:  make([]time.Time, n),
+		Counts: make([][]int64, n),
+		Sums:   make([]float64, n),
+	}
+	for i := range result.Times {
+		result.Times[i] = q.Start.Add(time.Duration(i) * q.Step)
+	}
+
+	var (
+		series    uint64
+		prev      *Histogram // Last point of the current cumulative series
+		haveBound bool
+	)
+	for rows.Next() {
+		var id uint64
+		var ts time.Time
+		var unit *string
+		var raw string
+		if err := rows.Scan(&id, &ts, &unit, &raw); err != nil {
+			return nil, fmt.Errorf("failed to scan histogram: %w", err)
+		}
+		h, ok := decodeHistogram(raw)
+		if !ok {
+			continue
+		}
+		if !haveBound {
+			result.Bounds, haveBound = h.ExplicitBounds, true
+			if unit != nil {
+				result.Unit = *unit
+			}
+		} else if !slices.Equal(h.ExplicitBounds, result.Bounds) {
+			return nil, fmt.Errorf("%w: %s and %s, narrow the attribute filters or time range",
+				ErrHistogramBounds, formatBounds(result.Bounds), formatBounds(h.ExplicitBounds))
+		}
+		if id != series || result.Series == 0 {
+			series, prev = id, nil
+			result.Series++
+		}
+
+		obs := h
+		if h.Temporality != TemporalityDelta {
+			if prev == nil {
+				prev = &h
+				continue
+			}
+			obs = h.since(*prev)
+			prev = &h
+		}
+
+		i := int(ts.Sub(q.Start) / q.Step)
+		if ts.Before(q.Start) || i >= n {
+			continue
+		}
+		if result.Counts[i] == nil {
+			result.Counts[i] = make([]int64, len(result.Bounds)+1)
+		}
+		for b, c := range obs.BucketCounts {
+			result.Counts[i][b] += c
+		}
+		result.Sums[i] += obs.Sum
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read histograms: %w", err)
+	}
+
+	for i := range result.Counts {
+		if result.Counts[i] == nil {
+			result.Counts[i] = make([]int64, len(result.Bounds)+1)
+		}
+	}
+	return result, nil
+}
+
+// since returns the observations of a cumulative histogram made after prev.
+// A point with fewer observations in any bucket follows a counter reset and
+// is returned as is.
+func (h Histogram) since(prev Histogram) Histogram {
+	d := Histogram{Count: h.Count - prev.Count, Sum: h.Sum - prev.Sum, BucketCounts: make([]int64, len(h.BucketCounts))}
+	for i, c := range h.BucketCounts {
+		d.BucketCounts[i] = c - prev.BucketCounts[i]
+		if d.BucketCounts[i] < 0 {
+			return h
+		}
+	}
+	return d
+}
+
+func formatBounds(bounds []float64) string {
+	parts := make([]string, len(bounds))
+	for i, b := range bounds {
+		parts[i] = strconv.FormatFloat(b, 'g', -1, 64)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
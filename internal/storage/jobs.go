@@ -0,0 +1,637 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/google/uuid"
+	"github.com/marcboeker/go-duckdb"
+)
+
+// Query job statuses.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Query job errors.
+var (
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobFinished  = errors.New("job has already finished")
+	ErrJobNoResult  = errors.New("job has no result")
+	ErrJobsDisabled = errors.New("query jobs are not configured")
+	ErrTooManyJobs  = errors.New("too many queued or running jobs")
+)
+
+const (
+	jobCleanupInterval = time.Minute // How often expired jobs are deleted
+	jobInterrupted     = "interrupted by a server shutdown"
+)
+
+// JobsConfig configures asynchronous query jobs.
+type JobsConfig struct {
+	Dir           string        // Where results are stored
+	MaxConcurrent int           // Jobs running at once; more wait in the queue
+	Timeout       time.Duration // Per job, from when it starts running; 0 for none
+	TTL           time.Duration // How long a finished job and its result are kept
+	MaxPending    int           // Queued and running jobs per tenant; 0 for no limit
+	CursorTTL     time.Duration // How long /query results stay pageable
+	CursorMaxRows int           // Rows of a /query result kept for paging; 0 for all
+}
+
+// Job is an asynchronous query. Its result is stored as an Arrow IPC stream
+// and can be read until the job expires.
+type Job struct {
+	ID         string
+	TenantID   string
+	Owner      string // API key ID, empty without auth
+	SQL        string
+	MaxRows    int // 0 for no cap
+	Status     string
+	Error      string
+	Rows       int64 // Written so far while running
+	Bytes      int64
+	Usage      *QueryUsage
+	CreatedAt  time.Time
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	ExpiresAt  *time.Time
+}
+
+// Done reports whether the job has finished.
+func (j *Job) Done() bool {
+	return j.Status != JobQueued && j.Status != JobRunning
+}
+
+// jobRunner runs query jobs in the background.
+type jobRunner struct {
+	cfg   JobsConfig
+	slots chan struct{}
+
+	ctx    context.Context // Canceled on shutdown
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	active  map[string]*activeJob
+	pending map[string]int // Active jobs per tenant
+
+	snapshots map[string]snapshot
+}
+
+// activeJob tracks a queued or running job.
+type activeJob struct {
+	cancel context.CancelFunc
+	rows   atomic.Int64
+	bytes  atomic.Int64
+}
+
+// ConfigureJobs enables query jobs. Jobs that were queued or running when
+// the server last stopped are marked failed. Must be called before jobs are
+// submitted; RunJobs deletes expired results.
+func (s *Storage) ConfigureJobs(ctx context.Context, cfg JobsConfig) error {
+	if cfg.MaxConcurrent < 1 {
+		cfg.MaxConcurrent = 1
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create job directory: %w", err)
+	}
+
+	now := time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE query_jobs SET status = ?, error = ?, finished_at = ?, expires_at = ?
+		WHERE status IN (?, ?)
+	`, JobFailed, jobInterrupted, now, now.Add(cfg.TTL), JobQueued, JobRunning)
+	if err != nil {
+		return fmt.Errorf("failed to recover jobs: %w", err)
+	}
+
+	// Results of interrupted jobs were never completed, and snapshots are
+	// only tracked in memory
+	partial, _ := filepath.Glob(filepath.Join(cfg.Dir, "*.tmp"))
+	snapshots, _ := filepath.Glob(filepath.Join(cfg.Dir, snapshotPrefix+"*"))
+	for _, path := range append(partial, snapshots...) {
+		os.Remove(path)
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	s.jobs = &jobRunner{
+		cfg:       cfg,
+		slots:     make(chan struct{}, cfg.MaxConcurrent),
+		ctx:       runCtx,
+		cancel:    cancel,
+		active:    make(map[string]*activeJob),
+		pending:   make(map[string]int),
+		snapshots: make(map[string]snapshot),
+	}
+	return nil
+}
+
+// RunJobs deletes expired jobs and their results until ctx is cancelled,
+// then cancels the jobs still running and waits for them.
+func (s *Storage) RunJobs(ctx context.Context) {
+	jobs := s.jobs
+	if jobs == nil {
+		return
+	}
+	log.Printf("Query jobs started: dir=%s, concurrency=%d, timeout=%s, ttl=%s",
+		jobs.cfg.Dir, jobs.cfg.MaxConcurrent, jobs.cfg.Timeout, jobs.cfg.TTL)
+
+	ticker := time.NewTicker(jobCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			jobs.cancel()
+			jobs.wg.Wait()
+			log.Println("Query jobs stopped")
+			return
+		case <-ticker.C:
+			if err := s.deleteExpiredJobs(ctx); err != nil {
+				log.Printf("Query jobs: cleanup failed: %v", err)
+			}
+			jobs.deleteExpiredSnapshots()
+		}
+	}
+}
+
+func (s *Storage) deleteExpiredJobs(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM query_jobs WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		os.Remove(s.jobs.resultPath(id))
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM query_jobs WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("Query jobs: deleted %d expired jobs", len(ids))
+	}
+	return nil
+}
+
+func (r *jobRunner) resultPath(id string) string {
+	return filepath.Join(r.cfg.Dir, id+".arrow")
+}
+
+// SubmitJob checks query like an ad-hoc query of the caller and queues it as
+// a job owned by the caller's API key. maxRows caps the result, 0 for no cap.
+// The job holds one of the key's maxConcurrent query slots, see
+// AcquireQuerySlot, from submission until it finishes.
+// Errors in query satisfy IsQueryError.
+func (s *Storage) SubmitJob(ctx context.Context, query string, maxRows, maxConcurrent int) (*Job, error) {
+	jobs := s.jobs
+	if jobs == nil {
+		return nil, ErrJobsDisabled
+	}
+	if _, err := CheckQuery(ctx, s.queryDB, query); err != nil {
+		return nil, NewQueryError(err)
+	}
+
+	tenantID := tenantFromContext(ctx)
+	if !jobs.reserve(tenantID) {
+		return nil, ErrTooManyJobs
+	}
+	releaseSlot, err := s.AcquireQuerySlot(ctx, maxConcurrent)
+	if err != nil {
+		jobs.release(tenantID)
+		return nil, err
+	}
+
+	origin := originFromContext(ctx)
+	job := &Job{
+		ID:        uuid.New().String(),
+		TenantID:  tenantID,
+		Owner:     origin.APIKeyID,
+		SQL:       query,
+		MaxRows:   maxRows,
+		Status:    JobQueued,
+		CreatedAt: time.Now(),
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO query_jobs (id, tenant_id, owner, sql, max_rows, status, error, rows, bytes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, '', 0, 0, ?)
+	`, job.ID, job.TenantID, job.Owner, job.SQL, job.MaxRows, job.Status, job.CreatedAt)
+	if err != nil {
+		releaseSlot()
+		jobs.release(tenantID)
+		return nil, fmt.Errorf("failed to create job: %w", err)
+	}
+
+	// Jobs outlive the request; only the reads stay scoped
+	runCtx, cancel := context.WithCancel(jobs.ctx)
+	active := &activeJob{cancel: cancel}
+	jobs.mu.Lock()
+	jobs.active[job.ID] = active
+	jobs.mu.Unlock()
+
+	jobs.wg.Add(1)
+	go func() {
+		defer jobs.wg.Done()
+		defer cancel()
+		defer releaseSlot()
+		s.runJob(runCtx, job, scopedTenant(ctx), origin.RequestID, active)
+	}()
+	return job, nil
+}
+
+// reserve counts a new job of tenantID as pending, reporting false if the
+// tenant already has MaxPending jobs queued or running.
+func (r *jobRunner) reserve(tenantID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cfg.MaxPending > 0 && r.pending[tenantID] >= r.cfg.MaxPending {
+		return false
+	}
+	r.pending[tenantID]++
+	return true
+}
+
+// release ends a pending job of tenantID counted by reserve.
+func (r *jobRunner) release(tenantID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending[tenantID]--; r.pending[tenantID] <= 0 {
+		delete(r.pending, tenantID)
+	}
+}
+
+// runJob waits for a slot, runs the job and records its outcome.
+func (s *Storage) runJob(ctx context.Context, job *Job, scopedTenantID, reqID string, active *activeJob) {
+	jobs := s.jobs
+	defer func() {
+		jobs.mu.Lock()
+		delete(jobs.active, job.ID)
+		jobs.mu.Unlock()
+		jobs.release(job.TenantID)
+	}()
+
+	select {
+	case jobs.slots <- struct{}{}:
+		defer func() { <-jobs.slots }()
+	case <-ctx.Done():
+		s.finishJob(job, active, nil, ctx.Err())
+		return
+	}
+
+	started := time.Now()
+	if _, err := s.db.ExecContext(ctx, "UPDATE query_jobs SET status = ?, started_at = ? WHERE id = ?",
+		JobRunning, started, job.ID); err != nil {
+		s.finishJob(job, active, nil, err)
+		return
+	}
+
+	runCtx := ctx
+	if jobs.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, jobs.cfg.Timeout)
+		defer cancel()
+	}
+	usage, err := s.writeJobResult(runCtx, job, scopedTenantID, active)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+		err = fmt.Errorf("query timed out after %s", jobs.cfg.Timeout)
+	case IsQueryError(err):
+		// As /query reports it
+		err = errors.Unwrap(err)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Printf("[%s] job %s failed: %v", reqID, job.ID, err)
+	}
+	s.finishJob(job, active, usage, err)
+}
+
+// writeJobResult runs the job's query and stores the result, counting rows
+// and bytes in active as they are written.
+func (s *Storage) writeJobResult(ctx context.Context, job *Job, scopedTenantID string, active *activeJob) (*QueryUsage, error) {
+	var conn *sql.Conn
+	if scopedTenantID != "" {
+		scoped, release, err := s.ScopedConn(ctx, scopedTenantID)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		conn = scoped
+	} else {
+		var err error
+		if conn, err = s.QueryConn(ctx); err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+	}
+
+	query := job.SQL
+	if job.MaxRows > 0 {
+		query = LimitQuery(query, job.MaxRows)
+	}
+
+	path := s.jobs.resultPath(job.ID)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create result file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := &countingWriter{w: f, n: &active.bytes}
+	err = QueryArrow(ctx, conn, query, nil, func(reader array.RecordReader) error {
+		return writeArrowStream(w, reader, &active.rows)
+	})
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return nil, fmt.Errorf("failed to store result: %w", err)
+	}
+
+	usage, err := LastQueryUsage(conn)
+	if err != nil {
+		log.Printf("Query jobs: failed to read usage of %s: %v", job.ID, err)
+	}
+	return usage, nil
+}
+
+// finishJob records the outcome of a job. A job deleted while it ran leaves
+// no row to update, and its result is removed.
+func (s *Storage) finishJob(job *Job, active *activeJob, usage *QueryUsage, err error) {
+	status, message := JobSucceeded, ""
+	switch {
+	case err != nil && s.jobs.ctx.Err() != nil:
+		status, message = JobFailed, jobInterrupted
+	case errors.Is(err, context.Canceled):
+		status, message = JobCanceled, "canceled"
+	case err != nil:
+		status, message = JobFailed, err.Error()
+	}
+
+	var usageJSON *string
+	if usage != nil {
+		b, _ := json.Marshal(usage)
+		u := string(b)
+		usageJSON = &u
+	}
+
+	// Recorded even when the server is shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := time.Now()
+	res, dbErr := s.db.ExecContext(ctx, `
+		UPDATE query_jobs SET status = ?, error = ?, rows = ?, bytes = ?, usage = ?, finished_at = ?, expires_at = ?
+		WHERE id = ?
+	`, status, message, active.rows.Load(), active.bytes.Load(), usageJSON, now, now.Add(s.jobs.cfg.TTL), job.ID)
+	if dbErr != nil {
+		log.Printf("Query jobs: failed to record outcome of %s: %v", job.ID, dbErr)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		os.Remove(s.jobs.resultPath(job.ID))
+	}
+}
+
+// writeArrowStream writes the records of reader to w as an Arrow IPC stream,
+// adding the rows written to rows.
+func writeArrowStream(w io.Writer, reader array.RecordReader, rows *atomic.Int64) error {
+	iw := ipc.NewWriter(w, ipc.WithSchema(reader.Schema()))
+	for reader.Next() {
+		if err := iw.Write(reader.Record()); err != nil {
+			iw.Close()
+			return err
+		}
+		rows.Add(reader.Record().NumRows())
+	}
+	if err := reader.Err(); err != nil {
+		iw.Close()
+		return err
+	}
+	return iw.Close()
+}
+
+// countingWriter adds the bytes written to n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// GetJob returns a job owned by the caller's API key, with the progress of a
+// running job.
+func (s *Storage) GetJob(ctx context.Context, id string) (*Job, error) {
+	jobs, err := s.queryJobs(ctx, "AND id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, ErrJobNotFound
+	}
+	return &jobs[0], nil
+}
+
+// ListJobs returns the jobs owned by the caller's API key, newest first.
+func (s *Storage) ListJobs(ctx context.Context) ([]Job, error) {
+	return s.queryJobs(ctx, "")
+}
+
+func (s *Storage) queryJobs(ctx context.Context, filter string, args ...any) ([]Job, error) {
+	origin := originFromContext(ctx)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, tenant_id, owner, sql, max_rows, status, error, rows, bytes, usage,
+			created_at, started_at, finished_at, expires_at
+		FROM query_jobs WHERE tenant_id = ? AND owner = ? `+filter+`
+		ORDER BY created_at DESC
+	`, append([]any{tenantFromContext(ctx), origin.APIKeyID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jobs: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		var j Job
+		var usageJSON sql.NullString
+		var startedAt, finishedAt, expiresAt sql.NullTime
+		err := rows.Scan(&j.ID, &j.TenantID, &j.Owner, &j.SQL, &j.MaxRows, &j.Status, &j.Error, &j.Rows, &j.Bytes, &usageJSON,
+			&j.CreatedAt, &startedAt, &finishedAt, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		if usageJSON.Valid {
+			j.Usage = &QueryUsage{}
+			json.Unmarshal([]byte(usageJSON.String), j.Usage)
+		}
+		j.StartedAt = nullTimePtr(startedAt)
+		j.FinishedAt = nullTimePtr(finishedAt)
+		j.ExpiresAt = nullTimePtr(expiresAt)
+		if active := s.activeJob(j.ID); active != nil && !j.Done() {
+			j.Rows, j.Bytes = active.rows.Load(), active.bytes.Load()
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func (s *Storage) activeJob(id string) *activeJob {
+	if s.jobs == nil {
+		return nil
+	}
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	return s.jobs.active[id]
+}
+
+// CancelJob cancels a queued or running job owned by the caller's API key.
+func (s *Storage) CancelJob(ctx context.Context, id string) error {
+	job, err := s.GetJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	active := s.activeJob(job.ID)
+	if job.Done() || active == nil {
+		return ErrJobFinished
+	}
+	active.cancel()
+	return nil
+}
+
+// DeleteJob deletes a job owned by the caller's API key and its result,
+// canceling it if it has not finished.
+func (s *Storage) DeleteJob(ctx context.Context, id string) error {
+	job, err := s.GetJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM query_jobs WHERE id = ?", job.ID); err != nil {
+		return fmt.Errorf("failed to delete job: %w", err)
+	}
+	if active := s.activeJob(job.ID); active != nil {
+		active.cancel()
+	}
+	os.Remove(s.jobs.resultPath(job.ID))
+	return nil
+}
+
+// OpenJobResult opens the result of a succeeded job owned by the caller's
+// API key, an Arrow IPC stream.
+func (s *Storage) OpenJobResult(ctx context.Context, id string) (*os.File, error) {
+	job, err := s.GetJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != JobSucceeded {
+		return nil, ErrJobNoResult
+	}
+	f, err := os.Open(s.jobs.resultPath(job.ID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrJobNoResult
+	}
+	return f, err
+}
+
+// jobResultView is the temporary view ViewJobResult registers.
+const jobResultView = "job_result"
+
+// ViewJobResult makes the result of a succeeded job owned by the caller's API
+// key readable on conn, a connection from QueryConn, and returns a query
+// selecting it. release drops the view before the connection goes back to
+// the pool.
+func (s *Storage) ViewJobResult(ctx context.Context, conn *sql.Conn, id string) (query string, release func(), err error) {
+	f, err := s.OpenJobResult(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+	if release, err = viewArrowFile(conn, f, jobResultView); err != nil {
+		return "", nil, err
+	}
+	return "SELECT * FROM " + jobResultView, release, nil
+}
+
+// viewArrowFile registers f, an Arrow IPC stream, as the temporary view name
+// on conn. release drops the view and closes f; it discards the connection
+// if the view cannot be dropped.
+func viewArrowFile(conn *sql.Conn, f *os.File, name string) (release func(), err error) {
+	reader, err := ipc.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read result: %w", err)
+	}
+
+	var releaseStream func()
+	err = conn.Raw(func(driverConn any) error {
+		dc, ok := driverConn.(driver.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected connection type: %T", driverConn)
+		}
+		ar, err := duckdb.NewArrowFromConn(dc)
+		if err != nil {
+			return err
+		}
+		releaseStream, err = ar.RegisterView(reader, name)
+		return err
+	})
+	if err != nil {
+		reader.Release()
+		f.Close()
+		return nil, fmt.Errorf("failed to read result: %w", err)
+	}
+
+	release = func() {
+		dropCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := conn.ExecContext(dropCtx, "DROP VIEW IF EXISTS temp.main."+name); err != nil {
+			// The view would outlive the stream it reads
+			log.Printf("Failed to drop view %s, discarding connection: %v", name, err)
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		releaseStream()
+		reader.Release()
+		f.Close()
+	}
+	return release, nil
+}
@@ -0,0 +1,464 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/marcboeker/go-duckdb"
+	collectormetricsv1 "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// Log metric rule types.
+const (
+	LogMetricCount = "count" // Sum of matching records
+	LogMetricSum   = "sum"   // Sum of a numeric field over matching records
+	LogMetricGauge = "gauge" // Last value of a numeric field
+)
+
+const logMetricsScopeName = "mo11y/logmetrics"
+
+// DefaultLogMetricsIdleFlushes is used when MaxIdleFlushes is not set.
+const DefaultLogMetricsIdleFlushes = 10
+
+// Log metric rule errors.
+var (
+	ErrRuleNotFound = errors.New("rule not found")
+	ErrRuleExists   = errors.New("rule with this name already exists")
+)
+
+// LogMetricsConfig holds log-to-metric evaluation configuration.
+type LogMetricsConfig struct {
+	FlushIntervalSecs int
+	MaxIdleFlushes    int // Flushes without matches after which a series is dropped
+}
+
+// LogMetricRule turns matching log records of its tenant into a metric of
+// the same tenant. Field names (Match keys, ValueField, GroupBy) are looked up in the record
+// attributes, then the structured body fields, then the resource attributes.
+type LogMetricRule struct {
+	ID           string
+	TenantID     string
+	Name         string
+	Metric       string
+	Description  string
+	Type         string
+	MinSeverity  int32
+	Match        map[string]string
+	BodyContains string
+	ValueField   string
+	GroupBy      []string
+	CreatedAt    time.Time
+}
+
+// Validate checks that the rule is complete and consistent.
+func (r *LogMetricRule) Validate() error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if r.Metric == "" {
+		return errors.New("metric is required")
+	}
+	switch r.Type {
+	case LogMetricCount:
+	case LogMetricSum, LogMetricGauge:
+		if r.ValueField == "" {
+			return fmt.Errorf("value_field is required for %s rules", r.Type)
+		}
+	default:
+		return fmt.Errorf("type must be %s, %s or %s", LogMetricCount, LogMetricSum, LogMetricGauge)
+	}
+	for _, key := range r.GroupBy {
+		if key == "" {
+			return errors.New("group_by keys must not be empty")
+		}
+	}
+	return nil
+}
+
+// LogMetricRuleStatus reports evaluation counters for a rule.
+type LogMetricRuleStatus struct {
+	ID      string
+	Name    string
+	Metric  string
+	Matches int64
+	Series  int
+	Evicted int64 // Series dropped after MaxIdleFlushes without matches
+}
+
+// ingestedLog is an accepted log record handed to ingest-time evaluators.
+type ingestedLog struct {
+	id            string
+	tenant        string
+	resourceAttrs duckdb.Map
+	attrs         duckdb.Map
+	bodyFields    duckdb.Map
+	body          string
+	record        *logsv1.LogRecord
+}
+
+// logMetricSeries holds the state of one group of a rule.
+type logMetricSeries struct {
+	tenant      string
+	service     string
+	attrs       []*commonv1.KeyValue
+	startTime   time.Time
+	value       float64
+	dirty       bool
+	idleFlushes int // Flushes since the series last matched
+}
+
+// logMetricState is a rule together with its evaluation state.
+type logMetricState struct {
+	rule    LogMetricRule
+	matches int64
+	evicted int64
+	series  map[string]*logMetricSeries
+}
+
+// logMetricsEngine evaluates rules against ingested logs. Series idle for
+// maxIdleFlushes are dropped, so that high-cardinality group_by fields do
+// not grow memory without bound; a series that matches again restarts its
+// cumulative value with a new start time.
+type logMetricsEngine struct {
+	mu             sync.Mutex
+	rules          map[string]*logMetricState
+	maxIdleFlushes int
+}
+
+// loadLogMetricRules reads persisted rules into a new engine.
+func (s *Storage) loadLogMetricRules(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, tenant_id, name, metric, description, type, min_severity, match_attrs, body_contains, value_field, group_by, created_at
+		FROM log_metric_rules
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	engine := &logMetricsEngine{
+		rules:          make(map[string]*logMetricState),
+		maxIdleFlushes: DefaultLogMetricsIdleFlushes,
+	}
+	for rows.Next() {
+		var r LogMetricRule
+		var matchJSON, groupByJSON string
+		err := rows.Scan(&r.ID, &r.TenantID, &r.Name, &r.Metric, &r.Description, &r.Type, &r.MinSeverity,
+			&matchJSON, &r.BodyContains, &r.ValueField, &groupByJSON, &r.CreatedAt)
+		if err != nil {
+			return err
+		}
+		json.Unmarshal([]byte(matchJSON), &r.Match)
+		json.Unmarshal([]byte(groupByJSON), &r.GroupBy)
+		engine.rules[r.ID] = newLogMetricState(r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.logMetrics = engine
+	return nil
+}
+
+func newLogMetricState(r LogMetricRule) *logMetricState {
+	return &logMetricState{rule: r, series: make(map[string]*logMetricSeries)}
+}
+
+// CreateLogMetricRule validates, persists and activates a rule of the
+// caller's tenant. Rule names are unique per tenant, enforced by an index so
+// that concurrent creates cannot both succeed.
+func (s *Storage) CreateLogMetricRule(ctx context.Context, r LogMetricRule) (*LogMetricRule, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	r.ID = uuid.New().String()
+	r.TenantID = tenantFromContext(ctx)
+	r.CreatedAt = time.Now()
+	if r.Match == nil {
+		r.Match = map[string]string{}
+	}
+	if r.GroupBy == nil {
+		r.GroupBy = []string{}
+	}
+	matchJSON, _ := json.Marshal(r.Match)
+	groupByJSON, _ := json.Marshal(r.GroupBy)
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO log_metric_rules (id, tenant_id, name, metric, description, type, min_severity, match_attrs, body_contains, value_field, group_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, r.ID, r.TenantID, r.Name, r.Metric, r.Description, r.Type, r.MinSeverity,
+		string(matchJSON), r.BodyContains, r.ValueField, string(groupByJSON), r.CreatedAt)
+	var dbErr *duckdb.Error
+	if errors.As(err, &dbErr) && dbErr.Type == duckdb.ErrorTypeConstraint {
+		return nil, ErrRuleExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save rule: %w", err)
+	}
+
+	s.logMetrics.mu.Lock()
+	s.logMetrics.rules[r.ID] = newLogMetricState(r)
+	s.logMetrics.mu.Unlock()
+	s.invalidateResults(r.TenantID, writeSet{"log_metric_rules": {}})
+
+	return &r, nil
+}
+
+// DeleteLogMetricRule removes a rule of the caller's tenant. Series already
+// written to the metrics table are kept.
+func (s *Storage) DeleteLogMetricRule(ctx context.Context, id string) error {
+	tenantID := tenantFromContext(ctx)
+	res, err := s.db.ExecContext(ctx, "DELETE FROM log_metric_rules WHERE id = ? AND tenant_id = ?", id, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete rule: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrRuleNotFound
+	}
+
+	s.logMetrics.mu.Lock()
+	delete(s.logMetrics.rules, id)
+	s.logMetrics.mu.Unlock()
+	s.invalidateResults(tenantID, writeSet{"log_metric_rules": {}})
+	return nil
+}
+
+// ListLogMetricRules returns the rules of the caller's tenant ordered by name.
+func (s *Storage) ListLogMetricRules(ctx context.Context) []LogMetricRule {
+	tenantID := tenantFromContext(ctx)
+	s.logMetrics.mu.Lock()
+	defer s.logMetrics.mu.Unlock()
+
+	var rules []LogMetricRule
+	for _, st := range s.logMetrics.rules {
+		if st.rule.TenantID == tenantID {
+			rules = append(rules, st.rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// logMetricRuleStatus returns match counters for the rules of tenantID, or
+// of all tenants if empty, ordered by name.
+func (s *Storage) logMetricRuleStatus(tenantID string) []LogMetricRuleStatus {
+	s.logMetrics.mu.Lock()
+	defer s.logMetrics.mu.Unlock()
+
+	status := make([]LogMetricRuleStatus, 0, len(s.logMetrics.rules))
+	for _, st := range s.logMetrics.rules {
+		if tenantID != "" && st.rule.TenantID != tenantID {
+			continue
+		}
+		status = append(status, LogMetricRuleStatus{
+			ID:      st.rule.ID,
+			Name:    st.rule.Name,
+			Metric:  st.rule.Metric,
+			Matches: st.matches,
+			Series:  len(st.series),
+			Evicted: st.evicted,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+// StartLogMetrics periodically writes log metric series to the metrics table.
+// Flushes pending series and stops when ctx is cancelled.
+func (s *Storage) StartLogMetrics(ctx context.Context, cfg LogMetricsConfig) {
+	if cfg.FlushIntervalSecs < 1 {
+		cfg.FlushIntervalSecs = 1
+	}
+	if cfg.MaxIdleFlushes >= 1 {
+		s.logMetrics.mu.Lock()
+		s.logMetrics.maxIdleFlushes = cfg.MaxIdleFlushes
+		s.logMetrics.mu.Unlock()
+	}
+
+	log.Printf("Log metrics worker started: interval=%ds, rules=%d", cfg.FlushIntervalSecs, len(s.logMetricRuleStatus("")))
+
+	ticker := time.NewTicker(time.Duration(cfg.FlushIntervalSecs) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			s.flushLogMetrics(flushCtx)
+			cancel()
+			log.Println("Log metrics worker stopped")
+			return
+		case <-ticker.C:
+			s.flushLogMetrics(ctx)
+		}
+	}
+}
+
+// observeLogs feeds accepted log records into the log metric rules.
+func (s *Storage) observeLogs(logs []ingestedLog) {
+	s.logMetrics.observe(logs)
+}
+
+// observe evaluates the rules of each tenant against its records in a batch
+// of accepted log records.
+func (e *logMetricsEngine) observe(logs []ingestedLog) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, st := range e.rules {
+		for _, l := range logs {
+			if l.tenant == st.rule.TenantID {
+				st.evaluate(l)
+			}
+		}
+	}
+}
+
+// evaluate applies the rule to one record, updating its series on a match.
+func (st *logMetricState) evaluate(l ingestedLog) {
+	r := &st.rule
+	if int32(l.record.SeverityNumber) < r.MinSeverity {
+		return
+	}
+	if r.BodyContains != "" && !strings.Contains(l.body, r.BodyContains) {
+		return
+	}
+	for key, want := range r.Match {
+		if lookupAttr(key, l.attrs, l.bodyFields, l.resourceAttrs) != want {
+			return
+		}
+	}
+
+	value := 1.0
+	if r.Type != LogMetricCount {
+		v, err := strconv.ParseFloat(lookupAttr(r.ValueField, l.attrs, l.bodyFields, l.resourceAttrs), 64)
+		if err != nil {
+			return
+		}
+		value = v
+	}
+
+	service := lookupAttr("service.name", l.resourceAttrs)
+	attrs := make([]*commonv1.KeyValue, 0, len(r.GroupBy))
+	for _, key := range r.GroupBy {
+		attrs = append(attrs, stringKeyValue(key, lookupAttr(key, l.attrs, l.bodyFields, l.resourceAttrs)))
+	}
+
+	key := l.tenant + "\x00" + seriesKey(service, attrs)
+	series, ok := st.series[key]
+	if !ok {
+		series = &logMetricSeries{tenant: l.tenant, service: service, attrs: attrs, startTime: time.Now()}
+		st.series[key] = series
+	}
+
+	if r.Type == LogMetricGauge {
+		series.value = value
+	} else {
+		series.value += value
+	}
+	series.dirty = true
+	series.idleFlushes = 0
+	st.matches++
+}
+
+// flushLogMetrics writes series updated since the last flush to the metrics table.
+func (s *Storage) flushLogMetrics(ctx context.Context) {
+	s.storeDerivedMetrics(ctx, "Log metrics", s.logMetrics.collect(time.Now()))
+}
+
+// collect builds an OTLP metrics request per tenant from dirty series and clears their dirty flag.
+// Series idle for maxIdleFlushes collections are dropped.
+// Returns an empty map if nothing changed since the last collection.
+func (e *logMetricsEngine) collect(now time.Time) map[string]*collectormetricsv1.ExportMetricsServiceRequest {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	nowNanos := uint64(now.UnixNano())
+
+	// Group data points by tenant and service, then by rule
+	metricsByService := make(map[tenantService][]*metricsv1.Metric)
+	var services []tenantService
+
+	for _, st := range e.rules {
+		pointsByService := make(map[tenantService][]*metricsv1.NumberDataPoint)
+		for key, series := range st.series {
+			if !series.dirty {
+				if series.idleFlushes++; series.idleFlushes >= e.maxIdleFlushes {
+					delete(st.series, key)
+					st.evicted++
+				}
+				continue
+			}
+			series.dirty = false
+
+			dp := &metricsv1.NumberDataPoint{
+				Attributes:   series.attrs,
+				TimeUnixNano: nowNanos,
+				Value:        &metricsv1.NumberDataPoint_AsDouble{AsDouble: series.value},
+			}
+			if st.rule.Type != LogMetricGauge {
+				dp.StartTimeUnixNano = uint64(series.startTime.UnixNano())
+			}
+			ts := tenantService{tenant: series.tenant, service: series.service}
+			pointsByService[ts] = append(pointsByService[ts], dp)
+		}
+
+		for ts, points := range pointsByService {
+			if _, ok := metricsByService[ts]; !ok {
+				services = append(services, ts)
+			}
+			metricsByService[ts] = append(metricsByService[ts], st.rule.toMetric(points))
+		}
+	}
+
+	sortTenantServices(services)
+
+	reqs := make(map[string]*collectormetricsv1.ExportMetricsServiceRequest)
+	for _, ts := range services {
+		rm := &metricsv1.ResourceMetrics{
+			ScopeMetrics: []*metricsv1.ScopeMetrics{{
+				Scope:   &commonv1.InstrumentationScope{Name: logMetricsScopeName},
+				Metrics: metricsByService[ts],
+			}},
+		}
+		if ts.service != "" {
+			rm.Resource = &resourcev1.Resource{Attributes: []*commonv1.KeyValue{stringKeyValue("service.name", ts.service)}}
+		}
+		req, ok := reqs[ts.tenant]
+		if !ok {
+			req = &collectormetricsv1.ExportMetricsServiceRequest{}
+			reqs[ts.tenant] = req
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, rm)
+	}
+	return reqs
+}
+
+// toMetric wraps data points in a metric of the rule's type.
+func (r *LogMetricRule) toMetric(points []*metricsv1.NumberDataPoint) *metricsv1.Metric {
+	m := &metricsv1.Metric{Name: r.Metric, Description: r.Description}
+	if r.Type == LogMetricGauge {
+		m.Data = &metricsv1.Metric_Gauge{Gauge: &metricsv1.Gauge{DataPoints: points}}
+		return m
+	}
+	m.Data = &metricsv1.Metric_Sum{Sum: &metricsv1.Sum{
+		DataPoints:             points,
+		AggregationTemporality: metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		IsMonotonic:            r.Type == LogMetricCount,
+	}}
+	return m
+}
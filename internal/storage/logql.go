@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"mo11y/internal/logql"
+	"mo11y/internal/promql"
+)
+
+// LogStream is the set of log lines sharing one label set.
+type LogStream struct {
+	Labels  map[string]string
+	Entries []LogEntry
+}
+
+// LogEntry is a log line of a LogQL result.
+type LogEntry struct {
+	Timestamp time.Time
+	Line      string
+}
+
+// logqlLogs defines logql.LogsRelation over the logs in a time range. Structured
+// bodies are presented as JSON lines so that | json can parse them.
+func logqlLogs(ctx context.Context, start, end time.Time, startInclusive bool) (string, []any) {
+	startOp := ">"
+	if startInclusive {
+		startOp = ">="
+	}
+	cond := "timestamp " + startOp + " ? AND timestamp <= ?"
+	args := []any{start, end}
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		cond += " AND tenant_id = ?"
+		args = append(args, tenantID)
+	}
+	return logql.LogsRelation + ` AS (
+		SELECT
+			timestamp,
+			CASE WHEN coalesce(body, '') = '' AND body_fields IS NOT NULL
+				THEN to_json(body_fields)::VARCHAR ELSE coalesce(body, '') END AS line,
+			` + logql.LabelsExpr("resource_attrs") + ` AS stream,
+			` + logql.LabelsExpr("attrs") + ` AS metadata
+		FROM logs
+		WHERE ` + cond + `
+	)`, args
+}
+
+// LogQLStreams runs a compiled LogQL log query over the logs in [start, end]
+// and returns up to limit lines grouped by stream, newest first unless
+// forward is set.
+func (s *Storage) LogQLStreams(ctx context.Context, q *logql.SQL, start, end time.Time, limit int, forward bool) ([]LogStream, error) {
+	if q.Metric {
+		return nil, fmt.Errorf("LogQLStreams requires a log query")
+	}
+	logs, args := logqlLogs(ctx, start, end, true)
+	args = append(args, q.Args...)
+	args = append(args, limit)
+
+	order := "DESC"
+	if forward {
+		order = "ASC"
+	}
+	rows, err := s.db.QueryContext(ctx, "WITH "+logs+",\n"+strings.Join(q.CTEs, ",\n")+`
+		SELECT epoch_us(timestamp), line, labels
+		FROM `+q.Result+`
+		ORDER BY timestamp `+order+`
+		LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run LogQL query: %w", err)
+	}
+	defer rows.Close()
+
+	var streams []LogStream
+	index := make(map[string]int)
+	for rows.Next() {
+		var ts int64
+		var line string
+		var labels any
+		if err := rows.Scan(&ts, &line, &labels); err != nil {
+			return nil, fmt.Errorf("failed to scan LogQL result: %w", err)
+		}
+		set := labelList(labels)
+		key := promql.Labels(set).Key()
+		i, ok := index[key]
+		if !ok {
+			i = len(streams)
+			index[key] = i
+			streams = append(streams, LogStream{Labels: set})
+		}
+		streams[i].Entries = append(streams[i].Entries, LogEntry{Timestamp: time.UnixMicro(ts), Line: line})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read LogQL results: %w", err)
+	}
+	return streams, nil
+}
+
+// LogQLSeries runs a compiled LogQL metric query at every step from start to
+// end and returns the resulting series. Steps without matching lines have no
+// sample.
+func (s *Storage) LogQLSeries(ctx context.Context, q *logql.SQL, start, end time.Time, step time.Duration) ([]promql.Series, error) {
+	if !q.Metric {
+		return nil, fmt.Errorf("LogQLSeries requires a metric query")
+	}
+	logs, args := logqlLogs(ctx, start.Add(-q.Lookback), end, false)
+	args = append(args, start.UnixMilli(), end.UnixMilli(), step.Milliseconds())
+	args = append(args, q.Args...)
+
+	rows, err := s.db.QueryContext(ctx, "WITH "+logs+`,
+		`+logql.StepsRelation+` AS (SELECT make_timestamp(unnest(generate_series(?::BIGINT, ?::BIGINT, ?::BIGINT)) * 1000) AS t),
+		`+strings.Join(q.CTEs, ",\n")+`
+		SELECT epoch_ms(t), labels, value
+		FROM `+q.Result+`
+		ORDER BY labels, t`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run LogQL query: %w", err)
+	}
+	defer rows.Close()
+
+	var series []promql.Series
+	var lastKey string
+	for rows.Next() {
+		var ts int64
+		var labels any
+		var value float64
+		if err := rows.Scan(&ts, &labels, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan LogQL sample: %w", err)
+		}
+		set := promql.Labels(labelList(labels))
+		// Rows are ordered by series
+		if key := set.Key(); len(series) == 0 || key != lastKey {
+			series = append(series, promql.Series{Metric: set})
+			lastKey = key
+		}
+		last := &series[len(series)-1]
+		last.Points = append(last.Points, promql.Point{T: ts, V: value})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read LogQL samples: %w", err)
+	}
+	return series, nil
+}
+
+// LogStreamLabels returns the distinct stream label sets of the logs in
+// [start, end] matching any of the selectors, or of all logs if there are none.
+func (s *Storage) LogStreamLabels(ctx context.Context, selectors [][]*logql.Matcher, start, end time.Time) ([]map[string]string, error) {
+	logs, args := logqlLogs(ctx, start, end, true)
+	conds := make([]string, 0, len(selectors))
+	for _, matchers := range selectors {
+		cond, condArgs := logql.CompileSelector(matchers)
+		conds = append(conds, "("+cond+")")
+		args = append(args, condArgs...)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " OR ")
+	}
+
+	rows, err := s.db.QueryContext(ctx, "WITH "+logs+" SELECT DISTINCT stream FROM "+logql.LogsRelation+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query log streams: %w", err)
+	}
+	defer rows.Close()
+
+	var result []map[string]string
+	for rows.Next() {
+		var labels any
+		if err := rows.Scan(&labels); err != nil {
+			return nil, fmt.Errorf("failed to scan log stream: %w", err)
+		}
+		result = append(result, labelList(labels))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read log streams: %w", err)
+	}
+	return result, nil
+}
+
+// labelList converts a scanned label list to a map; the first of duplicate
+// names wins.
+func labelList(v any) map[string]string {
+	list, _ := v.([]any)
+	labels := make(map[string]string, len(list))
+	for _, item := range list {
+		entry, _ := item.(map[string]any)
+		name, _ := entry["name"].(string)
+		value, _ := entry["value"].(string)
+		if _, ok := labels[name]; !ok && name != "" {
+			labels[name] = value
+		}
+	}
+	return labels
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,23 +25,38 @@ func (s *Storage) StoreLogs(ctx context.Context, req *collectorlogsv1.ExportLogs
 	}
 	defer conn.Close()
 
-	var appender *duckdb.Appender
+	// Create appenders for logs and their full-text postings
+	var appender, termAppender *duckdb.Appender
 	err = conn.Raw(func(driverConn any) error {
 		duckConn, ok := driverConn.(*duckdb.Conn)
 		if !ok {
 			return fmt.Errorf("unexpected connection type: %T", driverConn)
 		}
+
 		var appErr error
 		appender, appErr = duckdb.NewAppenderFromConn(duckConn, "", "logs")
-		return appErr
+		if appErr != nil {
+			return appErr
+		}
+
+		termAppender, appErr = duckdb.NewAppenderFromConn(duckConn, "", "log_terms")
+		if appErr != nil {
+			appender.Close()
+			return appErr
+		}
+
+		return nil
 	})
 	if err != nil {
-		return nil, NewInfrastructureError("failed to create appender", err)
+		return nil, NewInfrastructureError("failed to create appenders", err)
 	}
 	defer appender.Close()
+	defer termAppender.Close()
 
 	result := &StoreResult{}
 	now := time.Now()
+	tenantID := tenantFromContext(ctx)
+	var accepted []ingestedLog
 
 	// Flatten OTLP hierarchy and append rows
 	for _, rl := range req.GetResourceLogs() {
@@ -64,7 +80,13 @@ func (s *Storage) StoreLogs(ctx context.Context, req *collectorlogsv1.ExportLogs
 
 			for _, lr := range sl.GetLogRecords() {
 				logID := uuid.New().String()
+				if reason := s.validateLogRecord(lr, now); reason != "" {
+					s.reject(result, SignalLogs, reason, fmt.Sprintf("log %s: %s", logID, reason), logEnvelope(rl, sl, lr))
+					continue
+				}
+
 				body, bodyFields := extractLogBody(lr.Body)
+				attrs := flattenAttributes(lr.Attributes)
 
 				err := appender.AppendRow(
 					logID,
@@ -82,23 +104,48 @@ func (s *Storage) StoreLogs(ctx context.Context, req *collectorlogsv1.ExportLogs
 					scopeVersion,
 					scopeAttrs,
 					scopeSchemaURL,
-					flattenAttributes(lr.Attributes),
+					attrs,
 					int32(lr.DroppedAttributesCount),
 					int32(lr.Flags),
 					now,
+					tenantID,
 				)
 				if err != nil {
-					result.AddError(fmt.Sprintf("log %s: %v", logID, err))
+					s.reject(result, SignalLogs, ReasonAppendFailed, fmt.Sprintf("log %s: %v", logID, err), logEnvelope(rl, sl, lr))
 					continue
 				}
+				if err := appendLogTerms(termAppender, logID, body, bodyFields, unixNanoToTime(lr.TimeUnixNano),
+					int8(lr.SeverityNumber), now, tenantID); err != nil {
+					log.Printf("Failed to index log %s: %v", logID, err)
+				}
 				result.Accepted++
+				result.wrote("logs", unixNanoToTime(lr.TimeUnixNano))
+				result.wrote("log_terms", unixNanoToTime(lr.TimeUnixNano))
+				accepted = append(accepted, ingestedLog{
+					id:            logID,
+					tenant:        tenantID,
+					resourceAttrs: resourceAttrs,
+					attrs:         attrs,
+					bodyFields:    bodyFields,
+					body:          body,
+					record:        lr,
+				})
 			}
 		}
 	}
 
+	// Flushed rows are visible even if a later flush fails
+	defer s.invalidateResults(tenantID, result.written)
 	if err := appender.Flush(); err != nil {
 		return nil, NewInfrastructureError("failed to flush logs", err)
 	}
+	if err := termAppender.Flush(); err != nil {
+		return nil, NewInfrastructureError("failed to flush log terms", err)
+	}
+
+	s.observeLogs(accepted)
+	s.publishLogs(accepted)
+	s.writeDeadLetters(ctx, result)
 
 	return result, nil
 }
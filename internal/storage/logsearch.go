@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+
+	"mo11y/internal/logsearch"
+)
+
+// Log search orders; relevance falls back to time for equal scores.
+const (
+	LogSortRelevance = "relevance"
+	LogSortTime      = "time"
+)
+
+// BM25 parameters: term frequency saturation and document length normalization.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// LogSearch selects log records matching a full-text query.
+type LogSearch struct {
+	Query       logsearch.Expr
+	Start, End  time.Time // Log timestamp range
+	MinSeverity int8      // OTLP severity number, 0 for no bound
+	Sort        string    // LogSortRelevance (default) or LogSortTime
+	Limit       int
+}
+
+// LogSearchHit is a log record found by SearchLogs.
+type LogSearchHit struct {
+	LogID          string
+	Timestamp      time.Time
+	SeverityNumber int8
+	SeverityText   string
+	Body           string
+	BodyFields     map[string]string
+	Service        string
+	TraceID        string
+	SpanID         string
+	Score          float64 // BM25 relevance of the non-negated terms
+}
+
+// appendLogTerms indexes a log record: one posting per distinct term of the
+// body and of every body field value.
+func appendLogTerms(appender *duckdb.Appender, logID, body string, bodyFields duckdb.Map,
+	timestamp time.Time, severity int8, now time.Time, tenantID string) error {
+	type fieldTerms struct {
+		field  string
+		counts map[string]int
+	}
+	var fields []fieldTerms
+	docLen := 0
+	if body != "" {
+		counts, n := logsearch.TermCounts(body)
+		fields = append(fields, fieldTerms{"", counts})
+		docLen += n
+	}
+	for k, v := range bodyFields {
+		key, _ := k.(string)
+		value, _ := v.(string)
+		counts, n := logsearch.TermCounts(value)
+		fields = append(fields, fieldTerms{key, counts})
+		docLen += n
+	}
+
+	for _, f := range fields {
+		for term, tf := range f.counts {
+			if err := appender.AppendRow(term, logID, f.field, int32(tf), int32(docLen), timestamp, severity, now, tenantID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SearchLogs runs a full-text query over the log_terms index and returns the
+// matching records, most relevant or most recent first.
+func (s *Storage) SearchLogs(ctx context.Context, q LogSearch) ([]LogSearchHit, error) {
+	compiled, err := logsearch.Compile(q.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	postingConds := []string{"timestamp >= ?", "timestamp <= ?"}
+	postingArgs := []any{q.Start, q.End}
+	if q.MinSeverity > 0 {
+		postingConds = append(postingConds, "severity_number >= ?")
+		postingArgs = append(postingArgs, q.MinSeverity)
+	}
+	docConds := []string{"timestamp >= ?", "timestamp <= ?"}
+	docArgs := []any{q.Start, q.End}
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		postingConds = append(postingConds, "tenant_id = ?")
+		postingArgs = append(postingArgs, tenantID)
+		docConds = append(docConds, "tenant_id = ?")
+		docArgs = append(docArgs, tenantID)
+	}
+
+	// Every token of a non-negated term or phrase contributes to the score
+	var termRows []string
+	var termArgs []any
+	for _, t := range logsearch.Positive(q.Query) {
+		for _, token := range t.Tokens {
+			termRows = append(termRows, fmt.Sprintf("(%d, ?::VARCHAR, ?::BOOLEAN, ?::VARCHAR)", len(termRows)))
+			termArgs = append(termArgs, token, t.Scoped, t.Field)
+		}
+	}
+
+	order := "s.score DESC, l.timestamp DESC"
+	if q.Sort == LogSortTime {
+		order = "l.timestamp DESC"
+	}
+
+	ctes := []string{logsearch.PostingsRelation + ` AS (
+			SELECT term, log_id, field, tf, doc_len
+			FROM log_terms
+			WHERE ` + strings.Join(postingConds, " AND ") + `
+		)`}
+	args := postingArgs
+	if compiled.Docs {
+		ctes = append(ctes, logsearch.DocsRelation+` AS (
+			SELECT log_id, body, body_fields
+			FROM logs
+			WHERE `+strings.Join(docConds, " AND ")+`
+		)`)
+		args = append(args, docArgs...)
+	}
+	ctes = append(ctes, compiled.CTEs...)
+	args = append(args, compiled.Args...)
+	args = append(args, termArgs...)
+	args = append(args, bm25K1, bm25B)
+	args = append(args, docArgs...)
+	args = append(args, q.Limit)
+
+	// The same bounds let the final join prune logs instead of scanning them
+	joinConds := []string{"l.log_id = s.log_id"}
+	for _, cond := range docConds {
+		joinConds = append(joinConds, "l."+cond)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `WITH `+strings.Join(ctes, ",\n")+`,
+		query_terms AS (
+			SELECT * FROM (VALUES `+strings.Join(termRows, ", ")+`) t(i, term, scoped, field)
+		),
+		corpus AS (
+			SELECT count(DISTINCT log_id) AS n, coalesce(sum(tf), 0) / greatest(count(DISTINCT log_id), 1) AS avgdl
+			FROM `+logsearch.PostingsRelation+`
+		),
+		term_freqs AS (
+			SELECT q.i, p.log_id, sum(p.tf) AS tf, any_value(p.doc_len) AS doc_len
+			FROM query_terms q
+			JOIN `+logsearch.PostingsRelation+` p ON p.term = q.term AND (NOT q.scoped OR p.field = q.field)
+			GROUP BY q.i, p.log_id
+		),
+		doc_freqs AS (
+			SELECT i, count(*) AS df FROM term_freqs GROUP BY i
+		),
+		scores AS (
+			SELECT
+				m.log_id,
+				coalesce(sum(
+					ln(1 + (c.n - d.df + 0.5) / (d.df + 0.5)) * f.tf * (k1 + 1) /
+					(f.tf + k1 * (1 - b + b * f.doc_len / c.avgdl))
+				), 0) AS score
+			FROM (SELECT DISTINCT log_id FROM `+compiled.Result+`) m
+			LEFT JOIN term_freqs f ON f.log_id = m.log_id
+			LEFT JOIN doc_freqs d ON d.i = f.i
+			CROSS JOIN corpus c
+			CROSS JOIN (SELECT ?::DOUBLE AS k1, ?::DOUBLE AS b) params
+			GROUP BY m.log_id
+		)
+		SELECT
+			l.log_id, epoch_us(l.timestamp), l.severity_number, l.severity_text, l.body, l.body_fields,
+			l.resource_attrs['service.name'][1], l.trace_id, l.span_id, s.score
+		FROM scores s
+		JOIN logs l ON `+strings.Join(joinConds, " AND ")+`
+		ORDER BY `+order+`, l.log_id
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search logs: %w", err)
+	}
+	defer rows.Close()
+
+	var hits []LogSearchHit
+	for rows.Next() {
+		var h LogSearchHit
+		var ts int64
+		var severity sql.NullInt16
+		var severityText, body, service, traceID, spanID sql.NullString
+		var bodyFields duckdb.Map
+		if err := rows.Scan(&h.LogID, &ts, &severity, &severityText, &body, &bodyFields, &service, &traceID, &spanID, &h.Score); err != nil {
+			return nil, fmt.Errorf("failed to scan log search hit: %w", err)
+		}
+		h.Timestamp = time.UnixMicro(ts)
+		h.SeverityNumber = int8(severity.Int16)
+		h.SeverityText = severityText.String
+		h.Body = body.String
+		h.BodyFields = mapToStrings(bodyFields)
+		h.Service = service.String
+		h.TraceID = traceID.String
+		h.SpanID = spanID.String
+		hits = append(hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read log search hits: %w", err)
+	}
+	return hits, nil
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/marcboeker/go-duckdb"
 	collectormetricsv1 "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
 	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 // MetricType constants matching the schema.
@@ -26,6 +27,7 @@ type Histogram struct {
 	Sum            float64   `json:"sum"`
 	BucketCounts   []int64   `json:"bucket_counts"`
 	ExplicitBounds []float64 `json:"explicit_bounds"`
+	Temporality    string    `json:"temporality,omitempty"` // TemporalityCumulative or TemporalityDelta
 }
 
 // StoreMetrics stores metric data from OTLP request using DuckDB Appender.
@@ -41,23 +43,37 @@ func (s *Storage) StoreMetrics(ctx context.Context, req *collectormetricsv1.Expo
 	}
 	defer conn.Close()
 
-	var appender *duckdb.Appender
+	// Create appenders for metrics and their exemplars
+	var appender, exemplarAppender *duckdb.Appender
 	err = conn.Raw(func(driverConn any) error {
 		duckConn, ok := driverConn.(*duckdb.Conn)
 		if !ok {
 			return fmt.Errorf("unexpected connection type: %T", driverConn)
 		}
+
 		var appErr error
 		appender, appErr = duckdb.NewAppenderFromConn(duckConn, "", "metrics")
-		return appErr
+		if appErr != nil {
+			return appErr
+		}
+
+		exemplarAppender, appErr = duckdb.NewAppenderFromConn(duckConn, "", "metric_exemplars")
+		if appErr != nil {
+			appender.Close()
+			return appErr
+		}
+
+		return nil
 	})
 	if err != nil {
-		return nil, NewInfrastructureError("failed to create appender", err)
+		return nil, NewInfrastructureError("failed to create appenders", err)
 	}
 	defer appender.Close()
+	defer exemplarAppender.Close()
 
 	result := &StoreResult{}
 	now := time.Now()
+	tenantID := tenantFromContext(ctx)
 
 	// Flatten OTLP hierarchy and append rows
 	for _, rm := range req.GetResourceMetrics() {
@@ -79,16 +95,24 @@ func (s *Storage) StoreMetrics(ctx context.Context, req *collectormetricsv1.Expo
 			}
 			scopeSchemaURL = sm.SchemaUrl
 
+			envelope := func(m *metricsv1.Metric) proto.Message { return metricEnvelope(rm, sm, m) }
 			for _, m := range sm.GetMetrics() {
-				s.appendMetricDataPoints(appender, m, resourceAttrs, resourceSchemaURL,
-					scopeName, scopeVersion, scopeAttrs, scopeSchemaURL, now, result)
+				s.appendMetricDataPoints(appender, exemplarAppender, m, envelope, resourceAttrs, resourceSchemaURL,
+					scopeName, scopeVersion, scopeAttrs, scopeSchemaURL, now, tenantID, result)
 			}
 		}
 	}
 
+	// Flushed rows are visible even if a later flush fails
+	defer s.invalidateResults(tenantID, result.written)
 	if err := appender.Flush(); err != nil {
 		return nil, NewInfrastructureError("failed to flush metrics", err)
 	}
+	if err := exemplarAppender.Flush(); err != nil {
+		return nil, NewInfrastructureError("failed to flush exemplars", err)
+	}
+
+	s.writeDeadLetters(ctx, result)
 
 	return result, nil
 }
@@ -96,47 +120,90 @@ func (s *Storage) StoreMetrics(ctx context.Context, req *collectormetricsv1.Expo
 // appendMetricDataPoints extracts data points from a metric and appends them.
 func (s *Storage) appendMetricDataPoints(
 	appender *duckdb.Appender,
+	exemplarAppender *duckdb.Appender,
 	m *metricsv1.Metric,
+	envelope func(*metricsv1.Metric) proto.Message,
 	resourceAttrs duckdb.Map,
 	resourceSchemaURL string,
 	scopeName, scopeVersion string,
 	scopeAttrs duckdb.Map,
 	scopeSchemaURL string,
 	now time.Time,
+	tenantID string,
 	result *StoreResult,
 ) {
+	if reason := s.validateMetric(m); reason != "" {
+		for _, dp := range metricDataPoints(m) {
+			s.reject(result, SignalMetrics, reason, fmt.Sprintf("metric %q: %s", m.Name, reason),
+				envelope(singlePointMetric(m, dp)))
+		}
+		return
+	}
+
 	switch data := m.Data.(type) {
 	case *metricsv1.Metric_Gauge:
-		s.appendNumberDataPoints(appender, m, data.Gauge.DataPoints, MetricTypeGauge, false,
-			resourceAttrs, resourceSchemaURL, scopeName, scopeVersion, scopeAttrs, scopeSchemaURL, now, result)
+		s.appendNumberDataPoints(appender, exemplarAppender, m, envelope, data.Gauge.DataPoints, MetricTypeGauge, false,
+			metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED,
+			resourceAttrs, resourceSchemaURL, scopeName, scopeVersion, scopeAttrs, scopeSchemaURL, now, tenantID, result)
 
 	case *metricsv1.Metric_Sum:
-		s.appendNumberDataPoints(appender, m, data.Sum.DataPoints, MetricTypeSum, data.Sum.IsMonotonic,
-			resourceAttrs, resourceSchemaURL, scopeName, scopeVersion, scopeAttrs, scopeSchemaURL, now, result)
+		s.appendNumberDataPoints(appender, exemplarAppender, m, envelope, data.Sum.DataPoints, MetricTypeSum, data.Sum.IsMonotonic,
+			data.Sum.AggregationTemporality,
+			resourceAttrs, resourceSchemaURL, scopeName, scopeVersion, scopeAttrs, scopeSchemaURL, now, tenantID, result)
+
+	case *metricsv1.Metric_Histogram:
+		s.appendHistogramDataPoints(appender, exemplarAppender, m, envelope, data.Histogram.DataPoints,
+			data.Histogram.AggregationTemporality,
+			resourceAttrs, resourceSchemaURL, scopeName, scopeVersion, scopeAttrs, scopeSchemaURL, now, tenantID, result)
+	}
+}
 
+// metricDataPoints returns the data points of the stored metric types.
+func metricDataPoints(m *metricsv1.Metric) []proto.Message {
+	var points []proto.Message
+	switch data := m.Data.(type) {
+	case *metricsv1.Metric_Gauge:
+		for _, dp := range data.Gauge.DataPoints {
+			points = append(points, dp)
+		}
+	case *metricsv1.Metric_Sum:
+		for _, dp := range data.Sum.DataPoints {
+			points = append(points, dp)
+		}
 	case *metricsv1.Metric_Histogram:
-		s.appendHistogramDataPoints(appender, m, data.Histogram.DataPoints,
-			resourceAttrs, resourceSchemaURL, scopeName, scopeVersion, scopeAttrs, scopeSchemaURL, now, result)
+		for _, dp := range data.Histogram.DataPoints {
+			points = append(points, dp)
+		}
 	}
+	return points
 }
 
 // appendNumberDataPoints appends Gauge or Sum data points.
 func (s *Storage) appendNumberDataPoints(
 	appender *duckdb.Appender,
+	exemplarAppender *duckdb.Appender,
 	m *metricsv1.Metric,
+	envelope func(*metricsv1.Metric) proto.Message,
 	dataPoints []*metricsv1.NumberDataPoint,
 	metricType int8,
 	isMonotonic bool,
+	temporality metricsv1.AggregationTemporality,
 	resourceAttrs duckdb.Map,
 	resourceSchemaURL string,
 	scopeName, scopeVersion string,
 	scopeAttrs duckdb.Map,
 	scopeSchemaURL string,
 	now time.Time,
+	tenantID string,
 	result *StoreResult,
 ) {
 	for _, dp := range dataPoints {
 		metricID := uuid.New().String()
+		if reason := s.validateNumberDataPoint(dp, now); reason != "" {
+			s.reject(result, SignalMetrics, reason, fmt.Sprintf("metric %s/%s: %s", m.Name, metricID, reason),
+				envelope(singlePointMetric(m, dp)))
+			continue
+		}
 
 		var value float64
 		switch v := dp.Value.(type) {
@@ -164,30 +231,46 @@ func (s *Storage) appendNumberDataPoints(
 			scopeSchemaURL,
 			flattenAttributes(dp.Attributes),
 			now,
+			tenantID,
+			optionalTime(dp.StartTimeUnixNano),
+			temporalityColumn(temporality),
 		)
 		if err != nil {
-			result.AddError(fmt.Sprintf("metric %s/%s: %v", m.Name, metricID, err))
+			s.reject(result, SignalMetrics, ReasonAppendFailed, fmt.Sprintf("metric %s/%s: %v", m.Name, metricID, err),
+				envelope(singlePointMetric(m, dp)))
 			continue
 		}
 		result.Accepted++
+		result.wrote("metrics", unixNanoToTime(dp.TimeUnixNano))
+
+		s.appendExemplars(exemplarAppender, metricID, m.Name, dp.Exemplars, now, tenantID, result)
 	}
 }
 
 // appendHistogramDataPoints appends Histogram data points.
 func (s *Storage) appendHistogramDataPoints(
 	appender *duckdb.Appender,
+	exemplarAppender *duckdb.Appender,
 	m *metricsv1.Metric,
+	envelope func(*metricsv1.Metric) proto.Message,
 	dataPoints []*metricsv1.HistogramDataPoint,
+	temporality metricsv1.AggregationTemporality,
 	resourceAttrs duckdb.Map,
 	resourceSchemaURL string,
 	scopeName, scopeVersion string,
 	scopeAttrs duckdb.Map,
 	scopeSchemaURL string,
 	now time.Time,
+	tenantID string,
 	result *StoreResult,
 ) {
 	for _, dp := range dataPoints {
 		metricID := uuid.New().String()
+		if reason := s.validateHistogramDataPoint(dp, now); reason != "" {
+			s.reject(result, SignalMetrics, reason, fmt.Sprintf("histogram %s/%s: %s", m.Name, metricID, reason),
+				envelope(singlePointMetric(m, dp)))
+			continue
+		}
 
 		bucketCounts := make([]int64, len(dp.BucketCounts))
 		for i, c := range dp.BucketCounts {
@@ -199,6 +282,7 @@ func (s *Storage) appendHistogramDataPoints(
 			Sum:            dp.GetSum(),
 			BucketCounts:   bucketCounts,
 			ExplicitBounds: dp.ExplicitBounds,
+			Temporality:    histogramTemporality(temporality),
 		}
 		histogramJSON, _ := json.Marshal(histogram)
 
@@ -220,11 +304,77 @@ func (s *Storage) appendHistogramDataPoints(
 			scopeSchemaURL,
 			flattenAttributes(dp.Attributes),
 			now,
+			tenantID,
+			optionalTime(dp.StartTimeUnixNano),
+			temporalityColumn(temporality),
 		)
 		if err != nil {
-			result.AddError(fmt.Sprintf("histogram %s/%s: %v", m.Name, metricID, err))
+			s.reject(result, SignalMetrics, ReasonAppendFailed, fmt.Sprintf("histogram %s/%s: %v", m.Name, metricID, err),
+				envelope(singlePointMetric(m, dp)))
 			continue
 		}
 		result.Accepted++
+		result.wrote("metrics", unixNanoToTime(dp.TimeUnixNano))
+
+		s.appendExemplars(exemplarAppender, metricID, m.Name, dp.Exemplars, now, tenantID, result)
+	}
+}
+
+// temporalityColumn returns the temporality column value of a data point:
+// the OTLP enum value, or NULL for gauges.
+func temporalityColumn(t metricsv1.AggregationTemporality) any {
+	if t == metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED {
+		return nil
+	}
+	return int8(t)
+}
+
+// histogramTemporality returns the temporality recorded for an OTLP histogram.
+// Unspecified temporality is treated as cumulative.
+func histogramTemporality(t metricsv1.AggregationTemporality) string {
+	if t == metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA {
+		return TemporalityDelta
+	}
+	return TemporalityCumulative
+}
+
+// appendExemplars appends the exemplars of a stored data point, linked by
+// metric_id. They were validated with the data point and are appended after
+// it, so a rejected data point leaves none behind; one that still fails to
+// append is counted as dropped.
+func (s *Storage) appendExemplars(
+	appender *duckdb.Appender,
+	metricID string,
+	metricName string,
+	exemplars []*metricsv1.Exemplar,
+	now time.Time,
+	tenantID string,
+	result *StoreResult,
+) {
+	for _, ex := range exemplars {
+		var value float64
+		switch v := ex.Value.(type) {
+		case *metricsv1.Exemplar_AsDouble:
+			value = v.AsDouble
+		case *metricsv1.Exemplar_AsInt:
+			value = float64(v.AsInt)
+		}
+
+		err := appender.AppendRow(
+			metricID,
+			metricName,
+			unixNanoToTime(ex.TimeUnixNano),
+			value,
+			hexEncode(ex.TraceId),
+			hexEncode(ex.SpanId),
+			flattenAttributes(ex.FilteredAttributes),
+			now,
+			tenantID,
+		)
+		if err != nil {
+			s.dropped(result, SignalMetrics, ReasonExemplarFailed, fmt.Sprintf("exemplar %s/%s: %v", metricName, metricID, err))
+			continue
+		}
+		result.wrote("metric_exemplars", unixNanoToTime(ex.TimeUnixNano))
 	}
 }
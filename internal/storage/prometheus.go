@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+
+	"mo11y/internal/promql"
+)
+
+// promNameExpr converts a stored metric name to a Prometheus metric name,
+// matching PromMetricName.
+const promNameExpr = `regexp_replace(name, '[^a-zA-Z0-9_:]', '_', 'g')`
+
+// maxPromSamples limits the samples a selector loads into memory, like
+// Prometheus' query.max-samples. Only metric name equality is pushed down to
+// DuckDB, so a broad selector over a long range could otherwise load every
+// sample of the tenant.
+const maxPromSamples = 5_000_000
+
+// ErrTooManySamples reports a selector matching more than maxPromSamples.
+var ErrTooManySamples = fmt.Errorf("query loads more than %d samples", maxPromSamples)
+
+// Suffixes of the series a histogram is exposed as.
+var histogramSuffixes = []string{"_bucket", "_count", "_sum"}
+
+// PromMetricName converts an OTLP metric name such as http.server.duration to
+// a Prometheus metric name by replacing invalid characters with underscores.
+func PromMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// PromLabelName converts an attribute key to a Prometheus label name.
+func PromLabelName(key string) string {
+	name := strings.ReplaceAll(PromMetricName(key), ":", "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "key_" + name
+	}
+	return name
+}
+
+// PromSeries returns the metric series matching all matchers with their
+// samples in [start, end], as the PromQL engine sees them. Data point
+// attributes become labels, service.name becomes job and service.instance.id
+// becomes instance. Histograms are exposed as cumulative _bucket series with
+// an le label plus _count and _sum series.
+func (s *Storage) PromSeries(ctx context.Context, matchers []*promql.Matcher, start, end time.Time) ([]promql.Series, error) {
+	series := make(map[string]*promql.Series)
+	var order []string
+	err := s.scanPromSamples(ctx, matchers, start, end, true, func(labels promql.Labels, p promql.Point) {
+		key := labels.Key()
+		ss, ok := series[key]
+		if !ok {
+			ss = &promql.Series{Metric: labels}
+			series[key] = ss
+			order = append(order, key)
+		}
+		// Rows are ordered by time; a repeated timestamp replaces the sample
+		if n := len(ss.Points); n > 0 && ss.Points[n-1].T == p.T {
+			ss.Points[n-1] = p
+			return
+		}
+		ss.Points = append(ss.Points, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]promql.Series, len(order))
+	for i, key := range order {
+		result[i] = *series[key]
+	}
+	return result, nil
+}
+
+// PromLabelSets returns the distinct label sets of the series with samples in
+// [start, end] that match any of the selectors, or of all series if there are none.
+func (s *Storage) PromLabelSets(ctx context.Context, selectors [][]*promql.Matcher, start, end time.Time) ([]promql.Labels, error) {
+	if len(selectors) == 0 {
+		selectors = [][]*promql.Matcher{nil}
+	}
+	seen := make(map[string]bool)
+	var result []promql.Labels
+	for _, matchers := range selectors {
+		err := s.scanPromSamples(ctx, matchers, start, end, false, func(labels promql.Labels, _ promql.Point) {
+			if key := labels.Key(); !seen[key] {
+				seen[key] = true
+				result = append(result, labels)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// scanPromSamples calls fn for every sample matching all matchers in
+// [start, end]. Without withSamples it is called once per distinct series
+// with a zero point. It fails with ErrTooManySamples once fn would be called
+// more than maxPromSamples times.
+func (s *Storage) scanPromSamples(ctx context.Context, matchers []*promql.Matcher, start, end time.Time, withSamples bool, fn func(promql.Labels, promql.Point)) error {
+	conds := []string{"timestamp >= ?", "timestamp <= ?", "type IN (?, ?, ?)"}
+	args := []any{start, end, MetricTypeGauge, MetricTypeSum, MetricTypeHistogram}
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		conds = append(conds, "tenant_id = ?")
+		args = append(args, tenantID)
+	}
+
+	// Push metric name equality down; other matchers are applied to the labels
+	for _, m := range matchers {
+		if m.Name != promql.MetricNameLabel || m.Type != promql.MatchEqual {
+			continue
+		}
+		cond := "(" + promNameExpr + " = ? AND type <> ?)"
+		args = append(args, m.Value, MetricTypeHistogram)
+		for _, suffix := range histogramSuffixes {
+			if base, ok := strings.CutSuffix(m.Value, suffix); ok {
+				cond += " OR (" + promNameExpr + " = ? AND type = ?)"
+				args = append(args, base, MetricTypeHistogram)
+			}
+		}
+		conds = append(conds, "("+cond+")")
+	}
+
+	columns := `epoch_ms(timestamp), name, type, value, histogram_json, attrs,
+		resource_attrs['service.name'][1], resource_attrs['service.namespace'][1], resource_attrs['service.instance.id'][1]`
+	query := "SELECT " + columns + " FROM metrics WHERE " + strings.Join(conds, " AND ") + " ORDER BY timestamp"
+	if !withSamples {
+		// Histogram bounds determine the le labels
+		query = `SELECT DISTINCT 0, name, type, 0, CASE WHEN type = ` + strconv.Itoa(int(MetricTypeHistogram)) + ` THEN histogram_json->>'$.explicit_bounds' END, attrs,
+			resource_attrs['service.name'][1], resource_attrs['service.namespace'][1], resource_attrs['service.instance.id'][1]
+			FROM metrics WHERE ` + strings.Join(conds, " AND ")
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query metric series: %w", err)
+	}
+	defer rows.Close()
+
+	var samples int
+	for rows.Next() {
+		var ts int64
+		var name string
+		var metricType int8
+		var value *float64
+		var histogramJSON, service, namespace, instance *string
+		var attrs duckdb.Map
+		if err := rows.Scan(&ts, &name, &metricType, &value, &histogramJSON, &attrs, &service, &namespace, &instance); err != nil {
+			return fmt.Errorf("failed to scan metric sample: %w", err)
+		}
+
+		base := make(promql.Labels, len(attrs)+2)
+		for k, v := range attrs {
+			ks, _ := k.(string)
+			vs, _ := v.(string)
+			if vs != "" {
+				base[PromLabelName(ks)] = vs
+			}
+		}
+		if service != nil && *service != "" {
+			base["job"] = *service
+			if namespace != nil && *namespace != "" {
+				base["job"] = *namespace + "/" + *service
+			}
+		}
+		if instance != nil && *instance != "" {
+			base["instance"] = *instance
+		}
+		promName := PromMetricName(name)
+
+		emit := func(metricName string, extra map[string]string, v float64) {
+			labels := make(promql.Labels, len(base)+2)
+			for k, lv := range base {
+				labels[k] = lv
+			}
+			for k, lv := range extra {
+				labels[k] = lv
+			}
+			labels[promql.MetricNameLabel] = metricName
+			for _, m := range matchers {
+				if !m.Matches(labels[m.Name]) {
+					return
+				}
+			}
+			samples++
+			if samples <= maxPromSamples {
+				fn(labels, promql.Point{T: ts, V: v})
+			}
+		}
+
+		if metricType != MetricTypeHistogram {
+			if value != nil {
+				emit(promName, nil, *value)
+			}
+			if samples > maxPromSamples {
+				return ErrTooManySamples
+			}
+			continue
+		}
+		if histogramJSON == nil {
+			continue
+		}
+		var h Histogram
+		if withSamples {
+			if err := json.Unmarshal([]byte(*histogramJSON), &h); err != nil {
+				continue
+			}
+		} else if err := json.Unmarshal([]byte(*histogramJSON), &h.ExplicitBounds); err != nil {
+			continue
+		}
+
+		var cumulative int64
+		for i, bound := range h.ExplicitBounds {
+			if i < len(h.BucketCounts) {
+				cumulative += h.BucketCounts[i]
+			}
+			emit(promName+"_bucket", map[string]string{"le": strconv.FormatFloat(bound, 'f', -1, 64)}, float64(cumulative))
+		}
+		emit(promName+"_bucket", map[string]string{"le": "+Inf"}, float64(h.Count))
+		emit(promName+"_count", nil, float64(h.Count))
+		emit(promName+"_sum", nil, h.Sum)
+		if samples > maxPromSamples {
+			return ErrTooManySamples
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read metric samples: %w", err)
+	}
+	return nil
+}
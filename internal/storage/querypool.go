@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// QueryConfig configures how user queries run.
+//
+// DuckDB applies memory_limit, threads, temp_directory,
+// max_temp_directory_size and enable_external_access to the whole database
+// rather than to a connection, so these limits are shared with ingest. Empty
+// or zero fields keep DuckDB's defaults.
+type QueryConfig struct {
+	MaxConns       int    // Connections in the query pool, 0 for no limit
+	MemoryLimit    string // e.g. "4GB"
+	Threads        int
+	TempDirectory  string // Where operators spill when memory runs out
+	MaxTempSize    string // Cap on spilled data, e.g. "10GB"
+	ExternalAccess bool   // Disabling it also disables COPY, so Parquet output fails
+}
+
+// ErrTooManyQueries reports an API key already running as many queries as
+// its concurrency limit allows.
+var ErrTooManyQueries = errors.New("too many concurrent queries for this API key")
+
+// querySlots counts the queries each API key runs on the query pool. DuckDB
+// has no per-connection memory or thread limits, so a per-key concurrency
+// limit is what keeps one key from taking the whole pool.
+type querySlots struct {
+	mu      sync.Mutex
+	running map[string]int // API key ID -> queries running
+}
+
+// ErrParquetDisabled reports Parquet output requested while external access
+// is disabled.
+var ErrParquetDisabled = errors.New("parquet output requires DuckDB external access, which is disabled")
+
+// QueryUsage reports the resources a user query consumed, from DuckDB's profiler.
+type QueryUsage struct {
+	CPUTime      time.Duration // Summed over DuckDB's threads
+	Latency      time.Duration
+	RowsScanned  int64
+	RowsReturned int64
+	ResultBytes  int64
+}
+
+// queryConnector opens query pool connections on the database of the main
+// pool, with DuckDB's profiler collecting QueryUsage.
+type queryConnector struct {
+	connector *duckdb.Connector
+}
+
+func (c queryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.(driver.ExecerContext).ExecContext(ctx, "SET enable_profiling = 'no_output'", nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to enable profiling: %w", err)
+	}
+	return conn, nil
+}
+
+func (c queryConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// ConfigureQueries sizes the query pool and applies the DuckDB settings of cfg.
+// Must be called before queries run.
+func (s *Storage) ConfigureQueries(ctx context.Context, cfg QueryConfig) error {
+	s.queryDB.SetMaxOpenConns(cfg.MaxConns)
+
+	var settings []string
+	if cfg.MemoryLimit != "" {
+		settings = append(settings, "SET memory_limit = "+quoteLiteral(cfg.MemoryLimit))
+	}
+	if cfg.Threads > 0 {
+		settings = append(settings, "SET threads = "+strconv.Itoa(cfg.Threads))
+	}
+	if cfg.TempDirectory != "" {
+		settings = append(settings, "SET temp_directory = "+quoteLiteral(cfg.TempDirectory))
+	}
+	if cfg.MaxTempSize != "" {
+		settings = append(settings, "SET max_temp_directory_size = "+quoteLiteral(cfg.MaxTempSize))
+	}
+	if !cfg.ExternalAccess {
+		// Cannot be enabled again while the database is open
+		settings = append(settings, "SET enable_external_access = false")
+		s.noExternalAccess = true
+	}
+	for _, stmt := range settings {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to apply %q: %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// ParquetEnabled reports whether CopyParquet can write files, which DuckDB
+// refuses with external access disabled.
+func (s *Storage) ParquetEnabled() bool {
+	return !s.noExternalAccess
+}
+
+// QueryConn returns a connection from the query pool. User queries run there
+// so that they cannot take the connections ingest needs.
+func (s *Storage) QueryConn(ctx context.Context) (*sql.Conn, error) {
+	conn, err := s.queryDB.Conn(ctx)
+	if err != nil {
+		return nil, NewInfrastructureError("failed to get connection", err)
+	}
+	return conn, nil
+}
+
+// AcquireQuerySlot counts a query of the caller's API key against max
+// concurrent queries, failing with ErrTooManyQueries when the key already runs
+// max. release must be called once the query is done. A max of 0, or a
+// request without an API key, is not limited.
+func (s *Storage) AcquireQuerySlot(ctx context.Context, max int) (release func(), err error) {
+	keyID := originFromContext(ctx).APIKeyID
+	if max <= 0 || keyID == "" {
+		return func() {}, nil
+	}
+
+	slots := &s.querySlots
+	slots.mu.Lock()
+	defer slots.mu.Unlock()
+	if slots.running[keyID] >= max {
+		return nil, ErrTooManyQueries
+	}
+	if slots.running == nil {
+		slots.running = make(map[string]int)
+	}
+	slots.running[keyID]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			slots.mu.Lock()
+			defer slots.mu.Unlock()
+			if slots.running[keyID]--; slots.running[keyID] <= 0 {
+				delete(slots.running, keyID)
+			}
+		})
+	}, nil
+}
+
+// LastQueryUsage returns the usage of the last query completed on conn, a
+// connection from QueryConn or ScopedConn.
+func LastQueryUsage(conn *sql.Conn) (*QueryUsage, error) {
+	info, err := duckdb.GetProfilingInfo(conn)
+	if err != nil {
+		return nil, err
+	}
+	seconds := func(name string) time.Duration {
+		f, _ := strconv.ParseFloat(info.Metrics[name], 64)
+		return time.Duration(f * float64(time.Second))
+	}
+	count := func(name string) int64 {
+		n, _ := strconv.ParseInt(info.Metrics[name], 10, 64)
+		return n
+	}
+	return &QueryUsage{
+		CPUTime:      seconds("CPU_TIME"),
+		Latency:      seconds("LATENCY"),
+		RowsScanned:  count("CUMULATIVE_ROWS_SCANNED"),
+		RowsReturned: count("ROWS_RETURNED"),
+		ResultBytes:  count("RESULT_SET_SIZE"),
+	}, nil
+}
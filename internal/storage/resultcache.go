@@ -0,0 +1,495 @@
+package storage
+
+import (
+	"container/list"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResultCacheConfig configures the cache of query results.
+type ResultCacheConfig struct {
+	MaxBytes int64         // Total size of cached results, 0 disables the cache
+	TTL      time.Duration // How long a result is served at most
+}
+
+// TimeRange is a range of timestamps, both ends inclusive. A zero end is
+// unbounded.
+type TimeRange struct {
+	From, To time.Time
+}
+
+// extend returns r grown to include t. A zero t stands for rows without a
+// time column and makes r unbounded.
+func (r TimeRange) extend(t time.Time) TimeRange {
+	if t.IsZero() {
+		return TimeRange{}
+	}
+	if !r.From.IsZero() && t.Before(r.From) {
+		r.From = t
+	}
+	if !r.To.IsZero() && t.After(r.To) {
+		r.To = t
+	}
+	return r
+}
+
+func (r TimeRange) overlaps(o TimeRange) bool {
+	return (r.To.IsZero() || o.From.IsZero() || !r.To.Before(o.From)) &&
+		(r.From.IsZero() || o.To.IsZero() || !o.To.Before(r.From))
+}
+
+// ResultScope is the data a query result was computed from: the rows of
+// Tenant ("" for all tenants) in each table, within its time range.
+type ResultScope struct {
+	Tenant string
+	Reads  map[string]TimeRange
+}
+
+// timeColumns are the columns whose ranges cached results are invalidated
+// by. Tables without one are invalidated by any write.
+var timeColumns = map[string]string{
+	"spans":               "start_time",
+	"span_events":         "event_time",
+	"logs":                "timestamp",
+	"log_terms":           "timestamp",
+	"metrics":             "timestamp",
+	"metric_exemplars":    "timestamp",
+	"service_graph_edges": "window_start",
+}
+
+// writeSet collects the tables a write touched and the range of their time
+// column.
+type writeSet map[string]TimeRange
+
+// add records a row written to table with time t in its time column, or the
+// zero time for tables without one.
+func (ws writeSet) add(table string, t time.Time) {
+	if r, ok := ws[table]; ok {
+		ws[table] = r.extend(t)
+	} else {
+		ws[table] = TimeRange{From: t, To: t}
+	}
+}
+
+// ResultCacheStats reports the use of the result cache.
+type ResultCacheStats struct {
+	Entries       int
+	Bytes         int64
+	MaxBytes      int64
+	Hits          int64
+	Misses        int64
+	Invalidations int64 // Entries dropped because their data changed
+	Evictions     int64 // Entries dropped for space
+}
+
+// recentWrites is how many writes are kept to check results computed while
+// they happened.
+const recentWrites = 1024
+
+// resultCache holds query results, least recently used first out, until
+// their TTL passes or a write touches the data they were computed from.
+type resultCache struct {
+	cfg ResultCacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // Of *cachedResult
+	lru     list.List
+	byTable map[string]map[*cachedResult]struct{}
+	bytes   int64
+
+	// Writes since the cache started, the last recentWrites of them kept
+	seq    uint64
+	writes []cacheWrite
+
+	hits, misses, invalidations, evictions int64
+}
+
+type cachedResult struct {
+	key     string
+	value   any
+	size    int64
+	scope   ResultScope
+	created time.Time
+}
+
+type cacheWrite struct {
+	seq    uint64
+	tenant string // "" for all tenants
+	table  string
+	rows   TimeRange
+}
+
+// ConfigureResultCache enables the result cache. Must be called before
+// queries run.
+func (s *Storage) ConfigureResultCache(cfg ResultCacheConfig) {
+	if cfg.MaxBytes <= 0 || cfg.TTL <= 0 {
+		return
+	}
+	s.results = &resultCache{
+		cfg:     cfg,
+		entries: make(map[string]*list.Element),
+		byTable: make(map[string]map[*cachedResult]struct{}),
+	}
+}
+
+// ResultCacheLimit returns the size of the largest result worth caching, 0
+// when the cache is disabled.
+func (s *Storage) ResultCacheLimit() int64 {
+	if s.results == nil {
+		return 0
+	}
+	// Leaves room for other results
+	return s.results.cfg.MaxBytes / 4
+}
+
+// CachedResult returns the result cached under key and its age.
+func (s *Storage) CachedResult(key string) (value any, age time.Duration, ok bool) {
+	c := s.results
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, 0, false
+	}
+	e := el.Value.(*cachedResult)
+	if age = time.Since(e.created); age > c.cfg.TTL {
+		c.remove(el)
+		c.misses++
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(el)
+	c.hits++
+	return e.value, age, true
+}
+
+// ResultCacheVersion returns the version to pass to CacheResult for a
+// result computed from now on.
+func (s *Storage) ResultCacheVersion() uint64 {
+	c := s.results
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+// CacheResult caches value, of the given size, under key. version is the
+// ResultCacheVersion from before the result was computed: if a write since
+// then touched scope, value may not include it and is not cached.
+func (s *Storage) CacheResult(key string, version uint64, scope ResultScope, value any, size int64) {
+	c := s.results
+	if c == nil {
+		return
+	}
+	size += int64(len(key))
+	if size > c.cfg.MaxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seq-version > uint64(len(c.writes)) {
+		// The writes in between are no longer known
+		return
+	}
+	for _, w := range c.writes {
+		if w.seq > version && w.touches(scope) {
+			return
+		}
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	for c.bytes+size > c.cfg.MaxBytes {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+
+	e := &cachedResult{key: key, value: value, size: size, scope: scope, created: time.Now()}
+	c.entries[key] = c.lru.PushFront(e)
+	c.bytes += size
+	for table := range scope.Reads {
+		if c.byTable[table] == nil {
+			c.byTable[table] = make(map[*cachedResult]struct{})
+		}
+		c.byTable[table][e] = struct{}{}
+	}
+}
+
+// remove drops el from the cache. Must hold c.mu.
+func (c *resultCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cachedResult)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+	for table := range e.scope.Reads {
+		delete(c.byTable[table], e)
+	}
+}
+
+// touches reports whether w changed rows a result with scope was computed
+// from.
+func (w cacheWrite) touches(scope ResultScope) bool {
+	if w.tenant != "" && scope.Tenant != "" && w.tenant != scope.Tenant {
+		return false
+	}
+	r, ok := scope.Reads[w.table]
+	return ok && r.overlaps(w.rows)
+}
+
+// invalidateResults drops the cached results computed from rows of tenant
+// ("" for all tenants) that ws touched.
+func (s *Storage) invalidateResults(tenant string, ws writeSet) {
+	c := s.results
+	if c == nil || len(ws) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for table, rows := range ws {
+		c.seq++
+		w := cacheWrite{seq: c.seq, tenant: tenant, table: table, rows: rows}
+		if len(c.writes) == recentWrites {
+			c.writes = append(c.writes[:0], c.writes[1:]...)
+		}
+		c.writes = append(c.writes, w)
+
+		for e := range c.byTable[table] {
+			if w.touches(e.scope) {
+				c.remove(c.entries[e.key])
+				c.invalidations++
+			}
+		}
+	}
+}
+
+// resultCacheStatus returns the cache's statistics, nil when it is disabled.
+func (s *Storage) resultCacheStatus() *ResultCacheStats {
+	c := s.results
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &ResultCacheStats{
+		Entries:       len(c.entries),
+		Bytes:         c.bytes,
+		MaxBytes:      c.cfg.MaxBytes,
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Invalidations: c.invalidations,
+		Evictions:     c.evictions,
+	}
+}
+
+// Reads returns the tables the statement reads, with the range of their time
+// column that its rows come from. Ranges are only narrowed by comparisons of
+// the time column with timestamps, given as literals or as args, that are
+// ANDed into the WHERE clause of a SELECT reading the table alone; every
+// other read covers the whole table.
+func (sh QueryShape) Reads(args []any) map[string]TimeRange {
+	named := make(map[string]any)
+	for _, arg := range args {
+		if n, ok := arg.(sql.NamedArg); ok {
+			named[n.Name] = n.Value
+		}
+	}
+	reads := make(map[string]TimeRange)
+	collectReads(sh.tree, named, reads)
+	return reads
+}
+
+// collectReads adds the table reads in v to reads.
+func collectReads(v any, args map[string]any, reads map[string]TimeRange) {
+	switch v := v.(type) {
+	case map[string]any:
+		if v["type"] == "BASE_TABLE" {
+			addRead(reads, v, TimeRange{})
+			return
+		}
+		if v["type"] == "TABLE_FUNCTION" {
+			function, _ := v["function"].(map[string]any)
+			name, _ := function["function_name"].(string)
+			if table := counterMacros[strings.ToLower(name)]; table != "" {
+				addRead(reads, map[string]any{"table_name": table}, TimeRange{})
+			}
+		}
+		if v["type"] == "SELECT_NODE" {
+			if from, ok := v["from_table"].(map[string]any); ok && from["type"] == "BASE_TABLE" {
+				addRead(reads, from, whereRange(from, v["where_clause"], args))
+				for k, child := range v {
+					if k != "from_table" {
+						collectReads(child, args, reads)
+					}
+				}
+				return
+			}
+		}
+		for _, child := range v {
+			collectReads(child, args, reads)
+		}
+	case []any:
+		for _, child := range v {
+			collectReads(child, args, reads)
+		}
+	}
+}
+
+// addRead records a read of the table in ref. Names that are not tables,
+// such as CTEs, are skipped.
+func addRead(reads map[string]TimeRange, ref map[string]any, r TimeRange) {
+	table, _ := ref["table_name"].(string)
+	table = strings.ToLower(table)
+	if !slices.Contains(tenantTables, table) {
+		return
+	}
+	if prev, ok := reads[table]; ok {
+		// The smallest range covering both
+		if prev.From.IsZero() || r.From.IsZero() || r.From.After(prev.From) {
+			r.From = prev.From
+		}
+		if prev.To.IsZero() || r.To.IsZero() || r.To.Before(prev.To) {
+			r.To = prev.To
+		}
+	}
+	reads[table] = r
+}
+
+// whereRange returns the range of the time column of the table in ref that
+// the conditions in where restrict it to.
+func whereRange(ref map[string]any, where any, args map[string]any) TimeRange {
+	table, _ := ref["table_name"].(string)
+	column := timeColumns[strings.ToLower(table)]
+	alias, _ := ref["alias"].(string)
+	if alias == "" {
+		alias = table
+	}
+	isTime := func(v any) bool {
+		e, _ := v.(map[string]any)
+		if e == nil || e["class"] != "COLUMN_REF" {
+			return false
+		}
+		names, _ := e["column_names"].([]any)
+		switch len(names) {
+		case 1:
+			return strings.EqualFold(fmt.Sprint(names[0]), column)
+		case 2:
+			return strings.EqualFold(fmt.Sprint(names[0]), alias) && strings.EqualFold(fmt.Sprint(names[1]), column)
+		}
+		return false
+	}
+
+	var r TimeRange
+	lower := func(v any) {
+		if t, ok := timeValue(v, args); ok && (r.From.IsZero() || t.After(r.From)) {
+			r.From = t
+		}
+	}
+	upper := func(v any) {
+		if t, ok := timeValue(v, args); ok && (r.To.IsZero() || t.Before(r.To)) {
+			r.To = t
+		}
+	}
+
+	var visit func(v any)
+	visit = func(v any) {
+		e, _ := v.(map[string]any)
+		if e == nil || column == "" {
+			return
+		}
+		switch e["class"] {
+		case "CONJUNCTION":
+			if e["type"] == "CONJUNCTION_AND" {
+				children, _ := e["children"].([]any)
+				for _, child := range children {
+					visit(child)
+				}
+			}
+		case "BETWEEN":
+			if isTime(e["input"]) {
+				lower(e["lower"])
+				upper(e["upper"])
+			}
+		case "COMPARISON":
+			left, right := e["left"], e["right"]
+			op, _ := e["type"].(string)
+			if isTime(right) {
+				// Read as column op value
+				left, right = right, left
+				op = flippedComparisons[op]
+			}
+			if !isTime(left) {
+				return
+			}
+			switch op {
+			case "COMPARE_GREATERTHAN", "COMPARE_GREATERTHANOREQUALTO":
+				lower(right)
+			case "COMPARE_LESSTHAN", "COMPARE_LESSTHANOREQUALTO":
+				upper(right)
+			case "COMPARE_EQUAL":
+				lower(right)
+				upper(right)
+			}
+		}
+	}
+	visit(where)
+	return r
+}
+
+// flippedComparisons map the comparison a op b to the one of b and a.
+var flippedComparisons = map[string]string{
+	"COMPARE_EQUAL":                "COMPARE_EQUAL",
+	"COMPARE_LESSTHAN":             "COMPARE_GREATERTHAN",
+	"COMPARE_LESSTHANOREQUALTO":    "COMPARE_GREATERTHANOREQUALTO",
+	"COMPARE_GREATERTHAN":          "COMPARE_LESSTHAN",
+	"COMPARE_GREATERTHANOREQUALTO": "COMPARE_LESSTHANOREQUALTO",
+}
+
+// timeValue returns the timestamp expression v stands for, if it is a
+// literal or a parameter, possibly cast to TIMESTAMP or DATE.
+func timeValue(v any, args map[string]any) (time.Time, bool) {
+	e, _ := v.(map[string]any)
+	if e == nil {
+		return time.Time{}, false
+	}
+	var value any
+	switch e["class"] {
+	case "CAST":
+		castType, _ := e["cast_type"].(map[string]any)
+		if id := castType["id"]; id != "TIMESTAMP" && id != "DATE" {
+			return time.Time{}, false
+		}
+		return timeValue(e["child"], args)
+	case "CONSTANT":
+		c, _ := e["value"].(map[string]any)
+		if c["is_null"] == true {
+			return time.Time{}, false
+		}
+		value = c["value"]
+	case "PARAMETER":
+		name, _ := e["identifier"].(string)
+		value = args[name]
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -10,24 +11,29 @@ import (
 type CleanupConfig struct {
 	RetentionHours      int
 	CleanupIntervalMins int
+	Tenants             TenantRetentionSource // Optional per-tenant overrides, 0 hours keeps data forever
 }
 
 // CleanupResult contains the outcome of a cleanup run.
 type CleanupResult struct {
-	Timestamp         time.Time
-	Duration          time.Duration
-	SpansDeleted      int64
-	SpanEventsDeleted int64
-	SpanLinksDeleted  int64
-	LogsDeleted       int64
-	MetricsDeleted    int64
+	Timestamp          time.Time
+	Duration           time.Duration
+	SpansDeleted       int64
+	SpanEventsDeleted  int64
+	SpanLinksDeleted   int64
+	LogsDeleted        int64
+	LogTermsDeleted    int64
+	MetricsDeleted     int64
+	ExemplarsDeleted   int64
+	EdgesDeleted       int64
+	DeadLettersDeleted int64
 }
 
 // StartCleanupWorker starts the periodic cleanup goroutine.
-// Returns immediately if retention is disabled (hours=0).
+// Returns immediately if retention is disabled (hours=0) and there are no tenant overrides.
 // Stops when ctx is cancelled.
 func (s *Storage) StartCleanupWorker(ctx context.Context, cfg CleanupConfig) {
-	if cfg.RetentionHours == 0 {
+	if cfg.RetentionHours == 0 && cfg.Tenants == nil {
 		log.Println("Retention disabled, cleanup worker not started")
 		return
 	}
@@ -39,7 +45,7 @@ func (s *Storage) StartCleanupWorker(ctx context.Context, cfg CleanupConfig) {
 	log.Printf("Cleanup worker started: retention=%dh, interval=%dm", cfg.RetentionHours, cfg.CleanupIntervalMins)
 
 	// Run once at startup
-	s.runCleanup(ctx, cfg.RetentionHours)
+	s.runCleanup(ctx, cfg)
 
 	ticker := time.NewTicker(time.Duration(cfg.CleanupIntervalMins) * time.Minute)
 	defer ticker.Stop()
@@ -50,13 +56,13 @@ func (s *Storage) StartCleanupWorker(ctx context.Context, cfg CleanupConfig) {
 			log.Println("Cleanup worker stopped")
 			return
 		case <-ticker.C:
-			s.runCleanup(ctx, cfg.RetentionHours)
+			s.runCleanup(ctx, cfg)
 		}
 	}
 }
 
 // runCleanup executes a single cleanup cycle.
-func (s *Storage) runCleanup(ctx context.Context, retentionHours int) {
+func (s *Storage) runCleanup(ctx context.Context, cfg CleanupConfig) {
 	// Try to acquire semaphore (non-blocking)
 	select {
 	case s.cleanupRunning <- struct{}{}:
@@ -67,7 +73,20 @@ func (s *Storage) runCleanup(ctx context.Context, retentionHours int) {
 	}
 
 	start := time.Now()
-	cutoff := start.Add(-time.Duration(retentionHours) * time.Hour)
+
+	overrides := map[string]int{}
+	if cfg.Tenants != nil {
+		var err error
+		if overrides, err = cfg.Tenants.TenantRetention(ctx); err != nil {
+			// Without the overrides the global cutoff could delete data tenants keep longer
+			log.Printf("Cleanup failed to load tenant retention: %v", err)
+			return
+		}
+	}
+	where, args := retentionCondition(start, cfg.RetentionHours, overrides)
+	if where == "" {
+		return
+	}
 
 	result := &CleanupResult{Timestamp: start}
 
@@ -86,12 +105,16 @@ func (s *Storage) runCleanup(ctx context.Context, retentionHours int) {
 		{"span_events", &result.SpanEventsDeleted},
 		{"span_links", &result.SpanLinksDeleted},
 		{"spans", &result.SpansDeleted},
+		{"log_terms", &result.LogTermsDeleted},
 		{"logs", &result.LogsDeleted},
+		{"metric_exemplars", &result.ExemplarsDeleted},
 		{"metrics", &result.MetricsDeleted},
+		{"service_graph_edges", &result.EdgesDeleted},
+		{"dead_letters", &result.DeadLettersDeleted},
 	}
 
 	for _, t := range tables {
-		res, err := tx.ExecContext(ctx, "DELETE FROM "+t.name+" WHERE ingested_at < ?", cutoff)
+		res, err := tx.ExecContext(ctx, "DELETE FROM "+t.name+" WHERE "+where, args...)
 		if err != nil {
 			log.Printf("Cleanup failed to delete from %s: %v", t.name, err)
 			tx.Rollback()
@@ -105,6 +128,15 @@ func (s *Storage) runCleanup(ctx context.Context, retentionHours int) {
 		return
 	}
 
+	// Rows expire by ingest time, so any time range may have lost rows
+	deleted := make(writeSet)
+	for _, t := range tables {
+		if *t.deleted > 0 {
+			deleted[t.name] = TimeRange{}
+		}
+	}
+	s.invalidateResults("", deleted)
+
 	// Checkpoint to flush WAL
 	if _, err := s.db.ExecContext(ctx, "CHECKPOINT"); err != nil {
 		log.Printf("Cleanup checkpoint failed: %v", err)
@@ -114,14 +146,44 @@ func (s *Storage) runCleanup(ctx context.Context, retentionHours int) {
 	s.lastCleanup = result
 
 	total := result.SpansDeleted + result.SpanEventsDeleted + result.SpanLinksDeleted +
-		result.LogsDeleted + result.MetricsDeleted
+		result.LogsDeleted + result.LogTermsDeleted + result.MetricsDeleted + result.ExemplarsDeleted +
+		result.EdgesDeleted + result.DeadLettersDeleted
 
 	if total > 0 {
-		log.Printf("Cleanup completed in %v: spans=%d, events=%d, links=%d, logs=%d, metrics=%d",
+		log.Printf("Cleanup completed in %v: spans=%d, events=%d, links=%d, logs=%d, log_terms=%d, metrics=%d, exemplars=%d, edges=%d, dead_letters=%d",
 			result.Duration.Round(time.Millisecond),
 			result.SpansDeleted, result.SpanEventsDeleted, result.SpanLinksDeleted,
-			result.LogsDeleted, result.MetricsDeleted)
+			result.LogsDeleted, result.LogTermsDeleted, result.MetricsDeleted, result.ExemplarsDeleted,
+			result.EdgesDeleted, result.DeadLettersDeleted)
 	} else {
 		log.Printf("Cleanup completed in %v: no old data to delete", result.Duration.Round(time.Millisecond))
 	}
 }
+
+// retentionCondition builds the WHERE clause matching expired rows.
+// Tenants with an override use their own cutoff, all others the global one.
+// Returns "" if no data expires.
+func retentionCondition(now time.Time, retentionHours int, overrides map[string]int) (string, []any) {
+	var conds []string
+	var args []any
+
+	if retentionHours > 0 {
+		cond := "ingested_at < ?"
+		args = append(args, now.Add(-time.Duration(retentionHours)*time.Hour))
+		if len(overrides) > 0 {
+			cond += " AND tenant_id NOT IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(overrides)), ", ") + ")"
+			for tenantID := range overrides {
+				args = append(args, tenantID)
+			}
+		}
+		conds = append(conds, "("+cond+")")
+	}
+
+	for tenantID, hours := range overrides {
+		if hours > 0 {
+			conds = append(conds, "(tenant_id = ? AND ingested_at < ?)")
+			args = append(args, tenantID, now.Add(-time.Duration(hours)*time.Hour))
+		}
+	}
+	return strings.Join(conds, " OR "), args
+}
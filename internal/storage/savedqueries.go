@@ -0,0 +1,396 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Saved query visibilities.
+const (
+	VisibilityPrivate = "private" // Only the owning API key
+	VisibilityTenant  = "tenant"  // Every key of the owner's tenant
+)
+
+// Saved query errors.
+var (
+	ErrSavedQueryNotFound = errors.New("saved query not found")
+	ErrSavedQueryExists   = errors.New("saved query with this name already exists")
+)
+
+// paramTypes maps saved query parameter types to the DuckDB types their
+// values are cast to.
+var paramTypes = map[string]string{
+	"string":    "VARCHAR",
+	"int":       "BIGINT",
+	"float":     "DOUBLE",
+	"bool":      "BOOLEAN",
+	"timestamp": "TIMESTAMP", // RFC 3339, stored in UTC
+	"interval":  "INTERVAL",  // DuckDB interval text, e.g. "15 minutes"
+}
+
+var (
+	savedQueryName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+	paramName      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// SavedQuery is a named SQL query with typed $name parameters, stored per tenant.
+type SavedQuery struct {
+	Name        string
+	Description string
+	SQL         string
+	Params      []QueryParam
+	TenantID    string
+	Owner       string // API key ID, empty without auth
+	Visibility  string // VisibilityPrivate or VisibilityTenant
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// QueryParam declares a parameter of a saved query.
+type QueryParam struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"` // string, int, float, bool, timestamp or interval
+	Description string `json:"description,omitempty"`
+	Default     any    `json:"default,omitempty"` // nil makes the parameter required
+}
+
+// Validate checks the name, visibility and parameter declarations, and sets
+// the default visibility.
+func (q *SavedQuery) Validate() error {
+	if !savedQueryName.MatchString(q.Name) {
+		return errors.New("name must be 1-64 characters of A-Z, a-z, 0-9, '_', '.' or '-'")
+	}
+	if strings.TrimSpace(q.SQL) == "" {
+		return errors.New("sql is required")
+	}
+	switch q.Visibility {
+	case "":
+		q.Visibility = VisibilityPrivate
+	case VisibilityPrivate, VisibilityTenant:
+	default:
+		return fmt.Errorf("visibility must be %s or %s", VisibilityPrivate, VisibilityTenant)
+	}
+
+	seen := make(map[string]bool, len(q.Params))
+	for _, p := range q.Params {
+		if !paramName.MatchString(p.Name) {
+			return fmt.Errorf("invalid parameter name %q", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate parameter %s", p.Name)
+		}
+		seen[p.Name] = true
+		if _, ok := paramTypes[p.Type]; !ok {
+			return fmt.Errorf("parameter %s: type must be string, int, float, bool, timestamp or interval", p.Name)
+		}
+		if p.Default != nil {
+			if _, err := p.value(p.Default); err != nil {
+				return fmt.Errorf("parameter %s: default: %w", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// value converts a JSON value to the value bound for the parameter.
+func (p QueryParam) value(v any) (any, error) {
+	switch p.Type {
+	case "string", "interval":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "int":
+		switch n := v.(type) {
+		case float64:
+			if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+				return int64(n), nil
+			}
+		case int:
+			return int64(n), nil
+		case int64:
+			return n, nil
+		}
+	case "float":
+		switch n := v.(type) {
+		case float64:
+			return n, nil
+		case int:
+			return float64(n), nil
+		case int64:
+			return float64(n), nil
+		}
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "timestamp":
+		// Bound as text and cast by DuckDB, which cannot bind named TIMESTAMP parameters
+		if s, ok := v.(string); ok {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, errors.New("expected an RFC 3339 timestamp")
+			}
+			return t.UTC().Format("2006-01-02 15:04:05.999999"), nil
+		}
+	}
+	return nil, fmt.Errorf("expected a value of type %s", p.Type)
+}
+
+// BindParams returns the named arguments for running a saved query with
+// values, filling in defaults.
+func BindParams(params []QueryParam, values map[string]any) ([]any, error) {
+	declared := make(map[string]bool, len(params))
+	args := make([]any, 0, len(params))
+	for _, p := range params {
+		declared[p.Name] = true
+		v, ok := values[p.Name]
+		if !ok || v == nil {
+			if p.Default == nil {
+				return nil, fmt.Errorf("missing parameter %s", p.Name)
+			}
+			v = p.Default
+		}
+		bound, err := p.value(v)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", p.Name, err)
+		}
+		args = append(args, sql.Named(p.Name, bound))
+	}
+	for name := range values {
+		if !declared[name] {
+			return nil, fmt.Errorf("unknown parameter %s", name)
+		}
+	}
+	return args, nil
+}
+
+// ParamSQL returns query with every $name parameter cast to its declared
+// type. It fails on undeclared, unused or positional parameters.
+func (s *Storage) ParamSQL(ctx context.Context, query string, params []QueryParam) (string, error) {
+	tree, err := parseSelect(ctx, s.queryDB, query)
+	if err != nil {
+		return "", err
+	}
+
+	types := make(map[string]string, len(params))
+	for _, p := range params {
+		types[p.Name] = paramTypes[p.Type]
+	}
+	used := make(map[string]bool)
+	if tree, err = castParams(tree, types, used); err != nil {
+		return "", err
+	}
+	for _, p := range params {
+		if !used[p.Name] {
+			return "", fmt.Errorf("parameter %s is not used", p.Name)
+		}
+	}
+
+	serialized, err := json.Marshal(map[string]any{"error": false, "statements": []any{tree}})
+	if err != nil {
+		return "", err
+	}
+	var typed string
+	if err := s.queryDB.QueryRowContext(ctx, "SELECT json_deserialize_sql(?::JSON)", string(serialized)).Scan(&typed); err != nil {
+		return "", fmt.Errorf("failed to rewrite query: %w", err)
+	}
+	return typed, nil
+}
+
+// castParams wraps each parameter in the tree in a cast to its type in types
+// and records it in used.
+func castParams(v any, types map[string]string, used map[string]bool) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		if v["class"] == "PARAMETER" {
+			name, _ := v["identifier"].(string)
+			typ, ok := types[name]
+			if !ok {
+				if _, err := strconv.Atoi(name); err == nil {
+					return nil, errors.New("positional parameters are not allowed, use $name")
+				}
+				return nil, fmt.Errorf("undeclared parameter $%s", name)
+			}
+			used[name] = true
+
+			// The cast takes over the alias, as in CAST($x AS T) AS alias
+			param := make(map[string]any, len(v))
+			for k, child := range v {
+				param[k] = child
+			}
+			param["alias"] = ""
+			return map[string]any{
+				"class":          "CAST",
+				"type":           "OPERATOR_CAST",
+				"alias":          v["alias"],
+				"query_location": v["query_location"],
+				"child":          param,
+				"cast_type":      map[string]any{"id": typ, "type_info": nil},
+				"try_cast":       false,
+			}, nil
+		}
+		for k, child := range v {
+			c, err := castParams(child, types, used)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = c
+		}
+	case []any:
+		for i, child := range v {
+			c, err := castParams(child, types, used)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = c
+		}
+	}
+	return v, nil
+}
+
+// checkSavedQuery validates q and checks its SQL like an ad-hoc query of the caller.
+func (s *Storage) checkSavedQuery(ctx context.Context, q *SavedQuery) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	typed, err := s.ParamSQL(ctx, q.SQL, q.Params)
+	if err != nil {
+		return err
+	}
+	_, err = CheckQuery(ctx, s.queryDB, typed)
+	return err
+}
+
+// visibleTo reports whether the caller in origin may see q.
+func (q *SavedQuery) visibleTo(origin Origin) bool {
+	return q.Visibility == VisibilityTenant || q.Owner == origin.APIKeyID
+}
+
+// CreateSavedQuery validates and stores a query owned by the caller's API
+// key in the caller's tenant.
+func (s *Storage) CreateSavedQuery(ctx context.Context, q SavedQuery) (*SavedQuery, error) {
+	if err := s.checkSavedQuery(ctx, &q); err != nil {
+		return nil, err
+	}
+
+	q.TenantID = tenantFromContext(ctx)
+	q.Owner = originFromContext(ctx).APIKeyID
+	q.CreatedAt = time.Now()
+	q.UpdatedAt = q.CreatedAt
+	if q.Params == nil {
+		q.Params = []QueryParam{}
+	}
+
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM saved_queries WHERE tenant_id = ? AND name = ?",
+		q.TenantID, q.Name).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check saved query: %w", err)
+	}
+	if exists {
+		return nil, ErrSavedQueryExists
+	}
+
+	paramsJSON, _ := json.Marshal(q.Params)
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO saved_queries (tenant_id, name, description, sql, params, owner, visibility, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, q.TenantID, q.Name, q.Description, q.SQL, string(paramsJSON), q.Owner, q.Visibility, q.CreatedAt, q.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save query: %w", err)
+	}
+	return &q, nil
+}
+
+// UpdateSavedQuery replaces the description, SQL, parameters and visibility
+// of a query in the caller's tenant. The caller must be allowed to change it.
+func (s *Storage) UpdateSavedQuery(ctx context.Context, q SavedQuery) (*SavedQuery, error) {
+	if err := s.checkSavedQuery(ctx, &q); err != nil {
+		return nil, err
+	}
+	if q.Params == nil {
+		q.Params = []QueryParam{}
+	}
+
+	paramsJSON, _ := json.Marshal(q.Params)
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE saved_queries SET description = ?, sql = ?, params = ?, visibility = ?, updated_at = ?
+		WHERE tenant_id = ? AND name = ?
+	`, q.Description, q.SQL, string(paramsJSON), q.Visibility, time.Now(), tenantFromContext(ctx), q.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update saved query: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrSavedQueryNotFound
+	}
+	return s.GetSavedQuery(ctx, q.Name)
+}
+
+// DeleteSavedQuery removes a query from the caller's tenant. The caller must
+// be allowed to change it.
+func (s *Storage) DeleteSavedQuery(ctx context.Context, name string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM saved_queries WHERE tenant_id = ? AND name = ?",
+		tenantFromContext(ctx), name)
+	if err != nil {
+		return fmt.Errorf("failed to delete saved query: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSavedQueryNotFound
+	}
+	return nil
+}
+
+// GetSavedQuery returns a query of the caller's tenant that the caller may see.
+func (s *Storage) GetSavedQuery(ctx context.Context, name string) (*SavedQuery, error) {
+	queries, err := s.querySavedQueries(ctx, "AND name = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, ErrSavedQueryNotFound
+	}
+	return &queries[0], nil
+}
+
+// ListSavedQueries returns the queries of the caller's tenant that the caller
+// may see, ordered by name.
+func (s *Storage) ListSavedQueries(ctx context.Context) ([]SavedQuery, error) {
+	return s.querySavedQueries(ctx, "")
+}
+
+func (s *Storage) querySavedQueries(ctx context.Context, filter string, args ...any) ([]SavedQuery, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT tenant_id, name, description, sql, params, owner, visibility, created_at, updated_at
+		FROM saved_queries WHERE tenant_id = ? `+filter+`
+		ORDER BY name
+	`, append([]any{tenantFromContext(ctx)}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read saved queries: %w", err)
+	}
+	defer rows.Close()
+
+	origin := originFromContext(ctx)
+	queries := []SavedQuery{}
+	for rows.Next() {
+		var q SavedQuery
+		var paramsJSON string
+		err := rows.Scan(&q.TenantID, &q.Name, &q.Description, &q.SQL, &paramsJSON, &q.Owner, &q.Visibility, &q.CreatedAt, &q.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if !q.visibleTo(origin) {
+			continue
+		}
+		json.Unmarshal([]byte(paramsJSON), &q.Params)
+		queries = append(queries, q)
+	}
+	return queries, rows.Err()
+}
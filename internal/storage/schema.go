@@ -3,6 +3,12 @@ package storage
 // SQL schemas for OTLP data storage.
 // Based on docs/design/duckdb-schema-design.adoc
 // 5 tables: spans, span_events, span_links, logs, metrics
+// Linked tables: metric_exemplars
+// Derived tables: service_graph_edges
+// Configuration tables: log_metric_rules, saved_queries
+// Operational tables: dead_letters, query_jobs
+// Data tables end with tenant_id, see tenantMigrations, followed by columns
+// added since.
 
 const spansSchema = `
 CREATE TABLE IF NOT EXISTS spans (
@@ -37,7 +43,10 @@ CREATE TABLE IF NOT EXISTS spans (
     dropped_attrs_count INTEGER,
     
     -- Ingestion metadata
-    ingested_at TIMESTAMP NOT NULL
+    ingested_at TIMESTAMP NOT NULL,
+    
+    -- Owning tenant
+    tenant_id VARCHAR DEFAULT 'default'
 );
 `
 
@@ -61,7 +70,10 @@ CREATE TABLE IF NOT EXISTS span_events (
     dropped_attrs_count INTEGER,
     
     -- Ingestion metadata
-    ingested_at TIMESTAMP NOT NULL
+    ingested_at TIMESTAMP NOT NULL,
+    
+    -- Owning tenant
+    tenant_id VARCHAR DEFAULT 'default'
 );
 `
 
@@ -88,7 +100,10 @@ CREATE TABLE IF NOT EXISTS span_links (
     dropped_attrs_count INTEGER,
     
     -- Ingestion metadata
-    ingested_at TIMESTAMP NOT NULL
+    ingested_at TIMESTAMP NOT NULL,
+    
+    -- Owning tenant
+    tenant_id VARCHAR DEFAULT 'default'
 );
 `
 
@@ -133,7 +148,10 @@ CREATE TABLE IF NOT EXISTS logs (
     flags INTEGER,
     
     -- Ingestion metadata
-    ingested_at TIMESTAMP NOT NULL
+    ingested_at TIMESTAMP NOT NULL,
+    
+    -- Owning tenant
+    tenant_id VARCHAR DEFAULT 'default'
 );
 `
 
@@ -144,6 +162,32 @@ CREATE INDEX IF NOT EXISTS idx_logs_severity ON logs(severity_number);
 CREATE INDEX IF NOT EXISTS idx_logs_ingested_at ON logs(ingested_at);
 `
 
+const logTermsSchema = `
+CREATE TABLE IF NOT EXISTS log_terms (
+    -- Posting: a term of a log record's body or body field
+    term VARCHAR NOT NULL,
+    log_id VARCHAR NOT NULL,
+    field VARCHAR NOT NULL,        -- Body field name, empty for the body text
+    tf INTEGER NOT NULL,           -- Occurrences of the term in the field
+    doc_len INTEGER NOT NULL,      -- Tokens in the whole record
+    
+    -- Copied from the log record for filtering without a join
+    timestamp TIMESTAMP NOT NULL,
+    severity_number TINYINT,
+    
+    -- Ingestion metadata
+    ingested_at TIMESTAMP NOT NULL,
+    
+    -- Owning tenant
+    tenant_id VARCHAR DEFAULT 'default'
+);
+`
+
+const logTermsIndexes = `
+CREATE INDEX IF NOT EXISTS idx_log_terms_term ON log_terms(term);
+CREATE INDEX IF NOT EXISTS idx_log_terms_ingested_at ON log_terms(ingested_at);
+`
+
 const metricsSchema = `
 CREATE TABLE IF NOT EXISTS metrics (
     -- Identity
@@ -181,13 +225,185 @@ CREATE TABLE IF NOT EXISTS metrics (
     attrs MAP(VARCHAR, VARCHAR),
     
     -- Ingestion metadata
-    ingested_at TIMESTAMP NOT NULL
+    ingested_at TIMESTAMP NOT NULL,
+    
+    -- Owning tenant
+    tenant_id VARCHAR DEFAULT 'default',
+
+    -- Sum and histogram fields added after tenant_id, see metricsMigrations
+    start_time TIMESTAMP,
+    temporality TINYINT
 );
 `
 
+// logMetricRulesIndexes run after tenantMigrations, which add tenant_id to
+// databases created without it.
+var logMetricRulesIndexes = []string{
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_log_metric_rules_name ON log_metric_rules(tenant_id, name)",
+}
+
+// metricsMigrations add the columns appended to metrics after tenant_id to
+// databases created without them.
+var metricsMigrations = []string{
+	"ALTER TABLE metrics ADD COLUMN IF NOT EXISTS start_time TIMESTAMP",
+	"ALTER TABLE metrics ADD COLUMN IF NOT EXISTS temporality TINYINT",
+}
+
 const metricsIndexes = `
 CREATE INDEX IF NOT EXISTS idx_metrics_timestamp ON metrics(timestamp);
 CREATE INDEX IF NOT EXISTS idx_metrics_name ON metrics(name);
 CREATE INDEX IF NOT EXISTS idx_metrics_type ON metrics(type);
 CREATE INDEX IF NOT EXISTS idx_metrics_ingested_at ON metrics(ingested_at);
 `
+
+const metricExemplarsSchema = `
+CREATE TABLE IF NOT EXISTS metric_exemplars (
+    -- Parent data point reference
+    metric_id VARCHAR NOT NULL,
+    metric_name VARCHAR NOT NULL,
+    
+    -- Exemplar data
+    timestamp TIMESTAMP NOT NULL,
+    value DOUBLE,
+    trace_id VARCHAR,
+    span_id VARCHAR,
+    filtered_attrs MAP(VARCHAR, VARCHAR),
+    
+    -- Ingestion metadata
+    ingested_at TIMESTAMP NOT NULL,
+    
+    -- Owning tenant
+    tenant_id VARCHAR DEFAULT 'default'
+);
+`
+
+const metricExemplarsIndexes = `
+CREATE INDEX IF NOT EXISTS idx_metric_exemplars_metric_id ON metric_exemplars(metric_id);
+CREATE INDEX IF NOT EXISTS idx_metric_exemplars_name_time ON metric_exemplars(metric_name, timestamp);
+CREATE INDEX IF NOT EXISTS idx_metric_exemplars_trace_id ON metric_exemplars(trace_id);
+CREATE INDEX IF NOT EXISTS idx_metric_exemplars_ingested_at ON metric_exemplars(ingested_at);
+`
+
+const serviceGraphEdgesSchema = `
+CREATE TABLE IF NOT EXISTS service_graph_edges (
+    -- Aggregation window
+    window_start TIMESTAMP NOT NULL,
+    window_end TIMESTAMP NOT NULL,
+    
+    -- Edge identity (resource_attrs['service.name'] of both sides)
+    client VARCHAR NOT NULL,
+    server VARCHAR NOT NULL,
+    connection_type VARCHAR NOT NULL,
+    
+    -- Edge statistics
+    call_count BIGINT NOT NULL,
+    error_count BIGINT NOT NULL,
+    client_duration_sum_ns BIGINT NOT NULL,
+    server_duration_sum_ns BIGINT NOT NULL,
+    client_duration_max_ns BIGINT NOT NULL,
+    
+    -- Ingestion metadata
+    ingested_at TIMESTAMP NOT NULL,
+    
+    -- Owning tenant
+    tenant_id VARCHAR DEFAULT 'default'
+);
+`
+
+const serviceGraphEdgesIndexes = `
+CREATE INDEX IF NOT EXISTS idx_service_graph_edges_window ON service_graph_edges(window_start);
+CREATE INDEX IF NOT EXISTS idx_service_graph_edges_ingested_at ON service_graph_edges(ingested_at);
+`
+
+const logMetricRulesSchema = `
+CREATE TABLE IF NOT EXISTS log_metric_rules (
+    id VARCHAR PRIMARY KEY,
+    name VARCHAR NOT NULL,
+    metric VARCHAR NOT NULL,
+    description VARCHAR NOT NULL,
+    type VARCHAR NOT NULL,
+    
+    -- Match conditions
+    min_severity INTEGER NOT NULL,
+    match_attrs VARCHAR NOT NULL,  -- JSON object of field -> value
+    body_contains VARCHAR NOT NULL,
+    
+    -- Output
+    value_field VARCHAR NOT NULL,
+    group_by VARCHAR NOT NULL,     -- JSON array of field names
+    
+    created_at TIMESTAMP NOT NULL,
+    
+    -- Owning tenant, whose logs the rule reads and whose metrics it writes
+    tenant_id VARCHAR DEFAULT 'default'
+);
+`
+
+const savedQueriesSchema = `
+CREATE TABLE IF NOT EXISTS saved_queries (
+    tenant_id VARCHAR NOT NULL,
+    name VARCHAR NOT NULL,
+    description VARCHAR NOT NULL,
+    sql VARCHAR NOT NULL,
+    params VARCHAR NOT NULL,      -- JSON array of parameter definitions
+    
+    -- Access
+    owner VARCHAR NOT NULL,       -- API key ID, empty without auth
+    visibility VARCHAR NOT NULL,  -- private or tenant
+    
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (tenant_id, name)
+);
+`
+
+const deadLettersSchema = `
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id VARCHAR NOT NULL,
+    
+    -- Rejection
+    signal VARCHAR NOT NULL,       -- spans, logs or metrics
+    reason VARCHAR NOT NULL,
+    error VARCHAR NOT NULL,
+    
+    -- Origin
+    request_id VARCHAR NOT NULL,
+    api_key_id VARCHAR NOT NULL,   -- Empty when auth is disabled
+    
+    -- OTLP JSON export request holding only the rejected record
+    payload VARCHAR NOT NULL,
+    
+    -- Ingestion metadata
+    ingested_at TIMESTAMP NOT NULL,
+    
+    -- Owning tenant
+    tenant_id VARCHAR DEFAULT 'default'
+);
+`
+
+const deadLettersIndexes = `
+CREATE INDEX IF NOT EXISTS idx_dead_letters_id ON dead_letters(id);
+CREATE INDEX IF NOT EXISTS idx_dead_letters_ingested_at ON dead_letters(ingested_at);
+`
+
+const queryJobsSchema = `
+CREATE TABLE IF NOT EXISTS query_jobs (
+    id VARCHAR PRIMARY KEY,
+    tenant_id VARCHAR NOT NULL,
+    owner VARCHAR NOT NULL,       -- API key ID, empty without auth
+    sql VARCHAR NOT NULL,
+    max_rows BIGINT NOT NULL,     -- 0 for no cap
+    
+    -- Progress and outcome
+    status VARCHAR NOT NULL,      -- queued, running, succeeded, failed or canceled
+    error VARCHAR NOT NULL,
+    rows BIGINT NOT NULL,
+    bytes BIGINT NOT NULL,        -- Size of the stored result
+    usage VARCHAR,                -- JSON QueryUsage of a finished query
+    
+    created_at TIMESTAMP NOT NULL,
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP,
+    expires_at TIMESTAMP          -- When the result is deleted
+);
+`
@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// Connection types recorded on service graph edges.
+const (
+	ConnectionTypeRPC       = "rpc"       // client -> server
+	ConnectionTypeMessaging = "messaging" // producer -> consumer
+)
+
+// ServiceGraphConfig holds service graph generator configuration.
+type ServiceGraphConfig struct {
+	Enabled           bool
+	FlushIntervalSecs int
+	WaitSecs          int // How long an unpaired span waits for its counterpart
+	MaxPending        int // Upper bound on unpaired spans held in memory
+}
+
+// ServiceGraphEdge is an aggregated caller -> callee relationship.
+type ServiceGraphEdge struct {
+	Client              string
+	Server              string
+	ConnectionType      string
+	CallCount           int64
+	ErrorCount          int64
+	ClientDurationAvgNs int64
+	ServerDurationAvgNs int64
+	ClientDurationMaxNs int64
+}
+
+// pendingEdgeSpan is one half of an edge waiting for its counterpart.
+type pendingEdgeSpan struct {
+	tenant         string
+	service        string
+	connectionType string
+	durationNs     int64
+	failed         bool
+	seenAt         time.Time
+}
+
+type edgeKey struct {
+	tenant, client, server, connectionType string
+}
+
+type edgeStats struct {
+	calls, errors                        int64
+	clientDurationSum, serverDurationSum int64
+	clientDurationMax                    int64
+}
+
+// serviceGraphGenerator pairs client/producer spans with their server/consumer children.
+type serviceGraphGenerator struct {
+	cfg ServiceGraphConfig
+
+	mu             sync.Mutex
+	pendingClients map[string]*pendingEdgeSpan // trace_id + span_id of the client span
+	pendingServers map[string]*pendingEdgeSpan // trace_id + parent_span_id of the server span
+	edges          map[edgeKey]*edgeStats
+	windowStart    time.Time
+	dropped        int64
+}
+
+func newServiceGraphGenerator(cfg ServiceGraphConfig) *serviceGraphGenerator {
+	return &serviceGraphGenerator{
+		cfg:            cfg,
+		pendingClients: make(map[string]*pendingEdgeSpan),
+		pendingServers: make(map[string]*pendingEdgeSpan),
+		edges:          make(map[edgeKey]*edgeStats),
+		windowStart:    time.Now(),
+	}
+}
+
+// StartServiceGraph starts the service graph generator.
+// Returns immediately if disabled. Flushes pending edges and stops when ctx is cancelled.
+func (s *Storage) StartServiceGraph(ctx context.Context, cfg ServiceGraphConfig) {
+	if !cfg.Enabled {
+		log.Println("Service graph disabled, generator not started")
+		return
+	}
+
+	if cfg.FlushIntervalSecs < 1 {
+		cfg.FlushIntervalSecs = 1
+	}
+	if cfg.WaitSecs < 1 {
+		cfg.WaitSecs = 1
+	}
+
+	g := newServiceGraphGenerator(cfg)
+	s.serviceGraph.Store(g)
+
+	log.Printf("Service graph generator started: interval=%ds, wait=%ds", cfg.FlushIntervalSecs, cfg.WaitSecs)
+
+	ticker := time.NewTicker(time.Duration(cfg.FlushIntervalSecs) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			s.flushServiceGraph(flushCtx, g)
+			cancel()
+			log.Println("Service graph generator stopped")
+			return
+		case <-ticker.C:
+			s.flushServiceGraph(ctx, g)
+		}
+	}
+}
+
+// observe pairs spans of a batch with each other and with spans from earlier batches.
+func (g *serviceGraphGenerator) observe(spans []ingestedSpan) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for _, is := range spans {
+		span := is.span
+		service := lookupAttr("service.name", is.resourceAttrs)
+		if service == "" {
+			continue
+		}
+
+		half := &pendingEdgeSpan{
+			tenant:     is.tenant,
+			service:    service,
+			durationNs: spanDurationNanos(span),
+			failed:     span.Status != nil && span.Status.Code == tracev1.Status_STATUS_CODE_ERROR,
+			seenAt:     now,
+		}
+		// Spans only pair within their tenant
+		traceID := is.tenant + "\x00" + hexEncode(span.TraceId)
+
+		switch span.Kind {
+		case tracev1.Span_SPAN_KIND_CLIENT, tracev1.Span_SPAN_KIND_PRODUCER:
+			half.connectionType = connectionTypeForKind(span.Kind)
+			key := traceID + hexEncode(span.SpanId)
+			if server, ok := g.pendingServers[key]; ok {
+				delete(g.pendingServers, key)
+				g.recordEdge(half, server)
+			} else if g.hasRoom() {
+				g.pendingClients[key] = half
+			}
+
+		case tracev1.Span_SPAN_KIND_SERVER, tracev1.Span_SPAN_KIND_CONSUMER:
+			if len(span.ParentSpanId) == 0 {
+				continue
+			}
+			half.connectionType = connectionTypeForKind(span.Kind)
+			key := traceID + hexEncode(span.ParentSpanId)
+			if client, ok := g.pendingClients[key]; ok {
+				delete(g.pendingClients, key)
+				g.recordEdge(client, half)
+			} else if g.hasRoom() {
+				g.pendingServers[key] = half
+			}
+		}
+	}
+}
+
+// hasRoom reports whether another unpaired span may be held, counting drops when full.
+func (g *serviceGraphGenerator) hasRoom() bool {
+	if g.cfg.MaxPending > 0 && len(g.pendingClients)+len(g.pendingServers) >= g.cfg.MaxPending {
+		g.dropped++
+		return false
+	}
+	return true
+}
+
+// recordEdge adds a matched client/server pair to the current window.
+// Calls within a single service are not edges and are ignored.
+func (g *serviceGraphGenerator) recordEdge(client, server *pendingEdgeSpan) {
+	if client.service == server.service {
+		return
+	}
+
+	key := edgeKey{tenant: client.tenant, client: client.service, server: server.service, connectionType: client.connectionType}
+	stats, ok := g.edges[key]
+	if !ok {
+		stats = &edgeStats{}
+		g.edges[key] = stats
+	}
+
+	stats.calls++
+	if client.failed || server.failed {
+		stats.errors++
+	}
+	stats.clientDurationSum += client.durationNs
+	stats.serverDurationSum += server.durationNs
+	if client.durationNs > stats.clientDurationMax {
+		stats.clientDurationMax = client.durationNs
+	}
+}
+
+// collect returns the edges of the current window and starts a new one.
+// Unpaired spans older than the wait period are discarded.
+func (g *serviceGraphGenerator) collect(now time.Time) (time.Time, map[edgeKey]*edgeStats) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	expiry := now.Add(-time.Duration(g.cfg.WaitSecs) * time.Second)
+	for key, half := range g.pendingClients {
+		if half.seenAt.Before(expiry) {
+			delete(g.pendingClients, key)
+		}
+	}
+	for key, half := range g.pendingServers {
+		if half.seenAt.Before(expiry) {
+			delete(g.pendingServers, key)
+		}
+	}
+
+	windowStart, edges := g.windowStart, g.edges
+	g.windowStart = now
+	g.edges = make(map[edgeKey]*edgeStats)
+	return windowStart, edges
+}
+
+// flushServiceGraph writes the edges of the current window to service_graph_edges.
+func (s *Storage) flushServiceGraph(ctx context.Context, g *serviceGraphGenerator) {
+	now := time.Now()
+	windowStart, edges := g.collect(now)
+	if len(edges) == 0 {
+		return
+	}
+
+	if err := s.appendServiceGraphEdges(ctx, windowStart, now, edges); err != nil {
+		log.Printf("Service graph flush failed: %v", err)
+	}
+	// Edges of several tenants share the window
+	s.invalidateResults("", writeSet{"service_graph_edges": {From: windowStart, To: windowStart}})
+}
+
+func (s *Storage) appendServiceGraphEdges(ctx context.Context, windowStart, windowEnd time.Time, edges map[edgeKey]*edgeStats) error {
+	return s.withAppender(ctx, "service_graph_edges", func(appender *duckdb.Appender) error {
+		for key, stats := range edges {
+			err := appender.AppendRow(
+				windowStart,
+				windowEnd,
+				key.client,
+				key.server,
+				key.connectionType,
+				stats.calls,
+				stats.errors,
+				stats.clientDurationSum,
+				stats.serverDurationSum,
+				stats.clientDurationMax,
+				windowEnd,
+				key.tenant,
+			)
+			if err != nil {
+				return fmt.Errorf("edge %s -> %s: %w", key.client, key.server, err)
+			}
+		}
+		return nil
+	})
+}
+
+// ServiceGraph returns the edges observed in windows overlapping [start, end).
+func (s *Storage) ServiceGraph(ctx context.Context, start, end time.Time) ([]ServiceGraphEdge, error) {
+	where := "window_end > ? AND window_start < ?"
+	args := []any{start, end}
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		where += " AND tenant_id = ?"
+		args = append(args, tenantID)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			client,
+			server,
+			connection_type,
+			SUM(call_count) AS calls,
+			SUM(error_count) AS errors,
+			SUM(client_duration_sum_ns) // SUM(call_count) AS client_avg,
+			SUM(server_duration_sum_ns) // SUM(call_count) AS server_avg,
+			MAX(client_duration_max_ns) AS client_max
+		FROM service_graph_edges
+		WHERE `+where+`
+		GROUP BY client, server, connection_type
+		ORDER BY client, server, connection_type
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query service graph: %w", err)
+	}
+	defer rows.Close()
+
+	var edges []ServiceGraphEdge
+	for rows.Next() {
+		var e ServiceGraphEdge
+		err := rows.Scan(&e.Client, &e.Server, &e.ConnectionType, &e.CallCount, &e.ErrorCount,
+			&e.ClientDurationAvgNs, &e.ServerDurationAvgNs, &e.ClientDurationMaxNs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan service graph edge: %w", err)
+		}
+		edges = append(edges, e)
+	}
+	return edges, rows.Err()
+}
+
+// ServiceGraphStatus describes the in-memory state of the service graph generator.
+type ServiceGraphStatus struct {
+	PendingSpans int
+	DroppedSpans int64
+}
+
+// serviceGraphStatus returns the generator state, or nil if the generator is disabled.
+func (s *Storage) serviceGraphStatus() *ServiceGraphStatus {
+	g := s.serviceGraph.Load()
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return &ServiceGraphStatus{
+		PendingSpans: len(g.pendingClients) + len(g.pendingServers),
+		DroppedSpans: g.dropped,
+	}
+}
+
+func connectionTypeForKind(kind tracev1.Span_SpanKind) string {
+	if kind == tracev1.Span_SPAN_KIND_PRODUCER || kind == tracev1.Span_SPAN_KIND_CONSUMER {
+		return ConnectionTypeMessaging
+	}
+	return ConnectionTypeRPC
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/google/uuid"
+)
+
+// ErrCursorExpired is returned for a cursor whose stored result is gone: it
+// expired, the server restarted, or it belongs to another tenant.
+var ErrCursorExpired = errors.New("cursor expired, run the query again without it")
+
+const (
+	snapshotPrefix = "snapshot-" // Snapshot file names in the job directory
+	snapshotView   = "query_snapshot"
+)
+
+// snapshot is the stored result of a paged /query request. Pages are read
+// from it so that they come from one consistent result, and the query runs
+// once rather than once per page.
+type snapshot struct {
+	tenantID string
+	expires  time.Time
+}
+
+// StoreSnapshot runs query with args on conn, a connection from QueryConn or
+// ScopedConn, and stores up to CursorMaxRows rows of its result in the job
+// directory for ViewSnapshot. It returns the snapshot ID, the number of rows
+// stored, and the usage of the query. Errors in query satisfy IsQueryError.
+func (s *Storage) StoreSnapshot(ctx context.Context, conn *sql.Conn, query string, args []any) (id string, rows int64, usage *QueryUsage, err error) {
+	jobs := s.jobs
+	if jobs == nil {
+		return "", 0, nil, ErrJobsDisabled
+	}
+
+	if jobs.cfg.CursorMaxRows > 0 {
+		query = LimitQuery(query, jobs.cfg.CursorMaxRows)
+	}
+
+	id = uuid.New().String()
+	path := jobs.snapshotPath(id)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("failed to create result file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var written atomic.Int64
+	err = QueryArrow(ctx, conn, query, args, func(reader array.RecordReader) error {
+		return writeArrowStream(f, reader, &written)
+	})
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", 0, nil, fmt.Errorf("failed to store result: %w", err)
+	}
+
+	if usage, err = LastQueryUsage(conn); err != nil {
+		log.Printf("Failed to read usage of snapshot %s: %v", id, err)
+	}
+
+	jobs.mu.Lock()
+	jobs.snapshots[id] = snapshot{
+		tenantID: tenantFromContext(ctx),
+		expires:  time.Now().Add(jobs.cfg.CursorTTL),
+	}
+	jobs.mu.Unlock()
+	return id, written.Load(), usage, nil
+}
+
+// ViewSnapshot makes a snapshot stored for the caller's tenant readable on
+// conn and returns a query selecting limit rows of it after skipping offset.
+// release drops the view before the connection goes back to the pool.
+func (s *Storage) ViewSnapshot(ctx context.Context, conn *sql.Conn, id string, offset, limit int) (query string, release func(), err error) {
+	jobs := s.jobs
+	if jobs == nil {
+		return "", nil, ErrJobsDisabled
+	}
+
+	jobs.mu.Lock()
+	snap, ok := jobs.snapshots[id]
+	jobs.mu.Unlock()
+	if !ok || snap.tenantID != tenantFromContext(ctx) || time.Now().After(snap.expires) {
+		return "", nil, ErrCursorExpired
+	}
+
+	// Opened before a concurrent cleanup can remove it
+	f, err := os.Open(jobs.snapshotPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil, ErrCursorExpired
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if release, err = viewArrowFile(conn, f, snapshotView); err != nil {
+		return "", nil, err
+	}
+	query = "SELECT * FROM " + snapshotView +
+		" LIMIT " + strconv.Itoa(limit) + " OFFSET " + strconv.Itoa(offset)
+	return query, release, nil
+}
+
+// DeleteSnapshot removes a snapshot before it expires, once its last page
+// has been read.
+func (s *Storage) DeleteSnapshot(id string) {
+	if jobs := s.jobs; jobs != nil {
+		jobs.mu.Lock()
+		delete(jobs.snapshots, id)
+		jobs.mu.Unlock()
+		os.Remove(jobs.snapshotPath(id))
+	}
+}
+
+func (r *jobRunner) deleteExpiredSnapshots() {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, snap := range r.snapshots {
+		if now.After(snap.expires) {
+			delete(r.snapshots, id)
+			os.Remove(r.snapshotPath(id))
+		}
+	}
+}
+
+func (r *jobRunner) snapshotPath(id string) string {
+	return filepath.Join(r.cfg.Dir, snapshotPrefix+id+".arrow")
+}
@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	collectormetricsv1 "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// Span metrics names written to the metrics table, namespaced so they do not
+// collide with ingested metrics.
+const (
+	SpanMetricsCallsName    = "traces_spanmetrics_calls_total"
+	SpanMetricsDurationName = "traces_spanmetrics_duration"
+	spanMetricsScopeName    = "mo11y/spanmetrics"
+)
+
+// DefaultSpanMetricsIdleFlushes is used when MaxIdleFlushes is not set.
+const DefaultSpanMetricsIdleFlushes = 10
+
+// DefaultSpanMetricsBucketsMs are the histogram bounds used when none are configured.
+var DefaultSpanMetricsBucketsMs = []float64{2, 4, 6, 8, 10, 50, 100, 200, 400, 800, 1000, 1400, 2000, 5000, 10000, 15000}
+
+// SpanMetricsConfig holds span metrics (RED) generator configuration.
+type SpanMetricsConfig struct {
+	Enabled           bool
+	FlushIntervalSecs int
+	Dimensions        []string  // Extra span or resource attribute keys to group by
+	BucketsMs         []float64 // Histogram bounds in milliseconds
+	MaxIdleFlushes    int       // Flushes without spans after which a series is dropped
+}
+
+// ingestedSpan is an accepted span handed to ingest-time generators.
+type ingestedSpan struct {
+	tenant        string
+	resourceAttrs duckdb.Map
+	attrs         duckdb.Map
+	span          *tracev1.Span
+}
+
+// spanMetricsSeries holds the cumulative state of one dimension set.
+type spanMetricsSeries struct {
+	tenant       string
+	serviceName  string
+	attrs        []*commonv1.KeyValue
+	startTime    time.Time
+	calls        uint64
+	durationSum  float64
+	bucketCounts []uint64
+	dirty        bool
+	idleFlushes  int // Flushes since the series last had spans
+}
+
+// spanMetricsGenerator aggregates RED metrics from spans between flushes.
+// Series idle for MaxIdleFlushes are dropped, so that high-cardinality
+// dimensions do not grow memory without bound; a series seen again restarts
+// its cumulative values with a new start time.
+type spanMetricsGenerator struct {
+	cfg SpanMetricsConfig
+
+	mu     sync.Mutex
+	series map[string]*spanMetricsSeries
+}
+
+func newSpanMetricsGenerator(cfg SpanMetricsConfig) *spanMetricsGenerator {
+	if len(cfg.BucketsMs) == 0 {
+		cfg.BucketsMs = DefaultSpanMetricsBucketsMs
+	}
+	bounds := append([]float64(nil), cfg.BucketsMs...)
+	sort.Float64s(bounds)
+	cfg.BucketsMs = bounds
+	if cfg.MaxIdleFlushes < 1 {
+		cfg.MaxIdleFlushes = DefaultSpanMetricsIdleFlushes
+	}
+
+	return &spanMetricsGenerator{
+		cfg:    cfg,
+		series: make(map[string]*spanMetricsSeries),
+	}
+}
+
+// StartSpanMetrics starts the span metrics generator.
+// Returns immediately if disabled. Flushes pending series and stops when ctx is cancelled.
+func (s *Storage) StartSpanMetrics(ctx context.Context, cfg SpanMetricsConfig) {
+	if !cfg.Enabled {
+		log.Println("Span metrics disabled, generator not started")
+		return
+	}
+
+	if cfg.FlushIntervalSecs < 1 {
+		cfg.FlushIntervalSecs = 1
+	}
+
+	g := newSpanMetricsGenerator(cfg)
+	s.spanMetrics.Store(g)
+
+	log.Printf("Span metrics generator started: interval=%ds, dimensions=%v", cfg.FlushIntervalSecs, cfg.Dimensions)
+
+	ticker := time.NewTicker(time.Duration(cfg.FlushIntervalSecs) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Final flush with a fresh context, the worker context is already cancelled
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			s.flushSpanMetrics(flushCtx, g)
+			cancel()
+			log.Println("Span metrics generator stopped")
+			return
+		case <-ticker.C:
+			s.flushSpanMetrics(ctx, g)
+		}
+	}
+}
+
+// observeSpans feeds accepted spans into the enabled ingest-time generators.
+func (s *Storage) observeSpans(spans []ingestedSpan) {
+	if g := s.spanMetrics.Load(); g != nil {
+		g.observe(spans)
+	}
+	if g := s.serviceGraph.Load(); g != nil {
+		g.observe(spans)
+	}
+}
+
+// observe aggregates a batch of spans into their series.
+func (g *spanMetricsGenerator) observe(spans []ingestedSpan) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, is := range spans {
+		span := is.span
+		serviceName := lookupAttr("service.name", is.resourceAttrs)
+
+		var statusCode tracev1.Status_StatusCode
+		if span.Status != nil {
+			statusCode = span.Status.Code
+		}
+
+		attrs := []*commonv1.KeyValue{
+			stringKeyValue("span.name", span.Name),
+			stringKeyValue("span.kind", span.Kind.String()),
+			stringKeyValue("status.code", statusCode.String()),
+		}
+		for _, dim := range g.cfg.Dimensions {
+			if v := lookupAttr(dim, is.attrs, is.resourceAttrs); v != "" {
+				attrs = append(attrs, stringKeyValue(dim, v))
+			}
+		}
+
+		key := is.tenant + "\x00" + seriesKey(serviceName, attrs)
+		series, ok := g.series[key]
+		if !ok {
+			series = &spanMetricsSeries{
+				tenant:       is.tenant,
+				serviceName:  serviceName,
+				attrs:        attrs,
+				startTime:    time.Now(),
+				bucketCounts: make([]uint64, len(g.cfg.BucketsMs)+1),
+			}
+			g.series[key] = series
+		}
+
+		durationMs := float64(spanDurationNanos(span)) / 1e6
+		series.calls++
+		series.durationSum += durationMs
+		series.bucketCounts[sort.SearchFloat64s(g.cfg.BucketsMs, durationMs)]++
+		series.dirty = true
+		series.idleFlushes = 0
+	}
+}
+
+// flushSpanMetrics writes every series updated since the last flush to the metrics table.
+// Values are cumulative since the series was first seen.
+func (s *Storage) flushSpanMetrics(ctx context.Context, g *spanMetricsGenerator) {
+	s.storeDerivedMetrics(ctx, "Span metrics", g.collect(time.Now()))
+}
+
+// storeDerivedMetrics stores generated metrics requests, keyed by the tenant they belong to.
+func (s *Storage) storeDerivedMetrics(ctx context.Context, source string, reqs map[string]*collectormetricsv1.ExportMetricsServiceRequest) {
+	for tenantID, req := range reqs {
+		result, err := s.StoreMetrics(WithOrigin(ctx, Origin{TenantID: tenantID}), req)
+		if err != nil {
+			log.Printf("%s flush failed: %v", source, err)
+			continue
+		}
+		if result.HasRejections() {
+			log.Printf("%s flush rejected %d data points: %s", source, result.Rejected, result.ErrorMessage())
+		}
+	}
+}
+
+// tenantService groups generated series by tenant and service.
+type tenantService struct {
+	tenant, service string
+}
+
+// collect builds an OTLP metrics request per tenant from dirty series and clears their dirty flag.
+// Series idle for MaxIdleFlushes collections are dropped.
+// Returns an empty map if nothing changed since the last collection.
+func (g *spanMetricsGenerator) collect(now time.Time) map[string]*collectormetricsv1.ExportMetricsServiceRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	nowNanos := uint64(now.UnixNano())
+
+	type serviceMetrics struct {
+		calls     []*metricsv1.NumberDataPoint
+		durations []*metricsv1.HistogramDataPoint
+	}
+	byService := make(map[tenantService]*serviceMetrics)
+	var services []tenantService
+
+	for key, series := range g.series {
+		if !series.dirty {
+			if series.idleFlushes++; series.idleFlushes >= g.cfg.MaxIdleFlushes {
+				delete(g.series, key)
+			}
+			continue
+		}
+		series.dirty = false
+		startNanos := uint64(series.startTime.UnixNano())
+
+		ts := tenantService{tenant: series.tenant, service: series.serviceName}
+		sm, ok := byService[ts]
+		if !ok {
+			sm = &serviceMetrics{}
+			byService[ts] = sm
+			services = append(services, ts)
+		}
+
+		sm.calls = append(sm.calls, &metricsv1.NumberDataPoint{
+			Attributes:        series.attrs,
+			StartTimeUnixNano: startNanos,
+			TimeUnixNano:      nowNanos,
+			Value:             &metricsv1.NumberDataPoint_AsInt{AsInt: int64(series.calls)},
+		})
+
+		sum := series.durationSum
+		sm.durations = append(sm.durations, &metricsv1.HistogramDataPoint{
+			Attributes:        series.attrs,
+			StartTimeUnixNano: startNanos,
+			TimeUnixNano:      nowNanos,
+			Count:             series.calls,
+			Sum:               &sum,
+			BucketCounts:      append([]uint64(nil), series.bucketCounts...),
+			ExplicitBounds:    g.cfg.BucketsMs,
+		})
+	}
+
+	sortTenantServices(services)
+
+	reqs := make(map[string]*collectormetricsv1.ExportMetricsServiceRequest)
+	for _, ts := range services {
+		sm := byService[ts]
+		req, ok := reqs[ts.tenant]
+		if !ok {
+			req = &collectormetricsv1.ExportMetricsServiceRequest{}
+			reqs[ts.tenant] = req
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, &metricsv1.ResourceMetrics{
+			Resource: &resourcev1.Resource{
+				Attributes: []*commonv1.KeyValue{stringKeyValue("service.name", ts.service)},
+			},
+			ScopeMetrics: []*metricsv1.ScopeMetrics{{
+				Scope: &commonv1.InstrumentationScope{Name: spanMetricsScopeName},
+				Metrics: []*metricsv1.Metric{
+					{
+						Name:        SpanMetricsCallsName,
+						Description: "Number of spans, derived from traces",
+						Data: &metricsv1.Metric_Sum{Sum: &metricsv1.Sum{
+							DataPoints:             sm.calls,
+							AggregationTemporality: metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+							IsMonotonic:            true,
+						}},
+					},
+					{
+						Name:        SpanMetricsDurationName,
+						Description: "Span duration, derived from traces",
+						Unit:        "ms",
+						Data: &metricsv1.Metric_Histogram{Histogram: &metricsv1.Histogram{
+							DataPoints:             sm.durations,
+							AggregationTemporality: metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+						}},
+					},
+				},
+			}},
+		})
+	}
+	return reqs
+}
+
+func sortTenantServices(services []tenantService) {
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].tenant != services[j].tenant {
+			return services[i].tenant < services[j].tenant
+		}
+		return services[i].service < services[j].service
+	})
+}
+
+// spanDurationNanos returns the span duration, clamped to zero for spans ending before they start.
+func spanDurationNanos(span *tracev1.Span) int64 {
+	if span.EndTimeUnixNano < span.StartTimeUnixNano {
+		return 0
+	}
+	return int64(span.EndTimeUnixNano - span.StartTimeUnixNano)
+}
+
+// lookupAttr returns the first value found for key in the given flattened attribute maps.
+func lookupAttr(key string, maps ...duckdb.Map) string {
+	for _, m := range maps {
+		if v, ok := m[key]; ok {
+			if s, ok := v.(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// seriesKey builds a stable identity for a service and attribute set.
+func seriesKey(service string, attrs []*commonv1.KeyValue) string {
+	var b strings.Builder
+	b.WriteString(service)
+	for _, kv := range attrs {
+		b.WriteByte(0)
+		b.WriteString(kv.Key)
+		b.WriteByte('=')
+		b.WriteString(kv.Value.GetStringValue())
+	}
+	return b.String()
+}
+
+// stringKeyValue builds an OTLP string attribute.
+func stringKeyValue(key, value string) *commonv1.KeyValue {
+	return &commonv1.KeyValue{
+		Key:   key,
+		Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: value}},
+	}
+}
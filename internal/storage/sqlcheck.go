@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// internalTables hold data of every tenant that is only served through its
+// own API, such as other tenants' saved and job SQL and key IDs. User
+// queries may never read them, not even through a CTE of the same name.
+var internalTables = map[string]bool{"saved_queries": true, "query_jobs": true}
+
+// queryTableFunctions are the table functions allowed in user queries.
+// They generate values and cannot read tables, files or URLs.
+var queryTableFunctions = map[string]bool{"range": true, "generate_series": true, "unnest": true}
+
+// deniedFunctions are scalar functions user queries may not call: they expose
+// settings or change sequence state.
+var deniedFunctions = map[string]bool{
+	"current_setting": true,
+	"getvariable":     true,
+	"getenv":          true,
+	"nextval":         true,
+	"currval":         true,
+}
+
+// QueryRower is implemented by *sql.DB and *sql.Conn.
+type QueryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// QueryShape describes a checked statement.
+type QueryShape struct {
+	Limited bool // The outermost query has a row LIMIT of its own
+
+	// Fingerprint is the same for statements that differ only in
+	// whitespace, comments and keyword case
+	Fingerprint string
+
+	tree any
+}
+
+// CheckQuery verifies with DuckDB's parser that query is a single SELECT
+// statement reading only mo11y tables, CTEs and value-generating table
+// functions, and calling no denied functions. Qualified table names are
+// rejected, as they would bypass the tenant views of a scoped connection.
+func CheckQuery(ctx context.Context, db QueryRower, query string) (QueryShape, error) {
+	tree, err := parseSelect(ctx, db, query)
+	if err != nil {
+		return QueryShape{}, err
+	}
+
+	allowed := make(map[string]bool)
+	for _, table := range tenantTables {
+		allowed[table] = true
+	}
+	if err := checkQueryTree(tree, allowed); err != nil {
+		return QueryShape{}, err
+	}
+	return QueryShape{
+		Limited:     hasModifier(tree, "LIMIT_MODIFIER"),
+		Fingerprint: fingerprint(tree),
+		tree:        tree,
+	}, nil
+}
+
+// fingerprint returns a digest of tree without the source positions of its
+// nodes.
+func fingerprint(tree any) string {
+	var strip func(v any) any
+	strip = func(v any) any {
+		switch v := v.(type) {
+		case map[string]any:
+			m := make(map[string]any, len(v))
+			for k, child := range v {
+				if k != "query_location" {
+					m[k] = strip(child)
+				}
+			}
+			return m
+		case []any:
+			l := make([]any, len(v))
+			for i, child := range v {
+				l[i] = strip(child)
+			}
+			return l
+		}
+		return v
+	}
+	// Maps marshal with sorted keys
+	b, _ := json.Marshal(strip(tree))
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
+
+// LimitQuery wraps query so it returns at most limit rows. Duplicate column
+// names in query are made unique by the outer SELECT, e.g. a and a_1.
+func LimitQuery(query string, limit int) string {
+	// The newline ends a trailing line comment in query
+	return "SELECT * FROM (" + query + "\n) LIMIT " + strconv.Itoa(limit)
+}
+
+// parseSelect parses query with DuckDB's parser and returns the syntax tree
+// of its statement. It fails unless query is exactly one SELECT statement.
+func parseSelect(ctx context.Context, db QueryRower, query string) (any, error) {
+	var serialized string
+	err := db.QueryRowContext(ctx, "SELECT json_serialize_sql(?::VARCHAR)::VARCHAR", query).Scan(&serialized)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	var parsed struct {
+		Error        bool              `json:"error"`
+		ErrorType    string            `json:"error_type"`
+		ErrorMessage string            `json:"error_message"`
+		Statements   []json.RawMessage `json:"statements"`
+	}
+	if err := json.Unmarshal([]byte(serialized), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+	if parsed.Error {
+		if parsed.ErrorType == "not implemented" {
+			// The statement parsed but only SELECT statements serialize
+			return nil, errors.New("only SELECT statements are allowed")
+		}
+		return nil, errors.New(parsed.ErrorMessage)
+	}
+	if len(parsed.Statements) != 1 {
+		return nil, errors.New("exactly one SELECT statement is allowed")
+	}
+
+	// Numbers stay json.Number so that the tree serializes back unchanged
+	var tree any
+	dec := json.NewDecoder(bytes.NewReader(parsed.Statements[0]))
+	dec.UseNumber()
+	if err := dec.Decode(&tree); err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+	return tree, nil
+}
+
+// hasModifier reports whether the outermost query node of tree has a
+// modifier of the given type. A LIMIT with a percentage does not bound the
+// row count and does not count.
+func hasModifier(tree any, modifierType string) bool {
+	stmt, _ := tree.(map[string]any)
+	node, _ := stmt["node"].(map[string]any)
+	modifiers, _ := node["modifiers"].([]any)
+	for _, m := range modifiers {
+		m, ok := m.(map[string]any)
+		if !ok || m["type"] != modifierType {
+			continue
+		}
+		if modifierType != "LIMIT_MODIFIER" || m["limit"] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// cteNames returns the names of the common table expressions node defines,
+// or nil if it defines none.
+func cteNames(node map[string]any) []string {
+	cteMap, _ := node["cte_map"].(map[string]any)
+	entries, _ := cteMap["map"].([]any)
+	var names []string
+	for _, entry := range entries {
+		if e, ok := entry.(map[string]any); ok {
+			if key, ok := e["key"].(string); ok {
+				names = append(names, strings.ToLower(key))
+			}
+		}
+	}
+	return names
+}
+
+// checkQueryTree rejects table references outside the allowed names and
+// calls to denied functions anywhere in the tree. The CTEs a node defines
+// are allowed names within that node only.
+func checkQueryTree(v any, allowed map[string]bool) error {
+	switch v := v.(type) {
+	case map[string]any:
+		if names := cteNames(v); names != nil {
+			scope := maps.Clone(allowed)
+			for _, name := range names {
+				scope[name] = true
+			}
+			allowed = scope
+		}
+		if ref, ok := v["from_table"].(map[string]any); ok {
+			if err := checkTableRef(ref, allowed); err != nil {
+				return err
+			}
+		}
+		if v["class"] == "FUNCTION" {
+			name, _ := v["function_name"].(string)
+			if deniedFunctions[strings.ToLower(name)] {
+				return fmt.Errorf("function not allowed: %s", name)
+			}
+		}
+		for _, child := range v {
+			if err := checkQueryTree(child, allowed); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, child := range v {
+			if err := checkQueryTree(child, allowed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkTableRef rejects a FROM clause entry unless it is an allowed table,
+// an allowed table function or table macro, a subquery, VALUES or a join of
+// those. Table macros read tenant tables, which tenant views replace.
+// Subqueries are checked as part of the tree.
+func checkTableRef(ref map[string]any, allowed map[string]bool) error {
+	switch ref["type"] {
+	case "BASE_TABLE":
+		// Also covers files and URLs, which DuckDB scans when named as a table
+		schema, _ := ref["schema_name"].(string)
+		catalog, _ := ref["catalog_name"].(string)
+		table, _ := ref["table_name"].(string)
+		if schema != "" || catalog != "" {
+			return fmt.Errorf("qualified table names are not allowed: %s", table)
+		}
+		if internalTables[strings.ToLower(table)] {
+			return fmt.Errorf("table not allowed: %s", table)
+		}
+		if !allowed[strings.ToLower(table)] {
+			return fmt.Errorf("unknown table: %s", table)
+		}
+	case "TABLE_FUNCTION":
+		function, _ := ref["function"].(map[string]any)
+		name, _ := function["function_name"].(string)
+		if !queryTableFunctions[strings.ToLower(name)] && counterMacros[strings.ToLower(name)] == "" {
+			return fmt.Errorf("table function not allowed: %s", name)
+		}
+	case "JOIN":
+		for _, side := range []string{"left", "right"} {
+			if side, ok := ref[side].(map[string]any); ok {
+				if err := checkTableRef(side, allowed); err != nil {
+					return err
+				}
+			}
+		}
+	case "SUBQUERY", "EXPRESSION_LIST", "EMPTY":
+	case "SHOW_REF":
+		return errors.New("DESCRIBE, SHOW and SUMMARIZE are not allowed")
+	default:
+		return fmt.Errorf("table reference not allowed: %v", ref["type"])
+	}
+	return nil
+}
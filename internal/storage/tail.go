@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TailRecord is a log record or span published to live tail subscribers
+// once the batch containing it has been flushed.
+type TailRecord struct {
+	Signal        string // SignalLogs or SignalSpans
+	TenantID      string
+	Timestamp     time.Time // Log timestamp or span start time
+	Service       string
+	TraceID       string
+	SpanID        string
+	Attrs         map[string]string
+	ResourceAttrs map[string]string
+
+	// Logs
+	LogID          string
+	SeverityNumber int8
+	SeverityText   string
+	Body           string
+	BodyFields     map[string]string
+
+	// Spans
+	ParentSpanID string
+	Name         string
+	Kind         int8
+	StatusCode   int8
+	Duration     time.Duration
+}
+
+// TailFilter selects the records delivered to a subscriber.
+type TailFilter struct {
+	Signals     []string // SignalLogs and/or SignalSpans, empty for both
+	Service     string
+	MinSeverity int8 // Minimum log severity number; excludes spans when set
+	Attrs       []AttrFilter
+}
+
+// tailAttr is an AttrFilter with its regex compiled.
+type tailAttr struct {
+	key, value string
+	re         *regexp.Regexp
+}
+
+// TailSubscription receives the records matching its filter. Records that do
+// not fit into the buffer are dropped and counted rather than slowing ingest.
+type TailSubscription struct {
+	hub     *tailHub
+	records chan TailRecord
+	dropped atomic.Uint64
+
+	tenant      string // "" for all tenants
+	signals     map[string]bool
+	service     string
+	minSeverity int8
+	attrs       []tailAttr
+}
+
+// Records returns the channel records are delivered on.
+func (sub *TailSubscription) Records() <-chan TailRecord {
+	return sub.records
+}
+
+// Dropped returns the number of records dropped because the buffer was full.
+func (sub *TailSubscription) Dropped() uint64 {
+	return sub.dropped.Load()
+}
+
+// Close stops delivery to the subscription.
+func (sub *TailSubscription) Close() {
+	sub.hub.mu.Lock()
+	defer sub.hub.mu.Unlock()
+	delete(sub.hub.subs, sub)
+}
+
+func (sub *TailSubscription) match(rec *TailRecord) bool {
+	if sub.tenant != "" && rec.TenantID != sub.tenant {
+		return false
+	}
+	if len(sub.signals) > 0 && !sub.signals[rec.Signal] {
+		return false
+	}
+	if sub.service != "" && rec.Service != sub.service {
+		return false
+	}
+	if sub.minSeverity > 0 && (rec.Signal != SignalLogs || rec.SeverityNumber < sub.minSeverity) {
+		return false
+	}
+	for _, a := range sub.attrs {
+		// Record attributes take precedence over resource attributes of the same name
+		value, ok := rec.Attrs[a.key]
+		if !ok {
+			value, ok = rec.ResourceAttrs[a.key]
+		}
+		if !ok {
+			return false
+		}
+		if a.re != nil && !a.re.MatchString(value) || a.re == nil && value != a.value {
+			return false
+		}
+	}
+	return true
+}
+
+// tailHub fans out ingested records to live tail subscribers.
+type tailHub struct {
+	mu   sync.RWMutex
+	subs map[*TailSubscription]struct{}
+}
+
+func newTailHub() *tailHub {
+	return &tailHub{subs: make(map[*TailSubscription]struct{})}
+}
+
+func (h *tailHub) active() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs) > 0
+}
+
+// publish delivers records to every matching subscriber without blocking.
+func (h *tailHub) publish(records []TailRecord) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subs {
+		for i := range records {
+			if !sub.match(&records[i]) {
+				continue
+			}
+			select {
+			case sub.records <- records[i]:
+			default:
+				sub.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// SubscribeTail registers a live tail subscriber buffering up to buffer
+// records. Tenant-scoped callers only receive their tenant's records. The
+// caller must Close the subscription.
+func (s *Storage) SubscribeTail(ctx context.Context, f TailFilter, buffer int) (*TailSubscription, error) {
+	sub := &TailSubscription{
+		hub:         s.tail,
+		records:     make(chan TailRecord, buffer),
+		tenant:      scopedTenant(ctx),
+		service:     f.Service,
+		minSeverity: f.MinSeverity,
+	}
+	if len(f.Signals) > 0 {
+		sub.signals = make(map[string]bool, len(f.Signals))
+		for _, signal := range f.Signals {
+			if signal != SignalLogs && signal != SignalSpans {
+				return nil, fmt.Errorf("unknown signal %q", signal)
+			}
+			sub.signals[signal] = true
+		}
+	}
+	for _, a := range f.Attrs {
+		attr := tailAttr{key: a.Key, value: a.Value}
+		if a.Regex {
+			re, err := regexp.Compile("^(?:" + a.Value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid attr regex %q: %w", a.Value, err)
+			}
+			attr.re = re
+		}
+		sub.attrs = append(sub.attrs, attr)
+	}
+
+	s.tail.mu.Lock()
+	defer s.tail.mu.Unlock()
+	s.tail.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+// publishLogs hands flushed log records to live tail subscribers.
+func (s *Storage) publishLogs(logs []ingestedLog) {
+	if len(logs) == 0 || !s.tail.active() {
+		return
+	}
+	records := make([]TailRecord, len(logs))
+	for i, l := range logs {
+		lr := l.record
+		records[i] = TailRecord{
+			Signal:         SignalLogs,
+			TenantID:       l.tenant,
+			Timestamp:      unixNanoToTime(lr.TimeUnixNano),
+			Service:        lookupAttr("service.name", l.resourceAttrs),
+			TraceID:        hexEncode(lr.TraceId),
+			SpanID:         hexEncode(lr.SpanId),
+			Attrs:          mapToStrings(l.attrs),
+			ResourceAttrs:  mapToStrings(l.resourceAttrs),
+			LogID:          l.id,
+			SeverityNumber: int8(lr.SeverityNumber),
+			SeverityText:   lr.SeverityText,
+			Body:           l.body,
+			BodyFields:     mapToStrings(l.bodyFields),
+		}
+	}
+	s.tail.publish(records)
+}
+
+// publishSpans hands flushed spans to live tail subscribers.
+func (s *Storage) publishSpans(spans []ingestedSpan) {
+	if len(spans) == 0 || !s.tail.active() {
+		return
+	}
+	records := make([]TailRecord, len(spans))
+	for i, is := range spans {
+		span := is.span
+		rec := TailRecord{
+			Signal:        SignalSpans,
+			TenantID:      is.tenant,
+			Timestamp:     unixNanoToTime(span.StartTimeUnixNano),
+			Service:       lookupAttr("service.name", is.resourceAttrs),
+			TraceID:       hexEncode(span.TraceId),
+			SpanID:        hexEncode(span.SpanId),
+			Attrs:         mapToStrings(is.attrs),
+			ResourceAttrs: mapToStrings(is.resourceAttrs),
+			ParentSpanID:  hexEncode(span.ParentSpanId),
+			Name:          span.Name,
+			Kind:          int8(span.Kind),
+			Duration:      time.Duration(spanDurationNanos(span)),
+		}
+		if span.Status != nil {
+			rec.StatusCode = int8(span.Status.Code)
+		}
+		records[i] = rec
+	}
+	s.tail.publish(records)
+}
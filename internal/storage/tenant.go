@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// DefaultTenant owns data ingested without a tenant.
+// Matches auth.DefaultTenant.
+const DefaultTenant = "default"
+
+// tenantTables hold tenant data and carry a tenant_id column.
+var tenantTables = []string{
+	"spans", "span_events", "span_links", "logs", "log_terms", "metrics",
+	"metric_exemplars", "service_graph_edges", "dead_letters", "log_metric_rules",
+}
+
+// Origin identifies the client request that submitted or reads telemetry.
+type Origin struct {
+	RequestID string
+	APIKeyID  string
+	TenantID  string // Empty when auth is disabled
+}
+
+type originKey struct{}
+
+// WithOrigin returns a context carrying the request origin.
+// Ingested rows are stamped with its tenant and reads are restricted to it.
+func WithOrigin(ctx context.Context, origin Origin) context.Context {
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// originFromContext returns the request origin, or the zero Origin if not set.
+func originFromContext(ctx context.Context) Origin {
+	origin, _ := ctx.Value(originKey{}).(Origin)
+	return origin
+}
+
+// tenantFromContext returns the tenant to stamp on ingested rows.
+func tenantFromContext(ctx context.Context) string {
+	if tenantID := originFromContext(ctx).TenantID; tenantID != "" {
+		return tenantID
+	}
+	return DefaultTenant
+}
+
+// scopedTenant returns the tenant reads are restricted to, or "" for unrestricted reads.
+func scopedTenant(ctx context.Context) string {
+	return originFromContext(ctx).TenantID
+}
+
+// tenantMigrations add tenant_id to tables created before multi-tenancy.
+// The column follows the original columns in every CREATE TABLE, and columns
+// added later follow it, so appenders see the same layout either way.
+func tenantMigrations() []string {
+	stmts := make([]string, len(tenantTables))
+	for i, table := range tenantTables {
+		stmts[i] = fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS tenant_id VARCHAR DEFAULT '%s'", table, DefaultTenant)
+	}
+	return stmts
+}
+
+// TenantRetentionSource provides per-tenant retention overrides in hours.
+type TenantRetentionSource interface {
+	TenantRetention(ctx context.Context) (map[string]int, error)
+}
+
+// ScopedConn returns a connection on which every tenant table is shadowed by a
+// temporary view over the rows of tenantID, without the tenant_id column.
+// The connection comes from the query pool, see QueryConn. release drops the
+// views before the connection goes back to the pool.
+func (s *Storage) ScopedConn(ctx context.Context, tenantID string) (*sql.Conn, func(), error) {
+	conn, err := s.QueryConn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	release := func() {
+		dropCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, table := range tenantTables {
+			if _, err := conn.ExecContext(dropCtx, "DROP VIEW IF EXISTS temp.main."+table); err != nil {
+				// Never hand a connection with tenant views back to the pool
+				log.Printf("Failed to drop tenant view %s, discarding connection: %v", table, err)
+				conn.Raw(func(any) error { return driver.ErrBadConn })
+				break
+			}
+		}
+		conn.Close()
+	}
+
+	var catalog string
+	if err := conn.QueryRowContext(ctx, "SELECT current_database()").Scan(&catalog); err != nil {
+		release()
+		return nil, nil, fmt.Errorf("failed to resolve catalog: %w", err)
+	}
+
+	quotedTenant := "'" + strings.ReplaceAll(tenantID, "'", "''") + "'"
+	for _, table := range tenantTables {
+		stmt := fmt.Sprintf(`CREATE OR REPLACE TEMP VIEW %s AS SELECT * EXCLUDE (tenant_id) FROM "%s".main.%s WHERE tenant_id = %s`,
+			table, strings.ReplaceAll(catalog, `"`, `""`), table, quotedTenant)
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			release()
+			return nil, nil, fmt.Errorf("failed to create tenant view %s: %w", table, err)
+		}
+	}
+	return conn, release, nil
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"mo11y/internal/traceql"
+)
+
+// TraceQLResult is a trace matched by a TraceQL query.
+type TraceQLResult struct {
+	TraceSummary
+	MatchedCount int64         // Spans matched in the trace
+	Matched      []MatchedSpan // The earliest matched spans, up to the per-trace limit
+}
+
+// MatchedSpan is a span selected by a TraceQL query.
+type MatchedSpan struct {
+	SpanID     string
+	Name       string
+	Service    string
+	StartTime  time.Time
+	DurationNs int64
+}
+
+// TraceQL runs a compiled TraceQL query over the spans that started within
+// [start, end) and returns the most recent matching traces with up to
+// spansPerTrace of their matched spans.
+func (s *Storage) TraceQL(ctx context.Context, q *traceql.SQL, start, end time.Time, limit, spansPerTrace int) ([]TraceQLResult, error) {
+	tenantCond := ""
+	var tenantArgs []any
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		tenantCond = " AND tenant_id = ?"
+		tenantArgs = []any{tenantID}
+	}
+
+	with := "WITH "
+	if q.Recursive {
+		with = "WITH RECURSIVE "
+	}
+	args := append([]any{start, end}, tenantArgs...)
+	args = append(args, q.Args...)
+	args = append(args, tenantArgs...)
+	args = append(args, limit, spansPerTrace)
+
+	rows, err := s.db.QueryContext(ctx, with+traceql.SpansRelation+` AS (
+			SELECT trace_id, span_id, parent_span_id, name, kind, status_code, duration_ns, start_time, attrs, resource_attrs
+			FROM spans
+			WHERE start_time >= ? AND start_time < ?`+tenantCond+`
+			QUALIFY row_number() OVER (PARTITION BY trace_id, span_id ORDER BY ingested_at DESC) = 1
+		),
+		`+strings.Join(q.CTEs, ",\n")+`,
+		summaries AS (
+			`+traceSummarySelect+`
+			WHERE trace_id IN (SELECT trace_id FROM `+q.Result+`)`+tenantCond+`
+			GROUP BY trace_id
+			ORDER BY start_us DESC, trace_id DESC
+			LIMIT ?
+		),
+		matched AS (
+			SELECT
+				m.trace_id,
+				m.span_id,
+				sp.name,
+				sp.resource_attrs['service.name'][1] AS service,
+				epoch_us(sp.start_time) AS span_start_us,
+				sp.duration_ns AS span_duration_ns,
+				COUNT(*) OVER (PARTITION BY m.trace_id) AS matched_count
+			FROM `+q.Result+` m
+			JOIN `+traceql.SpansRelation+` sp ON sp.trace_id = m.trace_id AND sp.span_id = m.span_id
+			WHERE m.trace_id IN (SELECT trace_id FROM summaries)
+			QUALIFY row_number() OVER (PARTITION BY m.trace_id ORDER BY sp.start_time, m.span_id) <= ?
+		)
+		SELECT
+			s.trace_id, s.root_service, s.root_name, s.start_us, s.duration_ns, s.span_count, s.error_count, s.services,
+			m.matched_count, m.span_id, m.name, m.service, m.span_start_us, m.span_duration_ns
+		FROM summaries s
+		JOIN matched m ON m.trace_id = s.trace_id
+		ORDER BY s.start_us DESC, s.trace_id DESC, m.span_start_us, m.span_id
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run TraceQL query: %w", err)
+	}
+	defer rows.Close()
+
+	var result []TraceQLResult
+	for rows.Next() {
+		var r TraceQLResult
+		var sc traceSummaryScan
+		var span MatchedSpan
+		var service *string
+		var spanStartUs int64
+		dest := append(sc.dest(&r.TraceSummary), &r.MatchedCount,
+			&span.SpanID, &span.Name, &service, &spanStartUs, &span.DurationNs)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan TraceQL result: %w", err)
+		}
+		if service != nil {
+			span.Service = *service
+		}
+		span.StartTime = time.UnixMicro(spanStartUs)
+
+		// Rows are ordered by trace, one per matched span
+		if n := len(result); n == 0 || result[n-1].TraceID != r.TraceID {
+			sc.fill(&r.TraceSummary)
+			result = append(result, r)
+		}
+		last := &result[len(result)-1]
+		last.Matched = append(last.Matched, span)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read TraceQL results: %w", err)
+	}
+	return result, nil
+}
@@ -60,6 +60,8 @@ func (s *Storage) StoreTraces(ctx context.Context, req *collectortracev1.ExportT
 
 	result := &StoreResult{}
 	now := time.Now()
+	tenantID := tenantFromContext(ctx)
+	var accepted []ingestedSpan
 
 	// Flatten OTLP hierarchy and append rows
 	for _, rs := range req.GetResourceSpans() {
@@ -82,6 +84,11 @@ func (s *Storage) StoreTraces(ctx context.Context, req *collectortracev1.ExportT
 			scopeSchemaURL = ss.SchemaUrl
 
 			for _, span := range ss.GetSpans() {
+				if reason := s.validateSpan(span, now); reason != "" {
+					s.reject(result, SignalSpans, reason, fmt.Sprintf("span %s: %s", hexEncode(span.SpanId), reason), spanEnvelope(rs, ss, span))
+					continue
+				}
+
 				traceID := hexEncode(span.TraceId)
 				spanID := hexEncode(span.SpanId)
 
@@ -94,7 +101,8 @@ func (s *Storage) StoreTraces(ctx context.Context, req *collectortracev1.ExportT
 				}
 
 				// Calculate duration
-				durationNs := int64(span.EndTimeUnixNano - span.StartTimeUnixNano)
+				durationNs := spanDurationNanos(span)
+				attrs := flattenAttributes(span.Attributes)
 
 				// Append span
 				err := spanAppender.AppendRow(
@@ -114,17 +122,21 @@ func (s *Storage) StoreTraces(ctx context.Context, req *collectortracev1.ExportT
 					scopeVersion,
 					scopeAttrs,
 					scopeSchemaURL,
-					flattenAttributes(span.Attributes),
+					attrs,
 					int32(span.DroppedAttributesCount),
 					now,
+					tenantID,
 				)
 				if err != nil {
-					result.AddError(fmt.Sprintf("span %s: %v", spanID, err))
+					s.reject(result, SignalSpans, ReasonAppendFailed, fmt.Sprintf("span %s: %v", spanID, err), spanEnvelope(rs, ss, span))
 					continue
 				}
 				result.Accepted++
+				result.wrote("spans", unixNanoToTime(span.StartTimeUnixNano))
 
-				// Append events for this span
+				// Append events for this span. Events and links were validated with
+				// the span, which is already appended, so failures here are counted
+				// as dropped rather than rejecting the span
 				for _, event := range span.Events {
 					err := eventAppender.AppendRow(
 						traceID,
@@ -134,11 +146,13 @@ func (s *Storage) StoreTraces(ctx context.Context, req *collectortracev1.ExportT
 						flattenAttributes(event.Attributes),
 						int32(event.DroppedAttributesCount),
 						now,
+						tenantID,
 					)
 					if err != nil {
-						// Log but don't fail the span for event errors
-						result.Errors = append(result.Errors, fmt.Sprintf("event %s/%s: %v", spanID, event.Name, err))
+						s.dropped(result, SignalSpans, ReasonEventFailed, fmt.Sprintf("event %s/%s: %v", spanID, event.Name, err))
+						continue
 					}
+					result.wrote("span_events", unixNanoToTime(event.TimeUnixNano))
 				}
 
 				// Append links for this span
@@ -152,17 +166,22 @@ func (s *Storage) StoreTraces(ctx context.Context, req *collectortracev1.ExportT
 						flattenAttributes(link.Attributes),
 						int32(link.DroppedAttributesCount),
 						now,
+						tenantID,
 					)
 					if err != nil {
-						// Log but don't fail the span for link errors
-						result.Errors = append(result.Errors, fmt.Sprintf("link %s: %v", spanID, err))
+						s.dropped(result, SignalSpans, ReasonLinkFailed, fmt.Sprintf("link %s: %v", spanID, err))
+						continue
 					}
+					result.wrote("span_links", time.Time{})
 				}
+
+				accepted = append(accepted, ingestedSpan{tenant: tenantID, resourceAttrs: resourceAttrs, attrs: attrs, span: span})
 			}
 		}
 	}
 
-	// Flush all appenders
+	// Flush all appenders. Flushed rows are visible even if a later flush fails
+	defer s.invalidateResults(tenantID, result.written)
 	if err := spanAppender.Flush(); err != nil {
 		return nil, NewInfrastructureError("failed to flush spans", err)
 	}
@@ -173,5 +192,9 @@ func (s *Storage) StoreTraces(ctx context.Context, req *collectortracev1.ExportT
 		return nil, NewInfrastructureError("failed to flush links", err)
 	}
 
+	s.observeSpans(accepted)
+	s.publishSpans(accepted)
+	s.writeDeadLetters(ctx, result)
+
 	return result, nil
 }
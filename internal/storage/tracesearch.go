@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Trace search sort orders; both return the largest value first.
+const (
+	TraceSortStartTime = "start_time"
+	TraceSortDuration  = "duration"
+)
+
+// ErrInvalidCursor is returned for a malformed or foreign pagination cursor.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TraceSearch selects traces containing at least one span that matches every filter.
+type TraceSearch struct {
+	Start, End  time.Time // Span start time range
+	Service     string
+	SpanName    string
+	MinDuration time.Duration // Span duration, 0 for no bound
+	MaxDuration time.Duration
+	StatusCode  *int8 // OTLP status code
+	Attrs       []AttrFilter
+	Sort        string // TraceSortStartTime (default) or TraceSortDuration
+	Limit       int
+	Cursor      string // From a previous page, empty for the first page
+}
+
+// AttrFilter matches a span, data point or resource attribute by equality or
+// full regex match.
+type AttrFilter struct {
+	Key   string
+	Value string
+	Regex bool
+}
+
+// TraceSummary describes a trace found by SearchTraces.
+type TraceSummary struct {
+	TraceID     string
+	RootService string // Empty if the root span is missing
+	RootName    string
+	StartTime   time.Time
+	DurationNs  int64
+	SpanCount   int64
+	ErrorCount  int64
+	Services    []string
+}
+
+// traceCursor is the position after the last trace of a page.
+type traceCursor struct {
+	Sort    string `json:"s"`
+	Value   int64  `json:"v"`
+	TraceID string `json:"t"`
+}
+
+// SearchTraces returns summaries of matching traces, largest sort value first,
+// and a cursor for the next page or "" if there are no more results.
+func (s *Storage) SearchTraces(ctx context.Context, q TraceSearch) ([]TraceSummary, string, error) {
+	if q.Sort == "" {
+		q.Sort = TraceSortStartTime
+	}
+	if q.Sort != TraceSortStartTime && q.Sort != TraceSortDuration {
+		return nil, "", fmt.Errorf("unknown sort %q", q.Sort)
+	}
+
+	// Span filters select candidate traces within the time range
+	conds := []string{"start_time >= ?", "start_time < ?"}
+	args := []any{q.Start, q.End}
+	tenantCond := ""
+	var tenantArgs []any
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		tenantCond = " AND tenant_id = ?"
+		tenantArgs = []any{tenantID}
+		conds = append(conds, "tenant_id = ?")
+		args = append(args, tenantID)
+	}
+	if q.Service != "" {
+		conds = append(conds, "resource_attrs['service.name'][1] = ?")
+		args = append(args, q.Service)
+	}
+	if q.SpanName != "" {
+		conds = append(conds, "name = ?")
+		args = append(args, q.SpanName)
+	}
+	if q.MinDuration > 0 {
+		conds = append(conds, "duration_ns >= ?")
+		args = append(args, q.MinDuration.Nanoseconds())
+	}
+	if q.MaxDuration > 0 {
+		conds = append(conds, "duration_ns <= ?")
+		args = append(args, q.MaxDuration.Nanoseconds())
+	}
+	if q.StatusCode != nil {
+		conds = append(conds, "status_code = ?")
+		args = append(args, *q.StatusCode)
+	}
+	attrConds, attrArgs := attrFilterConditions(q.Attrs)
+	conds = append(conds, attrConds...)
+	args = append(args, attrArgs...)
+
+	// Summaries cover every span of a candidate trace, also outside the time range
+	args = append(args, tenantArgs...)
+
+	sortExpr := "start_us"
+	if q.Sort == TraceSortDuration {
+		sortExpr = "duration_ns"
+	}
+	page := ""
+	if q.Cursor != "" {
+		c, err := decodeTraceCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, "", err
+		}
+		page = fmt.Sprintf("WHERE %s < ? OR (%s = ? AND trace_id < ?)", sortExpr, sortExpr)
+		args = append(args, c.Value, c.Value, c.TraceID)
+	}
+	args = append(args, q.Limit+1)
+
+	rows, err := s.db.QueryContext(ctx, `
+		WITH candidates AS (
+			SELECT DISTINCT trace_id
+			FROM spans
+			WHERE `+strings.Join(conds, " AND ")+`
+		),
+		summaries AS (
+			`+traceSummarySelect+`
+			WHERE trace_id IN (SELECT trace_id FROM candidates)`+tenantCond+`
+			GROUP BY trace_id
+		)
+		SELECT trace_id, root_service, root_name, start_us, duration_ns, span_count, error_count, services
+		FROM summaries
+		`+page+`
+		ORDER BY `+sortExpr+` DESC, trace_id DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to search traces: %w", err)
+	}
+	defer rows.Close()
+
+	var result []TraceSummary
+	for rows.Next() {
+		var ts TraceSummary
+		var sc traceSummaryScan
+		if err := rows.Scan(sc.dest(&ts)...); err != nil {
+			return nil, "", fmt.Errorf("failed to scan trace summary: %w", err)
+		}
+		sc.fill(&ts)
+		result = append(result, ts)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to read trace summaries: %w", err)
+	}
+
+	if len(result) <= q.Limit {
+		return result, "", nil
+	}
+	result = result[:q.Limit]
+	last := result[len(result)-1]
+	c := traceCursor{Sort: q.Sort, Value: last.StartTime.UnixMicro(), TraceID: last.TraceID}
+	if q.Sort == TraceSortDuration {
+		c.Value = last.DurationNs
+	}
+	return result, encodeTraceCursor(c), nil
+}
+
+// attrFilterConditions returns WHERE conditions and their arguments matching
+// filters against the attrs and resource_attrs columns.
+func attrFilterConditions(filters []AttrFilter) ([]string, []any) {
+	var conds []string
+	var args []any
+	for _, f := range filters {
+		// Own attributes take precedence over resource attributes of the same name
+		value := "COALESCE(attrs[?][1], resource_attrs[?][1])"
+		if f.Regex {
+			conds = append(conds, "regexp_full_match("+value+", ?)")
+		} else {
+			conds = append(conds, value+" = ?")
+		}
+		args = append(args, f.Key, f.Key, f.Value)
+	}
+	return conds, args
+}
+
+// traceSummarySelect aggregates the spans of each trace into the columns
+// scanned by traceSummaryScan; the caller adds WHERE and GROUP BY trace_id.
+const traceSummarySelect = `SELECT
+	trace_id,
+	arg_min(resource_attrs['service.name'][1], start_time) FILTER (WHERE parent_span_id = '') AS root_service,
+	arg_min(name, start_time) FILTER (WHERE parent_span_id = '') AS root_name,
+	MIN(epoch_us(start_time)) AS start_us,
+	MAX(epoch_us(start_time) * 1000 + duration_ns) - MIN(epoch_us(start_time)) * 1000 AS duration_ns,
+	COUNT(DISTINCT span_id) AS span_count,
+	COUNT(DISTINCT span_id) FILTER (WHERE status_code = 2) AS error_count,
+	list_sort(list_distinct(list(resource_attrs['service.name'][1]))) AS services
+FROM spans`
+
+// traceSummaryScan holds the nullable and list columns of a trace summary row.
+type traceSummaryScan struct {
+	rootService, rootName *string
+	startUs               int64
+	services              []any
+}
+
+// dest returns the scan destinations for the traceSummarySelect columns.
+func (sc *traceSummaryScan) dest(ts *TraceSummary) []any {
+	return []any{&ts.TraceID, &sc.rootService, &sc.rootName, &sc.startUs, &ts.DurationNs,
+		&ts.SpanCount, &ts.ErrorCount, &sc.services}
+}
+
+func (sc *traceSummaryScan) fill(ts *TraceSummary) {
+	if sc.rootService != nil {
+		ts.RootService = *sc.rootService
+	}
+	if sc.rootName != nil {
+		ts.RootName = *sc.rootName
+	}
+	ts.StartTime = time.UnixMicro(sc.startUs)
+	ts.Services = make([]string, 0, len(sc.services))
+	for _, svc := range sc.services {
+		if s, ok := svc.(string); ok {
+			ts.Services = append(ts.Services, s)
+		}
+	}
+}
+
+func encodeTraceCursor(c traceCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeTraceCursor(s, sort string) (traceCursor, error) {
+	var c traceCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.Sort != sort {
+		return traceCursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// Operation is a span name observed for a service.
+type Operation struct {
+	Name string
+	Kind int8
+}
+
+// Services returns the names of all services that reported spans.
+func (s *Storage) Services(ctx context.Context) ([]string, error) {
+	where := ""
+	var args []any
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		where = " AND tenant_id = ?"
+		args = append(args, tenantID)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT resource_attrs['service.name'][1] AS service
+		FROM spans
+		WHERE resource_attrs['service.name'][1] IS NOT NULL`+where+`
+		ORDER BY service
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query services: %w", err)
+	}
+	defer rows.Close()
+
+	services := []string{}
+	for rows.Next() {
+		var service string
+		if err := rows.Scan(&service); err != nil {
+			return nil, fmt.Errorf("failed to scan service: %w", err)
+		}
+		services = append(services, service)
+	}
+	return services, rows.Err()
+}
+
+// Operations returns the distinct span names and kinds of a service.
+func (s *Storage) Operations(ctx context.Context, service string) ([]Operation, error) {
+	where := ""
+	args := []any{service}
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		where = " AND tenant_id = ?"
+		args = append(args, tenantID)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT name, kind
+		FROM spans
+		WHERE resource_attrs['service.name'][1] = ?`+where+`
+		ORDER BY name, kind
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query operations: %w", err)
+	}
+	defer rows.Close()
+
+	var ops []Operation
+	for rows.Next() {
+		var op Operation
+		if err := rows.Scan(&op.Name, &op.Kind); err != nil {
+			return nil, fmt.Errorf("failed to scan operation: %w", err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	collectortracev1 "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// ErrTraceNotFound is returned when no spans exist for a trace ID.
+var ErrTraceNotFound = errors.New("trace not found")
+
+// Trace is a stored trace assembled into a span tree.
+type Trace struct {
+	TraceID string
+	Spans   []*TraceSpan // All spans ordered by start time
+	Roots   []*TraceSpan // Root spans followed by orphans, ordered by start time
+}
+
+// TraceSpan is a stored span with its events, links and children.
+type TraceSpan struct {
+	SpanID            string
+	ParentSpanID      string
+	Name              string
+	Kind              int8
+	StartTime         time.Time
+	EndTime           time.Time
+	DurationNs        int64
+	StatusCode        int8
+	StatusMessage     string
+	ResourceAttrs     map[string]string
+	ResourceSchemaURL string
+	ScopeName         string
+	ScopeVersion      string
+	ScopeAttrs        map[string]string
+	ScopeSchemaURL    string
+	Attrs             map[string]string
+	DroppedAttrsCount int32
+	Events            []TraceSpanEvent
+	Links             []TraceSpanLink
+
+	// Derived from the tree
+	SelfTimeNs int64 // Duration not covered by any child span
+	Orphan     bool  // Parent span is missing from the trace
+	Children   []*TraceSpan
+
+	ingestedAt time.Time // Matches the events and links stored with this copy of the span
+}
+
+// TraceSpanEvent is a stored span event.
+type TraceSpanEvent struct {
+	Time              time.Time
+	Name              string
+	Attrs             map[string]string
+	DroppedAttrsCount int32
+}
+
+// TraceSpanLink is a stored span link.
+type TraceSpanLink struct {
+	TraceID           string
+	SpanID            string
+	TraceState        string
+	Attrs             map[string]string
+	DroppedAttrsCount int32
+}
+
+// Trace loads all spans of a trace with their events and links and assembles the span tree.
+// Returns ErrTraceNotFound if the trace has no spans.
+func (s *Storage) Trace(ctx context.Context, traceID string) (*Trace, error) {
+	where := "trace_id = ?"
+	args := []any{traceID}
+	if tenantID := scopedTenant(ctx); tenantID != "" {
+		where += " AND tenant_id = ?"
+		args = append(args, tenantID)
+	}
+
+	// Spans stored more than once (client retries, reingest) are returned once
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			span_id,
+			COALESCE(parent_span_id, ''),
+			name,
+			kind,
+			COALESCE(status_code, 0),
+			COALESCE(status_message, ''),
+			start_time,
+			end_time,
+			duration_ns,
+			resource_attrs,
+			COALESCE(resource_schema_url, ''),
+			COALESCE(scope_name, ''),
+			COALESCE(scope_version, ''),
+			scope_attrs,
+			COALESCE(scope_schema_url, ''),
+			attrs,
+			COALESCE(dropped_attrs_count, 0),
+			ingested_at
+		FROM spans
+		WHERE `+where+`
+		QUALIFY row_number() OVER (PARTITION BY span_id ORDER BY ingested_at DESC) = 1
+		ORDER BY start_time, span_id
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query spans: %w", err)
+	}
+	defer rows.Close()
+
+	t := &Trace{TraceID: traceID}
+	byID := make(map[string]*TraceSpan)
+	for rows.Next() {
+		var sp TraceSpan
+		var resourceAttrs, scopeAttrs, attrs duckdb.Map
+		err := rows.Scan(&sp.SpanID, &sp.ParentSpanID, &sp.Name, &sp.Kind, &sp.StatusCode, &sp.StatusMessage,
+			&sp.StartTime, &sp.EndTime, &sp.DurationNs, &resourceAttrs, &sp.ResourceSchemaURL,
+			&sp.ScopeName, &sp.ScopeVersion, &scopeAttrs, &sp.ScopeSchemaURL, &attrs, &sp.DroppedAttrsCount, &sp.ingestedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan span: %w", err)
+		}
+		sp.ResourceAttrs = mapToStrings(resourceAttrs)
+		sp.ScopeAttrs = mapToStrings(scopeAttrs)
+		sp.Attrs = mapToStrings(attrs)
+		t.Spans = append(t.Spans, &sp)
+		byID[sp.SpanID] = &sp
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read spans: %w", err)
+	}
+	if len(t.Spans) == 0 {
+		return nil, ErrTraceNotFound
+	}
+
+	if err := s.loadTraceEvents(ctx, where, args, byID); err != nil {
+		return nil, err
+	}
+	if err := s.loadTraceLinks(ctx, where, args, byID); err != nil {
+		return nil, err
+	}
+
+	t.assemble(byID)
+	return t, nil
+}
+
+func (s *Storage) loadTraceEvents(ctx context.Context, where string, args []any, byID map[string]*TraceSpan) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT span_id, event_time, event_name, event_attrs, COALESCE(dropped_attrs_count, 0), ingested_at
+		FROM span_events
+		WHERE `+where+`
+		ORDER BY event_time
+	`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query span events: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var spanID string
+		var ev TraceSpanEvent
+		var attrs duckdb.Map
+		var ingestedAt time.Time
+		if err := rows.Scan(&spanID, &ev.Time, &ev.Name, &attrs, &ev.DroppedAttrsCount, &ingestedAt); err != nil {
+			return fmt.Errorf("failed to scan span event: %w", err)
+		}
+		ev.Attrs = mapToStrings(attrs)
+		if sp, ok := byID[spanID]; ok && sp.ingestedAt.Equal(ingestedAt) {
+			sp.Events = append(sp.Events, ev)
+		}
+	}
+	return rows.Err()
+}
+
+func (s *Storage) loadTraceLinks(ctx context.Context, where string, args []any, byID map[string]*TraceSpan) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT span_id, linked_trace_id, linked_span_id, COALESCE(trace_state, ''), link_attrs, COALESCE(dropped_attrs_count, 0), ingested_at
+		FROM span_links
+		WHERE `+where+`
+	`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query span links: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var spanID string
+		var link TraceSpanLink
+		var attrs duckdb.Map
+		var ingestedAt time.Time
+		if err := rows.Scan(&spanID, &link.TraceID, &link.SpanID, &link.TraceState, &attrs, &link.DroppedAttrsCount, &ingestedAt); err != nil {
+			return fmt.Errorf("failed to scan span link: %w", err)
+		}
+		link.Attrs = mapToStrings(attrs)
+		if sp, ok := byID[spanID]; ok && sp.ingestedAt.Equal(ingestedAt) {
+			sp.Links = append(sp.Links, link)
+		}
+	}
+	return rows.Err()
+}
+
+// assemble links spans to their parents, flags orphans and computes self-times.
+// Spans are already ordered by start time, so children are too.
+func (t *Trace) assemble(byID map[string]*TraceSpan) {
+	for _, sp := range t.Spans {
+		parent, ok := byID[sp.ParentSpanID]
+		switch {
+		case sp.ParentSpanID == "":
+			t.Roots = append(t.Roots, sp)
+		case !ok || parent == sp:
+			sp.Orphan = true
+		default:
+			parent.Children = append(parent.Children, sp)
+		}
+	}
+
+	// Spans in a parent cycle are unreachable from any root; detach them as orphans
+	reachable := make(map[*TraceSpan]bool)
+	var visit func(sp *TraceSpan)
+	visit = func(sp *TraceSpan) {
+		reachable[sp] = true
+		for _, child := range sp.Children {
+			visit(child)
+		}
+	}
+	for _, sp := range t.Spans {
+		if sp.ParentSpanID == "" || sp.Orphan {
+			visit(sp)
+		}
+	}
+	for _, sp := range t.Spans {
+		if reachable[sp] {
+			continue
+		}
+		parent := byID[sp.ParentSpanID]
+		for i, child := range parent.Children {
+			if child == sp {
+				parent.Children = append(parent.Children[:i], parent.Children[i+1:]...)
+				break
+			}
+		}
+		sp.Orphan = true
+		visit(sp)
+	}
+
+	// Orphans follow the real roots
+	for _, sp := range t.Spans {
+		if sp.Orphan {
+			t.Roots = append(t.Roots, sp)
+		}
+	}
+
+	for _, sp := range t.Spans {
+		sp.SelfTimeNs = selfTimeNanos(sp)
+	}
+}
+
+// selfTimeNanos returns the part of the span's duration not covered by its children.
+// Overlapping children are counted once and time outside the span is ignored.
+func selfTimeNanos(sp *TraceSpan) int64 {
+	start := sp.StartTime.UnixNano()
+	end := start + sp.DurationNs
+
+	type interval struct{ start, end int64 }
+	var covered []interval
+	for _, child := range sp.Children {
+		cs := max(child.StartTime.UnixNano(), start)
+		ce := min(child.StartTime.UnixNano()+child.DurationNs, end)
+		if cs < ce {
+			covered = append(covered, interval{cs, ce})
+		}
+	}
+	sort.Slice(covered, func(i, j int) bool { return covered[i].start < covered[j].start })
+
+	self := sp.DurationNs
+	var cursor int64 = start
+	for _, iv := range covered {
+		if iv.end <= cursor {
+			continue
+		}
+		self -= iv.end - max(iv.start, cursor)
+		cursor = iv.end
+	}
+	return max(self, 0)
+}
+
+// OTLP rebuilds the trace as an OTLP export request, grouping spans by resource and scope.
+// Attribute values are stored flattened, so all attributes are returned as strings.
+func (t *Trace) OTLP() *collectortracev1.ExportTraceServiceRequest {
+	traceID, _ := hex.DecodeString(t.TraceID)
+
+	req := &collectortracev1.ExportTraceServiceRequest{}
+	resources := make(map[string]*tracev1.ResourceSpans)
+	scopes := make(map[string]*tracev1.ScopeSpans)
+	for _, sp := range t.Spans {
+		resourceKey := attrsKey(sp.ResourceSchemaURL, sp.ResourceAttrs)
+		rs, ok := resources[resourceKey]
+		if !ok {
+			rs = &tracev1.ResourceSpans{
+				Resource:  &resourcev1.Resource{Attributes: stringKeyValues(sp.ResourceAttrs)},
+				SchemaUrl: sp.ResourceSchemaURL,
+			}
+			resources[resourceKey] = rs
+			req.ResourceSpans = append(req.ResourceSpans, rs)
+		}
+
+		scopeKey := resourceKey + "\x00" + attrsKey(sp.ScopeName+"\x00"+sp.ScopeVersion+"\x00"+sp.ScopeSchemaURL, sp.ScopeAttrs)
+		ss, ok := scopes[scopeKey]
+		if !ok {
+			ss = &tracev1.ScopeSpans{
+				Scope: &commonv1.InstrumentationScope{
+					Name:       sp.ScopeName,
+					Version:    sp.ScopeVersion,
+					Attributes: stringKeyValues(sp.ScopeAttrs),
+				},
+				SchemaUrl: sp.ScopeSchemaURL,
+			}
+			scopes[scopeKey] = ss
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+
+		ss.Spans = append(ss.Spans, sp.otlp(traceID))
+	}
+	return req
+}
+
+func (sp *TraceSpan) otlp(traceID []byte) *tracev1.Span {
+	spanID, _ := hex.DecodeString(sp.SpanID)
+	parentSpanID, _ := hex.DecodeString(sp.ParentSpanID)
+	start := uint64(sp.StartTime.UnixNano())
+
+	span := &tracev1.Span{
+		TraceId:                traceID,
+		SpanId:                 spanID,
+		ParentSpanId:           parentSpanID,
+		Name:                   sp.Name,
+		Kind:                   tracev1.Span_SpanKind(sp.Kind),
+		StartTimeUnixNano:      start,
+		EndTimeUnixNano:        start + uint64(sp.DurationNs),
+		Attributes:             stringKeyValues(sp.Attrs),
+		DroppedAttributesCount: uint32(sp.DroppedAttrsCount),
+	}
+	if sp.StatusCode != 0 || sp.StatusMessage != "" {
+		span.Status = &tracev1.Status{Code: tracev1.Status_StatusCode(sp.StatusCode), Message: sp.StatusMessage}
+	}
+	for _, ev := range sp.Events {
+		span.Events = append(span.Events, &tracev1.Span_Event{
+			TimeUnixNano:           uint64(ev.Time.UnixNano()),
+			Name:                   ev.Name,
+			Attributes:             stringKeyValues(ev.Attrs),
+			DroppedAttributesCount: uint32(ev.DroppedAttrsCount),
+		})
+	}
+	for _, link := range sp.Links {
+		linkTraceID, _ := hex.DecodeString(link.TraceID)
+		linkSpanID, _ := hex.DecodeString(link.SpanID)
+		span.Links = append(span.Links, &tracev1.Span_Link{
+			TraceId:                linkTraceID,
+			SpanId:                 linkSpanID,
+			TraceState:             link.TraceState,
+			Attributes:             stringKeyValues(link.Attrs),
+			DroppedAttributesCount: uint32(link.DroppedAttrsCount),
+		})
+	}
+	return span
+}
+
+// stringKeyValues converts stored attributes to OTLP string attributes sorted by key.
+func stringKeyValues(attrs map[string]string) []*commonv1.KeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]*commonv1.KeyValue, len(keys))
+	for i, k := range keys {
+		kvs[i] = stringKeyValue(k, attrs[k])
+	}
+	return kvs
+}
+
+// attrsKey identifies a resource or scope by a prefix and its attributes.
+func attrsKey(prefix string, attrs map[string]string) string {
+	b, _ := json.Marshal(attrs) // Map keys are sorted
+	return prefix + "\x00" + string(b)
+}
@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	logsv1 "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// ValidationMode controls how invalid telemetry is handled.
+type ValidationMode int
+
+const (
+	// ValidationOff stores records as received.
+	ValidationOff ValidationMode = iota
+	// ValidationRepair fixes repairable records and rejects the rest.
+	ValidationRepair
+	// ValidationStrict rejects every invalid record.
+	ValidationStrict
+)
+
+// ParseValidationMode parses "off", "repair" or "strict".
+func ParseValidationMode(s string) (ValidationMode, error) {
+	switch s {
+	case "off":
+		return ValidationOff, nil
+	case "repair":
+		return ValidationRepair, nil
+	case "strict":
+		return ValidationStrict, nil
+	}
+	return ValidationOff, fmt.Errorf("invalid validation mode %q (expected off, repair or strict)", s)
+}
+
+func (m ValidationMode) String() string {
+	switch m {
+	case ValidationRepair:
+		return "repair"
+	case ValidationStrict:
+		return "strict"
+	default:
+		return "off"
+	}
+}
+
+// ValidationConfig holds validation configuration.
+type ValidationConfig struct {
+	Mode ValidationMode
+}
+
+// Signals, used as counter keys.
+const (
+	SignalSpans   = "spans"
+	SignalLogs    = "logs"
+	SignalMetrics = "metrics"
+)
+
+// Validation reasons, used as counter keys.
+const (
+	ReasonInvalidTraceID      = "invalid_trace_id"
+	ReasonInvalidSpanID       = "invalid_span_id"
+	ReasonInvalidParentSpanID = "invalid_parent_span_id"
+	ReasonMissingTimestamp    = "missing_timestamp"
+	ReasonEndBeforeStart      = "end_before_start"
+	ReasonEmptyMetricName     = "empty_metric_name"
+	ReasonInvalidBuckets      = "invalid_histogram_buckets"
+	ReasonAppendFailed        = "append_failed"
+	ReasonInvalidLink         = "invalid_link"
+	ReasonExemplarFailed      = "exemplar_append_failed"
+	ReasonEventFailed         = "event_append_failed"
+	ReasonLinkFailed          = "link_append_failed"
+)
+
+// ValidationStatus reports validation mode and per-reason counters.
+type ValidationStatus struct {
+	Mode     string
+	Rejected map[string]map[string]int64 // signal -> reason -> count
+	Repaired map[string]map[string]int64 // signal -> reason -> count
+	Dropped  map[string]map[string]int64 // Parts of stored records: signal -> reason -> count
+}
+
+// validationCounters tracks rejected and repaired records, and dropped parts
+// of stored records, per signal and reason.
+type validationCounters struct {
+	mu       sync.Mutex
+	rejected map[string]map[string]int64
+	repaired map[string]map[string]int64
+	dropped  map[string]map[string]int64
+}
+
+func newValidationCounters() *validationCounters {
+	return &validationCounters{
+		rejected: make(map[string]map[string]int64),
+		repaired: make(map[string]map[string]int64),
+		dropped:  make(map[string]map[string]int64),
+	}
+}
+
+func (c *validationCounters) add(counts map[string]map[string]int64, signal, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if counts[signal] == nil {
+		counts[signal] = make(map[string]int64)
+	}
+	counts[signal][reason]++
+}
+
+func (c *validationCounters) snapshot() (rejected, repaired, dropped map[string]map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copyCounts(c.rejected), copyCounts(c.repaired), copyCounts(c.dropped)
+}
+
+func copyCounts(counts map[string]map[string]int64) map[string]map[string]int64 {
+	result := make(map[string]map[string]int64, len(counts))
+	for signal, reasons := range counts {
+		result[signal] = make(map[string]int64, len(reasons))
+		for reason, n := range reasons {
+			result[signal][reason] = n
+		}
+	}
+	return result
+}
+
+// SetValidation configures validation of incoming telemetry.
+// Must be called before ingestion starts.
+func (s *Storage) SetValidation(cfg ValidationConfig) {
+	s.validation = cfg
+}
+
+// validationStatus returns the current validation counters.
+func (s *Storage) validationStatus() ValidationStatus {
+	rejected, repaired, dropped := s.validationCounts.snapshot()
+	return ValidationStatus{
+		Mode:     s.validation.Mode.String(),
+		Rejected: rejected,
+		Repaired: repaired,
+		Dropped:  dropped,
+	}
+}
+
+// reject records a rejected item in the result and the per-reason counters.
+// record is the export request holding only the rejected item, kept as a dead letter.
+func (s *Storage) reject(result *StoreResult, signal, reason, msg string, record proto.Message) {
+	result.AddError(msg)
+	s.validationCounts.add(s.validationCounts.rejected, signal, reason)
+	result.deadLetters = append(result.deadLetters, deadLetter{signal: signal, reason: reason, err: msg, record: record})
+}
+
+// repaired records a repaired item in the per-reason counters.
+func (s *Storage) repaired(signal, reason string) {
+	s.validationCounts.add(s.validationCounts.repaired, signal, reason)
+}
+
+// dropped records a part of a stored item that could not be stored, such as
+// an exemplar, in the result and the per-reason counters.
+func (s *Storage) dropped(result *StoreResult, signal, reason, msg string) {
+	result.AddWarning(msg)
+	s.validationCounts.add(s.validationCounts.dropped, signal, reason)
+}
+
+// validateSpan checks a span, repairing it in place when allowed.
+// Returns the rejection reason, or "" if the span may be stored.
+func (s *Storage) validateSpan(span *tracev1.Span, now time.Time) string {
+	mode := s.validation.Mode
+	if mode == ValidationOff {
+		return ""
+	}
+
+	if !validID(span.TraceId, 16) {
+		return ReasonInvalidTraceID
+	}
+	if !validID(span.SpanId, 8) {
+		return ReasonInvalidSpanID
+	}
+	if len(span.ParentSpanId) > 0 && !validID(span.ParentSpanId, 8) {
+		if mode == ValidationStrict {
+			return ReasonInvalidParentSpanID
+		}
+		span.ParentSpanId = nil
+		s.repaired(SignalSpans, ReasonInvalidParentSpanID)
+	}
+
+	if span.StartTimeUnixNano == 0 || span.EndTimeUnixNano == 0 {
+		if mode == ValidationStrict {
+			return ReasonMissingTimestamp
+		}
+		switch {
+		case span.StartTimeUnixNano == 0 && span.EndTimeUnixNano == 0:
+			span.StartTimeUnixNano = uint64(now.UnixNano())
+			span.EndTimeUnixNano = span.StartTimeUnixNano
+		case span.StartTimeUnixNano == 0:
+			span.StartTimeUnixNano = span.EndTimeUnixNano
+		default:
+			span.EndTimeUnixNano = span.StartTimeUnixNano
+		}
+		s.repaired(SignalSpans, ReasonMissingTimestamp)
+	}
+
+	if span.EndTimeUnixNano < span.StartTimeUnixNano {
+		if mode == ValidationStrict {
+			return ReasonEndBeforeStart
+		}
+		span.EndTimeUnixNano = span.StartTimeUnixNano
+		s.repaired(SignalSpans, ReasonEndBeforeStart)
+	}
+
+	return s.validateSpanChildren(span)
+}
+
+// validateSpanChildren checks the events and links of a span before the span
+// is stored, so that a span is either stored whole or rejected. Repair fills
+// missing event timestamps from the span start and drops malformed links.
+func (s *Storage) validateSpanChildren(span *tracev1.Span) string {
+	mode := s.validation.Mode
+
+	for _, event := range span.Events {
+		if event.TimeUnixNano == 0 {
+			if mode == ValidationStrict {
+				return ReasonMissingTimestamp
+			}
+			event.TimeUnixNano = span.StartTimeUnixNano
+			s.repaired(SignalSpans, ReasonMissingTimestamp)
+		}
+	}
+
+	links := span.Links[:0]
+	for _, link := range span.Links {
+		if !validID(link.TraceId, 16) || !validID(link.SpanId, 8) {
+			if mode == ValidationStrict {
+				return ReasonInvalidLink
+			}
+			s.repaired(SignalSpans, ReasonInvalidLink)
+			continue
+		}
+		links = append(links, link)
+	}
+	span.Links = links
+
+	return ""
+}
+
+// validateLogRecord checks a log record, repairing it in place when allowed.
+// Returns the rejection reason, or "" if the record may be stored.
+//
+// A missing timestamp with an observed timestamp is valid OTLP and is
+// filled from the observed timestamp in every mode except off.
+func (s *Storage) validateLogRecord(lr *logsv1.LogRecord, now time.Time) string {
+	mode := s.validation.Mode
+	if mode == ValidationOff {
+		return ""
+	}
+
+	if len(lr.TraceId) > 0 && !validID(lr.TraceId, 16) {
+		if mode == ValidationStrict {
+			return ReasonInvalidTraceID
+		}
+		lr.TraceId = nil
+		s.repaired(SignalLogs, ReasonInvalidTraceID)
+	}
+	if len(lr.SpanId) > 0 && !validID(lr.SpanId, 8) {
+		if mode == ValidationStrict {
+			return ReasonInvalidSpanID
+		}
+		lr.SpanId = nil
+		s.repaired(SignalLogs, ReasonInvalidSpanID)
+	}
+
+	if lr.TimeUnixNano == 0 {
+		switch {
+		case lr.ObservedTimeUnixNano != 0:
+			lr.TimeUnixNano = lr.ObservedTimeUnixNano
+		case mode == ValidationStrict:
+			return ReasonMissingTimestamp
+		default:
+			lr.TimeUnixNano = uint64(now.UnixNano())
+			lr.ObservedTimeUnixNano = lr.TimeUnixNano
+			s.repaired(SignalLogs, ReasonMissingTimestamp)
+		}
+	}
+
+	return ""
+}
+
+// validateMetric checks metric-level fields.
+// Returns the rejection reason for all data points of the metric, or "".
+func (s *Storage) validateMetric(m *metricsv1.Metric) string {
+	if s.validation.Mode == ValidationOff {
+		return ""
+	}
+	if m.Name == "" {
+		return ReasonEmptyMetricName
+	}
+	return ""
+}
+
+// validateNumberDataPoint checks a Gauge or Sum data point and its exemplars, repairing them in place when allowed.
+// Returns the rejection reason, or "" if the data point may be stored.
+func (s *Storage) validateNumberDataPoint(dp *metricsv1.NumberDataPoint, now time.Time) string {
+	if reason := s.validateExemplars(dp.Exemplars); reason != "" {
+		return reason
+	}
+	return s.validateDataPointTime(&dp.TimeUnixNano, dp.StartTimeUnixNano, now)
+}
+
+// validateHistogramDataPoint checks bucket layout, timestamp and exemplars, repairing them in place when allowed.
+// Returns the rejection reason, or "" if the data point may be stored.
+func (s *Storage) validateHistogramDataPoint(dp *metricsv1.HistogramDataPoint, now time.Time) string {
+	if s.validation.Mode == ValidationOff {
+		return ""
+	}
+	if len(dp.BucketCounts) > 0 && len(dp.BucketCounts) != len(dp.ExplicitBounds)+1 {
+		return ReasonInvalidBuckets
+	}
+	if reason := s.validateExemplars(dp.Exemplars); reason != "" {
+		return reason
+	}
+	return s.validateDataPointTime(&dp.TimeUnixNano, dp.StartTimeUnixNano, now)
+}
+
+// validateExemplars checks the exemplars of a data point, repairing them in
+// place when allowed. Returns the rejection reason for the data point, or ""
+// if it may be stored with its exemplars.
+func (s *Storage) validateExemplars(exemplars []*metricsv1.Exemplar) string {
+	mode := s.validation.Mode
+	if mode == ValidationOff {
+		return ""
+	}
+
+	for _, ex := range exemplars {
+		if len(ex.TraceId) > 0 && !validID(ex.TraceId, 16) {
+			if mode == ValidationStrict {
+				return ReasonInvalidTraceID
+			}
+			ex.TraceId = nil
+			s.repaired(SignalMetrics, ReasonInvalidTraceID)
+		}
+		if len(ex.SpanId) > 0 && !validID(ex.SpanId, 8) {
+			if mode == ValidationStrict {
+				return ReasonInvalidSpanID
+			}
+			ex.SpanId = nil
+			s.repaired(SignalMetrics, ReasonInvalidSpanID)
+		}
+	}
+	return ""
+}
+
+// validateDataPointTime fills a missing data point timestamp from its start time or now.
+func (s *Storage) validateDataPointTime(ts *uint64, startTimeUnixNano uint64, now time.Time) string {
+	mode := s.validation.Mode
+	if mode == ValidationOff || *ts != 0 {
+		return ""
+	}
+	if mode == ValidationStrict {
+		return ReasonMissingTimestamp
+	}
+	if startTimeUnixNano != 0 {
+		*ts = startTimeUnixNano
+	} else {
+		*ts = uint64(now.UnixNano())
+	}
+	s.repaired(SignalMetrics, ReasonMissingTimestamp)
+	return ""
+}
+
+// validID reports whether id has the expected length and is not all zeros.
+func validID(id []byte, size int) bool {
+	if len(id) != size {
+		return false
+	}
+	for _, b := range id {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
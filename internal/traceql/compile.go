@@ -0,0 +1,231 @@
+package traceql
+
+import "fmt"
+
+// SpansRelation is the relation compiled queries read spans from. The caller
+// defines it as a CTE with one row per span and the columns trace_id, span_id,
+// parent_span_id, name, kind, status_code, duration_ns, attrs and resource_attrs.
+const SpansRelation = "traceql_spans"
+
+// ancestorsRelation maps every span to each of its ancestors, for ">>".
+const ancestorsRelation = "traceql_ancestors"
+
+// SQL is a compiled query: CTE definitions to follow SpansRelation in a WITH
+// clause, the CTE holding the matching (trace_id, span_id) pairs, and the
+// positional arguments of the CTEs in order.
+type SQL struct {
+	CTEs      []string // "name AS (...)"
+	Result    string
+	Recursive bool // The WITH clause must be WITH RECURSIVE
+	Args      []any
+}
+
+// Compile translates a parsed query to SQL.
+func Compile(e Expr) (*SQL, error) {
+	c := &compiler{}
+	result, err := c.expr(e)
+	if err != nil {
+		return nil, err
+	}
+	if c.recursive {
+		ancestors := ancestorsRelation + ` AS (
+			SELECT trace_id, span_id, parent_span_id AS ancestor_id
+			FROM ` + SpansRelation + `
+			WHERE parent_span_id <> ''
+			UNION
+			SELECT a.trace_id, a.span_id, p.parent_span_id
+			FROM ` + ancestorsRelation + ` a
+			JOIN ` + SpansRelation + ` p ON p.trace_id = a.trace_id AND p.span_id = a.ancestor_id
+			WHERE p.parent_span_id <> ''
+		)`
+		c.ctes = append([]string{ancestors}, c.ctes...)
+	}
+	return &SQL{CTEs: c.ctes, Result: result, Recursive: c.recursive, Args: c.args}, nil
+}
+
+type compiler struct {
+	ctes      []string
+	args      []any
+	recursive bool
+}
+
+// add registers a CTE and returns its name.
+func (c *compiler) add(query string, args ...any) string {
+	name := fmt.Sprintf("traceql_%d", len(c.ctes))
+	c.ctes = append(c.ctes, name+" AS ("+query+")")
+	c.args = append(c.args, args...)
+	return name
+}
+
+func (c *compiler) expr(e Expr) (string, error) {
+	switch e := e.(type) {
+	case *SpansetFilter:
+		where := "true"
+		var args []any
+		if e.Cond != nil {
+			var err error
+			if where, args, err = c.cond(e.Cond); err != nil {
+				return "", err
+			}
+		}
+		return c.add("SELECT trace_id, span_id FROM "+SpansRelation+" WHERE "+where, args...), nil
+
+	case *SpansetOp:
+		lhs, err := c.expr(e.LHS)
+		if err != nil {
+			return "", err
+		}
+		rhs, err := c.expr(e.RHS)
+		if err != nil {
+			return "", err
+		}
+		switch e.Op {
+		case "&&":
+			return c.add(fmt.Sprintf(
+				"SELECT trace_id, span_id FROM %[1]s WHERE trace_id IN (SELECT trace_id FROM %[2]s) "+
+					"UNION SELECT trace_id, span_id FROM %[2]s WHERE trace_id IN (SELECT trace_id FROM %[1]s)",
+				lhs, rhs)), nil
+		case "||":
+			return c.add(fmt.Sprintf("SELECT trace_id, span_id FROM %s UNION SELECT trace_id, span_id FROM %s", lhs, rhs)), nil
+		case ">":
+			return c.add(fmt.Sprintf(
+				"SELECT DISTINCT r.trace_id, r.span_id FROM %s r "+
+					"JOIN %s s ON s.trace_id = r.trace_id AND s.span_id = r.span_id "+
+					"JOIN %s l ON l.trace_id = s.trace_id AND l.span_id = s.parent_span_id",
+				rhs, SpansRelation, lhs)), nil
+		case ">>":
+			c.recursive = true
+			return c.add(fmt.Sprintf(
+				"SELECT DISTINCT r.trace_id, r.span_id FROM %s r "+
+					"JOIN %s a ON a.trace_id = r.trace_id AND a.span_id = r.span_id "+
+					"JOIN %s l ON l.trace_id = a.trace_id AND l.span_id = a.ancestor_id",
+				rhs, ancestorsRelation, lhs)), nil
+		}
+		return "", fmt.Errorf("unknown spanset operator %q", e.Op)
+
+	case *Pipeline:
+		input, err := c.expr(e.Input)
+		if err != nil {
+			return "", err
+		}
+		for _, agg := range e.Aggs {
+			value, args := "*", []any(nil)
+			if agg.Field != nil {
+				value, args = numericField(*agg.Field)
+			}
+			args = append(args, aggregateArg(agg.Value))
+			input = c.add(fmt.Sprintf(
+				"SELECT trace_id, span_id FROM %[1]s WHERE trace_id IN ("+
+					"SELECT m.trace_id FROM %[1]s m JOIN %[2]s s ON s.trace_id = m.trace_id AND s.span_id = m.span_id "+
+					"GROUP BY m.trace_id HAVING %[3]s(%[4]s) %[5]s ?)",
+				input, SpansRelation, agg.Func, value, agg.Op), args...)
+		}
+		return input, nil
+	}
+	return "", fmt.Errorf("unsupported expression %T", e)
+}
+
+// cond returns a WHERE condition over SpansRelation and its arguments.
+func (c *compiler) cond(cond Cond) (string, []any, error) {
+	switch cond := cond.(type) {
+	case *BinaryCond:
+		lhs, largs, err := c.cond(cond.LHS)
+		if err != nil {
+			return "", nil, err
+		}
+		rhs, rargs, err := c.cond(cond.RHS)
+		if err != nil {
+			return "", nil, err
+		}
+		op := "AND"
+		if cond.Op == "||" {
+			op = "OR"
+		}
+		return "(" + lhs + " " + op + " " + rhs + ")", append(largs, rargs...), nil
+
+	case *NotCond:
+		inner, args, err := c.cond(cond.Cond)
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT " + inner, args, nil
+
+	case *Comparison:
+		return comparison(cond)
+	}
+	return "", nil, fmt.Errorf("unsupported condition %T", cond)
+}
+
+func comparison(c *Comparison) (string, []any, error) {
+	field, args := fieldExpr(c.Field, "")
+	v := c.Value
+
+	switch {
+	case v.Kind == ValueNil:
+		if c.Op == "=" {
+			return "(" + field + " IS NULL)", args, nil
+		}
+		return "(" + field + " IS NOT NULL)", args, nil
+
+	case c.Op == "=~" || c.Op == "!~":
+		cond := "regexp_full_match(" + field + ", ?)"
+		if c.Op == "!~" {
+			cond = "NOT " + cond
+		}
+		return "(" + cond + ")", append(args, v.Str), nil
+	}
+
+	switch v.Kind {
+	case ValueString:
+		return "(" + field + " " + c.Op + " ?)", append(args, v.Str), nil
+	case ValueNumber:
+		// Attributes are stored as strings
+		return "(TRY_CAST(" + field + " AS DOUBLE) " + c.Op + " ?)", append(args, v.Num), nil
+	case ValueBool:
+		return "(" + field + " " + c.Op + " ?)", append(args, fmt.Sprint(v.Bool)), nil
+	case ValueDuration:
+		return "(" + field + " " + c.Op + " ?)", append(args, v.Dur.Nanoseconds()), nil
+	case ValueStatus, ValueKind:
+		return "(" + field + " " + c.Op + " ?)", append(args, v.Int), nil
+	}
+	return "", nil, fmt.Errorf("unsupported value for %s", c.Field)
+}
+
+var intrinsicColumns = map[string]string{
+	IntrinsicName:     "name",
+	IntrinsicStatus:   "status_code",
+	IntrinsicKind:     "kind",
+	IntrinsicDuration: "duration_ns",
+}
+
+// fieldExpr returns the SQL expression of a field and its arguments; columns
+// are prefixed with qualifier.
+func fieldExpr(f Field, qualifier string) (string, []any) {
+	switch f.Scope {
+	case ScopeIntrinsic:
+		return qualifier + intrinsicColumns[f.Name], nil
+	case ScopeSpan:
+		return qualifier + "attrs[?][1]", []any{f.Name}
+	case ScopeResource:
+		return qualifier + "resource_attrs[?][1]", []any{f.Name}
+	}
+	// Span attributes take precedence over resource attributes of the same name
+	return "COALESCE(" + qualifier + "attrs[?][1], " + qualifier + "resource_attrs[?][1])", []any{f.Name, f.Name}
+}
+
+// numericField returns a field of the aggregate join's span alias as a number.
+func numericField(f Field) (string, []any) {
+	expr, args := fieldExpr(f, "s.")
+	if f.Scope == ScopeIntrinsic {
+		return expr, args
+	}
+	// Attributes are stored as strings
+	return "TRY_CAST(" + expr + " AS DOUBLE)", args
+}
+
+func aggregateArg(v Value) any {
+	if v.Kind == ValueDuration {
+		return v.Dur.Nanoseconds()
+	}
+	return v.Num
+}
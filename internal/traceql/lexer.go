@@ -0,0 +1,167 @@
+package traceql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokDuration
+	tokPunct // Braces, parentheses, operators
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+
+	num float64       // tokNumber
+	dur time.Duration // tokDuration
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of query"
+	}
+	return strconv.Quote(t.text)
+}
+
+// Operators, longest first so that ">>" wins over ">".
+var punctuation = []string{
+	"&&", "||", ">>", ">=", "<=", "!=", "=~", "!~",
+	"{", "}", "(", ")", "|", ",", "=", ">", "<", "!",
+}
+
+// durationUnits are the suffixes accepted on numbers, longest first.
+var durationUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"ns", time.Nanosecond}, {"us", time.Microsecond}, {"µs", time.Microsecond},
+	{"ms", time.Millisecond}, {"s", time.Second}, {"m", time.Minute}, {"h", time.Hour},
+}
+
+// lex splits a query into tokens.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := rune(input[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '"' || c == '`':
+			s, n, err := lexString(input[i:])
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %w", i, err)
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, pos: i})
+			i += n
+
+		case c >= '0' && c <= '9' || (c == '-' && i+1 < len(input) && input[i+1] >= '0' && input[i+1] <= '9'):
+			tok, n, err := lexNumber(input[i:])
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %w", i, err)
+			}
+			tok.pos = i
+			tokens = append(tokens, tok)
+			i += n
+
+		case c == '.' || c == '_' || unicode.IsLetter(c):
+			n := identLength(input[i:])
+			tokens = append(tokens, token{kind: tokIdent, text: input[i : i+n], pos: i})
+			i += n
+
+		default:
+			matched := false
+			for _, p := range punctuation {
+				if strings.HasPrefix(input[i:], p) {
+					tokens = append(tokens, token{kind: tokPunct, text: p, pos: i})
+					i += len(p)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("at %d: unexpected character %q", i, c)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+// identLength returns the length of an identifier such as span.http.status_code or span:duration.
+func identLength(s string) int {
+	for i, c := range s {
+		if !(c == '.' || c == '_' || c == ':' || c == '-' || c == '/' || unicode.IsLetter(c) || unicode.IsDigit(c)) {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// lexString reads a double-quoted string with escapes or a raw backtick string.
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	if quote == '`' {
+		end := strings.IndexByte(s[1:], '`')
+		if end < 0 {
+			return "", 0, fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], end + 2, nil
+	}
+
+	escaped := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			v, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string %s", s[:i+1])
+			}
+			return v, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// lexNumber reads a number, optionally followed by a duration unit.
+func lexNumber(s string) (token, int, error) {
+	n := 0
+	if s[0] == '-' {
+		n++
+	}
+	for n < len(s) && (s[n] >= '0' && s[n] <= '9' || s[n] == '.') {
+		n++
+	}
+	num, err := strconv.ParseFloat(s[:n], 64)
+	if err != nil {
+		return token{}, 0, fmt.Errorf("invalid number %q", s[:n])
+	}
+
+	rest := s[n:]
+	for _, u := range durationUnits {
+		if strings.HasPrefix(rest, u.suffix) && identLength(rest[len(u.suffix):]) == 0 {
+			end := n + len(u.suffix)
+			return token{kind: tokDuration, text: s[:end], dur: time.Duration(num * float64(u.unit))}, end, nil
+		}
+	}
+	if identLength(rest) > 0 {
+		return token{}, 0, fmt.Errorf("invalid number %q", s[:n+identLength(rest)])
+	}
+	return token{kind: tokNumber, text: s[:n], num: num}, n, nil
+}
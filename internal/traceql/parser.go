@@ -0,0 +1,503 @@
+// Package traceql parses a subset of the TraceQL span query language and
+// compiles it to DuckDB SQL over the spans table.
+//
+// Supported are spanset filters with span, resource and unscoped attributes,
+// the intrinsics name, status, kind and duration, boolean logic within and
+// between spansets, the structural operators > (child) and >> (descendant)
+// and aggregate filters such as | count() > 2 or | avg(duration) > 1s.
+package traceql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Expr is a spanset expression; it evaluates to a set of spans per trace.
+type Expr interface {
+	expr()
+}
+
+// SpansetFilter selects the spans matching Cond, or all spans if Cond is nil.
+type SpansetFilter struct {
+	Cond Cond
+}
+
+// SpansetOp combines two spansets. Op is "&&" (traces with both, spans of
+// either), "||" (spans of either), ">" (RHS spans whose parent is in LHS) or
+// ">>" (RHS spans with an ancestor in LHS).
+type SpansetOp struct {
+	Op       string
+	LHS, RHS Expr
+}
+
+// Pipeline keeps the spansets of Input whose traces pass every aggregate filter.
+type Pipeline struct {
+	Input Expr
+	Aggs  []*Aggregate
+}
+
+func (*SpansetFilter) expr() {}
+func (*SpansetOp) expr()     {}
+func (*Pipeline) expr()      {}
+
+// Cond is a span condition within a spanset filter.
+type Cond interface {
+	cond()
+}
+
+// BinaryCond is Op ("&&" or "||") applied to two conditions.
+type BinaryCond struct {
+	Op       string
+	LHS, RHS Cond
+}
+
+// NotCond negates a condition.
+type NotCond struct {
+	Cond Cond
+}
+
+// Comparison compares a field with a static value.
+type Comparison struct {
+	Field Field
+	Op    string // =, !=, <, <=, >, >=, =~, !~
+	Value Value
+}
+
+func (*BinaryCond) cond() {}
+func (*NotCond) cond()    {}
+func (*Comparison) cond() {}
+
+// Attribute scopes; ScopeIntrinsic fields are columns of the span.
+const (
+	ScopeAny       = ""
+	ScopeSpan      = "span"
+	ScopeResource  = "resource"
+	ScopeIntrinsic = "intrinsic"
+)
+
+// Intrinsic field names.
+const (
+	IntrinsicName     = "name"
+	IntrinsicStatus   = "status"
+	IntrinsicKind     = "kind"
+	IntrinsicDuration = "duration"
+)
+
+// Field is an intrinsic or an attribute. Unscoped attributes (.key) match
+// span attributes first and resource attributes second.
+type Field struct {
+	Scope string
+	Name  string
+}
+
+func (f Field) String() string {
+	switch f.Scope {
+	case ScopeIntrinsic:
+		return f.Name
+	case ScopeAny:
+		return "." + f.Name
+	}
+	return f.Scope + "." + f.Name
+}
+
+// Value kinds.
+const (
+	ValueString = iota
+	ValueNumber
+	ValueDuration
+	ValueBool
+	ValueStatus
+	ValueKind
+	ValueNil
+)
+
+// Value is a static operand. Status and kind values carry their OTLP code in Int.
+type Value struct {
+	Kind int
+	Str  string
+	Num  float64
+	Dur  time.Duration
+	Bool bool
+	Int  int64
+}
+
+// Aggregate filters traces by an aggregate over their spanset, e.g. avg(duration) > 1s.
+type Aggregate struct {
+	Func  string // count, avg, min, max or sum
+	Field *Field // nil for count
+	Op    string
+	Value Value
+}
+
+var statusValues = map[string]int64{"unset": 0, "ok": 1, "error": 2}
+
+var kindValues = map[string]int64{
+	"unspecified": 0, "internal": 1, "server": 2, "client": 3, "producer": 4, "consumer": 5,
+}
+
+var aggregateFuncs = map[string]bool{"count": true, "avg": true, "min": true, "max": true, "sum": true}
+
+var comparisonOps = map[string]bool{
+	"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "=~": true, "!~": true,
+}
+
+// Parse parses a TraceQL query.
+func Parse(query string) (Expr, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t)
+	}
+	return e, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the given punctuation.
+func (p *parser) accept(punct string) bool {
+	if t := p.peek(); t.kind == tokPunct && t.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(punct string) error {
+	if !p.accept(punct) {
+		return fmt.Errorf("at %d: expected %q, got %s", p.peek().pos, punct, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) unexpected(t token) error {
+	return fmt.Errorf("at %d: unexpected %s", t.pos, t)
+}
+
+// pipeline := spansetOr ( "|" aggregate )*
+func (p *parser) parsePipeline() (Expr, error) {
+	input, err := p.parseSpansetOr()
+	if err != nil {
+		return nil, err
+	}
+	var aggs []*Aggregate
+	for p.accept("|") {
+		agg, err := p.parseAggregate()
+		if err != nil {
+			return nil, err
+		}
+		aggs = append(aggs, agg)
+	}
+	if len(aggs) == 0 {
+		return input, nil
+	}
+	return &Pipeline{Input: input, Aggs: aggs}, nil
+}
+
+// spansetOr := spansetAnd ( "||" spansetAnd )*
+func (p *parser) parseSpansetOr() (Expr, error) {
+	lhs, err := p.parseSpansetAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		rhs, err := p.parseSpansetAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &SpansetOp{Op: "||", LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+// spansetAnd := structural ( "&&" structural )*
+func (p *parser) parseSpansetAnd() (Expr, error) {
+	lhs, err := p.parseStructural()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		rhs, err := p.parseStructural()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &SpansetOp{Op: "&&", LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+// structural := spanset ( ( ">" | ">>" ) spanset )*
+func (p *parser) parseStructural() (Expr, error) {
+	lhs, err := p.parseSpanset()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		switch {
+		case p.accept(">>"):
+			op = ">>"
+		case p.accept(">"):
+			op = ">"
+		default:
+			return lhs, nil
+		}
+		rhs, err := p.parseSpanset()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &SpansetOp{Op: op, LHS: lhs, RHS: rhs}
+	}
+}
+
+// spanset := "{" cond? "}" | "(" pipeline ")"
+func (p *parser) parseSpanset() (Expr, error) {
+	if p.accept("(") {
+		e, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	if p.accept("}") {
+		return &SpansetFilter{}, nil
+	}
+	c, err := p.parseCondOr()
+	if err != nil {
+		return nil, err
+	}
+	return &SpansetFilter{Cond: c}, p.expect("}")
+}
+
+// condOr := condAnd ( "||" condAnd )*
+func (p *parser) parseCondOr() (Cond, error) {
+	lhs, err := p.parseCondAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		rhs, err := p.parseCondAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryCond{Op: "||", LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+// condAnd := condUnary ( "&&" condUnary )*
+func (p *parser) parseCondAnd() (Cond, error) {
+	lhs, err := p.parseCondUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		rhs, err := p.parseCondUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryCond{Op: "&&", LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+// condUnary := "!" condUnary | "(" condOr ")" | field op value
+func (p *parser) parseCondUnary() (Cond, error) {
+	if p.accept("!") {
+		c, err := p.parseCondUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &NotCond{Cond: c}, nil
+	}
+	if p.accept("(") {
+		c, err := p.parseCondOr()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect(")")
+	}
+
+	field, err := p.parseField()
+	if err != nil {
+		return nil, err
+	}
+	t := p.next()
+	if t.kind != tokPunct || !comparisonOps[t.text] {
+		return nil, fmt.Errorf("at %d: expected comparison operator after %s, got %s", t.pos, field, t)
+	}
+	value, err := p.parseValue(field)
+	if err != nil {
+		return nil, err
+	}
+	c := &Comparison{Field: field, Op: t.text, Value: value}
+	if err := checkComparison(c); err != nil {
+		return nil, fmt.Errorf("at %d: %w", t.pos, err)
+	}
+	return c, nil
+}
+
+// parseField reads an intrinsic or an attribute reference.
+func (p *parser) parseField() (Field, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return Field{}, fmt.Errorf("at %d: expected field, got %s", t.pos, t)
+	}
+	name := strings.TrimPrefix(t.text, "span:")
+	switch {
+	case name == IntrinsicName || name == IntrinsicStatus || name == IntrinsicKind || name == IntrinsicDuration:
+		return Field{Scope: ScopeIntrinsic, Name: name}, nil
+	case strings.HasPrefix(t.text, ".") && len(t.text) > 1:
+		return Field{Scope: ScopeAny, Name: t.text[1:]}, nil
+	case strings.HasPrefix(t.text, "span.") && len(t.text) > 5:
+		return Field{Scope: ScopeSpan, Name: t.text[5:]}, nil
+	case strings.HasPrefix(t.text, "resource.") && len(t.text) > 9:
+		return Field{Scope: ScopeResource, Name: t.text[9:]}, nil
+	}
+	return Field{}, fmt.Errorf("at %d: unknown field %q", t.pos, t.text)
+}
+
+// parseValue reads a static value; bare words are resolved against the field.
+func (p *parser) parseValue(field Field) (Value, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return Value{Kind: ValueString, Str: t.text}, nil
+	case tokNumber:
+		return Value{Kind: ValueNumber, Num: t.num}, nil
+	case tokDuration:
+		return Value{Kind: ValueDuration, Dur: t.dur}, nil
+	case tokIdent:
+		switch {
+		case t.text == "true" || t.text == "false":
+			return Value{Kind: ValueBool, Bool: t.text == "true"}, nil
+		case t.text == "nil":
+			return Value{Kind: ValueNil}, nil
+		case field.Name == IntrinsicStatus && field.Scope == ScopeIntrinsic:
+			if code, ok := statusValues[t.text]; ok {
+				return Value{Kind: ValueStatus, Int: code}, nil
+			}
+		case field.Name == IntrinsicKind && field.Scope == ScopeIntrinsic:
+			if code, ok := kindValues[t.text]; ok {
+				return Value{Kind: ValueKind, Int: code}, nil
+			}
+		}
+		return Value{}, fmt.Errorf("at %d: invalid value %q for %s", t.pos, t.text, field)
+	}
+	return Value{}, fmt.Errorf("at %d: expected value, got %s", t.pos, t)
+}
+
+// checkComparison rejects operators and values that do not fit the field.
+func checkComparison(c *Comparison) error {
+	regex := c.Op == "=~" || c.Op == "!~"
+	equality := c.Op == "=" || c.Op == "!="
+	if regex && c.Value.Kind != ValueString {
+		return fmt.Errorf("%s needs a string pattern", c.Op)
+	}
+	if regex {
+		if _, err := regexp.Compile(c.Value.Str); err != nil {
+			return fmt.Errorf("invalid regular expression %q: %w", c.Value.Str, err)
+		}
+	}
+
+	if c.Field.Scope != ScopeIntrinsic {
+		switch c.Value.Kind {
+		case ValueDuration:
+			return fmt.Errorf("cannot compare attribute %s with a duration", c.Field)
+		case ValueBool, ValueNil:
+			if !equality {
+				return fmt.Errorf("%s is not supported for %s", c.Op, c.Field)
+			}
+		}
+		return nil
+	}
+
+	switch c.Field.Name {
+	case IntrinsicName:
+		if c.Value.Kind != ValueString {
+			return fmt.Errorf("name must be compared with a string")
+		}
+	case IntrinsicStatus, IntrinsicKind:
+		want := ValueStatus
+		if c.Field.Name == IntrinsicKind {
+			want = ValueKind
+		}
+		if c.Value.Kind != want || !equality {
+			return fmt.Errorf("%s supports only = and != with one of its values", c.Field.Name)
+		}
+	case IntrinsicDuration:
+		if c.Value.Kind != ValueDuration || regex {
+			return fmt.Errorf("duration must be compared with a duration such as 200ms")
+		}
+	}
+	return nil
+}
+
+// aggregate := "count" "(" ")" op number | fn "(" field ")" op value
+func (p *parser) parseAggregate() (*Aggregate, error) {
+	t := p.next()
+	if t.kind != tokIdent || !aggregateFuncs[t.text] {
+		return nil, fmt.Errorf("at %d: expected aggregate (count, avg, min, max, sum), got %s", t.pos, t)
+	}
+	agg := &Aggregate{Func: t.text}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if agg.Func != "count" {
+		field, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		if field.Scope == ScopeIntrinsic && field.Name != IntrinsicDuration {
+			return nil, fmt.Errorf("at %d: %s() needs duration or a numeric attribute", t.pos, agg.Func)
+		}
+		agg.Field = &field
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	if op.kind != tokPunct || !comparisonOps[op.text] || op.text == "=~" || op.text == "!~" {
+		return nil, fmt.Errorf("at %d: expected comparison operator after %s(), got %s", op.pos, agg.Func, op)
+	}
+	agg.Op = op.text
+
+	v := p.next()
+	wantDuration := agg.Field != nil && agg.Field.Scope == ScopeIntrinsic
+	switch {
+	case wantDuration && v.kind == tokDuration:
+		agg.Value = Value{Kind: ValueDuration, Dur: v.dur}
+	case !wantDuration && v.kind == tokNumber:
+		agg.Value = Value{Kind: ValueNumber, Num: v.num}
+	case wantDuration:
+		return nil, fmt.Errorf("at %d: expected duration, got %s", v.pos, v)
+	default:
+		return nil, fmt.Errorf("at %d: expected number, got %s", v.pos, v)
+	}
+	return agg, nil
+}
@@ -0,0 +1,27 @@
+package traceql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRegex(t *testing.T) {
+	for _, query := range []string{
+		`{ name =~ "GET /api/.*" }`,
+		`{ span.http.route !~ "^/health" }`,
+	} {
+		if _, err := Parse(query); err != nil {
+			t.Errorf("Parse(%s): %v", query, err)
+		}
+	}
+
+	for _, query := range []string{
+		`{ name =~ "(" }`,
+		`{ resource.service.name !~ "[a-" }`,
+	} {
+		_, err := Parse(query)
+		if err == nil || !strings.Contains(err.Error(), "invalid regular expression") {
+			t.Errorf("Parse(%s) = %v, want an invalid regular expression error", query, err)
+		}
+	}
+}